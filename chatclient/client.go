@@ -0,0 +1,569 @@
+// Package chatclient connects to the chat server. It matches the server's
+// replies to the requests they answer, delivers everything else as events,
+// reassembles received files and reconnects when the connection drops,
+// logging in again and rejoining the room it was in.
+package chatclient
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"chatap.com/shared"
+)
+
+// minReconnectDelay is the shortest wait between reconnection attempts, so
+// that a zero ReconnectDelay does not retry in a busy loop
+const minReconnectDelay = 100 * time.Millisecond
+
+var (
+	ErrNotConnected = errors.New("not connected to the server")
+	ErrDisconnected = errors.New("disconnected before the server replied")
+	ErrClosed       = errors.New("client closed")
+)
+
+// ServerError is an error the server replied with
+type ServerError struct {
+	Message string
+}
+
+func (e *ServerError) Error() string {
+	return e.Message
+}
+
+// Config holds the settings of a client
+type Config struct {
+	Addr              string        // Server address, host:port
+	Device            string        // Names the session in the user's session list
+	DataDir           string        // Where received files are saved
+	RequestTimeout    time.Duration // For requests whose context has no deadline
+	Reconnect         bool          // Reconnect when the connection drops
+	ReconnectDelay    time.Duration // First wait before reconnecting, doubled after each failure, at least 100ms
+	MaxReconnectDelay time.Duration
+	UploadRate        int    // Bytes per second, below the server's default file rate limit
+	EncryptionKey     []byte // For encrypted direct messages
+	EventBuffer       int    // Size of the Events channel
+
+	// OnEvent, when set, is called with every event instead of sending it to
+	// the Events channel. It runs on the goroutine reading from the server, so
+	// anything that waits for the server must be started in a new goroutine.
+	OnEvent func(Event)
+}
+
+// DefaultConfig returns the default client settings for a server address
+func DefaultConfig(addr string) Config {
+	return Config{
+		Addr:              addr,
+		DataDir:           "appData",
+		RequestTimeout:    10 * time.Second,
+		Reconnect:         true,
+		ReconnectDelay:    time.Second,
+		MaxReconnectDelay: 30 * time.Second,
+		UploadRate:        2 << 20,
+		// Simple demo key - in production, use secure key exchange
+		EncryptionKey: []byte("0123456789abcdef"),
+		EventBuffer:   256,
+	}
+}
+
+// request is a request waiting for the server's replies
+type request struct {
+	reply Reply
+	err   error
+	done  chan struct{}
+}
+
+// Client is a connection to the chat server. Its methods are safe for
+// concurrent use.
+type Client struct {
+	config Config
+	events chan Event
+	done   chan struct{} // Closed once the client stops for good
+
+	mu       sync.Mutex
+	conn     net.Conn
+	closed   bool
+	ended    bool // The server ended the session on purpose
+	loggedIn bool
+	username string
+	room     string
+	login    *shared.AuthMessage // Sent again after reconnecting
+	nextID   uint64
+	pending  map[string]*request
+	incoming map[string]*shared.FileAssembler // Files being received, by upload ID
+	readUpTo map[string]time.Time             // Read markers not yet sent, by conversation
+
+	writeMu sync.Mutex // Frames written by different goroutines must not interleave
+}
+
+// Dial connects to the server
+func Dial(config Config) (*Client, error) {
+	conn, err := net.Dial("tcp", config.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to server: %v", err)
+	}
+
+	c := &Client{
+		config:   config,
+		events:   make(chan Event, config.EventBuffer),
+		done:     make(chan struct{}),
+		conn:     conn,
+		pending:  make(map[string]*request),
+		incoming: make(map[string]*shared.FileAssembler),
+		readUpTo: make(map[string]time.Time),
+	}
+	go c.readLoop(conn)
+	return c, nil
+}
+
+// Events returns the channel events are delivered on, unless Config.OnEvent
+// is set. It must be drained: the client waits when it is full.
+func (c *Client) Events() <-chan Event {
+	return c.events
+}
+
+// Done is closed when the client stops for good: it was closed, the server
+// ended the session, the connection dropped and reconnecting is off, or
+// logging in again after reconnecting failed
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Close disconnects from the server
+func (c *Client) Close() {
+	c.mu.Lock()
+	conn := c.conn
+	c.conn = nil
+	c.mu.Unlock()
+
+	if conn != nil {
+		conn.Close()
+	}
+	c.stop()
+}
+
+// stop marks the client as stopped and fails waiting requests
+func (c *Client) stop() {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return
+	}
+	c.closed = true
+	pending := c.pending
+	c.pending = make(map[string]*request)
+	incoming := c.takeIncoming()
+	c.mu.Unlock()
+
+	for _, req := range pending {
+		req.err = ErrClosed
+		close(req.done)
+	}
+	for _, assembler := range incoming {
+		assembler.Abort()
+	}
+	close(c.done)
+}
+
+// Username returns the name the client is logged in as
+func (c *Client) Username() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.username
+}
+
+// LoggedIn reports whether the client is logged in
+func (c *Client) LoggedIn() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.loggedIn
+}
+
+// Room returns the room the client is in, if any
+func (c *Client) Room() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.room
+}
+
+// send writes a message to the server
+func (c *Client) send(msg interface{}) error {
+	if f, ok := msg.(framed); ok {
+		header, err := json.Marshal(f.msg)
+		if err != nil {
+			return err
+		}
+		return c.sendFrame(shared.AppendPayload(header, f.payload))
+	}
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return c.sendFrame(data)
+}
+
+// sendFrame writes a frame built by shared.EncodeFrame or shared.AppendPayload
+func (c *Client) sendFrame(frame []byte) error {
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+	if conn == nil {
+		return ErrNotConnected
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_, err := conn.Write(append(frame, '\n'))
+	return err
+}
+
+// request sends a message and waits for the server's replies. header is the
+// shared.Message embedded in msg; it gets the request ID.
+func (c *Client) request(ctx context.Context, header *shared.Message, msg interface{}) (Reply, error) {
+	if _, ok := ctx.Deadline(); !ok && c.config.RequestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.config.RequestTimeout)
+		defer cancel()
+	}
+
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, ErrClosed
+	}
+	c.nextID++
+	id := strconv.FormatUint(c.nextID, 36)
+	req := &request{done: make(chan struct{})}
+	c.pending[id] = req
+	c.mu.Unlock()
+
+	header.RequestID = id
+	if header.Timestamp.IsZero() {
+		header.Timestamp = time.Now()
+	}
+	if err := c.send(msg); err != nil {
+		c.forget(id)
+		return nil, err
+	}
+
+	select {
+	case <-req.done:
+		return req.reply, req.err
+	case <-ctx.Done():
+		c.forget(id)
+		return nil, ctx.Err()
+	}
+}
+
+// forget stops waiting for a request's replies. Replies that still come are
+// delivered as events.
+func (c *Client) forget(id string) {
+	c.mu.Lock()
+	delete(c.pending, id)
+	c.mu.Unlock()
+}
+
+// Command sends a command, as typed after the slash in the chat client, and
+// returns the server's reply
+func (c *Client) Command(ctx context.Context, content string) (Reply, error) {
+	msg := shared.Message{
+		Type:    shared.MessageTypeCommand,
+		Content: content,
+	}
+	return c.request(ctx, &msg, &msg)
+}
+
+// emit delivers an event
+func (c *Client) emit(event Event) {
+	if c.config.OnEvent != nil {
+		c.config.OnEvent(event)
+		return
+	}
+	select {
+	case c.events <- event:
+	case <-c.done:
+	}
+}
+
+// readLoop reads from a connection until it fails
+func (c *Client) readLoop(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	for {
+		message, payload, err := shared.ReadFrame(reader, shared.MaxChunkSize)
+		if err != nil {
+			c.connectionLost(conn, err)
+			return
+		}
+		c.dispatch(message, payload)
+	}
+}
+
+// connectionLost fails the requests waiting on a dropped connection and
+// reconnects if the session should go on
+func (c *Client) connectionLost(conn net.Conn, err error) {
+	c.mu.Lock()
+	if c.conn != conn || c.closed {
+		// Closed by us, or replaced already
+		c.mu.Unlock()
+		return
+	}
+	c.conn = nil
+	c.loggedIn = false
+	ended := c.ended
+	pending := c.pending
+	c.pending = make(map[string]*request)
+	incoming := c.takeIncoming()
+	c.mu.Unlock()
+	conn.Close()
+
+	for _, req := range pending {
+		req.err = ErrDisconnected
+		close(req.done)
+	}
+	// The rest of their chunks will not come; a download can be asked for again
+	for _, assembler := range incoming {
+		assembler.Abort()
+		c.emit(Event{Type: EventFileFailed, File: &assembler.Info, Err: ErrDisconnected})
+	}
+
+	c.emit(Event{Type: EventDisconnected, Err: err})
+	if ended || !c.config.Reconnect {
+		c.stop()
+		return
+	}
+	go c.reconnect()
+}
+
+// reconnect dials the server until it answers, then logs in again and
+// rejoins the room the client was in
+func (c *Client) reconnect() {
+	delay := c.config.ReconnectDelay
+	if delay < minReconnectDelay {
+		delay = minReconnectDelay
+	}
+	maxDelay := c.config.MaxReconnectDelay
+	if maxDelay < delay {
+		maxDelay = delay
+	}
+	for {
+		select {
+		case <-time.After(delay):
+		case <-c.done:
+			return
+		}
+
+		conn, err := net.Dial("tcp", c.config.Addr)
+		if err != nil {
+			if delay *= 2; delay > maxDelay {
+				delay = maxDelay
+			}
+			continue
+		}
+
+		c.mu.Lock()
+		if c.closed {
+			c.mu.Unlock()
+			conn.Close()
+			return
+		}
+		c.conn = conn
+		login, room := c.login, c.room
+		c.mu.Unlock()
+		go c.readLoop(conn)
+
+		ctx := context.Background()
+		if login != nil {
+			authMsg := *login
+			authMsg.Timestamp = time.Time{}
+			if _, err := c.request(ctx, &authMsg.Message, &authMsg); err != nil {
+				var serverErr *ServerError
+				if errors.As(err, &serverErr) {
+					// The account or token is gone; trying again will not help
+					c.emit(Event{Type: EventDisconnected, Err: err})
+					c.Close()
+					return
+				}
+				if err != ErrDisconnected && err != ErrClosed {
+					// No answer in time. Dropping the connection reconnects
+					// and tries again, rather than staying logged out.
+					conn.Close()
+				}
+				// Otherwise the connection dropped again and is being reconnected
+				return
+			}
+			if room != "" {
+				c.Join(ctx, room)
+			}
+		}
+		c.emit(Event{Type: EventReconnected})
+		return
+	}
+}
+
+// dispatch passes a message from the server to the request it answers, or
+// delivers it as an event
+func (c *Client) dispatch(message, payload []byte) {
+	var msg shared.Message
+	if err := json.Unmarshal(message, &msg); err != nil {
+		return
+	}
+
+	switch msg.Type {
+	case shared.MessageTypePing:
+		// Answer the server's heartbeat so an idle session stays connected
+		c.send(shared.Message{
+			Type:      shared.MessageTypePong,
+			Timestamp: time.Now(),
+		})
+		return
+
+	case shared.MessageTypeFile:
+		c.handleFileChunk(message, payload)
+		return
+
+	case shared.MessageTypeSession:
+		var session shared.SessionMessage
+		if err := json.Unmarshal(message, &session); err == nil {
+			c.observe(session)
+		}
+
+	case shared.MessageTypeReadMarker:
+		var marker shared.ReadMarkerMessage
+		if err := json.Unmarshal(message, &marker); err == nil {
+			// Read on another session; no need to send our marker if it is older
+			c.mu.Lock()
+			if !c.readUpTo[marker.Conversation].After(marker.ReadUpTo) {
+				delete(c.readUpTo, marker.Conversation)
+			}
+			c.mu.Unlock()
+		}
+	}
+
+	event := c.newEvent(msg, message, payload)
+	if msg.RequestID != "" && c.reply(msg, event) {
+		return
+	}
+	if msg.Type == shared.MessageTypeAck || msg.Type == shared.MessageTypeUpload {
+		// Late acks, and upload replies only make sense to their request
+		return
+	}
+	c.emit(event)
+}
+
+// reply adds a message to the replies of its request, completing it on the
+// server's ack. It reports whether the request was still waiting.
+func (c *Client) reply(msg shared.Message, event Event) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	req, ok := c.pending[msg.RequestID]
+	if !ok {
+		return false
+	}
+	if msg.Type != shared.MessageTypeAck {
+		req.reply = append(req.reply, event)
+		return true
+	}
+
+	delete(c.pending, msg.RequestID)
+	for _, e := range req.reply {
+		// Only the server's own command replies; stored messages, even the
+		// server's, may start alike
+		m := e.Message
+		if m.Type == shared.MessageTypeCommand && m.Sender == "Server" && strings.HasPrefix(m.Content, "ERROR: ") {
+			req.err = &ServerError{Message: strings.TrimPrefix(m.Content, "ERROR: ")}
+			break
+		}
+	}
+	close(req.done)
+	return true
+}
+
+// observe follows the session state the server reports
+func (c *Client) observe(session shared.SessionMessage) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if session.Ended {
+		// The session was ended on purpose, so it is not resumed
+		c.ended = true
+		return
+	}
+	c.loggedIn = session.Username != ""
+	c.username = session.Username
+	if c.login != nil {
+		c.login.Username = session.Username
+	}
+	c.room = session.Room
+}
+
+// newEvent classifies a message from the server
+func (c *Client) newEvent(msg shared.Message, raw, payload []byte) Event {
+	event := Event{Message: msg, Raw: raw, Payload: payload}
+
+	switch msg.Type {
+	case shared.MessageTypeText:
+		event.Type = EventChat
+	case shared.MessageTypeDirect:
+		event.Type = EventDirect
+	case shared.MessageTypeEncrypted:
+		event.Type = EventDirect
+		event.Text, event.Err = shared.Decrypt(msg.Content, c.config.EncryptionKey)
+	case shared.MessageTypeGroup:
+		event.Type = EventGroup
+	case shared.MessageTypePreview:
+		event.Type = EventPreview
+	case shared.MessageTypeProfile:
+		event.Type = EventProfile
+	case shared.MessageTypeUpload:
+		event.Type = EventUpload
+	case shared.MessageTypeReadMarker:
+		event.Type = EventReadMarker
+	case shared.MessageTypeSession:
+		event.Type = EventSession
+	default:
+		event.Type = EventNotice
+	}
+	return event
+}
+
+// MarkRead notes that a conversation was shown up to a message. The markers
+// are sent by FlushReadMarkers, so the user's other sessions know it was read.
+func (c *Client) MarkRead(conversation string, readUpTo time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if readUpTo.After(c.readUpTo[conversation]) {
+		c.readUpTo[conversation] = readUpTo
+	}
+}
+
+// FlushReadMarkers sends the read markers noted since the last flush
+func (c *Client) FlushReadMarkers() error {
+	c.mu.Lock()
+	markers := c.readUpTo
+	c.readUpTo = make(map[string]time.Time)
+	c.mu.Unlock()
+
+	for conversation, readUpTo := range markers {
+		marker := shared.ReadMarkerMessage{
+			Message: shared.Message{
+				Type:      shared.MessageTypeReadMarker,
+				Timestamp: time.Now(),
+			},
+			Conversation: conversation,
+			ReadUpTo:     readUpTo,
+		}
+		if err := c.send(marker); err != nil {
+			return fmt.Errorf("error sending read marker: %v", err)
+		}
+	}
+	return nil
+}
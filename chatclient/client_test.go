@@ -0,0 +1,372 @@
+package chatclient
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"chatap.com/shared"
+)
+
+// fakeServer accepts the client's connections so that a test can play the
+// server's part
+type fakeServer struct {
+	t     *testing.T
+	addr  string
+	conns chan net.Conn
+}
+
+func newFakeServer(t *testing.T) *fakeServer {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	s := &fakeServer{t: t, addr: listener.Addr().String(), conns: make(chan net.Conn, 4)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			s.conns <- conn
+		}
+	}()
+	return s
+}
+
+// dial connects a client that does not reconnect unless the test says so
+func (s *fakeServer) dial(reconnect bool) *Client {
+	s.t.Helper()
+	config := DefaultConfig(s.addr)
+	config.DataDir = s.t.TempDir()
+	config.Reconnect = reconnect
+	config.ReconnectDelay = 0
+	c, err := Dial(config)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	s.t.Cleanup(c.Close)
+	return c
+}
+
+// accept waits for the client to connect
+func (s *fakeServer) accept() *fakeConn {
+	s.t.Helper()
+	select {
+	case conn := <-s.conns:
+		return &fakeConn{t: s.t, conn: conn, reader: bufio.NewReader(conn)}
+	case <-time.After(5 * time.Second):
+		s.t.Fatal("the client did not connect")
+		return nil
+	}
+}
+
+// fakeConn is the server's end of a connection
+type fakeConn struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// read returns the next message the client sent
+func (fc *fakeConn) read() shared.Message {
+	fc.t.Helper()
+	fc.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	header, _, err := shared.ReadFrame(fc.reader, shared.MaxChunkSize)
+	if err != nil {
+		fc.t.Fatalf("reading from the client: %v", err)
+	}
+	var msg shared.Message
+	if err := json.Unmarshal(header, &msg); err != nil {
+		fc.t.Fatal(err)
+	}
+	return msg
+}
+
+// send writes a message, or a frame built by shared.EncodeFrame
+func (fc *fakeConn) send(msg interface{}) {
+	fc.t.Helper()
+	frame, ok := msg.([]byte)
+	if !ok {
+		frame, _ = json.Marshal(msg)
+	}
+	if _, err := fc.conn.Write(append(frame, '\n')); err != nil {
+		fc.t.Fatalf("writing to the client: %v", err)
+	}
+}
+
+// reply sends a command reply to a request
+func (fc *fakeConn) reply(id, content string) {
+	fc.send(shared.Message{Type: shared.MessageTypeCommand, Content: content, Sender: "Server", RequestID: id})
+}
+
+// ack tells the client all replies to a request were sent
+func (fc *fakeConn) ack(id string) {
+	fc.send(shared.Message{Type: shared.MessageTypeAck, RequestID: id})
+}
+
+// answer replies to a request that changes the session and acks it
+func (fc *fakeConn) answer(request shared.Message, username, room, content string) {
+	fc.send(shared.SessionMessage{
+		Message:  shared.Message{Type: shared.MessageTypeSession, Room: room, RequestID: request.RequestID},
+		Username: username,
+	})
+	fc.reply(request.RequestID, content)
+	fc.ack(request.RequestID)
+}
+
+// nextEvent waits for the next event of one of the given types
+func nextEvent(t *testing.T, c *Client, types ...EventType) Event {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case event := <-c.Events():
+			for _, eventType := range types {
+				if event.Type == eventType {
+					return event
+				}
+			}
+		case <-timeout:
+			t.Fatalf("no event of types %v", types)
+		}
+	}
+}
+
+type result struct {
+	reply Reply
+	err   error
+}
+
+func TestRepliesFindTheirRequests(t *testing.T) {
+	s := newFakeServer(t)
+	c := s.dial(false)
+	conn := s.accept()
+
+	// Two requests wait at the same time
+	results := make(map[string]chan result)
+	for _, content := range []string{"first", "second"} {
+		done := make(chan result, 1)
+		results[content] = done
+		go func(content string) {
+			reply, err := c.Command(context.Background(), content)
+			done <- result{reply, err}
+		}(content)
+	}
+	ids := make(map[string]string)
+	for len(ids) < 2 {
+		msg := conn.read()
+		ids[msg.Content] = msg.RequestID
+	}
+	if ids["first"] == ids["second"] {
+		t.Fatalf("both requests have ID %s", ids["first"])
+	}
+
+	// Their replies interleave with each other and with other traffic
+	conn.send(shared.Message{Type: shared.MessageTypeText, Content: "from alice", Sender: "alice", Room: "general"})
+	conn.reply(ids["second"], "SUCCESS: second done")
+	conn.reply(ids["first"], "ERROR: first failed")
+	conn.send(shared.Message{Type: shared.MessageTypeDirect, Content: "psst", Sender: "bob", Recipient: "carol"})
+	conn.ack(ids["second"])
+	conn.ack(ids["first"])
+
+	second := <-results["second"]
+	if second.err != nil || second.reply.Text() != "SUCCESS: second done" {
+		t.Fatalf("second request: %q, %v", second.reply.Text(), second.err)
+	}
+	first := <-results["first"]
+	var serverErr *ServerError
+	if !errors.As(first.err, &serverErr) || serverErr.Message != "first failed" {
+		t.Fatalf("first request: %q, %v", first.reply.Text(), first.err)
+	}
+
+	// The rest arrives as events, in order
+	if event := nextEvent(t, c, EventChat, EventDirect); event.Message.Content != "from alice" {
+		t.Fatalf("first event: %q", event.Message.Content)
+	}
+	if event := nextEvent(t, c, EventChat, EventDirect); event.Message.Content != "psst" {
+		t.Fatalf("second event: %q", event.Message.Content)
+	}
+}
+
+func TestHistoryReturnsMessages(t *testing.T) {
+	s := newFakeServer(t)
+	c := s.dial(false)
+	conn := s.accept()
+
+	done := make(chan []shared.Message, 1)
+	go func() {
+		messages, err := c.History(context.Background(), "bob")
+		if err != nil {
+			t.Error(err)
+		}
+		done <- messages
+	}()
+
+	request := conn.read()
+	if request.Content != "history bob" {
+		t.Fatalf("request: %q", request.Content)
+	}
+	conn.reply(request.RequestID, "Message history with bob:")
+	for _, stored := range []struct{ sender, content string }{
+		{"bob", "hi"},
+		{"bob", "ERROR: just kidding"},
+		{"Server", "ERROR: a stored notice"},
+	} {
+		conn.send(shared.Message{Type: shared.MessageTypeHistory, Content: stored.content, Sender: stored.sender,
+			Recipient: "alice", RequestID: request.RequestID})
+	}
+	conn.ack(request.RequestID)
+
+	messages := <-done
+	// Stored messages that look like errors do not fail the request
+	if len(messages) != 3 || messages[0].Content != "hi" || messages[2].Sender != "Server" {
+		t.Fatalf("history: %+v", messages)
+	}
+}
+
+func TestReconnectLogsInAndRejoins(t *testing.T) {
+	s := newFakeServer(t)
+	c := s.dial(true)
+	conn := s.accept()
+	ctx := context.Background()
+
+	logins := make(chan error, 1)
+	go func() {
+		_, err := c.Login(ctx, "alice", "secret1")
+		logins <- err
+	}()
+	conn.answer(conn.read(), "alice", "", "SUCCESS: Logged in successfully")
+	if err := <-logins; err != nil {
+		t.Fatal(err)
+	}
+
+	joins := make(chan error, 1)
+	go func() {
+		_, err := c.Join(ctx, "general")
+		joins <- err
+	}()
+	conn.answer(conn.read(), "alice", "general", "SUCCESS: Joined room: general")
+	if err := <-joins; err != nil {
+		t.Fatal(err)
+	}
+
+	// A request waiting when the connection drops fails
+	waiting := make(chan error, 1)
+	go func() {
+		_, err := c.Command(ctx, "rooms")
+		waiting <- err
+	}()
+	conn.read()
+	conn.conn.Close()
+	if err := <-waiting; err != ErrDisconnected {
+		t.Fatalf("request waiting across the drop: %v", err)
+	}
+	nextEvent(t, c, EventDisconnected)
+
+	// The new connection logs in and rejoins before it is reported
+	conn = s.accept()
+	login := conn.read()
+	if login.Type != shared.MessageTypeAuth || login.Content != "login" || login.RequestID == "" {
+		t.Fatalf("first message after reconnecting: %+v", login)
+	}
+	conn.answer(login, "alice", "", "SUCCESS: Logged in successfully")
+	join := conn.read()
+	if join.Content != "join" || join.Room != "general" {
+		t.Fatalf("second message after reconnecting: %+v", join)
+	}
+	conn.answer(join, "alice", "general", "SUCCESS: Joined room: general")
+
+	nextEvent(t, c, EventReconnected)
+	if !c.LoggedIn() || c.Username() != "alice" || c.Room() != "general" {
+		t.Fatalf("after reconnecting: logged in %v as %q in %q", c.LoggedIn(), c.Username(), c.Room())
+	}
+}
+
+func TestFileCutOffMidway(t *testing.T) {
+	s := newFakeServer(t)
+	c := s.dial(false)
+	conn := s.accept()
+
+	data := []byte("0123456789ab")
+	for chunkID := 0; chunkID < 2; chunkID++ {
+		frame, err := shared.EncodeFrame(shared.FileMessage{
+			Message:     shared.Message{Type: shared.MessageTypeFile, Sender: "alice"},
+			UploadID:    "0123456789abcdef",
+			Filename:    "notes.txt",
+			Size:        int64(len(data)),
+			ChunkID:     chunkID,
+			TotalChunks: 3,
+			Offset:      int64(chunkID * 4),
+			Data:        data[chunkID*4 : chunkID*4+4],
+		}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.send(frame)
+	}
+	if event := nextEvent(t, c, EventFileIncoming, EventFileFailed); event.Type != EventFileIncoming {
+		t.Fatalf("first file event: %v", event.Err)
+	}
+	conn.conn.Close()
+
+	event := nextEvent(t, c, EventFileFailed, EventFileSaved)
+	if event.Type != EventFileFailed || event.Err != ErrDisconnected || event.File.Filename != "notes.txt" {
+		t.Fatalf("after the drop: type %v, error %v", event.Type, event.Err)
+	}
+	nextEvent(t, c, EventDisconnected)
+	<-c.Done()
+
+	// Nothing is saved and the partial file is removed
+	if _, err := os.Stat(filepath.Join(c.config.DataDir, "notes.txt")); !os.IsNotExist(err) {
+		t.Fatalf("partial download saved: %v", err)
+	}
+	if entries, _ := os.ReadDir(filepath.Join(c.config.DataDir, ".partial")); len(entries) > 0 {
+		t.Fatalf("partial download left behind: %s", entries[0].Name())
+	}
+}
+
+func TestReconnectRetriesAnUnansweredLogin(t *testing.T) {
+	s := newFakeServer(t)
+	c := s.dial(true)
+	c.config.RequestTimeout = 200 * time.Millisecond
+	conn := s.accept()
+
+	logins := make(chan error, 1)
+	go func() {
+		_, err := c.Login(context.Background(), "alice", "secret1")
+		logins <- err
+	}()
+	conn.answer(conn.read(), "alice", "", "SUCCESS: Logged in successfully")
+	if err := <-logins; err != nil {
+		t.Fatal(err)
+	}
+	conn.conn.Close()
+
+	// The first login after reconnecting gets no answer
+	silent := s.accept()
+	if login := silent.read(); login.Content != "login" {
+		t.Fatalf("first message after reconnecting: %+v", login)
+	}
+
+	// The client gives up on that connection and logs in on a new one
+	conn = s.accept()
+	login := conn.read()
+	if login.Content != "login" {
+		t.Fatalf("first message on the next connection: %+v", login)
+	}
+	conn.answer(login, "alice", "", "SUCCESS: Logged in successfully")
+	nextEvent(t, c, EventReconnected)
+	if !c.LoggedIn() {
+		t.Fatal("not logged in after reconnecting")
+	}
+}
@@ -0,0 +1,290 @@
+package chatclient
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"chatap.com/shared"
+)
+
+// Login logs in with a username and password. The login is repeated after
+// reconnecting.
+func (c *Client) Login(ctx context.Context, username, password string) (Reply, error) {
+	return c.authenticate(ctx, shared.AuthMessage{
+		Message:  shared.Message{Content: "login"},
+		Username: username,
+		Password: password,
+	})
+}
+
+// LoginBot logs in as a bot with one of its API tokens
+func (c *Client) LoginBot(ctx context.Context, bot, token string) (Reply, error) {
+	return c.authenticate(ctx, shared.AuthMessage{
+		Message:  shared.Message{Content: "token"},
+		Username: bot,
+		Token:    token,
+	})
+}
+
+// Register creates an account and logs in with it. inviteCode is only needed
+// when registration is invite-only.
+func (c *Client) Register(ctx context.Context, username, password, inviteCode string) (Reply, error) {
+	return c.authenticate(ctx, shared.AuthMessage{
+		Message:    shared.Message{Content: "register"},
+		Username:   username,
+		Password:   password,
+		InviteCode: inviteCode,
+	})
+}
+
+// SetDevice changes the device name used by the next login
+func (c *Client) SetDevice(device string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.config.Device = device
+}
+
+// authenticate sends a login or registration and remembers it once the
+// server accepts it, so it can be sent again after reconnecting
+func (c *Client) authenticate(ctx context.Context, authMsg shared.AuthMessage) (Reply, error) {
+	authMsg.Type = shared.MessageTypeAuth
+	c.mu.Lock()
+	authMsg.Device = c.config.Device
+	c.mu.Unlock()
+
+	reply, err := c.request(ctx, &authMsg.Message, &authMsg)
+	if err != nil {
+		return reply, err
+	}
+
+	c.mu.Lock()
+	c.username = authMsg.Username
+	if c.loggedIn {
+		// A registration is repeated as a login
+		login := authMsg
+		if login.Content == "register" {
+			login.Content = "login"
+			login.InviteCode = ""
+		}
+		login.RequestID = ""
+		c.login = &login
+	}
+	c.mu.Unlock()
+	return reply, nil
+}
+
+// ChangePassword changes the user's password
+func (c *Client) ChangePassword(ctx context.Context, current, newPassword string) (Reply, error) {
+	reply, err := c.account(ctx, shared.AuthMessage{
+		Message:     shared.Message{Content: "passwd"},
+		Password:    current,
+		NewPassword: newPassword,
+	})
+	if err == nil {
+		c.mu.Lock()
+		if c.login != nil && c.login.Content == "login" {
+			c.login.Password = newPassword
+		}
+		c.mu.Unlock()
+	}
+	return reply, err
+}
+
+// Rename changes the user's username
+func (c *Client) Rename(ctx context.Context, newUsername, password string) (Reply, error) {
+	return c.account(ctx, shared.AuthMessage{
+		Message:  shared.Message{Content: "rename"},
+		Username: newUsername,
+		Password: password,
+	})
+}
+
+// DeleteAccount deletes the user's account. The server then ends the session.
+func (c *Client) DeleteAccount(ctx context.Context, password string) (Reply, error) {
+	return c.account(ctx, shared.AuthMessage{
+		Message:  shared.Message{Content: "delete"},
+		Password: password,
+	})
+}
+
+// account sends an account change, confirmed with the current password
+func (c *Client) account(ctx context.Context, authMsg shared.AuthMessage) (Reply, error) {
+	authMsg.Type = shared.MessageTypeAuth
+	return c.request(ctx, &authMsg.Message, &authMsg)
+}
+
+// CreateRoom creates a room and joins it
+func (c *Client) CreateRoom(ctx context.Context, room string) (Reply, error) {
+	return c.roomCommand(ctx, "create", room)
+}
+
+// Join joins a room, leaving the current one. The reply holds the room's
+// recent history.
+func (c *Client) Join(ctx context.Context, room string) (Reply, error) {
+	return c.roomCommand(ctx, "join", room)
+}
+
+// Leave leaves the current room
+func (c *Client) Leave(ctx context.Context) (Reply, error) {
+	return c.Command(ctx, "leave")
+}
+
+func (c *Client) roomCommand(ctx context.Context, command, room string) (Reply, error) {
+	msg := shared.Message{
+		Type:    shared.MessageTypeCommand,
+		Content: command,
+		Room:    room,
+	}
+	return c.request(ctx, &msg, &msg)
+}
+
+// Rooms returns the names of all rooms
+func (c *Client) Rooms(ctx context.Context) ([]string, error) {
+	reply, err := c.Command(ctx, "rooms")
+	if err != nil {
+		return nil, err
+	}
+
+	var rooms []string
+	if err := json.Unmarshal([]byte(reply.Text()), &rooms); err != nil {
+		return nil, fmt.Errorf("invalid room list: %v", err)
+	}
+	return rooms, nil
+}
+
+// List lists the users in the current room
+func (c *Client) List(ctx context.Context) (Reply, error) {
+	return c.Command(ctx, "list")
+}
+
+// Send sends a message to the current room
+func (c *Client) Send(ctx context.Context, text string) (Reply, error) {
+	room := c.Room()
+	if room == "" {
+		return nil, fmt.Errorf("you must join a room before sending messages")
+	}
+
+	msg := shared.Message{
+		Type:    shared.MessageTypeText,
+		Content: text,
+		Room:    room,
+	}
+	return c.request(ctx, &msg, &msg)
+}
+
+// DM sends a direct message to a user
+func (c *Client) DM(ctx context.Context, recipient, text string) (Reply, error) {
+	return c.direct(ctx, recipient, text, false)
+}
+
+// UrgentDM sends a direct message that reaches the user even when they are busy
+func (c *Client) UrgentDM(ctx context.Context, recipient, text string) (Reply, error) {
+	return c.direct(ctx, recipient, text, true)
+}
+
+func (c *Client) direct(ctx context.Context, recipient, text string, urgent bool) (Reply, error) {
+	msg := shared.Message{
+		Type:      shared.MessageTypeDirect,
+		Content:   text,
+		Recipient: recipient,
+		Urgent:    urgent,
+	}
+	return c.request(ctx, &msg, &msg)
+}
+
+// SendEncrypted sends a direct message encrypted with Config.EncryptionKey
+func (c *Client) SendEncrypted(ctx context.Context, recipient, text string) (Reply, error) {
+	encrypted, err := shared.Encrypt(text, c.config.EncryptionKey)
+	if err != nil {
+		return nil, fmt.Errorf("encryption failed: %v", err)
+	}
+
+	msg := shared.Message{
+		Type:      shared.MessageTypeEncrypted,
+		Content:   encrypted,
+		Recipient: recipient,
+		Encrypted: true,
+	}
+	return c.request(ctx, &msg, &msg)
+}
+
+// GroupMessage messages a group conversation, given by its ID or as a comma
+// separated list of members that starts one
+func (c *Client) GroupMessage(ctx context.Context, group, text string) (Reply, error) {
+	return c.Command(ctx, "gmsg "+group+" "+text)
+}
+
+// History returns the current room's recent messages, or those exchanged
+// with a user if username is set, oldest first. Their Type is
+// shared.MessageTypeHistory; Room or Recipient says where they were sent.
+func (c *Client) History(ctx context.Context, username string) ([]shared.Message, error) {
+	return c.history(ctx, strings.TrimSpace("history "+username))
+}
+
+// GroupHistory returns a group conversation's recent messages, oldest first,
+// as History does
+func (c *Client) GroupHistory(ctx context.Context, group string) ([]shared.Message, error) {
+	return c.history(ctx, "ghistory "+group)
+}
+
+// history sends a history command and collects the messages of its reply
+func (c *Client) history(ctx context.Context, command string) ([]shared.Message, error) {
+	reply, err := c.Command(ctx, command)
+	if err != nil {
+		return nil, err
+	}
+
+	messages := make([]shared.Message, 0, len(reply))
+	for _, event := range reply {
+		if event.Message.Type == shared.MessageTypeHistory {
+			messages = append(messages, event.Message)
+		}
+	}
+	return messages, nil
+}
+
+// SetStatus changes the user's status, with optional text such as
+// "in a meeting"
+func (c *Client) SetStatus(ctx context.Context, status shared.UserStatus, text string) (Reply, error) {
+	statusMsg := shared.StatusMessage{
+		Message: shared.Message{
+			Type:    shared.MessageTypeStatus,
+			Content: status.String(),
+		},
+		Status:     status,
+		StatusText: strings.TrimSpace(text),
+	}
+	return c.request(ctx, &statusMsg.Message, &statusMsg)
+}
+
+// Download asks for a stored file, by name or ID. The file arrives as file
+// events after the reply.
+func (c *Client) Download(ctx context.Context, nameOrID string) (Reply, error) {
+	return c.Command(ctx, "download "+nameOrID)
+}
+
+// Preview describes a stored file, by name or ID, and returns the PNG
+// thumbnail of an image
+func (c *Client) Preview(ctx context.Context, nameOrID string) (shared.PreviewMessage, []byte, error) {
+	var preview shared.PreviewMessage
+	reply, err := c.Command(ctx, "preview "+nameOrID)
+	if err != nil {
+		return preview, nil, err
+	}
+	thumbnail, err := reply.decode(EventPreview, &preview)
+	return preview, thumbnail, err
+}
+
+// Profile returns a user's profile, or the client's own without a username,
+// and their avatar if they have one
+func (c *Client) Profile(ctx context.Context, username string) (shared.ProfileMessage, []byte, error) {
+	var profile shared.ProfileMessage
+	reply, err := c.Command(ctx, strings.TrimSpace("profile "+username))
+	if err != nil {
+		return profile, nil, err
+	}
+	avatar, err := reply.decode(EventProfile, &profile)
+	return profile, avatar, err
+}
@@ -0,0 +1,73 @@
+package chatclient
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"chatap.com/shared"
+)
+
+// EventType says what an Event is about
+type EventType int
+
+const (
+	EventNotice       EventType = iota // Server notices and command output
+	EventChat                          // A message in a room, or a room event
+	EventDirect                        // A direct message, from someone or sent from one of our sessions
+	EventGroup                         // A message in a group conversation
+	EventPreview                       // A file preview; Payload holds the thumbnail, if any
+	EventProfile                       // A user's profile; Payload holds the avatar, if any
+	EventUpload                        // The server's answer to an upload request
+	EventReadMarker                    // A conversation was read on another session
+	EventSession                       // The session's user or room changed, or it ended
+	EventFileIncoming                  // A file started arriving
+	EventFileSaved                     // A file was received; Path says where it was saved
+	EventFileFailed                    // A file could not be received; Err says why
+	EventDisconnected                  // The connection dropped; Err says why
+	EventReconnected                   // The connection is back, logged in and in the same room
+)
+
+// Event is something the server sent, or a change in the connection. The
+// server's replies to a request are events too.
+type Event struct {
+	Type    EventType
+	Message shared.Message     // The message as received
+	Raw     []byte             // The message's JSON header, for its type-specific fields
+	Payload []byte             // Binary data sent after the header
+	Text    string             // Decrypted content of encrypted direct messages
+	File    *shared.UploadInfo // The file of file events
+	Path    string             // Where a received file was saved
+	Err     error
+}
+
+// Decode unmarshals the message into one of the shared message types, for
+// the fields shared.Message does not have
+func (e Event) Decode(v interface{}) error {
+	return json.Unmarshal(e.Raw, v)
+}
+
+// Reply is what the server sent in answer to a request, in order
+type Reply []Event
+
+// decode unmarshals the reply's event of the given type into v and returns
+// its payload
+func (r Reply) decode(eventType EventType, v interface{}) ([]byte, error) {
+	for _, event := range r {
+		if event.Type == eventType {
+			return event.Payload, event.Decode(v)
+		}
+	}
+	return nil, errors.New("the server's reply is missing")
+}
+
+// Text returns the content of the reply's messages, one per line
+func (r Reply) Text() string {
+	lines := make([]string, 0, len(r))
+	for _, event := range r {
+		if event.Message.Content != "" {
+			lines = append(lines, event.Message.Content)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,274 @@
+package chatclient
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"chatap.com/shared"
+)
+
+// Upload is a file being sent to the server
+type Upload struct {
+	Info     shared.UploadInfo // As agreed with the server
+	Skipped  bool              // The server already had the file, so nothing is sent
+	Received int               // Chunks the server kept from an earlier attempt
+
+	done chan struct{}
+	err  error
+}
+
+// Wait waits until all chunks were sent
+func (u *Upload) Wait() error {
+	<-u.done
+	return u.err
+}
+
+// UploadFile shares a file in the current room
+func (c *Client) UploadFile(ctx context.Context, filePath string) (*Upload, error) {
+	if c.Room() == "" {
+		return nil, fmt.Errorf("you must join a room before sending files")
+	}
+	return c.upload(ctx, filePath, shared.UploadStart, "")
+}
+
+// SendFileTo sends a file privately to a single user
+func (c *Client) SendFileTo(ctx context.Context, recipient, filePath string) (*Upload, error) {
+	return c.upload(ctx, filePath, shared.UploadStart, recipient)
+}
+
+// ResumeUpload sends the chunks of an interrupted upload that the server
+// is still missing
+func (c *Client) ResumeUpload(ctx context.Context, filePath string) (*Upload, error) {
+	return c.upload(ctx, filePath, shared.UploadResume, "")
+}
+
+// upload asks the server to open an upload for a file and starts sending the
+// chunks it asks for, using the chunk size and compression it agreed to
+func (c *Client) upload(ctx context.Context, filePath, action, recipient string) (*Upload, error) {
+	hash, size, err := shared.HashFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read file: %v", err)
+	}
+	if size == 0 {
+		return nil, fmt.Errorf("file is empty: %s", filePath)
+	}
+
+	// The server stores the sanitized name and replies with it
+	filename, err := shared.SanitizeFilename(filepath.Base(filePath))
+	if err != nil {
+		return nil, fmt.Errorf("cannot send %s: %v", filePath, err)
+	}
+
+	uploadMsg := shared.UploadMessage{
+		Message: shared.Message{
+			Type:      shared.MessageTypeUpload,
+			Content:   action,
+			Room:      c.Room(),
+			Recipient: recipient,
+		},
+		UploadInfo: shared.UploadInfo{
+			Filename:    filename,
+			Size:        size,
+			Hash:        hash,
+			ChunkSize:   shared.ChunkSize,
+			TotalChunks: shared.ChunkCount(size, shared.ChunkSize),
+			Compression: shared.CompressionDeflate,
+		},
+	}
+	answer, err := c.uploadRequest(ctx, &uploadMsg)
+	if err != nil {
+		return nil, err
+	}
+
+	// The server shares a copy it already stores once we prove we have the
+	// file too, by hashing the chunk it picked
+	if answer.Content == shared.UploadProve && answer.Challenge != nil {
+		proof, err := shared.ProveChunk(filePath, *answer.Challenge)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read file: %v", err)
+		}
+		uploadMsg.Content = shared.UploadProof
+		uploadMsg.Proof = proof
+		if answer, err = c.uploadRequest(ctx, &uploadMsg); err != nil {
+			return nil, err
+		}
+	}
+
+	upload := &Upload{Info: answer.UploadInfo, done: make(chan struct{})}
+	switch answer.Content {
+	case shared.UploadSkipped:
+		upload.Skipped = true
+		close(upload.done)
+		return upload, nil
+	case shared.UploadReady:
+		upload.Received = answer.Received
+	default:
+		return nil, fmt.Errorf("the server did not accept the upload of %s", filename)
+	}
+
+	go func() {
+		defer close(upload.done)
+		info := answer.UploadInfo
+		upload.err = shared.StreamFileChunks(filePath, info.ChunkSize, answer.Missing, func(chunk shared.FileMessage) error {
+			// Set message metadata for each chunk
+			chunk.UploadID = info.UploadID
+			chunk.Sender = c.Username()
+			chunk.Room = answer.Room
+			chunk.Timestamp = time.Now()
+
+			frame, err := shared.EncodeFrame(chunk, info.Compression == shared.CompressionDeflate)
+			if err != nil {
+				return err
+			}
+			if err := c.sendFrame(frame); err != nil {
+				return fmt.Errorf("error sending chunk %d: %v", chunk.ChunkID, err)
+			}
+
+			// Pace the upload to prevent flooding
+			if c.config.UploadRate > 0 {
+				time.Sleep(time.Duration(len(frame)) * time.Second / time.Duration(c.config.UploadRate))
+			}
+			return nil
+		})
+	}()
+	return upload, nil
+}
+
+// uploadRequest sends an upload message and returns the server's answer
+func (c *Client) uploadRequest(ctx context.Context, uploadMsg *shared.UploadMessage) (shared.UploadMessage, error) {
+	var answer shared.UploadMessage
+	reply, err := c.request(ctx, &uploadMsg.Message, uploadMsg)
+	if err != nil {
+		return answer, err
+	}
+
+	for _, event := range reply {
+		if event.Type == EventUpload {
+			event.Decode(&answer)
+		}
+	}
+	return answer, nil
+}
+
+// SetAvatar uploads an image file as the user's avatar
+func (c *Client) SetAvatar(ctx context.Context, path string) (Reply, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read avatar: %v", err)
+	}
+	if len(data) > shared.MaxAvatarBytes {
+		return nil, fmt.Errorf("an avatar must be at most %s", shared.FormatSize(shared.MaxAvatarBytes))
+	}
+
+	profileMsg := shared.ProfileMessage{
+		Message: shared.Message{
+			Type:    shared.MessageTypeProfile,
+			Content: "avatar",
+		},
+		PayloadLen: len(data),
+	}
+	return c.requestFrame(ctx, &profileMsg.Message, &profileMsg, data)
+}
+
+// handleFileChunk writes incoming file chunks to a temporary file and saves
+// the file once all chunks arrived
+func (c *Client) handleFileChunk(message, payload []byte) {
+	fileMsg, err := shared.DecodeFileFrame(message, payload, shared.MaxChunkSize)
+	if err != nil {
+		c.emit(Event{Type: EventFileFailed, Err: fmt.Errorf("error parsing file message: %v", err)})
+		return
+	}
+
+	// Never trust a file name from the network with our file system
+	filename, err := shared.SanitizeFilename(fileMsg.Filename)
+	if err != nil {
+		c.emit(Event{Type: EventFileFailed, Message: fileMsg.Message,
+			Err: fmt.Errorf("ignoring file with invalid name %q from %s", fileMsg.Filename, fileMsg.Sender)})
+		return
+	}
+	fileMsg.Filename = filename
+
+	fileKey := fileMsg.UploadID
+	if fileKey == "" {
+		fileKey = fileMsg.Sender + "/" + fileMsg.Filename
+	}
+
+	// Find or start the assembly for this file
+	c.mu.Lock()
+	assembler, exists := c.incoming[fileKey]
+	if !exists {
+		info := shared.UploadInfo{
+			UploadID:    fileMsg.UploadID,
+			Filename:    fileMsg.Filename,
+			Size:        fileMsg.Size,
+			Hash:        fileMsg.Hash,
+			TotalChunks: fileMsg.TotalChunks,
+		}
+
+		var err error
+		assembler, err = shared.NewFileAssembler(filepath.Join(c.config.DataDir, ".partial"), info, fileMsg.Sender, fileMsg.Room)
+		if err != nil {
+			c.mu.Unlock()
+			c.emit(Event{Type: EventFileFailed, Message: fileMsg.Message, File: &info, Err: err})
+			return
+		}
+		c.incoming[fileKey] = assembler
+	}
+	c.mu.Unlock()
+
+	if !exists {
+		c.emit(Event{Type: EventFileIncoming, Message: fileMsg.Message, File: &assembler.Info})
+	}
+
+	if err := assembler.WriteChunk(fileMsg); err != nil {
+		if err == shared.ErrDuplicateChunk {
+			return
+		}
+		c.mu.Lock()
+		delete(c.incoming, fileKey)
+		c.mu.Unlock()
+		assembler.Abort()
+		c.emit(Event{Type: EventFileFailed, Message: fileMsg.Message, File: &assembler.Info, Err: err})
+		return
+	}
+
+	if assembler.Complete() {
+		c.mu.Lock()
+		delete(c.incoming, fileKey)
+		c.mu.Unlock()
+		go c.saveFile(fileMsg.Message, assembler)
+	}
+}
+
+// takeIncoming empties the files being received and returns them. The caller
+// must hold c.mu.
+func (c *Client) takeIncoming() map[string]*shared.FileAssembler {
+	incoming := c.incoming
+	c.incoming = make(map[string]*shared.FileAssembler)
+	return incoming
+}
+
+// saveFile moves a completely received file into the data directory
+func (c *Client) saveFile(msg shared.Message, assembler *shared.FileAssembler) {
+	savedPath, err := assembler.Commit(c.config.DataDir)
+	if err != nil {
+		assembler.Abort()
+		c.emit(Event{Type: EventFileFailed, Message: msg, File: &assembler.Info, Err: err})
+		return
+	}
+	c.emit(Event{Type: EventFileSaved, Message: msg, File: &assembler.Info, Path: savedPath})
+}
+
+// requestFrame is request for messages with a binary payload
+func (c *Client) requestFrame(ctx context.Context, header *shared.Message, msg interface{}, payload []byte) (Reply, error) {
+	return c.request(ctx, header, framed{msg: msg, payload: payload})
+}
+
+// framed marshals a message followed by its payload
+type framed struct {
+	msg     interface{}
+	payload []byte
+}
@@ -2,276 +2,344 @@ package main
 
 import (
 	"bufio"
-	"encoding/json"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
-	"net"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strings"
-	"sync"
 	"syscall"
 	"time"
 
+	"chatap.com/chatclient"
 	"chatap.com/shared"
 )
 
-const (
-	appDataDir = "appData"
-)
+const appDataDir = "appData"
 
-// Client represents the chat client
+// Client is the command line interface to a chatclient.Client
 type Client struct {
-	conn              net.Conn
-	serverAddr        string
-	username          string
-	currentRoom       string
-	isAuthenticated   bool
-	shouldExit        bool
-	mutex             sync.Mutex
-	pendingFileChunks map[string][]shared.FileMessage
+	chat *chatclient.Client
 }
 
-func NewClient(serverAddr string) *Client {
-	return &Client{
-		serverAddr:        serverAddr,
-		isAuthenticated:   false,
-		pendingFileChunks: make(map[string][]shared.FileMessage),
+// directPartner returns who a direct message was exchanged with, and whether
+// we sent it from one of our sessions
+func (c *Client) directPartner(msg shared.Message) (string, bool) {
+	if msg.Sender == c.chat.Username() {
+		return msg.Recipient, true
 	}
+	return msg.Sender, false
 }
 
-// Connect establishes a connection to the chat server
-func (c *Client) Connect() error {
-	conn, err := net.Dial("tcp", c.serverAddr)
-	if err != nil {
-		return fmt.Errorf("error connecting to server: %v", err)
+// senderLabel shows a message's sender with their display name, if any
+func senderLabel(msg shared.Message) string {
+	label := msg.Sender
+	if msg.SenderName != "" && msg.SenderName != msg.Sender {
+		label = msg.SenderName + " (" + msg.Sender + ")"
 	}
-	c.conn = conn
-	return nil
-}
-
-// Close closes the connection to the server
-func (c *Client) Close() {
-	if c.conn != nil {
-		c.conn.Close()
+	if msg.Bot {
+		label += " [bot]"
 	}
+	return label
 }
 
-// SetAuthenticated sets the authentication status
-func (c *Client) SetAuthenticated(username string) {
-	c.mutex.Lock()
-	defer c.mutex.Unlock()
-	c.isAuthenticated = true
-	c.username = username
-}
-
-// IsAuthenticated returns the authentication status
-func (c *Client) IsAuthenticated() bool {
-	c.mutex.Lock()
-	defer c.mutex.Unlock()
-	return c.isAuthenticated
-}
-
-// SetCurrentRoom sets the current room
-func (c *Client) SetCurrentRoom(room string) {
-	c.mutex.Lock()
-	defer c.mutex.Unlock()
-	c.currentRoom = room
+// printEvents prints incoming events until the client stops
+func (c *Client) printEvents() {
+	for {
+		select {
+		case event := <-c.chat.Events():
+			c.printEvent(event)
+		case <-c.chat.Done():
+			// Print what arrived before the client stopped
+			for {
+				select {
+				case event := <-c.chat.Events():
+					c.printEvent(event)
+				default:
+					return
+				}
+			}
+		}
+	}
 }
 
-// GetCurrentRoom gets the current room
-func (c *Client) GetCurrentRoom() string {
-	c.mutex.Lock()
-	defer c.mutex.Unlock()
-	return c.currentRoom
+// printReply prints the server's reply to a command. Errors the server
+// replied with are part of the reply.
+func (c *Client) printReply(reply chatclient.Reply, err error) {
+	for _, event := range reply {
+		c.printEvent(event)
+	}
+	var serverErr *chatclient.ServerError
+	if err != nil && !errors.As(err, &serverErr) {
+		fmt.Printf("Error: %v\n", err)
+	}
 }
 
-// SendMessage sends a message to the server
-func (c *Client) SendMessage(msg interface{}) error {
-	data, err := json.Marshal(msg)
-	if err != nil {
-		return err
+// printHistory prints past messages with when and by whom they were sent
+func (c *Client) printHistory(messages []shared.Message, err error) {
+	var serverErr *chatclient.ServerError
+	switch {
+	case errors.As(err, &serverErr):
+		fmt.Printf("ERROR: %s\n", serverErr.Message)
+		return
+	case err != nil:
+		fmt.Printf("Error: %v\n", err)
+		return
+	case len(messages) == 0:
+		fmt.Println("No message history")
+		return
 	}
 
-	_, err = c.conn.Write(append(data, '\n'))
-	return err
+	for _, msg := range messages {
+		fmt.Printf("[%s] %s: %s\n",
+			msg.Timestamp.Format("15:04:05"),
+			senderLabel(msg),
+			msg.Content)
+	}
 }
 
-// processMessage handles incoming server messages
-func (c *Client) processMessage(message []byte) {
-	var msg shared.Message
-	if err := json.Unmarshal(message, &msg); err != nil {
-		fmt.Printf("Error parsing message: %v\n", err)
-		return
-	}
+// printEvent shows a message from the server, or a change in the connection.
+// Shown messages are marked read.
+func (c *Client) printEvent(event chatclient.Event) {
+	msg := event.Message
 
-	switch msg.Type {
-	case shared.MessageTypeText:
+	switch event.Type {
+	case chatclient.EventChat:
 		// Display regular chat message
 		if msg.Room != "" {
+			if msg.Sender != "Server" {
+				c.chat.MarkRead(shared.RoomConversation(msg.Room), msg.Timestamp)
+			}
 			fmt.Printf("[%s] [%s] %s: %s\n",
 				msg.Timestamp.Format("15:04:05"),
 				msg.Room,
-				msg.Sender,
+				senderLabel(msg),
 				msg.Content)
 		} else {
 			fmt.Printf("[%s] %s: %s\n",
 				msg.Timestamp.Format("15:04:05"),
-				msg.Sender,
+				senderLabel(msg),
 				msg.Content)
 		}
 
-	case shared.MessageTypeCommand:
-		// Handle command responses
-		fmt.Printf("%s\n", msg.Content)
-
-		// Check for specific command responses
-		if strings.HasPrefix(msg.Content, "SUCCESS: Logged in") ||
-			strings.HasPrefix(msg.Content, "SUCCESS: Registered") {
-			c.SetAuthenticated(c.username)
-		} else if strings.HasPrefix(msg.Content, "SUCCESS: Room created and joined:") ||
-			strings.HasPrefix(msg.Content, "SUCCESS: Joined room:") {
-			parts := strings.Split(msg.Content, ":")
-			if len(parts) > 1 {
-				roomName := strings.TrimSpace(parts[1])
-				c.SetCurrentRoom(roomName)
-			}
-		} else if strings.HasPrefix(msg.Content, "SUCCESS: Left room") {
-			c.SetCurrentRoom("")
-		} else if strings.HasPrefix(msg.Content, "SUCCESS: Goodbye!") {
-			c.shouldExit = true
+	case chatclient.EventNotice:
+		// Command responses
+		if msg.Type == shared.MessageTypeCommand {
+			fmt.Printf("%s\n", msg.Content)
 		}
 
-	case shared.MessageTypeDirect:
-		// Handle direct messages
-		fmt.Printf("[%s] [DM from %s]: %s\n",
-			msg.Timestamp.Format("15:04:05"),
-			msg.Sender,
-			msg.Content)
-
-	case shared.MessageTypeEncrypted:
-		// Handle encrypted messages
-		if msg.Encrypted {
-			// Simple demo key - in production, use secure key exchange
-			key := []byte("0123456789abcdef")
+	case chatclient.EventDirect:
+		partner, sent := c.directPartner(msg)
+		c.chat.MarkRead(shared.DirectConversation(partner), msg.Timestamp)
 
-			decrypted, err := shared.Decrypt(msg.Content, key)
-			if err != nil {
-				fmt.Printf("[%s] [Encrypted from %s]: Error decrypting: %v\n",
+		if msg.Type == shared.MessageTypeEncrypted {
+			direction := "from " + senderLabel(msg)
+			if sent {
+				direction = "to " + partner
+			}
+			if event.Err != nil {
+				fmt.Printf("[%s] [Encrypted %s]: Error decrypting: %v\n",
 					msg.Timestamp.Format("15:04:05"),
-					msg.Sender,
-					err)
+					direction,
+					event.Err)
 				return
 			}
+			fmt.Printf("[%s] [Encrypted %s]: %s\n",
+				msg.Timestamp.Format("15:04:05"),
+				direction,
+				event.Text)
+			return
+		}
 
-			fmt.Printf("[%s] [Encrypted from %s]: %s\n",
+		label := "DM"
+		if msg.Urgent {
+			label = "URGENT DM"
+		}
+		if sent {
+			// Sent by us, maybe from another session
+			fmt.Printf("[%s] [%s to %s]: %s\n",
 				msg.Timestamp.Format("15:04:05"),
-				msg.Sender,
-				decrypted)
+				label,
+				partner,
+				msg.Content)
+			return
 		}
+		fmt.Printf("[%s] [%s from %s]: %s\n",
+			msg.Timestamp.Format("15:04:05"),
+			label,
+			senderLabel(msg),
+			msg.Content)
 
-	case shared.MessageTypeFile:
-		// Handle file messages
-		var fileMsg shared.FileMessage
-		if err := json.Unmarshal(message, &fileMsg); err != nil {
-			fmt.Printf("Error parsing file message: %v\n", err)
+	case chatclient.EventGroup:
+		c.chat.MarkRead(msg.Group, msg.Timestamp)
+		fmt.Printf("[%s] [group %s] %s: %s\n",
+			msg.Timestamp.Format("15:04:05"),
+			msg.Group,
+			senderLabel(msg),
+			msg.Content)
+
+	case chatclient.EventProfile:
+		var profileMsg shared.ProfileMessage
+		if err := event.Decode(&profileMsg); err != nil {
+			fmt.Printf("Error parsing profile: %v\n", err)
 			return
 		}
+		c.showProfile(profileMsg, event.Payload)
+
+	case chatclient.EventPreview:
+		var preview shared.PreviewMessage
+		if err := event.Decode(&preview); err != nil {
+			fmt.Printf("Error parsing preview: %v\n", err)
+			return
+		}
+		c.showPreview(preview, event.Payload)
+
+	case chatclient.EventFileIncoming:
+		fmt.Printf("Receiving %s (%s) uploaded by %s...\n",
+			event.File.Filename,
+			shared.FormatSize(event.File.Size),
+			msg.Sender)
+
+	case chatclient.EventFileSaved:
+		fmt.Printf("File %s saved successfully to %s.\n", event.File.Filename, event.Path)
+
+	case chatclient.EventFileFailed:
+		switch {
+		case event.File == nil:
+			fmt.Printf("Error receiving file: %v\n", event.Err)
+		case errors.Is(event.Err, shared.ErrHashMismatch):
+			fmt.Printf("File %s from %s failed its integrity check and was discarded.\n", event.File.Filename, msg.Sender)
+		default:
+			fmt.Printf("Error receiving file %s: %v\n", event.File.Filename, event.Err)
+		}
+
+	case chatclient.EventDisconnected:
+		if event.Err == nil || event.Err == io.EOF {
+			fmt.Println("\nDisconnected from server")
+		} else {
+			fmt.Printf("\nDisconnected from server: %v\n", event.Err)
+		}
 
-		c.handleFileChunk(fileMsg)
+	case chatclient.EventReconnected:
+		fmt.Println("Reconnected to server.")
 	}
 }
 
-// handleFileChunk processes incoming file chunks
-func (c *Client) handleFileChunk(fileMsg shared.FileMessage) {
-	fileKey := fileMsg.Sender + "_" + fileMsg.Filename
+// showPreview prints a stored file's description and saves an image's
+// thumbnail next to downloaded files
+func (c *Client) showPreview(preview shared.PreviewMessage, thumbnail []byte) {
+	fmt.Printf("Preview of %s (%s, id %s) by %s\n",
+		preview.Filename, shared.FormatSize(preview.Size), preview.FileID, preview.Uploader)
+	fmt.Printf("  %s\n", preview.FileMeta.Summary())
 
-	// First chunk notification
-	if fileMsg.ChunkID == 0 {
-		fmt.Printf("[%s] %s is sending file: %s\n",
-			fileMsg.Timestamp.Format("15:04:05"),
-			fileMsg.Sender,
-			fileMsg.Filename)
+	for _, line := range preview.Head {
+		fmt.Printf("  | %s\n", line)
 	}
-
-	// Store the chunk
-	c.mutex.Lock()
-	if _, exists := c.pendingFileChunks[fileKey]; !exists {
-		c.pendingFileChunks[fileKey] = make([]shared.FileMessage, 0, fileMsg.TotalChunks)
+	if preview.Lines > len(preview.Head) && len(preview.Head) > 0 {
+		fmt.Printf("  | ... %d more lines\n", preview.Lines-len(preview.Head))
 	}
-	c.pendingFileChunks[fileKey] = append(c.pendingFileChunks[fileKey], fileMsg)
-	chunksReceived := len(c.pendingFileChunks[fileKey])
-	c.mutex.Unlock()
 
-	// Check if we have all chunks
-	if chunksReceived == fileMsg.TotalChunks {
-		fmt.Printf("All chunks received for %s. Assembling file...\n", fileMsg.Filename)
-		go c.saveFile(fileKey, fileMsg.Filename)
+	if len(thumbnail) == 0 {
+		return
 	}
-}
-
-// saveFile assembles and saves a complete file from chunks
-func (c *Client) saveFile(fileKey, filename string) {
-	// Ensure app data directory exists
-	if err := os.MkdirAll(appDataDir, 0755); err != nil {
-		fmt.Printf("Error creating appData directory: %v\n", err)
+	name, err := shared.SanitizeFilename(preview.FileID + ".png")
+	if err != nil {
 		return
 	}
-
-	// Get file chunks
-	c.mutex.Lock()
-	chunks := c.pendingFileChunks[fileKey]
-	delete(c.pendingFileChunks, fileKey)
-	c.mutex.Unlock()
-
-	// Save file
-	if err := shared.SaveFileFromChunks(chunks, appDataDir); err != nil {
-		fmt.Printf("Error saving file %s: %v\n", filename, err)
+	thumbDir := filepath.Join(appDataDir, "thumbnails")
+	thumbPath := filepath.Join(thumbDir, name)
+	err = os.MkdirAll(thumbDir, 0755)
+	if err == nil {
+		err = os.WriteFile(thumbPath, thumbnail, 0644)
+	}
+	if err != nil {
+		fmt.Printf("  Could not save thumbnail: %v\n", err)
 		return
 	}
-
-	fmt.Printf("File %s saved successfully to %s directory.\n", filename, appDataDir)
+	fmt.Printf("  Thumbnail saved to %s\n", thumbPath)
 }
 
-// sendFile sends a file to the current room
-func (c *Client) sendFile(filePath string) error {
-	if !c.IsAuthenticated() {
-		return fmt.Errorf("you must be logged in to send files")
+// showProfile prints a user's profile and saves their avatar next to
+// downloaded files
+func (c *Client) showProfile(profileMsg shared.ProfileMessage, avatar []byte) {
+	profile := profileMsg.UserProfile
+	fmt.Printf("Profile of %s\n", profileMsg.Username)
+	if profile.DisplayName != "" {
+		fmt.Printf("  Name:     %s\n", profile.DisplayName)
 	}
-
-	currentRoom := c.GetCurrentRoom()
-	if currentRoom == "" {
-		return fmt.Errorf("you must join a room before sending files")
+	if profile.Pronouns != "" {
+		fmt.Printf("  Pronouns: %s\n", profile.Pronouns)
+	}
+	if profile.Timezone != "" {
+		if location, err := time.LoadLocation(profile.Timezone); err == nil {
+			fmt.Printf("  Timezone: %s (%s there)\n", profile.Timezone, time.Now().In(location).Format("15:04"))
+		} else {
+			fmt.Printf("  Timezone: %s\n", profile.Timezone)
+		}
+	}
+	if profile.Bio != "" {
+		fmt.Printf("  Bio:      %s\n", profile.Bio)
+	}
+	if profile == (shared.UserProfile{}) {
+		fmt.Println("  (empty)")
 	}
 
-	chunks, err := shared.EncodeFileToChunks(filePath)
+	if len(avatar) == 0 {
+		return
+	}
+	name, err := shared.SanitizeFilename(profileMsg.Username + ".png")
 	if err != nil {
-		return fmt.Errorf("error encoding file: %v", err)
+		return
 	}
-
-	// Set message metadata for each chunk
-	for i := range chunks {
-		chunks[i].Sender = c.username
-		chunks[i].Room = currentRoom
-		chunks[i].Timestamp = time.Now()
+	avatarDir := filepath.Join(appDataDir, "avatars")
+	avatarPath := filepath.Join(avatarDir, name)
+	err = os.MkdirAll(avatarDir, 0755)
+	if err == nil {
+		err = os.WriteFile(avatarPath, avatar, 0644)
+	}
+	if err != nil {
+		fmt.Printf("  Could not save avatar: %v\n", err)
+		return
 	}
+	fmt.Printf("  Avatar saved to %s\n", avatarPath)
+}
 
-	// Send each chunk
-	for i, chunk := range chunks {
-		if err := c.SendMessage(chunk); err != nil {
-			return fmt.Errorf("error sending chunk %d: %v", i, err)
+// upload starts sending a file and reports its progress
+func (c *Client) upload(filePath string, start func(context.Context, string) (*chatclient.Upload, error)) error {
+	upload, err := start(context.Background(), filePath)
+	if err != nil {
+		var serverErr *chatclient.ServerError
+		if errors.As(err, &serverErr) {
+			fmt.Printf("ERROR: %s\n", serverErr.Message)
+			return nil
 		}
+		return err
+	}
 
-		// Small delay to prevent flooding
-		time.Sleep(10 * time.Millisecond)
+	filename := upload.Info.Filename
+	if upload.Skipped {
+		fmt.Printf("The server already has %s, shared without uploading it again.\n", filename)
+		return nil
+	}
+	if upload.Received > 0 {
+		fmt.Printf("Resuming %s: server already has %d of %d chunks.\n", filename, upload.Received, upload.Info.TotalChunks)
 	}
 
+	go func() {
+		if err := upload.Wait(); err != nil {
+			fmt.Printf("Upload of %s interrupted: %v\nUse /resume %s once reconnected.\n", filename, err, filePath)
+			return
+		}
+		fmt.Printf("Finished sending %s.\n", filename)
+	}()
 	return nil
 }
 
-// parseCommand processes user commands
+// parseCommand processes user input
 func (c *Client) parseCommand(input string) error {
 	input = strings.TrimSpace(input)
 	if len(input) == 0 {
@@ -285,24 +353,12 @@ func (c *Client) parseCommand(input string) error {
 	}
 
 	// Regular chat message
-	if !c.IsAuthenticated() {
+	if !c.chat.LoggedIn() {
 		return fmt.Errorf("you must be logged in to send messages")
 	}
 
-	currentRoom := c.GetCurrentRoom()
-	if currentRoom == "" {
-		return fmt.Errorf("you must join a room before sending messages")
-	}
-
-	// Create and send text message
-	msg := shared.Message{
-		Type:      shared.MessageTypeText,
-		Content:   input,
-		Room:      currentRoom,
-		Timestamp: time.Now(),
-	}
-
-	return c.SendMessage(msg)
+	c.printReply(c.chat.Send(context.Background(), input))
+	return nil
 }
 
 // executeCommand processes specific commands
@@ -313,296 +369,316 @@ func (c *Client) executeCommand(cmd string) error {
 	}
 
 	command := parts[0]
+	ctx := context.Background()
+
+	switch command {
+	case "login", "botlogin", "register", "help", "exit":
+	default:
+		if !c.chat.LoggedIn() {
+			return fmt.Errorf("you must be logged in to use /%s", command)
+		}
+	}
 
 	switch command {
 	case "login":
 		if len(parts) < 3 {
-			return fmt.Errorf("usage: /login <username> <password>")
+			return fmt.Errorf("usage: /login <username> <password> [device]")
 		}
-		username, password := parts[1], parts[2]
-		c.username = username // Store tentatively, confirmed when server responds
-
-		authMsg := shared.AuthMessage{
-			Message: shared.Message{
-				Type:      shared.MessageTypeAuth,
-				Content:   "login",
-				Timestamp: time.Now(),
-			},
-			Username: username,
-			Password: password,
+		if len(parts) > 3 {
+			c.chat.SetDevice(strings.Join(parts[3:], " "))
 		}
+		c.printReply(c.chat.Login(ctx, parts[1], parts[2]))
 
-		return c.SendMessage(authMsg)
+	case "botlogin":
+		if len(parts) < 3 {
+			return fmt.Errorf("usage: /botlogin <bot-name> <token> [device]")
+		}
+		if len(parts) > 3 {
+			c.chat.SetDevice(strings.Join(parts[3:], " "))
+		}
+		c.printReply(c.chat.LoginBot(ctx, parts[1], parts[2]))
 
 	case "register":
 		if len(parts) < 3 {
-			return fmt.Errorf("usage: /register <username> <password>")
+			return fmt.Errorf("usage: /register <username> <password> [invite-code]")
 		}
-		username, password := parts[1], parts[2]
-		c.username = username // Store tentatively, confirmed when server responds
-
-		authMsg := shared.AuthMessage{
-			Message: shared.Message{
-				Type:      shared.MessageTypeAuth,
-				Content:   "register",
-				Timestamp: time.Now(),
-			},
-			Username: username,
-			Password: password,
+		inviteCode := ""
+		if len(parts) > 3 {
+			inviteCode = parts[3]
 		}
+		c.printReply(c.chat.Register(ctx, parts[1], parts[2], inviteCode))
 
-		return c.SendMessage(authMsg)
+	// Every account change is confirmed with the current password
+	case "passwd":
+		if len(parts) < 3 {
+			return fmt.Errorf("usage: /passwd <current-password> <new-password>")
+		}
+		c.printReply(c.chat.ChangePassword(ctx, parts[1], parts[2]))
 
-	case "create":
-		if !c.IsAuthenticated() {
-			return fmt.Errorf("you must be logged in to create rooms")
+	case "rename":
+		if len(parts) < 3 {
+			return fmt.Errorf("usage: /rename <new-username> <password>")
 		}
+		c.printReply(c.chat.Rename(ctx, parts[1], parts[2]))
 
+	case "deleteaccount":
 		if len(parts) < 2 {
-			return fmt.Errorf("usage: /create <room-name>")
+			return fmt.Errorf("usage: /deleteaccount <password>")
 		}
+		c.printReply(c.chat.DeleteAccount(ctx, parts[1]))
 
-		roomName := parts[1]
-		msg := shared.Message{
-			Type:      shared.MessageTypeCommand,
-			Content:   "create",
-			Room:      roomName,
-			Timestamp: time.Now(),
+	case "create":
+		if len(parts) < 2 {
+			return fmt.Errorf("usage: /create <room-name>")
 		}
-
-		return c.SendMessage(msg)
+		c.printReply(c.chat.CreateRoom(ctx, parts[1]))
 
 	case "join":
-		if !c.IsAuthenticated() {
-			return fmt.Errorf("you must be logged in to join rooms")
-		}
-
 		if len(parts) < 2 {
 			return fmt.Errorf("usage: /join <room-name>")
 		}
+		c.printReply(c.chat.Join(ctx, parts[1]))
 
-		roomName := parts[1]
-		msg := shared.Message{
-			Type:      shared.MessageTypeCommand,
-			Content:   "join",
-			Room:      roomName,
-			Timestamp: time.Now(),
-		}
+	case "leave":
+		c.printReply(c.chat.Leave(ctx))
 
-		return c.SendMessage(msg)
+	case "list":
+		c.printReply(c.chat.List(ctx))
 
-	case "leave":
-		if !c.IsAuthenticated() {
-			return fmt.Errorf("you must be logged in to leave rooms")
+	case "msg", "urgent":
+		if len(parts) < 3 {
+			return fmt.Errorf("usage: /%s <username> <message>", parts[0])
 		}
 
-		msg := shared.Message{
-			Type:      shared.MessageTypeCommand,
-			Content:   "leave",
-			Timestamp: time.Now(),
+		// Urgent messages reach users who are busy
+		content := strings.Join(parts[2:], " ")
+		if command == "urgent" {
+			c.printReply(c.chat.UrgentDM(ctx, parts[1], content))
+		} else {
+			c.printReply(c.chat.DM(ctx, parts[1], content))
 		}
 
-		return c.SendMessage(msg)
-
-	case "rooms":
-		if !c.IsAuthenticated() {
-			return fmt.Errorf("you must be logged in to list rooms")
+	case "encrypt":
+		if len(parts) < 3 {
+			return fmt.Errorf("usage: /encrypt <username> <message>")
 		}
+		c.printReply(c.chat.SendEncrypted(ctx, parts[1], strings.Join(parts[2:], " ")))
 
-		msg := shared.Message{
-			Type:      shared.MessageTypeCommand,
-			Content:   "rooms",
-			Timestamp: time.Now(),
+	case "file":
+		if len(parts) < 2 {
+			return fmt.Errorf("usage: /file <filepath>")
 		}
+		return c.upload(parts[1], c.chat.UploadFile)
 
-		return c.SendMessage(msg)
-
-	case "list":
-		if !c.IsAuthenticated() {
-			return fmt.Errorf("you must be logged in to list users")
+	case "sendfile":
+		if len(parts) < 3 {
+			return fmt.Errorf("usage: /sendfile <username> <filepath>")
 		}
+		return c.upload(parts[2], func(ctx context.Context, filePath string) (*chatclient.Upload, error) {
+			return c.chat.SendFileTo(ctx, parts[1], filePath)
+		})
 
-		msg := shared.Message{
-			Type:      shared.MessageTypeCommand,
-			Content:   "list",
-			Timestamp: time.Now(),
+	case "resume":
+		if len(parts) < 2 {
+			return fmt.Errorf("usage: /resume <filepath>")
 		}
+		return c.upload(parts[1], c.chat.ResumeUpload)
 
-		return c.SendMessage(msg)
-
-	case "msg":
-		if !c.IsAuthenticated() {
-			return fmt.Errorf("you must be logged in to send direct messages")
+	case "download", "preview", "delfile":
+		// File names may contain spaces
+		nameOrID := strings.TrimSpace(strings.TrimPrefix(cmd, command))
+		if nameOrID == "" {
+			return fmt.Errorf("usage: /%s <name|id>", command)
 		}
+		c.printReply(c.chat.Command(ctx, command+" "+nameOrID))
 
-		if len(parts) < 3 {
-			return fmt.Errorf("usage: /msg <username> <message>")
+	case "status":
+		if len(parts) < 2 {
+			return fmt.Errorf("usage: /status <online|away|busy|offline> [text]")
 		}
 
-		recipient := parts[1]
-		content := strings.Join(parts[2:], " ")
-
-		msg := shared.Message{
-			Type:      shared.MessageTypeDirect,
-			Content:   content,
-			Recipient: recipient,
-			Timestamp: time.Now(),
+		status, ok := shared.ParseStatus(parts[1])
+		if !ok {
+			return fmt.Errorf("invalid status. Use: online, away, busy, or offline")
 		}
 
-		return c.SendMessage(msg)
-
-	case "encrypt":
-		if !c.IsAuthenticated() {
-			return fmt.Errorf("you must be logged in to send encrypted messages")
+		// Anything after the status is the custom status text
+		statusText := ""
+		if fields := strings.SplitN(cmd, " ", 3); len(fields) == 3 {
+			statusText = fields[2]
 		}
+		c.printReply(c.chat.SetStatus(ctx, status, statusText))
 
+	case "gmsg":
 		if len(parts) < 3 {
-			return fmt.Errorf("usage: /encrypt <username> <message>")
+			return fmt.Errorf("usage: /gmsg <user1,user2,...|group-id> <message>")
 		}
+		c.printReply(c.chat.GroupMessage(ctx, parts[1], strings.Join(parts[2:], " ")))
 
-		recipient := parts[1]
-		content := strings.Join(parts[2:], " ")
-
-		// Simple demo key - in production, use secure key exchange
-		key := []byte("0123456789abcdef")
-
-		encrypted, err := shared.Encrypt(content, key)
-		if err != nil {
-			return fmt.Errorf("encryption failed: %v", err)
+	case "gadd":
+		if len(parts) < 3 {
+			return fmt.Errorf("usage: /gadd <group-id> <username>")
 		}
+		c.printReply(c.chat.Command(ctx, "gadd "+parts[1]+" "+parts[2]))
 
-		msg := shared.Message{
-			Type:      shared.MessageTypeEncrypted,
-			Content:   encrypted,
-			Recipient: recipient,
-			Timestamp: time.Now(),
-			Encrypted: true,
+	case "profile":
+		// Avatars are read from a local file and uploaded
+		if len(parts) >= 4 && parts[1] == "set" && strings.EqualFold(parts[2], "avatar") {
+			c.printReply(c.chat.SetAvatar(ctx, strings.Join(parts[3:], " ")))
+			return nil
 		}
+		c.printReply(c.chat.Command(ctx, strings.Join(parts, " ")))
 
-		return c.SendMessage(msg)
-
-	case "file":
-		if !c.IsAuthenticated() {
-			return fmt.Errorf("you must be logged in to send files")
-		}
+	case "rooms", "uploads", "quota", "files", "contacts", "blocked", "groups",
+		"sessions", "unread", "bots", "invitecode", "pending":
+		c.printReply(c.chat.Command(ctx, command))
 
+	case "whois", "unwatch", "addcontact", "removecontact", "block", "unblock", "invite",
+		"approve", "reject", "gleave":
 		if len(parts) < 2 {
-			return fmt.Errorf("usage: /file <filepath>")
+			return fmt.Errorf("usage: /%s <%s>", command, commandArgument(command))
 		}
+		c.printReply(c.chat.Command(ctx, command+" "+parts[1]))
 
-		filePath := parts[1]
-		return c.sendFile(filePath)
-
-	case "status":
-		if !c.IsAuthenticated() {
-			return fmt.Errorf("you must be logged in to change status")
+	case "bot":
+		if len(parts) < 3 {
+			return fmt.Errorf("usage: /bot <create|token|tokens|revoke|rooms|caps|delete> <name> ...")
 		}
+		c.printReply(c.chat.Command(ctx, strings.Join(parts, " ")))
 
+	case "logout":
 		if len(parts) < 2 {
-			return fmt.Errorf("usage: /status <online|away|busy|offline>")
+			return fmt.Errorf("usage: /logout <session-id>, see /sessions")
 		}
+		c.printReply(c.chat.Command(ctx, "logout "+parts[1]))
 
-		statusStr := parts[1]
-		var statusValue shared.UserStatus
-
-		switch strings.ToLower(statusStr) {
-		case "online":
-			statusValue = shared.StatusOnline
-		case "away":
-			statusValue = shared.StatusAway
-		case "busy":
-			statusValue = shared.StatusBusy
-		case "offline":
-			statusValue = shared.StatusOffline
-		default:
-			return fmt.Errorf("invalid status. Use: online, away, busy, or offline")
-		}
-
-		statusMsg := shared.StatusMessage{
-			Message: shared.Message{
-				Type:      shared.MessageTypeStatus,
-				Content:   statusStr,
-				Timestamp: time.Now(),
-			},
-			Status: statusValue,
-		}
-
-		return c.SendMessage(statusMsg)
+	case "watch":
+		c.printReply(c.chat.Command(ctx, strings.Join(parts, " ")))
 
 	case "history":
-		if !c.IsAuthenticated() {
-			return fmt.Errorf("you must be logged in to view history")
-		}
-
-		var msgContent string
+		username := ""
 		if len(parts) > 1 {
 			// Direct message history with specific user
-			msgContent = "history " + parts[1]
-		} else {
-			// Room history
-			msgContent = "history"
+			username = parts[1]
 		}
+		c.printHistory(c.chat.History(ctx, username))
 
-		msg := shared.Message{
-			Type:      shared.MessageTypeCommand,
-			Content:   msgContent,
-			Timestamp: time.Now(),
+	case "ghistory":
+		if len(parts) < 2 {
+			return fmt.Errorf("usage: /ghistory <group-id>")
 		}
-
-		return c.SendMessage(msg)
+		c.printHistory(c.chat.GroupHistory(ctx, parts[1]))
 
 	case "exit":
-		msg := shared.Message{
-			Type:      shared.MessageTypeCommand,
-			Content:   "exit",
-			Timestamp: time.Now(),
-		}
-
-		return c.SendMessage(msg)
+		// The server says goodbye and disconnects, which stops the client
+		reply, _ := c.chat.Command(ctx, "exit")
+		c.printReply(reply, nil)
 
 	case "help":
 		printHelp()
-		return nil
 
 	default:
 		return fmt.Errorf("unknown command: %s", command)
 	}
+	return nil
+}
+
+// commandArgument names the argument of a command taking one
+func commandArgument(command string) string {
+	if command == "gleave" {
+		return "group-id"
+	}
+	return "username"
 }
 
 // printHelp displays available commands
 func printHelp() {
 	fmt.Println("\n=== TCP Chat Client Help ===")
 	fmt.Println("Authentication:")
-	fmt.Println("  /register <username> <password> - Register a new account")
-	fmt.Println("  /login <username> <password>    - Log in with existing account")
+	fmt.Println("  /register <username> <password> [invite-code] - Register a new account")
+	fmt.Println("  /login <username> <password> [device] - Log in with existing account")
+	fmt.Println("  /passwd <current> <new>         - Change your password")
+	fmt.Println("  /rename <new-username> <password> - Change your username, keeping your history")
+	fmt.Println("  /deleteaccount <password>       - Delete your account and disconnect")
+	fmt.Println("  /botlogin <bot-name> <token> [device] - Log in as a bot with one of its API tokens")
+	fmt.Println("  /sessions                       - List the devices you are logged in on")
+	fmt.Println("  /logout <session-id>            - Log out one of your sessions")
 
 	fmt.Println("\nRoom Management:")
 	fmt.Println("  /rooms                          - List available rooms")
 	fmt.Println("  /create <room-name>             - Create and join a new room")
 	fmt.Println("  /join <room-name>               - Join an existing room")
 	fmt.Println("  /leave                          - Leave current room")
+	fmt.Println("  /invite <username>              - Invite a user to your current room")
 	fmt.Println("  /list                           - List users in current room")
 
 	fmt.Println("\nMessaging:")
 	fmt.Println("  <message>                       - Send message to current room")
 	fmt.Println("  /msg <username> <message>       - Send direct message to user")
+	fmt.Println("  /urgent <username> <message>    - Send a direct message that reaches the user even when busy")
+	fmt.Println("  /gmsg <user1,user2,...> <message> - Message a group of 3 to 10 people, including you")
+	fmt.Println("  /gmsg <group-id> <message>      - Message an existing group")
+	fmt.Println("  /groups                         - List your group conversations")
+	fmt.Println("  /ghistory <group-id>            - Show a group's message history")
+	fmt.Println("  /gadd <group-id> <username>     - Add someone to a group")
+	fmt.Println("  /gleave <group-id>              - Leave a group")
 	fmt.Println("  /encrypt <username> <message>   - Send encrypted message to user")
 
 	fmt.Println("\nFile Sharing:")
 	fmt.Println("  /file <filepath>                - Send file to current room")
+	fmt.Println("  /sendfile <username> <filepath> - Send file privately to a user")
+	fmt.Println("  /resume <filepath>              - Continue an interrupted upload")
+	fmt.Println("  /uploads                        - List your unfinished uploads")
+	fmt.Println("  /files                          - List files stored in current room")
+	fmt.Println("  /download <name|id>             - Download a file from current room")
+	fmt.Println("  /download @<username> <name|id> - Download a file sent between you and a user")
+	fmt.Println("  /preview <name|id>              - Show a file's type, size and first lines or dimensions")
+	fmt.Println("  /delfile <name|id>              - Delete a file you uploaded (also @<username> <name|id>)")
+	fmt.Println("  /quota                          - Show your storage usage and limits")
+
+	fmt.Println("\nBots:")
+	fmt.Println("  /bots                           - List the bots you own (admins: all bots)")
+	fmt.Println("  /bot create <name> [owner]      - Create a bot account; admins may name another owner")
+	fmt.Println("  /bot token <name> [label]       - Create an API token for a bot (shown once)")
+	fmt.Println("  /bot tokens <name>              - List a bot's tokens")
+	fmt.Println("  /bot revoke <name> <token-id>   - Revoke a token and log out its sessions")
+	fmt.Println("  /bot rooms <name> <r1,r2|*|none> - Set the rooms a bot may join")
+	fmt.Println("  /bot caps <name> <post,dm,files,history|none> - Set what a bot may do")
+	fmt.Println("  /bot delete <name>              - Delete a bot")
+
+	fmt.Println("\nAdministration:")
+	fmt.Println("  /invitecode                     - Create a single-use registration invite")
+	fmt.Println("  /pending                        - List registrations awaiting approval")
+	fmt.Println("  /approve <username>             - Approve a pending registration")
+	fmt.Println("  /reject <username>              - Reject a pending registration")
 
 	fmt.Println("\nOther Commands:")
-	fmt.Println("  /status <online|away|busy|offline> - Change your status")
+	fmt.Println("  /status <online|away|busy|offline> [text] - Change your status, with optional text")
+	fmt.Println("  /whois <username>               - Show a user's status or when they were last seen")
+	fmt.Println("  /watch [username]               - Get told when a user's status changes (no name lists them)")
+	fmt.Println("  /unwatch <username>             - Stop watching a user")
+	fmt.Println("  /profile [username]             - Show your profile or someone else's")
+	fmt.Println("  /profile set <name|bio|timezone|pronouns> [value] - Change your profile (no value clears it)")
+	fmt.Println("  /profile set avatar [image]     - Upload a PNG, JPEG or GIF avatar (no image removes it)")
+	fmt.Println("  /contacts                       - List your contacts and their status")
+	fmt.Println("  /addcontact <username>          - Add a contact and follow their status")
+	fmt.Println("  /removecontact <username>       - Remove a contact")
+	fmt.Println("  /block <username>               - Stop a user from messaging, mentioning or inviting you")
+	fmt.Println("  /unblock <username>             - Lift a block")
+	fmt.Println("  /blocked                        - List the users you block")
 	fmt.Println("  /history                        - View room message history")
 	fmt.Println("  /history <username>             - View direct message history with user")
+	fmt.Println("  /unread                         - Count unread messages in your rooms, DMs and groups")
 	fmt.Println("  /help                           - Show this help message")
 	fmt.Println("  /exit                           - Exit the chat client")
-	fmt.Println("===============================\n")
+	fmt.Println("===============================")
+	fmt.Println()
 }
 
 func main() {
 	// Define command-line flags
 	serverAddr := flag.String("server", "localhost:8080", "Chat server address")
+	device := flag.String("device", "", "Device name shown in /sessions (default: host name)")
 	flag.Parse()
 
 	// Create app data directory
@@ -610,8 +686,12 @@ func main() {
 		log.Fatalf("Error creating data directory: %v", err)
 	}
 
-	// Initialize client
-	client := NewClient(*serverAddr)
+	config := chatclient.DefaultConfig(*serverAddr)
+	config.DataDir = appDataDir
+	config.Device = *device
+	if config.Device == "" {
+		config.Device, _ = os.Hostname()
+	}
 
 	// Display welcome message
 	fmt.Println("TCP Chat Client")
@@ -619,39 +699,24 @@ func main() {
 	fmt.Printf("Connecting to %s...\n", *serverAddr)
 
 	// Connect to server
-	if err := client.Connect(); err != nil {
+	chat, err := chatclient.Dial(config)
+	if err != nil {
 		log.Fatalf("Failed to connect: %v", err)
 	}
-	defer client.Close()
+	defer chat.Close()
 
 	fmt.Println("Connected to server!")
+	client := &Client{chat: chat}
 
 	// Set up signal handling for graceful shutdown
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
 
-	// Start reader goroutine
+	// Print incoming messages until the session ends
+	stopped := make(chan struct{})
 	go func() {
-		reader := bufio.NewReader(client.conn)
-		for {
-			message, err := reader.ReadBytes('\n')
-			if err != nil {
-				if err == io.EOF {
-					fmt.Println("\nDisconnected from server")
-				} else {
-					fmt.Printf("\nError reading from server: %v\n", err)
-				}
-				sigCh <- syscall.SIGTERM
-				return
-			}
-			client.processMessage(message)
-
-			// Check if we should exit
-			if client.shouldExit {
-				sigCh <- syscall.SIGTERM
-				return
-			}
-		}
+		client.printEvents()
+		close(stopped)
 	}()
 
 	// Input handler
@@ -659,6 +724,11 @@ func main() {
 		scanner := bufio.NewScanner(os.Stdin)
 		for scanner.Scan() {
 			input := scanner.Text()
+
+			// What was shown before we typed counts as read
+			if err := chat.FlushReadMarkers(); err != nil {
+				fmt.Printf("Error: %v\n", err)
+			}
 			if err := client.parseCommand(input); err != nil {
 				fmt.Printf("Error: %v\n", err)
 			}
@@ -671,7 +741,10 @@ func main() {
 		sigCh <- syscall.SIGTERM
 	}()
 
-	// Wait for termination signal
-	<-sigCh
+	// Wait for termination signal or the end of the session
+	select {
+	case <-sigCh:
+	case <-stopped:
+	}
 	fmt.Println("\nShutting down client...")
 }
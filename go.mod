@@ -1,3 +1,5 @@
 module chatap.com
 
 go 1.20
+
+require golang.org/x/crypto v0.33.0
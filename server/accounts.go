@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"chatap.com/shared"
+)
+
+// deletedUser replaces the name of a deleted account in anonymized history,
+// files and groups. It is not a valid username, so nobody can take it.
+const deletedUser = "[deleted]"
+
+// handleAccountChange handles the account flows a logged-in user can start,
+// each confirmed with their current password:
+//
+//	passwd: Password is the current password, NewPassword the new one
+//	rename: Username is the new name
+//	delete: the account is deleted as the server's deletion policy says
+func (c *Client) handleAccountChange(authMsg shared.AuthMessage) {
+	if !c.loggedIn.Load() {
+		c.sendError("Not authenticated")
+		return
+	}
+	if c.IsBot {
+		c.sendError("Bots have no password. Their owner manages them with the bot command")
+		return
+	}
+
+	ip := remoteIP(c.Conn)
+	guard := c.Server.LoginGuard
+	if wait := guard.LockedFor(c.Username(), ip); wait > 0 {
+		c.Server.Metrics.Inc("auth.locked_attempts")
+		c.sendError(fmt.Sprintf("Too many failed password attempts, try again in %v", wait.Round(time.Second)))
+		return
+	}
+	if !c.Server.AuthManager.AuthenticateUser(c.Username(), authMsg.Password) {
+		guard.RecordFailure(c.Username(), ip)
+		c.Server.Metrics.Inc("auth.failures")
+		log.Printf("Wrong password for %s of %s from %s", authMsg.Content, c.Username(), ip)
+		c.sendError("Wrong password")
+		return
+	}
+
+	if authMsg.Content != "passwd" && c.Server.AuthManager.IsAdmin(c.Username()) {
+		c.sendError("Admin accounts are named in the server config and cannot be renamed or deleted")
+		return
+	}
+
+	switch authMsg.Content {
+	case "passwd":
+		if authMsg.NewPassword == "" {
+			c.sendError("The new password cannot be empty")
+			return
+		}
+		if err := c.Server.AuthManager.ChangePassword(c.Username(), authMsg.Password, authMsg.NewPassword); err != nil {
+			c.sendError("Could not change password: " + err.Error())
+			return
+		}
+		log.Printf("User %s changed their password", c.Username())
+		c.sendSuccess("Password changed")
+
+	case "rename":
+		c.renameAccount(authMsg.Password, authMsg.Username)
+
+	case "delete":
+		c.deleteAccount(authMsg.Password)
+	}
+}
+
+// renameAccount gives the client's account a new username and moves
+// everything kept under the old one
+func (c *Client) renameAccount(password, newName string) {
+	oldName := c.Username()
+	s := c.Server
+
+	if newName == oldName {
+		c.sendError("That is already your username")
+		return
+	}
+	if err := s.AuthManager.Rename(oldName, password, newName); err != nil {
+		switch err {
+		case ErrUserExists:
+			c.sendError("Username already exists")
+		default:
+			c.sendError("Could not rename account: " + err.Error())
+		}
+		return
+	}
+
+	// Unfinished uploads would be filed under the old name
+	if aborted := s.Uploads.AbortUser(oldName); aborted > 0 {
+		c.sendSuccess(fmt.Sprintf("Cancelled %d unfinished uploads", aborted))
+	}
+
+	partners := s.MessageStore.RenameUser(c.UserID, oldName, newName)
+	for _, partner := range partners {
+		if partner == oldName {
+			partner = newName
+		}
+		s.Files.MoveArea(directTarget(oldName, partner), directTarget(newName, partner))
+	}
+	s.Files.ReplaceUploader(oldName, newName)
+	s.Presence.RenameUser(oldName, newName)
+	s.Contacts.RenameUser(oldName, newName)
+	s.Groups.RenameUser(oldName, newName)
+	s.Profiles.RenameUser(oldName, newName)
+	s.Mailbox.RenameUser(oldName, newName)
+	s.DND.RenameUser(oldName, newName)
+	s.ReadMarkers.RenameUser(oldName, newName)
+
+	// Every session of the user follows the rename
+	sessions := s.ClientsOf(oldName)
+	s.mu.Lock()
+	for _, client := range sessions {
+		client.setUsername(newName)
+	}
+	s.mu.Unlock()
+
+	log.Printf("User %s renamed their account to %s", oldName, newName)
+	c.sendSuccess("Your username is now " + newName)
+	c.sendSession(false)
+	for _, client := range sessions {
+		if client != c {
+			client.notify("Your username is now " + newName)
+			client.notifySession(false)
+		}
+	}
+	s.announceProfile(newName, "changed their username from "+oldName)
+}
+
+// deleteAccount deletes the client's account and disconnects it
+func (c *Client) deleteAccount(password string) {
+	username := c.Username()
+
+	bots, err := c.Server.AuthManager.DeleteUser(username, password)
+	if err != nil {
+		c.sendError("Could not delete account: " + err.Error())
+		return
+	}
+	c.Server.forgetUser(c.UserID, username)
+
+	for _, client := range c.Server.ClientsOf(username) {
+		client.endSession(c, "Your account has been deleted")
+	}
+
+	// Nobody could manage the user's bots any more
+	for name, id := range bots {
+		c.Server.forgetBot(id, name, "The owner of this bot deleted their account")
+	}
+}
+
+// forgetUser removes what is kept about a deleted account. Room and group
+// messages are anonymized; direct messages and uploads are anonymized or
+// erased as the server's deletion policy says.
+func (s *Server) forgetUser(id, username string) {
+	erase := s.Config().Auth.DeletionPolicy == DeletionErase
+
+	s.Uploads.AbortUser(username)
+	partners := s.MessageStore.RemoveUser(id, username, erase)
+	for _, partner := range partners {
+		if erase {
+			s.Files.RemoveArea(directTarget(username, partner))
+		} else {
+			s.Files.MoveArea(directTarget(username, partner), directTarget(deletedUser, partner))
+		}
+	}
+	if erase {
+		s.Files.RemoveUploads(username)
+	} else {
+		s.Files.ReplaceUploader(username, deletedUser)
+	}
+	s.Presence.RemoveUser(username)
+	s.Contacts.RemoveUser(username)
+	s.Profiles.RemoveUser(username)
+	s.Mailbox.RemoveUser(username, erase)
+	s.DND.Release(username)
+	s.ReadMarkers.RemoveUser(username)
+	for _, group := range s.Groups.RemoveUser(username) {
+		s.groupNotice(group, username+" deleted their account and left the group")
+	}
+
+	log.Printf("Removed account %s (%s)", username, s.Config().Auth.DeletionPolicy)
+}
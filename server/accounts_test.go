@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"chatap.com/shared"
+)
+
+// testSession is the user's end of a client connected over a pipe
+type testSession struct {
+	t      *testing.T
+	client *Client
+	conn   net.Conn
+	lines  chan string
+}
+
+// connectTestSession connects a client to a running server and reads what
+// the server sends it
+func connectTestSession(t *testing.T, s *Server) *testSession {
+	t.Helper()
+	conn, peer := net.Pipe()
+	t.Cleanup(func() { peer.Close() })
+
+	session := &testSession{t: t, client: NewClient(conn, s), conn: peer, lines: make(chan string, 256)}
+	if !s.register(session.client) {
+		t.Fatal("server refused the client")
+	}
+	go session.client.ReadPump()
+	go session.client.WritePump()
+
+	go func() {
+		defer close(session.lines)
+		scanner := bufio.NewScanner(peer)
+		for scanner.Scan() {
+			var msg shared.Message
+			json.Unmarshal(scanner.Bytes(), &msg)
+			select {
+			case session.lines <- msg.Content:
+			default: // Nobody waits for this much
+			}
+		}
+	}()
+	return session
+}
+
+func (ts *testSession) send(msg interface{}) {
+	ts.t.Helper()
+	if err := ts.trySend(msg); err != nil {
+		ts.t.Fatalf("send: %v", err)
+	}
+}
+
+// trySend sends a message to a session that may have been ended meanwhile
+func (ts *testSession) trySend(msg interface{}) error {
+	data, _ := json.Marshal(msg)
+	_, err := ts.conn.Write(append(data, '\n'))
+	return err
+}
+
+// expect waits for a message from the server starting with prefix
+func (ts *testSession) expect(prefix string) {
+	ts.t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case line, ok := <-ts.lines:
+			if !ok {
+				ts.t.Fatalf("connection closed waiting for %q", prefix)
+			}
+			if strings.HasPrefix(line, prefix) {
+				return
+			}
+		case <-timeout:
+			ts.t.Fatalf("timed out waiting for %q", prefix)
+		}
+	}
+}
+
+// expectOneOf waits for a message starting with any of the prefixes
+func (ts *testSession) expectOneOf(prefixes ...string) {
+	ts.t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case line, ok := <-ts.lines:
+			if !ok {
+				ts.t.Fatalf("connection closed waiting for one of %q", prefixes)
+			}
+			for _, prefix := range prefixes {
+				if strings.HasPrefix(line, prefix) {
+					return
+				}
+			}
+		case <-timeout:
+			ts.t.Fatalf("timed out waiting for one of %q", prefixes)
+		}
+	}
+}
+
+// loginTestSession connects and logs in an existing account
+func loginTestSession(t *testing.T, s *Server, username, password string) *testSession {
+	t.Helper()
+	session := connectTestSession(t, s)
+	session.send(shared.AuthMessage{
+		Message:  shared.Message{Type: shared.MessageTypeAuth, Content: "login"},
+		Username: username,
+		Password: password,
+	})
+	session.expect("SUCCESS: Logged in")
+	return session
+}
+
+func TestRenameWhileOtherSessionsChat(t *testing.T) {
+	s := newTestServer(t)
+	go s.handleChannels()
+	defer close(s.quit)
+	s.AuthManager.RegisterUser("alice", "secret1")
+
+	renaming := loginTestSession(t, s, "alice", "secret1")
+	chatting := loginTestSession(t, s, "alice", "secret1")
+	chatting.send(shared.Message{Type: shared.MessageTypeCommand, Content: "join", Room: "general"})
+	chatting.expect("SUCCESS: Joined room")
+
+	// The chatting session keeps using its name while the other renames it
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 10; i++ {
+			chatting.send(shared.Message{Type: shared.MessageTypeText, Content: "hello", Room: "general"})
+		}
+	}()
+	renaming.send(shared.AuthMessage{
+		Message:  shared.Message{Type: shared.MessageTypeAuth, Content: "rename"},
+		Username: "carol",
+		Password: "secret1",
+	})
+	<-done
+
+	chatting.expect("SUCCESS: Your username is now carol")
+	for _, session := range []*testSession{renaming, chatting} {
+		if name := session.client.Username(); name != "carol" {
+			t.Fatalf("session is still called %q", name)
+		}
+	}
+	if clients := s.ClientsOf("carol"); len(clients) != 2 {
+		t.Fatalf("%d sessions of carol, want 2", len(clients))
+	}
+}
+
+func TestDeleteAccountDeletesOwnedBots(t *testing.T) {
+	s := newTestServer(t)
+	go s.handleChannels()
+	defer close(s.quit)
+	am := s.AuthManager
+	am.RegisterUser("owner", "secret1")
+	am.CreateBot("helper", "owner")
+	token, _, err := am.CreateToken("helper", "", "owner")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	owner := loginTestSession(t, s, "owner", "secret1")
+	bot := connectTestSession(t, s)
+	bot.send(shared.AuthMessage{
+		Message:  shared.Message{Type: shared.MessageTypeAuth, Content: "token"},
+		Username: "helper",
+		Token:    token,
+	})
+	bot.expect("SUCCESS: Logged in")
+
+	owner.send(shared.AuthMessage{
+		Message:  shared.Message{Type: shared.MessageTypeAuth, Content: "delete"},
+		Password: "secret1",
+	})
+	owner.expect("SUCCESS: Goodbye!")
+	bot.expect("SUCCESS: Goodbye! The owner of this bot deleted their account")
+
+	if _, ok := am.AuthenticateToken("helper", token); ok {
+		t.Fatal("token of a deleted owner's bot still logs in")
+	}
+	if am.UserExists("helper") {
+		t.Fatal("bot kept after its owner was deleted")
+	}
+}
+
+func TestRenameKeepsProfileAndPresence(t *testing.T) {
+	s := newTestServer(t)
+	go s.handleChannels()
+	defer close(s.quit)
+	s.AuthManager.RegisterUser("alice", "secret1")
+	s.AuthManager.RegisterUser("bob", "secret2")
+
+	alice := loginTestSession(t, s, "alice", "secret1")
+	bob := loginTestSession(t, s, "bob", "secret2")
+	alice.send(shared.Message{Type: shared.MessageTypeCommand, Content: "profile set name Alice Liddell"})
+	alice.expect("SUCCESS: Profile updated")
+	alice.send(shared.Message{Type: shared.MessageTypeCommand, Content: "status busy in a meeting"})
+	alice.expect("SUCCESS: Status updated to: busy (in a meeting)")
+	bob.send(shared.Message{Type: shared.MessageTypeCommand, Content: "watch alice"})
+	bob.expect("SUCCESS: Watching alice")
+
+	alice.send(shared.AuthMessage{
+		Message:  shared.Message{Type: shared.MessageTypeAuth, Content: "rename"},
+		Username: "alicia",
+		Password: "secret1",
+	})
+	alice.expect("SUCCESS: Your username is now alicia")
+
+	if name := s.Profiles.DisplayName("alicia"); name != "Alice Liddell" {
+		t.Fatalf("display name after rename is %q", name)
+	}
+	if profile := s.Profiles.Get("alice"); profile != (shared.UserProfile{}) {
+		t.Fatalf("old name keeps a profile: %+v", profile)
+	}
+
+	bob.send(shared.Message{Type: shared.MessageTypeCommand, Content: "whois alicia"})
+	bob.expect("SUCCESS: alicia is busy (in a meeting)")
+	bob.send(shared.Message{Type: shared.MessageTypeCommand, Content: "watch"})
+	bob.expect("SUCCESS: You are watching: alicia")
+
+	// The watcher follows the new name
+	alice.send(shared.Message{Type: shared.MessageTypeCommand, Content: "status online"})
+	bob.expect("alicia is now online")
+}
@@ -1,57 +1,539 @@
 package main
 
 import (
+	"crypto/rand"
 	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
+	"time"
+
+	"chatap.com/shared"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	ErrUserExists     = errors.New("username already exists")
+	ErrInviteRequired = errors.New("an invite code is required to register")
+	ErrInvalidInvite  = errors.New("invalid, expired or already used invite code")
+	ErrUserNotFound   = errors.New("user not found")
+	ErrNotPending     = errors.New("user is not awaiting approval")
+	ErrWrongPassword  = errors.New("wrong password")
+	ErrLongPassword   = errors.New("password must be at most 72 bytes")
 )
 
+// maxPasswordBytes is the longest password bcrypt can hash
+const maxPasswordBytes = 72
+
 type UserCredentials struct {
-	Username     string
-	PasswordHash string
+	ID           string    `json:"id"` // Stays the same when the user is renamed
+	Username     string    `json:"username"`
+	PasswordHash string    `json:"password_hash"`
+	Pending      bool      `json:"pending,omitempty"` // Awaiting admin approval
+	CreatedAt    time.Time `json:"created_at"`
+	Bot          *BotInfo  `json:"bot,omitempty"` // Set for bot accounts, which log in with tokens
+}
+
+type invite struct {
+	CreatedBy string
+	ExpiresAt time.Time
 }
 
 type AuthManager struct {
-	users map[string]UserCredentials
-	mu    sync.RWMutex
+	path             string // Where accounts are saved
+	users            map[string]UserCredentials
+	admins           map[string]bool
+	invites          map[string]invite
+	registrationMode string
+	inviteValidity   time.Duration
+	unsaved          bool // Token use times changed since the last save
+	mu               sync.RWMutex
+}
+
+func NewAuthManager(config AuthConfig, path string) *AuthManager {
+	am := &AuthManager{
+		path:    path,
+		users:   make(map[string]UserCredentials),
+		admins:  make(map[string]bool),
+		invites: make(map[string]invite),
+	}
+	am.Configure(config)
+
+	data, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		var users []UserCredentials
+		if err := json.Unmarshal(data, &users); err != nil {
+			log.Printf("Error parsing accounts %s: %v", path, err)
+			break
+		}
+		for _, credentials := range users {
+			am.users[credentials.Username] = credentials
+		}
+		log.Printf("Loaded %d accounts", len(am.users))
+	case !os.IsNotExist(err):
+		log.Printf("Error reading accounts %s: %v", path, err)
+	}
+
+	return am
+}
+
+func newUserID() (string, error) {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// newCredentials creates the account record of a new user
+func newCredentials(username, password string) (UserCredentials, error) {
+	id, err := newUserID()
+	if err != nil {
+		return UserCredentials{}, err
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return UserCredentials{}, err
+	}
+	return UserCredentials{
+		ID:           id,
+		Username:     username,
+		PasswordHash: hash,
+		CreatedAt:    time.Now(),
+	}, nil
+}
+
+// UserCount returns the number of accounts, pending ones included
+func (am *AuthManager) UserCount() int {
+	am.mu.RLock()
+	defer am.mu.RUnlock()
+	return len(am.users)
+}
+
+// Configure applies the registration settings from config
+func (am *AuthManager) Configure(config AuthConfig) {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	am.registrationMode = config.RegistrationMode
+	am.inviteValidity = time.Duration(config.InviteValidHours) * time.Hour
 }
 
-func NewAuthManager() *AuthManager {
-	return &AuthManager{
-		users: make(map[string]UserCredentials),
+// InviteValidity returns how long new invite codes remain valid
+func (am *AuthManager) InviteValidity() time.Duration {
+	am.mu.RLock()
+	defer am.mu.RUnlock()
+	return am.inviteValidity
+}
+
+// hashPassword returns a salted bcrypt hash of password
+func hashPassword(password string) (string, error) {
+	if len(password) > maxPasswordBytes {
+		return "", ErrLongPassword
 	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// checkPassword reports whether password matches hash. Hashes from before
+// bcrypt are unsalted SHA-256, reported as legacy so they can be replaced.
+func checkPassword(hash, password string) (ok, legacy bool) {
+	if !strings.HasPrefix(hash, "$2") {
+		sum := sha256.Sum256([]byte(password))
+		return subtle.ConstantTimeCompare([]byte(hash), []byte(hex.EncodeToString(sum[:]))) == 1, true
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil, false
 }
 
 func (am *AuthManager) RegisterUser(username, password string) bool {
+	// Hashing is slow, so it is done before taking the lock
+	credentials, err := newCredentials(username, password)
+	if err != nil {
+		log.Printf("Error creating account %s: %v", username, err)
+		return false
+	}
+
 	am.mu.Lock()
 	defer am.mu.Unlock()
 
 	if _, exists := am.users[username]; exists {
 		return false
 	}
+	am.users[username] = credentials
+	am.save()
 
-	hash := sha256.Sum256([]byte(password))
-	hashString := hex.EncodeToString(hash[:])
+	return true
+}
 
-	am.users[username] = UserCredentials{
-		Username:     username,
-		PasswordHash: hashString,
+// RegisterAccount registers a user according to the registration mode.
+// In invite mode the invite code is consumed; in approval mode the account
+// is created pending and pending is returned as true.
+func (am *AuthManager) RegisterAccount(username, password, inviteCode string) (pending bool, err error) {
+	if err := shared.ValidateUsername(username); err != nil {
+		return false, err
+	}
+	credentials, err := newCredentials(username, password)
+	if err != nil {
+		return false, err
 	}
 
-	return true
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	if _, exists := am.users[username]; exists {
+		return false, ErrUserExists
+	}
+
+	if am.registrationMode == RegistrationInvite {
+		if inviteCode == "" {
+			return false, ErrInviteRequired
+		}
+		inv, ok := am.invites[inviteCode]
+		if !ok || time.Now().After(inv.ExpiresAt) {
+			delete(am.invites, inviteCode)
+			return false, ErrInvalidInvite
+		}
+		delete(am.invites, inviteCode)
+	}
+
+	pending = am.registrationMode == RegistrationApproval
+	credentials.Pending = pending
+	am.users[username] = credentials
+	am.save()
+
+	return pending, nil
 }
 
+// AuthenticateUser checks a user's password. A legacy hash is replaced by a
+// bcrypt one once the password is known to match.
 func (am *AuthManager) AuthenticateUser(username, password string) bool {
+	am.mu.RLock()
+	credentials, exists := am.users[username]
+	am.mu.RUnlock()
+	if !exists || credentials.Bot != nil {
+		return false
+	}
+
+	ok, legacy := checkPassword(credentials.PasswordHash, password)
+	if ok && legacy {
+		if hash, err := hashPassword(password); err == nil {
+			am.mu.Lock()
+			if current, err := am.checked(username, credentials.PasswordHash); err == nil {
+				current.PasswordHash = hash
+				am.users[username] = current
+				am.save()
+			}
+			am.mu.Unlock()
+		}
+	}
+	return ok
+}
+
+// verifyPassword checks a user's password and returns the hash it was checked
+// against. bcrypt takes tens of milliseconds, so am.mu is only held to read
+// the hash; callers that then change the account do so under the lock after
+// making sure with checked that the hash is still the same.
+func (am *AuthManager) verifyPassword(username, password string) (string, error) {
+	am.mu.RLock()
+	credentials, exists := am.users[username]
+	am.mu.RUnlock()
+	if !exists {
+		return "", ErrUserNotFound
+	}
+	if ok, _ := checkPassword(credentials.PasswordHash, password); !ok {
+		return "", ErrWrongPassword
+	}
+	return credentials.PasswordHash, nil
+}
+
+// checked returns a user's credentials if their password hash is still the
+// one verifyPassword checked. The caller must hold am.mu.
+func (am *AuthManager) checked(username, hash string) (UserCredentials, error) {
+	credentials, exists := am.users[username]
+	if !exists {
+		return UserCredentials{}, ErrUserNotFound
+	}
+	// The password was changed in the meantime
+	if credentials.PasswordHash != hash {
+		return UserCredentials{}, ErrWrongPassword
+	}
+	return credentials, nil
+}
+
+// UserExists reports whether username is a registered, approved account
+func (am *AuthManager) UserExists(username string) bool {
 	am.mu.RLock()
 	defer am.mu.RUnlock()
 
+	credentials, exists := am.users[username]
+	return exists && !credentials.Pending
+}
+
+// UserID returns a user's stable ID, or "" if there is no such account
+func (am *AuthManager) UserID(username string) string {
+	am.mu.RLock()
+	defer am.mu.RUnlock()
+
+	return am.users[username].ID
+}
+
+// ChangePassword replaces a user's password after checking the current one
+func (am *AuthManager) ChangePassword(username, current, password string) error {
+	checkedHash, err := am.verifyPassword(username, current)
+	if err != nil {
+		return err
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	credentials, err := am.checked(username, checkedHash)
+	if err != nil {
+		return err
+	}
+	credentials.PasswordHash = hash
+	am.users[username] = credentials
+	am.save()
+	return nil
+}
+
+// Rename moves an account to a new username after checking its password. The
+// user ID stays the same.
+func (am *AuthManager) Rename(username, password, newName string) error {
+	if err := shared.ValidateUsername(newName); err != nil {
+		return err
+	}
+	checkedHash, err := am.verifyPassword(username, password)
+	if err != nil {
+		return err
+	}
+
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	credentials, err := am.checked(username, checkedHash)
+	if err != nil {
+		return err
+	}
+	if _, taken := am.users[newName]; taken {
+		return ErrUserExists
+	}
+
+	delete(am.users, username)
+	credentials.Username = newName
+	am.users[newName] = credentials
+	am.setBotOwner(username, newName)
+	am.save()
+	return nil
+}
+
+// DeleteUser removes an account after checking its password. The user's bots
+// are deleted with it; their IDs are returned by name.
+func (am *AuthManager) DeleteUser(username, password string) (map[string]string, error) {
+	checkedHash, err := am.verifyPassword(username, password)
+	if err != nil {
+		return nil, err
+	}
+
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	if _, err := am.checked(username, checkedHash); err != nil {
+		return nil, err
+	}
+
+	delete(am.users, username)
+	bots := make(map[string]string)
+	for name, bot := range am.users {
+		if bot.Bot != nil && bot.Bot.Owner == username {
+			bots[name] = bot.ID
+			delete(am.users, name)
+		}
+	}
+	am.save()
+	return bots, nil
+}
+
+// setBotOwner moves the bots of an owner to another. The caller must hold am.mu.
+func (am *AuthManager) setBotOwner(owner, newOwner string) {
+	for _, credentials := range am.users {
+		if credentials.Bot != nil && credentials.Bot.Owner == owner {
+			credentials.Bot.Owner = newOwner
+		}
+	}
+}
+
+// IsPending reports whether a registered user is still awaiting approval
+func (am *AuthManager) IsPending(username string) bool {
+	am.mu.RLock()
+	defer am.mu.RUnlock()
+
+	return am.users[username].Pending
+}
+
+// SetAdmins replaces the set of admin users
+func (am *AuthManager) SetAdmins(usernames []string) {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	am.admins = make(map[string]bool, len(usernames))
+	for _, username := range usernames {
+		am.admins[username] = true
+	}
+}
+
+// SetAdmin grants admin rights to a user
+func (am *AuthManager) SetAdmin(username string) {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+	am.admins[username] = true
+}
+
+func (am *AuthManager) IsAdmin(username string) bool {
+	am.mu.RLock()
+	defer am.mu.RUnlock()
+	return am.admins[username]
+}
+
+// CreateInvite generates a single-use invite code
+func (am *AuthManager) CreateInvite(createdBy string) (string, error) {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	code := hex.EncodeToString(buf)
+
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	am.invites[code] = invite{
+		CreatedBy: createdBy,
+		ExpiresAt: time.Now().Add(am.inviteValidity),
+	}
+
+	return code, nil
+}
+
+// PendingUsers returns the usernames awaiting approval, sorted
+func (am *AuthManager) PendingUsers() []string {
+	am.mu.RLock()
+	defer am.mu.RUnlock()
+
+	pending := make([]string, 0)
+	for username, credentials := range am.users {
+		if credentials.Pending {
+			pending = append(pending, username)
+		}
+	}
+	sort.Strings(pending)
+	return pending
+}
+
+// ApproveUser activates a pending account
+func (am *AuthManager) ApproveUser(username string) error {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
 	credentials, exists := am.users[username]
 	if !exists {
-		return false
+		return ErrUserNotFound
+	}
+	if !credentials.Pending {
+		return ErrNotPending
 	}
 
-	hash := sha256.Sum256([]byte(password))
-	hashString := hex.EncodeToString(hash[:])
+	credentials.Pending = false
+	am.users[username] = credentials
+	am.save()
+	return nil
+}
 
-	return credentials.PasswordHash == hashString
+// RejectUser removes a pending account
+func (am *AuthManager) RejectUser(username string) error {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	credentials, exists := am.users[username]
+	if !exists {
+		return ErrUserNotFound
+	}
+	if !credentials.Pending {
+		return ErrNotPending
+	}
+
+	delete(am.users, username)
+	am.save()
+	return nil
+}
+
+// save writes the accounts. The caller must hold am.mu.
+func (am *AuthManager) save() {
+	users := make([]UserCredentials, 0, len(am.users))
+	for _, credentials := range am.users {
+		users = append(users, credentials)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].CreatedAt.Before(users[j].CreatedAt)
+	})
+
+	data, err := json.MarshalIndent(users, "", "  ")
+	if err != nil {
+		log.Printf("Error serializing accounts: %v", err)
+		return
+	}
+
+	if err := os.MkdirAll(filepath.Dir(am.path), 0755); err != nil {
+		log.Printf("Error creating accounts directory: %v", err)
+		return
+	}
+
+	// Write to a temporary file and rename it so a crash never leaves a truncated file.
+	// Password hashes are only readable by the server's user.
+	tmpPath := am.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		log.Printf("Error writing accounts %s: %v", am.path, err)
+		return
+	}
+	if err := os.Rename(tmpPath, am.path); err != nil {
+		log.Printf("Error replacing accounts %s: %v", am.path, err)
+		return
+	}
+	am.unsaved = false
+}
+
+// Flush saves the token use times recorded since the last save
+func (am *AuthManager) Flush() {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	if am.unsaved {
+		am.save()
+	}
+}
+
+// flushLoop flushes the accounts at the given interval until quit is closed
+func (am *AuthManager) flushLoop(interval time.Duration, quit <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			am.Flush()
+		case <-quit:
+			return
+		}
+	}
 }
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPasswordHashesAreSalted(t *testing.T) {
+	first, err := hashPassword("secret1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _ := hashPassword("secret1")
+	if first == second {
+		t.Fatal("the same password hashed twice gave the same hash")
+	}
+	for _, hash := range []string{first, second} {
+		if ok, legacy := checkPassword(hash, "secret1"); !ok || legacy {
+			t.Fatalf("checkPassword(%q) = %v, %v", hash, ok, legacy)
+		}
+		if ok, _ := checkPassword(hash, "secret2"); ok {
+			t.Fatal("wrong password accepted")
+		}
+	}
+
+	if _, err := hashPassword(strings.Repeat("x", maxPasswordBytes+1)); err != ErrLongPassword {
+		t.Fatalf("hashing an overlong password: %v", err)
+	}
+}
+
+func TestLegacyPasswordHashIsReplacedOnLogin(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.json")
+	am := NewAuthManager(DefaultAuthConfig(), path)
+	am.RegisterUser("alice", "secret1")
+
+	sum := sha256.Sum256([]byte("secret1"))
+	credentials := am.users["alice"]
+	credentials.PasswordHash = hex.EncodeToString(sum[:])
+	am.users["alice"] = credentials
+
+	if am.AuthenticateUser("alice", "secret2") {
+		t.Fatal("wrong password accepted against a legacy hash")
+	}
+	if am.users["alice"].PasswordHash != credentials.PasswordHash {
+		t.Fatal("legacy hash replaced after a failed login")
+	}
+	if !am.AuthenticateUser("alice", "secret1") {
+		t.Fatal("legacy hash no longer accepted")
+	}
+	if hash := am.users["alice"].PasswordHash; !strings.HasPrefix(hash, "$2") {
+		t.Fatalf("legacy hash kept after login: %q", hash)
+	}
+	if !am.AuthenticateUser("alice", "secret1") {
+		t.Fatal("password not accepted after rehashing")
+	}
+
+	// The new hash is what is saved
+	reloaded := NewAuthManager(DefaultAuthConfig(), path)
+	if hash := reloaded.users["alice"].PasswordHash; hash != am.users["alice"].PasswordHash {
+		t.Fatalf("saved hash %q, want %q", hash, am.users["alice"].PasswordHash)
+	}
+}
+
+func TestPasswordChecksDoNotTakeTheAccountsLock(t *testing.T) {
+	am := NewAuthManager(DefaultAuthConfig(), filepath.Join(t.TempDir(), "users.json"))
+	am.RegisterUser("alice", "secret1")
+
+	// Carol's hash is costlier than usual, so that checking it outlasts a
+	// registration made meanwhile
+	am.mu.Lock()
+	am.users["carol"] = UserCredentials{Username: "carol", PasswordHash: "$2a$12$NRhJji8AevxU3WYIlD51YewFP7W5EEN/nwsS/KP3FatVGrho7nGFa"}
+	am.mu.Unlock()
+
+	done := make(chan bool, 1)
+	go func() { done <- am.AuthenticateUser("carol", "secret1") }()
+	if !am.RegisterUser("bob", "secret2") {
+		t.Fatal("bob not registered")
+	}
+	select {
+	case <-done:
+		t.Fatal("registration waited for the password check")
+	default:
+	}
+	if !<-done {
+		t.Fatal("login refused")
+	}
+
+	// A password changed after it was checked is not overwritten
+	checkedHash, err := am.verifyPassword("alice", "secret1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := am.ChangePassword("alice", "secret1", "secret2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := am.checked("alice", checkedHash); err != ErrWrongPassword {
+		t.Fatalf("checked after a password change: %v", err)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// blobsDir holds the stored file contents. Room names cannot start with '.',
+// so it never clashes with a room.
+const blobsDir = ".blobs"
+
+// BlobStore keeps a single copy of every stored file, named by its SHA-256
+// hash, e.g. ".blobs/ab/ab12...". Rooms and conversations refer to blobs from
+// their file indexes.
+type BlobStore struct {
+	dir string
+}
+
+func NewBlobStore(dir string) *BlobStore {
+	return &BlobStore{dir: dir}
+}
+
+// isBlobHash reports whether hash is a lowercase hex SHA-256, the only names
+// the store uses
+func isBlobHash(hash string) bool {
+	if len(hash) != 64 {
+		return false
+	}
+	for _, r := range hash {
+		if !(r >= '0' && r <= '9' || r >= 'a' && r <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// Path returns where a blob lives on disk, or "" for an invalid hash
+func (bs *BlobStore) Path(hash string) string {
+	if !isBlobHash(hash) {
+		return ""
+	}
+	return filepath.Join(bs.dir, hash[:2], hash)
+}
+
+// Has reports whether a blob of the given size is stored
+func (bs *BlobStore) Has(hash string, size int64) bool {
+	path := bs.Path(hash)
+	if path == "" {
+		return false
+	}
+	info, err := os.Stat(path)
+	return err == nil && info.Mode().IsRegular() && info.Size() == size
+}
+
+// Put moves the file at srcPath into the store under hash, which the caller
+// must have verified. If the blob is already stored the file is removed.
+func (bs *BlobStore) Put(srcPath, hash string) error {
+	path := bs.Path(hash)
+	if path == "" {
+		return os.ErrInvalid
+	}
+
+	if _, err := os.Lstat(path); err == nil {
+		return os.Remove(srcPath)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.Rename(srcPath, path)
+}
+
+// ThumbnailPath returns where the thumbnail of an image blob is kept
+func (bs *BlobStore) ThumbnailPath(hash string) string {
+	path := bs.Path(hash)
+	if path == "" {
+		return ""
+	}
+	return path + ".thumb.png"
+}
+
+// Remove deletes a blob and its thumbnail
+func (bs *BlobStore) Remove(hash string) error {
+	path := bs.Path(hash)
+	if path == "" {
+		return os.ErrInvalid
+	}
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	os.Remove(bs.ThumbnailPath(hash))
+	// Drop the fan-out directory once it is empty
+	os.Remove(filepath.Dir(path))
+	return nil
+}
@@ -0,0 +1,572 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"chatap.com/shared"
+)
+
+// Bot capabilities. A bot can only do what its capabilities allow, and only
+// in the rooms it is scoped to.
+const (
+	CapPost    = "post"    // Post messages in its rooms
+	CapDirect  = "dm"      // Send direct and group messages
+	CapFiles   = "files"   // Share, list and download files
+	CapHistory = "history" // Read message history
+)
+
+// botCapabilities describes each capability for error messages
+var botCapabilities = map[string]string{
+	CapPost:    "post in rooms",
+	CapDirect:  "send direct or group messages",
+	CapFiles:   "share or download files",
+	CapHistory: "read message history",
+}
+
+// botMessageCapabilities and botCommandCapabilities name the capability a
+// bot needs to send a message type or use a command
+var botMessageCapabilities = map[int]string{
+	shared.MessageTypeText:      CapPost,
+	shared.MessageTypeDirect:    CapDirect,
+	shared.MessageTypeEncrypted: CapDirect,
+	shared.MessageTypeFile:      CapFiles,
+	shared.MessageTypeUpload:    CapFiles,
+}
+
+var botCommandCapabilities = map[string]string{
+	"msg":      CapDirect,
+	"encrypt":  CapDirect,
+	"gmsg":     CapDirect,
+	"gadd":     CapDirect,
+	"history":  CapHistory,
+	"ghistory": CapHistory,
+	"files":    CapFiles,
+	"download": CapFiles,
+	"delfile":  CapFiles,
+	"preview":  CapFiles,
+	"uploads":  CapFiles,
+	"quota":    CapFiles,
+}
+
+// allRooms scopes a bot to every room
+const allRooms = "*"
+
+var (
+	ErrNotBot        = errors.New("no such bot")
+	ErrTokenNotFound = errors.New("no such token")
+)
+
+// BotInfo is kept with a bot's account. Bots have no password; they log in
+// with one of their API tokens.
+type BotInfo struct {
+	Owner        string     `json:"owner"`        // Deleting the owner deletes the bot
+	Rooms        []string   `json:"rooms"`        // Rooms it may join, or allRooms
+	Capabilities []string   `json:"capabilities"` // Sorted
+	Tokens       []APIToken `json:"tokens"`
+}
+
+// APIToken is a long-lived bot credential. Only its hash is stored; the
+// token itself is shown once, when it is created.
+type APIToken struct {
+	ID        string    `json:"id"`
+	Label     string    `json:"label,omitempty"`
+	Hash      string    `json:"hash"`
+	CreatedBy string    `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+	LastUsed  time.Time `json:"last_used"`
+}
+
+// Can reports whether the bot has a capability
+func (b BotInfo) Can(capability string) bool {
+	for _, c := range b.Capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// InRoom reports whether the bot may be in a room
+func (b BotInfo) InRoom(room string) bool {
+	for _, r := range b.Rooms {
+		if r == allRooms || r == room {
+			return true
+		}
+	}
+	return false
+}
+
+func (b BotInfo) copy() BotInfo {
+	b.Rooms = append([]string(nil), b.Rooms...)
+	b.Capabilities = append([]string(nil), b.Capabilities...)
+	b.Tokens = append([]APIToken(nil), b.Tokens...)
+	return b
+}
+
+// CreateBot adds a bot account owned by a user. New bots may post but are in
+// no rooms until their owner scopes them.
+func (am *AuthManager) CreateBot(name, owner string) error {
+	if err := shared.ValidateUsername(name); err != nil {
+		return err
+	}
+
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	if _, exists := am.users[name]; exists {
+		return ErrUserExists
+	}
+	id, err := newUserID()
+	if err != nil {
+		return err
+	}
+	am.users[name] = UserCredentials{
+		ID:        id,
+		Username:  name,
+		CreatedAt: time.Now(),
+		Bot: &BotInfo{
+			Owner:        owner,
+			Rooms:        []string{},
+			Capabilities: []string{CapPost},
+			Tokens:       []APIToken{},
+		},
+	}
+	am.save()
+	return nil
+}
+
+// Bot returns a copy of a bot's settings
+func (am *AuthManager) Bot(name string) (BotInfo, bool) {
+	am.mu.RLock()
+	defer am.mu.RUnlock()
+
+	credentials, exists := am.users[name]
+	if !exists || credentials.Bot == nil {
+		return BotInfo{}, false
+	}
+	return credentials.Bot.copy(), true
+}
+
+// IsBot reports whether an account is a bot
+func (am *AuthManager) IsBot(name string) bool {
+	am.mu.RLock()
+	defer am.mu.RUnlock()
+	return am.users[name].Bot != nil
+}
+
+// Bots returns the names of all bots, sorted
+func (am *AuthManager) Bots() []string {
+	am.mu.RLock()
+	defer am.mu.RUnlock()
+
+	names := make([]string, 0)
+	for name, credentials := range am.users {
+		if credentials.Bot != nil {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// updateBot changes a bot's settings and saves them
+func (am *AuthManager) updateBot(name string, update func(bot *BotInfo) error) error {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	credentials, exists := am.users[name]
+	if !exists || credentials.Bot == nil {
+		return ErrNotBot
+	}
+	if err := update(credentials.Bot); err != nil {
+		return err
+	}
+	am.save()
+	return nil
+}
+
+// SetBotRooms replaces the rooms a bot may join
+func (am *AuthManager) SetBotRooms(name string, rooms []string) error {
+	return am.updateBot(name, func(bot *BotInfo) error {
+		bot.Rooms = rooms
+		return nil
+	})
+}
+
+// SetBotCapabilities replaces what a bot may do
+func (am *AuthManager) SetBotCapabilities(name string, capabilities []string) error {
+	sort.Strings(capabilities)
+	return am.updateBot(name, func(bot *BotInfo) error {
+		bot.Capabilities = capabilities
+		return nil
+	})
+}
+
+// CreateToken adds an API token to a bot. It returns the token, which is not
+// stored and cannot be shown again, and its ID.
+func (am *AuthManager) CreateToken(name, label, createdBy string) (token, id string, err error) {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", err
+	}
+	id = "t" + hex.EncodeToString(buf[:3])
+	token = id + "." + hex.EncodeToString(buf[3:])
+
+	err = am.updateBot(name, func(bot *BotInfo) error {
+		bot.Tokens = append(bot.Tokens, APIToken{
+			ID:        id,
+			Label:     label,
+			Hash:      hashToken(token),
+			CreatedBy: createdBy,
+			CreatedAt: time.Now(),
+		})
+		return nil
+	})
+	return token, id, err
+}
+
+// hashToken returns the SHA-256 of an API token. Tokens are long and random,
+// so unlike passwords they need no salt or slow hash.
+func hashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// RevokeToken removes one of a bot's tokens
+func (am *AuthManager) RevokeToken(name, id string) error {
+	return am.updateBot(name, func(bot *BotInfo) error {
+		for i, token := range bot.Tokens {
+			if token.ID == id {
+				bot.Tokens = append(bot.Tokens[:i], bot.Tokens[i+1:]...)
+				return nil
+			}
+		}
+		return ErrTokenNotFound
+	})
+}
+
+// AuthenticateToken checks a bot's API token and returns the token's ID. When
+// the token was used is saved later, see Flush.
+func (am *AuthManager) AuthenticateToken(name, token string) (string, bool) {
+	id, _, found := strings.Cut(token, ".")
+	if !found {
+		return "", false
+	}
+
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	credentials, exists := am.users[name]
+	if !exists || credentials.Bot == nil {
+		return "", false
+	}
+	for i := range credentials.Bot.Tokens {
+		t := &credentials.Bot.Tokens[i]
+		if t.ID == id && subtle.ConstantTimeCompare([]byte(t.Hash), []byte(hashToken(token))) == 1 {
+			t.LastUsed = time.Now()
+			am.unsaved = true
+			return id, true
+		}
+	}
+	return "", false
+}
+
+// DeleteBot removes a bot account and returns its user ID
+func (am *AuthManager) DeleteBot(name string) (string, error) {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	credentials, exists := am.users[name]
+	if !exists || credentials.Bot == nil {
+		return "", ErrNotBot
+	}
+	delete(am.users, name)
+	am.save()
+	return credentials.ID, nil
+}
+
+// forgetBot removes what is kept about a deleted bot and ends its sessions
+func (s *Server) forgetBot(id, name, reason string) {
+	s.forgetUser(id, name)
+	for _, client := range s.ClientsOf(name) {
+		client.endSession(nil, reason)
+	}
+}
+
+// botMay reports whether the client may do something its capability covers.
+// Only bots are limited.
+func (c *Client) botMay(capability string) bool {
+	if !c.IsBot {
+		return true
+	}
+	bot, ok := c.Server.AuthManager.Bot(c.Username())
+	return ok && bot.Can(capability)
+}
+
+// botRefuses tells a bot client when its capabilities do not allow something
+// and reports whether it was refused
+func (c *Client) botRefuses(capability string) bool {
+	if c.botMay(capability) {
+		return false
+	}
+	c.sendError("This bot is not allowed to " + botCapabilities[capability])
+	return true
+}
+
+// botRefusesRoom is botRefuses for the rooms a bot is scoped to
+func (c *Client) botRefusesRoom(room string) bool {
+	if c.botAllowedIn(room) {
+		return false
+	}
+	c.sendError("This bot is not allowed in room " + room)
+	return true
+}
+
+// botAllowedIn reports whether the client may be in a room. Bots may only be
+// in the rooms they are scoped to.
+func (c *Client) botAllowedIn(room string) bool {
+	if !c.IsBot {
+		return true
+	}
+	bot, ok := c.Server.AuthManager.Bot(c.Username())
+	return ok && bot.InRoom(room)
+}
+
+// historySender shows who sent a message in history listings
+func historySender(msg shared.Message) string {
+	if msg.Bot {
+		return msg.Sender + " [bot]"
+	}
+	return msg.Sender
+}
+
+// canManageBot reports whether the client's user may manage a bot: admins
+// manage all bots, users the bots they own
+func (c *Client) canManageBot(bot BotInfo) bool {
+	return c.Server.AuthManager.IsAdmin(c.Username()) || bot.Owner == c.Username()
+}
+
+// describeBot returns a bot's line for the bots command
+func describeBot(name string, bot BotInfo) string {
+	rooms := strings.Join(bot.Rooms, ",")
+	if rooms == "" {
+		rooms = "none"
+	}
+	capabilities := strings.Join(bot.Capabilities, ",")
+	if capabilities == "" {
+		capabilities = "none"
+	}
+	return fmt.Sprintf("  %s  owner %s  rooms %s  can %s  %d tokens", name, bot.Owner, rooms, capabilities, len(bot.Tokens))
+}
+
+// parseBotRooms parses the room list of the bot rooms command
+func parseBotRooms(list string) ([]string, error) {
+	if list == allRooms {
+		return []string{allRooms}, nil
+	}
+	rooms := make([]string, 0)
+	if list == "none" {
+		return rooms, nil
+	}
+	for _, room := range strings.Split(list, ",") {
+		if err := shared.ValidateRoomName(room); err != nil {
+			return nil, fmt.Errorf("invalid room name %q: %v", room, err)
+		}
+		rooms = append(rooms, room)
+	}
+	return rooms, nil
+}
+
+// parseBotCapabilities parses the capability list of the bot caps command
+func parseBotCapabilities(list string) ([]string, error) {
+	capabilities := make([]string, 0)
+	if list == "none" {
+		return capabilities, nil
+	}
+	seen := make(map[string]bool)
+	for _, capability := range strings.Split(list, ",") {
+		if _, ok := botCapabilities[capability]; !ok {
+			return nil, fmt.Errorf("unknown capability %q, use %s, %s, %s or %s", capability, CapPost, CapDirect, CapFiles, CapHistory)
+		}
+		if !seen[capability] {
+			seen[capability] = true
+			capabilities = append(capabilities, capability)
+		}
+	}
+	return capabilities, nil
+}
+
+// handleBotCommand lets users create bots and manage their tokens and scope:
+//
+//	bots                            list the bots you manage
+//	bot create <name> [owner]       create a bot; only admins may name another owner
+//	bot token <name> [label]        create an API token
+//	bot tokens <name>               list a bot's tokens
+//	bot revoke <name> <token-id>    revoke a token and end its sessions
+//	bot rooms <name> <r1,r2|*|none> scope a bot to rooms
+//	bot caps <name> <c1,c2|none>    set what a bot may do
+//	bot delete <name>               delete a bot
+func (c *Client) handleBotCommand(args []string) {
+	am := c.Server.AuthManager
+	if c.IsBot {
+		c.sendError("Bots cannot manage bots")
+		return
+	}
+
+	if args[0] == "bots" {
+		lines := make([]string, 0)
+		for _, name := range am.Bots() {
+			if bot, ok := am.Bot(name); ok && c.canManageBot(bot) {
+				lines = append(lines, describeBot(name, bot))
+			}
+		}
+		if len(lines) == 0 {
+			c.sendSuccess("You have no bots. Create one with bot create <name>")
+			return
+		}
+		c.sendSuccess(fmt.Sprintf("Bots (%d):\n%s", len(lines), strings.Join(lines, "\n")))
+		return
+	}
+
+	if len(args) < 3 {
+		c.sendError("Usage: bot <create|token|tokens|revoke|rooms|caps|delete> <name> ...")
+		return
+	}
+	action, name := args[1], args[2]
+
+	if action == "create" {
+		owner := c.Username()
+		if len(args) > 3 {
+			if !am.IsAdmin(c.Username()) {
+				c.sendError("Only admins can create bots for someone else")
+				return
+			}
+			owner = args[3]
+			if !am.UserExists(owner) || am.IsBot(owner) {
+				c.sendError("User not found: " + owner)
+				return
+			}
+		}
+		// Bots are accounts too, so registration rules apply to them
+		if c.Server.Config().Auth.RegistrationMode != RegistrationOpen && !am.IsAdmin(c.Username()) {
+			c.sendError("Only admins can create bots on this server")
+			return
+		}
+		switch err := am.CreateBot(name, owner); {
+		case err == ErrUserExists:
+			c.sendError("Username already exists")
+		case err != nil:
+			c.sendError("Could not create bot: " + err.Error())
+		default:
+			log.Printf("User %s created bot %s owned by %s", c.Username(), name, owner)
+			c.sendSuccess(fmt.Sprintf("Created bot %s. Give it a token with bot token %s, and rooms with bot rooms %s <rooms>", name, name, name))
+		}
+		return
+	}
+
+	bot, ok := am.Bot(name)
+	if !ok || !c.canManageBot(bot) {
+		c.sendError("No such bot: " + name)
+		return
+	}
+
+	switch action {
+	case "token":
+		label := cleanText(strings.Join(args[3:], " "), maxDeviceNameLength)
+		token, id, err := am.CreateToken(name, label, c.Username())
+		if err != nil {
+			c.sendError("Could not create token: " + err.Error())
+			return
+		}
+		log.Printf("User %s created token %s for bot %s", c.Username(), id, name)
+		c.sendSuccess(fmt.Sprintf("Token %s for %s: %s\nKeep it safe, it will not be shown again", id, name, token))
+
+	case "tokens":
+		if len(bot.Tokens) == 0 {
+			c.sendSuccess(name + " has no tokens")
+			return
+		}
+		lines := make([]string, len(bot.Tokens))
+		for i, token := range bot.Tokens {
+			lines[i] = fmt.Sprintf("  %s  %s  created by %s %s", token.ID, token.Label, token.CreatedBy, token.CreatedAt.Format("2006-01-02 15:04"))
+			if !token.LastUsed.IsZero() {
+				lines[i] += "  last used " + token.LastUsed.Format("2006-01-02 15:04")
+			}
+		}
+		c.sendSuccess(fmt.Sprintf("Tokens of %s (%d):\n%s", name, len(lines), strings.Join(lines, "\n")))
+
+	case "revoke":
+		if len(args) < 4 {
+			c.sendError("Usage: bot revoke <name> <token-id>")
+			return
+		}
+		if err := am.RevokeToken(name, args[3]); err != nil {
+			c.sendError("No such token: " + args[3])
+			return
+		}
+		for _, client := range c.Server.ClientsOf(name) {
+			if client.TokenID == args[3] {
+				client.endSession(nil, "The token was revoked")
+			}
+		}
+		log.Printf("User %s revoked token %s of bot %s", c.Username(), args[3], name)
+		c.sendSuccess("Revoked token " + args[3] + " of " + name)
+
+	case "rooms", "caps":
+		if len(args) < 4 {
+			c.sendError("Usage: bot " + action + " <name> <list>")
+			return
+		}
+		var err error
+		if action == "rooms" {
+			var rooms []string
+			if rooms, err = parseBotRooms(args[3]); err == nil {
+				err = am.SetBotRooms(name, rooms)
+			}
+		} else {
+			var capabilities []string
+			if capabilities, err = parseBotCapabilities(args[3]); err == nil {
+				err = am.SetBotCapabilities(name, capabilities)
+			}
+		}
+		if err != nil {
+			c.sendError("Could not change " + name + ": " + err.Error())
+			return
+		}
+
+		// Bots leave rooms they are no longer scoped to. Sessions joining a
+		// room meanwhile see the new scope, see enterRoom.
+		bot, _ = am.Bot(name)
+		for _, client := range c.Server.ClientsOf(name) {
+			disallowed := func(room *Room) bool { return !bot.InRoom(room.Name) }
+			if room := client.leaveRoomIf(disallowed); room != nil {
+				room.BroadcastEvent(shared.EventUserLeft, name, "")
+				client.notify("Left room: " + room.Name + ". This bot is no longer allowed in it")
+				client.notifySession(false)
+			}
+		}
+		c.sendSuccess(describeBot(name, bot)[2:])
+
+	case "delete":
+		id, err := am.DeleteBot(name)
+		if err != nil {
+			c.sendError("Could not delete bot: " + err.Error())
+			return
+		}
+		c.Server.forgetBot(id, name, "This bot has been deleted")
+		log.Printf("User %s deleted bot %s", c.Username(), name)
+		c.sendSuccess("Deleted bot " + name)
+
+	default:
+		c.sendError("Unknown bot command: " + action)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"chatap.com/shared"
+)
+
+func TestBotScopeChangeWhileJoining(t *testing.T) {
+	s := newTestServer(t)
+	go s.handleChannels()
+	defer close(s.quit)
+	s.AuthManager.RegisterUser("owner", "secret1")
+	s.AuthManager.CreateBot("helper", "owner")
+	s.AuthManager.SetBotRooms("helper", []string{"general", "lobby"})
+	token, tokenID, err := s.AuthManager.CreateToken("helper", "", "owner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.RoomManager.CreateRoom("lobby")
+
+	owner := loginTestSession(t, s, "owner", "secret1")
+	bot := connectTestSession(t, s)
+	bot.send(shared.AuthMessage{
+		Message:  shared.Message{Type: shared.MessageTypeAuth, Content: "token"},
+		Username: "helper",
+		Token:    token,
+	})
+	bot.expect("SUCCESS: Logged in")
+
+	// The owner narrows the bot's rooms while it moves between them, staying
+	// within the bot's command rate limit. The bot reads each reply before
+	// it joins again, so its replies never pile up.
+	go owner.trySend(shared.Message{Type: shared.MessageTypeCommand, Content: "bot rooms helper lobby"})
+	for i := 0; i < 8; i++ {
+		for _, room := range []string{"general", "lobby"} {
+			bot.send(shared.Message{Type: shared.MessageTypeCommand, Content: "join", Room: room})
+			bot.expectOneOf("SUCCESS: Joined room", "ERROR: This bot is not allowed")
+		}
+	}
+	owner.expect("SUCCESS: helper")
+
+	// Once a later join is refused, every earlier one has been handled
+	bot.send(shared.Message{Type: shared.MessageTypeCommand, Content: "join", Room: "general"})
+	bot.expect("ERROR: This bot is not allowed in room general")
+	general := s.RoomManager.GetRoom("general")
+	general.mu.RLock()
+	inGeneral := general.Clients[bot.client]
+	general.mu.RUnlock()
+	if inGeneral || bot.client.Room() == general {
+		t.Fatal("bot stayed in a room it is no longer scoped to")
+	}
+
+	// A revoked token ends the session, which then no longer counts as online
+	owner.send(shared.Message{Type: shared.MessageTypeCommand, Content: "bot revoke helper " + tokenID})
+	bot.expect("SUCCESS: Goodbye!")
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, connected := s.Presence.Get("helper"); !connected {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("bot still online after its token was revoked")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if room := bot.client.Room(); room != nil {
+		t.Fatalf("revoked bot still in room %s", room.Name)
+	}
+}
+
+func TestTokenUseIsSavedLazily(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.json")
+	am := NewAuthManager(DefaultAuthConfig(), path)
+	am.RegisterUser("owner", "secret1")
+	am.CreateBot("helper", "owner")
+	token, _, err := am.CreateToken("helper", "", "owner")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	saved, _ := os.ReadFile(path)
+	if _, ok := am.AuthenticateToken("helper", token); !ok {
+		t.Fatal("token refused")
+	}
+	if data, _ := os.ReadFile(path); !bytes.Equal(data, saved) {
+		t.Fatal("accounts saved on token login")
+	}
+
+	am.Flush()
+	bot, _ := NewAuthManager(DefaultAuthConfig(), path).Bot("helper")
+	if bot.Tokens[0].LastUsed.IsZero() {
+		t.Fatal("token use not saved by Flush")
+	}
+}
+
+func TestRefusedTokenLoginLeavesNoBotSession(t *testing.T) {
+	s := newTestServer(t)
+	config := *s.Config()
+	config.Auth.MaxSessions = 1
+	s.config.Store(&config)
+	go s.handleChannels()
+	defer close(s.quit)
+	s.AuthManager.RegisterUser("owner", "secret1")
+	s.AuthManager.CreateBot("helper", "owner")
+	token, _, err := s.AuthManager.CreateToken("helper", "", "owner")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	login := shared.AuthMessage{
+		Message:  shared.Message{Type: shared.MessageTypeAuth, Content: "token"},
+		Username: "helper",
+		Token:    token,
+	}
+	first := connectTestSession(t, s)
+	first.send(login)
+	first.expect("SUCCESS: Logged in")
+
+	// Over the session limit the token login is refused, and a password
+	// login on the same connection is a human's
+	session := connectTestSession(t, s)
+	session.send(login)
+	session.expect("ERROR: You already have 1 sessions open")
+	session.send(shared.AuthMessage{
+		Message:  shared.Message{Type: shared.MessageTypeAuth, Content: "login"},
+		Username: "owner",
+		Password: "secret1",
+	})
+	session.expect("SUCCESS: Logged in")
+	if session.client.IsBot || session.client.TokenID != "" {
+		t.Fatalf("password login kept the refused token: IsBot %v, token %q", session.client.IsBot, session.client.TokenID)
+	}
+}
+
+func TestBotNeedsDirectCapabilityToSendFilesToUsers(t *testing.T) {
+	s := newTestServer(t)
+	go s.handleChannels()
+	defer close(s.quit)
+	s.AuthManager.RegisterUser("owner", "secret1")
+	s.AuthManager.CreateBot("helper", "owner")
+	s.AuthManager.SetBotCapabilities("helper", []string{CapFiles})
+	token, _, err := s.AuthManager.CreateToken("helper", "", "owner")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bot := connectTestSession(t, s)
+	bot.send(shared.AuthMessage{
+		Message:  shared.Message{Type: shared.MessageTypeAuth, Content: "token"},
+		Username: "helper",
+		Token:    token,
+	})
+	bot.expect("SUCCESS: Logged in")
+
+	data := testFileData()
+	sum := sha256.Sum256(data)
+	bot.send(shared.UploadMessage{
+		Message: shared.Message{Type: shared.MessageTypeUpload, Content: shared.UploadStart, Recipient: "owner"},
+		UploadInfo: shared.UploadInfo{
+			Filename:    "notes.txt",
+			Size:        int64(len(data)),
+			Hash:        hex.EncodeToString(sum[:]),
+			ChunkSize:   shared.MinChunkSize,
+			TotalChunks: shared.ChunkCount(int64(len(data)), shared.MinChunkSize),
+		},
+	})
+	bot.expect("ERROR: This bot is not allowed to " + botCapabilities[CapDirect])
+	if uploads := s.Uploads.List("helper"); len(uploads) > 0 {
+		t.Fatalf("%d uploads started", len(uploads))
+	}
+}
@@ -7,44 +7,77 @@ import (
 	"log"
 	"net"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"chatap.com/shared"
 )
 
 type Client struct {
-	Conn       net.Conn
-	Send       chan []byte
-	Username   string
-	Room       *Room
-	Server     *Server
-	isLoggedIn bool
-	Status     shared.UserStatus
+	Conn     net.Conn
+	queue    *sendQueue
+	username atomic.Value         // string, changed by renames from other sessions
+	UserID   string               // Stable across renames
+	room     atomic.Pointer[Room] // Read by other sessions, see enterRoom
+	roomMu   sync.Mutex           // Serializes joining and leaving rooms
+	Server   *Server
+	loggedIn atomic.Bool // Set after the session's fields, see login
+	limiter  atomic.Pointer[rateLimiter]
+
+	lastMuteNotice time.Time    // Muted clients are reminded at most once a second
+	proof          *storedProof // Challenge to answer before a stored file is shared
+
+	// A user may be logged in from several devices at once
+	SessionID   string
+	Device      string
+	ConnectedAt time.Time
+
+	// Bots log in with an API token instead of a password
+	IsBot   bool
+	TokenID string
+
+	closeOnce sync.Once
+	dropped   int64 // Messages dropped by the slow-consumer policy
+
+	request atomic.Value // ID of the request being handled, see shared.Message.RequestID
+
+	lastActive atomic.Int64 // Unix nanoseconds of the last message other than a heartbeat
+	idle       atomic.Bool  // Marked idle by the heartbeat
+	dnd        atomic.Bool  // The user is busy, so notifications are held
 }
 
+var newline = []byte("\n")
+
 func NewClient(conn net.Conn, server *Server) *Client {
-	return &Client{
-		Conn:       conn,
-		Send:       make(chan []byte, 256),
-		Server:     server,
-		isLoggedIn: false,
-		Status:     shared.StatusOnline,
+	client := &Client{
+		Conn:   conn,
+		queue:  newSendQueue(server.Config().SendQueue),
+		Server: server,
 	}
+	client.limiter.Store(newRateLimiter(server.Config().RateLimits.PerConnection))
+	client.lastActive.Store(time.Now().UnixNano())
+	return client
 }
 
 func (c *Client) ReadPump() {
 	defer func() {
-		c.Server.Unregister <- c
-		c.Conn.Close()
+		c.Server.unregister(c)
+		c.disconnect()
 	}()
 
 	reader := bufio.NewReader(c.Conn)
 
 	for {
 		// Reset the deadline whenever we attempt to read
-		c.Conn.SetReadDeadline(time.Now().Add(5 * time.Minute))
+		c.Conn.SetReadDeadline(time.Now().Add(c.Server.Config().ReadTimeout()))
 
-		message, err := reader.ReadBytes('\n')
+		// File chunks and avatars are the only frames with a payload
+		maxPayload := c.Server.Config().ChunkSize
+		if maxPayload < shared.MaxAvatarBytes {
+			maxPayload = shared.MaxAvatarBytes
+		}
+		message, payload, err := shared.ReadFrame(reader, maxPayload)
 		if err != nil {
 			log.Printf("Unexpected read error from %s: %v", c.Conn.RemoteAddr(), err)
 			return
@@ -56,8 +89,46 @@ func (c *Client) ReadPump() {
 			continue
 		}
 
-		c.handleMessage(msg, message)
+		c.request.Store(msg.RequestID)
+		allowed, disconnect := c.checkRateLimit(msg, len(message)+len(payload))
+		if disconnect {
+			// The connection closes once the error has been written
+			c.disconnectAfterFlush()
+			return
+		}
+
+		if allowed {
+			if !isHeartbeat(msg.Type) {
+				c.markActive()
+			}
+			c.handleMessage(msg, message, payload)
+		}
+		c.finishRequest(msg.RequestID)
+	}
+}
+
+// requestID returns the ID of the request being handled, for its replies
+func (c *Client) requestID() string {
+	id, _ := c.request.Load().(string)
+	return id
+}
+
+// finishRequest tells the client that all replies to its request were sent.
+// Replies sent later, like file announcements, come without the request ID.
+func (c *Client) finishRequest(id string) {
+	c.request.Store("")
+	if id == "" {
+		return
+	}
+
+	ack := shared.Message{
+		Type:      shared.MessageTypeAck,
+		Sender:    "Server",
+		Timestamp: time.Now(),
+		RequestID: id,
 	}
+	ackBytes, _ := json.Marshal(ack)
+	c.EnqueueReliable(ackBytes)
 }
 
 func (c *Client) WritePump() {
@@ -66,34 +137,159 @@ func (c *Client) WritePump() {
 	}()
 
 	for {
-		message, ok := <-c.Send
+		message, ok := c.queue.pop()
 		if !ok {
 			return
 		}
 
 		// Reset the deadline whenever we send data
-		c.Conn.SetWriteDeadline(time.Now().Add(5 * time.Minute))
+		c.Conn.SetWriteDeadline(time.Now().Add(c.Server.Config().WriteTimeout()))
 
-		c.Conn.Write(message)
-		c.Conn.Write([]byte("\n"))
+		// Broadcast messages are shared between clients, so never append to them
+		frame := net.Buffers{message, newline}
+		if _, err := frame.WriteTo(c.Conn); err != nil {
+			log.Printf("Write error to %s: %v", c.Conn.RemoteAddr(), err)
+			c.disconnect()
+			return
+		}
 	}
 }
 
-func (c *Client) joinRoom(room *Room) {
-	// Leave current room if any
-	if c.Room != nil {
-		c.Room.RemoveClient(c)
-		c.Room.BroadcastEvent(shared.EventUserLeft, c.Username, "")
+// Enqueue queues a message for delivery, applying the slow-consumer policy
+func (c *Client) Enqueue(message []byte) bool {
+	return c.enqueue(message, false)
+}
+
+// EnqueueControl queues a control frame ahead of regular traffic
+func (c *Client) EnqueueControl(message []byte) bool {
+	return c.enqueue(message, true)
+}
+
+// EnqueueReliable queues a message in order with regular traffic, but it is
+// never dropped: a client whose queue cannot take it is disconnected. Replies
+// use it so they neither overtake nor lose what they belong to.
+func (c *Client) EnqueueReliable(message []byte) bool {
+	return c.record(c.queue.pushKept(message))
+}
+
+func (c *Client) enqueue(message []byte, control bool) bool {
+	return c.record(c.queue.push(message, control))
+}
+
+// record counts the messages a push dropped and disconnects the client if
+// its queue overflowed
+func (c *Client) record(result pushResult) bool {
+	if result.droppedCount > 0 {
+		metrics := c.Server.Metrics
+		metrics.Add("sendqueue.dropped_messages", int64(result.droppedCount))
+		metrics.Add("sendqueue.dropped_bytes", int64(result.droppedBytes))
+
+		// Log the first drop and then periodically to keep logs readable
+		total := atomic.AddInt64(&c.dropped, int64(result.droppedCount))
+		if total == int64(result.droppedCount) || total/100 != (total-int64(result.droppedCount))/100 {
+			log.Printf("Slow consumer %s (username: %s): %d messages dropped so far",
+				c.Conn.RemoteAddr(), c.Username(), total)
+		}
+	}
+
+	if result.overflow {
+		c.Server.Metrics.Inc("sendqueue.slow_disconnects")
+		log.Printf("Disconnecting slow consumer %s (username: %s): send queue full",
+			c.Conn.RemoteAddr(), c.Username())
+		c.disconnect()
 	}
 
-	c.Room = room
+	return result.queued
+}
+
+// disconnect stops delivery and closes the connection. ReadPump then notices
+// the closed connection and unregisters the client. Safe to call repeatedly.
+func (c *Client) disconnect() {
+	c.closeOnce.Do(func() {
+		c.queue.close()
+		c.Conn.Close()
+	})
+}
+
+// disconnectAfterFlush stops queueing messages and lets WritePump write those
+// already queued before it closes the connection. A later disconnect does not
+// cut it short.
+func (c *Client) disconnectAfterFlush() {
+	c.closeOnce.Do(c.queue.drain)
+}
+
+// Room returns the room the client is in, or nil. Another session may take
+// the client out of it at any time, so callers keep the result rather than
+// calling Room again.
+func (c *Client) Room() *Room {
+	return c.room.Load()
+}
+
+// enterRoom moves the client into room and returns the room it left, if any.
+// A bot is refused rooms it is not scoped to; the scope is checked here so
+// that a change made meanwhile by its owner is never missed.
+func (c *Client) enterRoom(room *Room) (left *Room, ok bool) {
+	c.roomMu.Lock()
+	defer c.roomMu.Unlock()
+
+	if !c.botAllowedIn(room.Name) {
+		return nil, false
+	}
+	left = c.room.Swap(room)
+	if left != nil {
+		left.RemoveClient(c)
+	}
 	room.AddClient(c)
+	return left, true
+}
+
+// leaveRoomIf takes the client out of its room if leave approves of that
+// room, and returns the room it left. Other sessions call it, so the room is
+// checked and left in one step.
+func (c *Client) leaveRoomIf(leave func(room *Room) bool) *Room {
+	c.roomMu.Lock()
+	defer c.roomMu.Unlock()
+
+	left := c.room.Load()
+	if left == nil || !leave(left) {
+		return nil
+	}
+	c.room.Store(nil)
+	left.RemoveClient(c)
+	return left
+}
+
+// leaveRoom takes the client out of its room and returns that room, or nil if
+// it was in none. Other sessions call it to end this one.
+func (c *Client) leaveRoom() *Room {
+	return c.leaveRoomIf(func(*Room) bool { return true })
+}
+
+// joinRoom moves the client into room and tells both rooms. It replies with
+// an error and returns false if a bot is not allowed in the room.
+func (c *Client) joinRoom(room *Room) bool {
+	left, ok := c.enterRoom(room)
+	if !ok {
+		c.sendError("This bot is not allowed in room " + room.Name)
+		return false
+	}
+
+	// Leave current room if any
+	if left != nil {
+		left.BroadcastEvent(shared.EventUserLeft, c.Username(), "")
+	}
 
 	// Notify room about new user
-	room.BroadcastEvent(shared.EventUserJoined, c.Username, "")
+	room.BroadcastEvent(shared.EventUserJoined, c.Username(), "")
+	c.sendSession(false)
+	return true
 }
 
-func (c *Client) handleMessage(msg shared.Message, rawMsg []byte) {
+func (c *Client) handleMessage(msg shared.Message, rawMsg, payload []byte) {
+	if capability, ok := botMessageCapabilities[msg.Type]; ok && c.botRefuses(capability) {
+		return
+	}
+
 	switch msg.Type {
 	case shared.MessageTypeAuth:
 		var authMsg shared.AuthMessage
@@ -106,23 +302,35 @@ func (c *Client) handleMessage(msg shared.Message, rawMsg []byte) {
 	case shared.MessageTypeCommand:
 		c.handleCommand(msg)
 
+	case shared.MessageTypePing:
+		c.answerPing()
+
+	case shared.MessageTypePong:
+		// Reading it already reset the read deadline
+
 	case shared.MessageTypeText:
-		if !c.isLoggedIn {
+		if !c.loggedIn.Load() {
 			c.sendError("Not authenticated")
 			return
 		}
 
-		if c.Room == nil {
+		room := c.Room()
+		if room == nil {
 			c.sendError("You are not in a room. Join a room first.")
 			return
 		}
 
-		// Set message metadata
-		msg.Sender = c.Username
+		// Set message metadata. The request ID is the sender's own and would
+		// pass the message off as a reply to recipients' requests.
+		msg.RequestID = ""
+		msg.Sender = c.Username()
+		msg.SenderID = c.UserID
+		msg.Bot = c.IsBot
+		msg.SenderName = c.Server.Profiles.DisplayName(c.Username())
 		msg.Timestamp = time.Now()
-		msg.Room = c.Room.Name // Ensure room name is set correctly
+		msg.Room = room.Name // Ensure room name is set correctly
 
-		log.Printf("Room message from %s in %s: %s", c.Username, c.Room.Name, msg.Content)
+		log.Printf("Room message from %s in %s: %s", c.Username(), room.Name, msg.Content)
 
 		// Re-encode message with updated metadata
 		updatedMsg, err := json.Marshal(msg)
@@ -132,113 +340,96 @@ func (c *Client) handleMessage(msg shared.Message, rawMsg []byte) {
 		}
 
 		// Broadcast to everyone in the room (including back to sender for confirmation)
-		c.Room.BroadcastMessage(updatedMsg, nil) // Use nil instead of c to send to everyone
+		room.BroadcastChat(msg, updatedMsg)
 
 		// Store message in history
-		c.Server.MessageStore.AddRoomMessage(c.Room.Name, msg)
+		c.Server.MessageStore.AddRoomMessage(room.Name, msg)
 
 	case shared.MessageTypeFile:
-		if !c.isLoggedIn {
-			c.sendError("Not authenticated")
-			return
-		}
-
-		var fileMsg shared.FileMessage
-		if err := json.Unmarshal(rawMsg, &fileMsg); err != nil {
-			log.Printf("Error unmarshaling file message: %v", err)
-			return
-		}
-
-		fileMsg.Sender = c.Username
-		fileMsg.Timestamp = time.Now()
-		fileMsg.Room = c.Room.Name // Ensure room name is set properly
+		c.handleFileChunk(rawMsg, payload)
 
-		if c.Room != nil {
-			// Log receipt of file chunk
-			log.Printf("Received file chunk %d/%d for %s from %s in room %s",
-				fileMsg.ChunkID+1, fileMsg.TotalChunks, fileMsg.Filename,
-				c.Username, c.Room.Name)
+	case shared.MessageTypeUpload:
+		c.handleUploadMessage(rawMsg)
 
-			// Announce file transfer to the room on first chunk
-			if fileMsg.ChunkID == 0 {
-				c.Room.BroadcastEvent(shared.EventFileSending, c.Username, fileMsg.Filename)
-			}
+	case shared.MessageTypeProfile:
+		c.handleAvatarUpload(rawMsg, payload)
 
-			// Process the file chunk on the server
-			c.Room.HandleFileChunk(fileMsg)
-
-			// Forward the file chunk to other clients
-			updatedMsg, _ := json.Marshal(fileMsg)
-			log.Printf("Broadcasting file chunk %d/%d for %s to room %s",
-				fileMsg.ChunkID+1, fileMsg.TotalChunks, fileMsg.Filename, c.Room.Name)
-			c.Room.BroadcastMessage(updatedMsg, c)
-		} else {
-			c.sendError("You are not in a room. Join a room first.")
-		}
+	case shared.MessageTypeReadMarker:
+		c.handleReadMarker(rawMsg)
 
 	case shared.MessageTypeDirect:
-		if !c.isLoggedIn {
+		if !c.loggedIn.Load() {
 			c.sendError("Not authenticated")
 			return
 		}
 
-		// Set message metadata
-		msg.Sender = c.Username
+		// Set message metadata. The request ID is the sender's own and would
+		// pass the message off as a reply to recipients' requests.
+		msg.RequestID = ""
+		msg.Sender = c.Username()
+		msg.SenderID = c.UserID
+		msg.Bot = c.IsBot
+		msg.SenderName = c.Server.Profiles.DisplayName(c.Username())
 		msg.Timestamp = time.Now()
 
 		// Find the recipient
-		recipient := c.Server.FindClientByUsername(msg.Recipient)
-		if recipient == nil {
-			c.sendError("User not found: " + msg.Recipient)
+		targets := c.reachableClients(msg.Recipient)
+		if len(targets) == 0 {
+			c.sendUnreachable(msg.Recipient)
 			return
 		}
 
 		// Store in message history
-		c.Server.MessageStore.AddDirectMessage(c.Username, msg.Recipient, msg)
+		c.Server.MessageStore.AddDirectMessage(c.Username(), msg.Recipient, msg)
 
 		// Encode and send
 		msgBytes, _ := json.Marshal(msg)
-		recipient.SendDirectMessage(msgBytes)
+		c.deliverDirect(targets, msg, msgBytes)
 
-		// Also send a copy back to sender for confirmation
-		c.SendDirectMessage(msgBytes)
+		// Also send a copy back to the sender's sessions for confirmation
+		c.Server.SendToUser(c.Username(), msgBytes)
 
-		log.Printf("Direct message from %s to %s", c.Username, msg.Recipient)
+		log.Printf("Direct message from %s to %s", c.Username(), msg.Recipient)
 
 	case shared.MessageTypeEncrypted:
-		if !c.isLoggedIn {
+		if !c.loggedIn.Load() {
 			c.sendError("Not authenticated")
 			return
 		}
 
-		// Set message metadata
-		msg.Sender = c.Username
+		// Set message metadata. The request ID is the sender's own and would
+		// pass the message off as a reply to recipients' requests.
+		msg.RequestID = ""
+		msg.Sender = c.Username()
+		msg.SenderID = c.UserID
+		msg.Bot = c.IsBot
+		msg.SenderName = c.Server.Profiles.DisplayName(c.Username())
 		msg.Timestamp = time.Now()
 		msg.Encrypted = true
 
 		// Find the recipient
-		recipient := c.Server.FindClientByUsername(msg.Recipient)
-		if recipient == nil {
-			c.sendError("User not found: " + msg.Recipient)
+		targets := c.reachableClients(msg.Recipient)
+		if len(targets) == 0 {
+			c.sendUnreachable(msg.Recipient)
 			return
 		}
 
 		// Note: For encrypted messages, we store only metadata in history, not content
 		historyMsg := msg
 		historyMsg.Content = "[Encrypted message]"
-		c.Server.MessageStore.AddDirectMessage(c.Username, msg.Recipient, historyMsg)
+		c.Server.MessageStore.AddDirectMessage(c.Username(), msg.Recipient, historyMsg)
 
 		// Pass through the encrypted message
 		msgBytes, _ := json.Marshal(msg)
-		recipient.SendDirectMessage(msgBytes)
+		c.deliverDirect(targets, msg, msgBytes)
 
-		// Also send a copy back to sender
-		c.SendDirectMessage(msgBytes)
+		// Also send a copy back to the sender's sessions
+		c.Server.SendToUser(c.Username(), msgBytes)
 
-		log.Printf("Encrypted message from %s to %s", c.Username, msg.Recipient)
+		log.Printf("Encrypted message from %s to %s", c.Username(), msg.Recipient)
 
 	case shared.MessageTypeStatus:
-		if !c.isLoggedIn {
+		if !c.loggedIn.Load() {
 			c.sendError("Not authenticated")
 			return
 		}
@@ -249,26 +440,11 @@ func (c *Client) handleMessage(msg shared.Message, rawMsg []byte) {
 			return
 		}
 
-		c.Status = statusMsg.Status
-
-		// Notify all rooms the user is in
-		if c.Room != nil {
-			var statusText string
-			switch c.Status {
-			case shared.StatusOnline:
-				statusText = "online"
-			case shared.StatusAway:
-				statusText = "away"
-			case shared.StatusBusy:
-				statusText = "busy"
-			case shared.StatusOffline:
-				statusText = "offline"
-			}
-
-			c.Room.BroadcastEvent(shared.EventStatusChange, c.Username, statusText)
+		if statusMsg.Status.String() == "unknown" {
+			c.sendError("Invalid status. Use: online, away, busy, or offline")
+			return
 		}
-
-		log.Printf("User %s changed status to %d", c.Username, c.Status)
+		c.setStatus(statusMsg.Status, statusMsg.StatusText)
 
 	default:
 		log.Printf("Unknown message type: %v", msg.Type)
@@ -277,51 +453,156 @@ func (c *Client) handleMessage(msg shared.Message, rawMsg []byte) {
 
 // Add this new method to send a message directly to this client
 func (c *Client) SendDirectMessage(message []byte) {
-	select {
-	case c.Send <- message:
-		// Message sent successfully
-	default:
-		// Client's message buffer is full
-		c.Server.Unregister <- c
-		close(c.Send)
+	c.Enqueue(message)
+}
+
+// Username returns the name the client is logged in as, or "" before login
+func (c *Client) Username() string {
+	username, _ := c.username.Load().(string)
+	return username
+}
+
+// setUsername changes the client's username. A rename sets it from the
+// session that made it.
+func (c *Client) setUsername(username string) {
+	c.username.Store(username)
+}
+
+// login marks the client logged in. Other sessions read its fields once they
+// see it logged in, so they are all set before that.
+func (c *Client) login(username, device string) {
+	c.UserID = c.Server.AuthManager.UserID(username)
+	c.Device = deviceName(device)
+	c.IsBot = c.TokenID != ""
+	c.ConnectedAt = time.Now()
+	if id, err := newSessionID(); err == nil {
+		c.SessionID = id
+	} else {
+		log.Printf("Error creating session ID for %s: %v", username, err)
+	}
+	c.setUsername(username)
+	c.loggedIn.Store(true)
+}
+
+// startSession runs once the client has logged in. It restores the user's
+// presence, tells their watchers and delivers anything queued for them.
+func (c *Client) startSession() {
+	log.Printf("User %s logged in from %s as session %s", c.Username(), c.Device, c.SessionID)
+	c.sendSession(false)
+	if others := c.otherSessions(); others != "" {
+		c.sendSuccess("You are also logged in on: " + others)
+	}
+
+	presence := c.Server.Presence.Connect(c.Username())
+	c.dnd.Store(presence.Status == shared.StatusBusy)
+	if presence.Status != shared.StatusOnline {
+		c.sendSuccess("Your status is " + presence.Describe())
+	}
+	if presence.Status != shared.StatusOffline {
+		c.Server.announcePresence(c.Username(), presence.Describe())
+	}
+
+	c.deliverMail()
+	if presence.Status != shared.StatusBusy {
+		c.releaseHeld()
 	}
 }
 
 func (c *Client) handleAuth(authMsg shared.AuthMessage) {
-	// Check if the user is already logged in elsewhere
-	if c.Server.IsUserLoggedIn(authMsg.Username) {
-		c.sendError("This user is already logged in. Only one connection per user is allowed.")
+	switch authMsg.Content {
+	case "passwd", "rename", "delete":
+		c.handleAccountChange(authMsg)
 		return
 	}
 
+	if c.loggedIn.Load() {
+		c.sendError("Already logged in as " + c.Username())
+		return
+	}
+
+	ip := remoteIP(c.Conn)
+	guard := c.Server.LoginGuard
+
 	if authMsg.Content == "register" {
-		success := c.Server.AuthManager.RegisterUser(authMsg.Username, authMsg.Password)
-		if success {
-			c.Username = authMsg.Username
-			c.isLoggedIn = true
-			c.sendSuccess("Registered and logged in successfully")
-		} else {
+		if !guard.AllowRegistration(ip) {
+			c.Server.Metrics.Inc("auth.registrations_throttled")
+			log.Printf("Registration throttled for %s", ip)
+			c.sendError("Too many registrations from your address, try again later")
+			return
+		}
+
+		pending, err := c.Server.AuthManager.RegisterAccount(authMsg.Username, authMsg.Password, authMsg.InviteCode)
+		switch {
+		case err == ErrUserExists:
 			c.sendError("Username already exists")
+		case err != nil:
+			c.sendError("Registration failed: " + err.Error())
+		case pending:
+			log.Printf("User %s registered from %s and is awaiting approval", authMsg.Username, ip)
+			c.sendSuccess("Registration received. Your account is awaiting admin approval")
+		default:
+			c.login(authMsg.Username, authMsg.Device)
+			c.sendSuccess("Registered and logged in successfully")
+			c.startSession()
 		}
+		return
+	}
+
+	if wait := guard.LockedFor(authMsg.Username, ip); wait > 0 {
+		c.Server.Metrics.Inc("auth.locked_attempts")
+		c.sendError(fmt.Sprintf("Too many failed login attempts, try again in %v", wait.Round(time.Second)))
+		return
+	}
+
+	// The token ID marks the session as a bot's, so it is only kept once the
+	// login goes through
+	var tokenID string
+	var authenticated bool
+	if authMsg.Content == "token" {
+		tokenID, authenticated = c.Server.AuthManager.AuthenticateToken(authMsg.Username, authMsg.Token)
 	} else {
-		success := c.Server.AuthManager.AuthenticateUser(authMsg.Username, authMsg.Password)
-		if success {
-			c.Username = authMsg.Username
-			c.isLoggedIn = true
-			c.sendSuccess("Logged in successfully")
-		} else {
-			c.sendError("Invalid credentials")
-		}
+		authenticated = c.Server.AuthManager.AuthenticateUser(authMsg.Username, authMsg.Password)
+	}
+	if !authenticated {
+		guard.RecordFailure(authMsg.Username, ip)
+		c.Server.Metrics.Inc("auth.failures")
+		log.Printf("Failed login for %s from %s", authMsg.Username, ip)
+		c.sendError("Invalid credentials")
+		return
 	}
+
+	if c.Server.AuthManager.IsPending(authMsg.Username) {
+		c.sendError("Your account is awaiting admin approval")
+		return
+	}
+
+	if limit := c.Server.Config().Auth.MaxSessions; len(c.Server.ClientsOf(authMsg.Username)) >= limit {
+		c.sendError(fmt.Sprintf("You already have %d sessions open. Use /logout on one of them first", limit))
+		return
+	}
+
+	guard.RecordSuccess(authMsg.Username)
+	c.TokenID = tokenID
+	c.login(authMsg.Username, authMsg.Device)
+	c.sendSuccess("Logged in successfully")
+	c.startSession()
 }
 
 func (c *Client) handleCommand(msg shared.Message) {
-	if !c.isLoggedIn {
+	if !c.loggedIn.Load() {
 		c.sendError("Not authenticated")
 		return
 	}
 
+	// Commands may carry arguments after the command name
 	cmd := msg.Content
+	if fields := strings.Fields(msg.Content); len(fields) > 0 {
+		cmd = fields[0]
+	}
+
+	if capability, ok := botCommandCapabilities[cmd]; ok && c.botRefuses(capability) {
+		return
+	}
 
 	switch cmd {
 	case "rooms":
@@ -333,43 +614,47 @@ func (c *Client) handleCommand(msg shared.Message) {
 			Content:   string(roomList),
 			Sender:    "Server",
 			Timestamp: time.Now(),
+			RequestID: c.requestID(),
 		}
 
 		respBytes, _ := json.Marshal(response)
-		// Replace direct channel usage with SendDirectMessage for consistency
-		c.SendDirectMessage(respBytes)
+		c.EnqueueReliable(respBytes)
 
 	case "list":
 		// Check if the client is in a room
-		if c.Room == nil {
+		room := c.Room()
+		if room == nil {
 			c.sendError("You are not in a room")
 			return
 		}
 
 		// Get the list of clients in the room
-		c.Room.mu.RLock()
-		clientList := make([]string, 0, len(c.Room.Clients))
-		for client := range c.Room.Clients {
-			if client.Username != "" {
-				clientList = append(clientList, client.Username)
+		// A user with several sessions in the room is listed once
+		room.mu.RLock()
+		clientList := make([]string, 0, len(room.Clients))
+		listed := make(map[string]bool)
+		for client := range room.Clients {
+			if client.Username() != "" && !listed[client.Username()] {
+				listed[client.Username()] = true
+				clientList = append(clientList, client.Username())
 			}
 		}
-		c.Room.mu.RUnlock()
+		room.mu.RUnlock()
 
 		// Create and send the response
 		responseContent := fmt.Sprintf("Users in room %s (%d): %s",
-			c.Room.Name, len(clientList), strings.Join(clientList, ", "))
+			room.Name, len(clientList), c.Server.describeUsers(clientList))
 
 		response := shared.Message{
 			Type:      shared.MessageTypeCommand,
 			Content:   responseContent,
 			Sender:    "Server",
 			Timestamp: time.Now(),
+			RequestID: c.requestID(),
 		}
 
 		respBytes, _ := json.Marshal(response)
-		// Replace direct channel usage with SendDirectMessage for consistency
-		c.SendDirectMessage(respBytes)
+		c.EnqueueReliable(respBytes)
 
 	case "create":
 		if msg.Room == "" {
@@ -377,8 +662,18 @@ func (c *Client) handleCommand(msg shared.Message) {
 			return
 		}
 
+		if err := shared.ValidateRoomName(msg.Room); err != nil {
+			c.sendError("Invalid room name: " + err.Error())
+			return
+		}
+		if c.botRefusesRoom(msg.Room) {
+			return
+		}
+
 		room := c.Server.RoomManager.CreateRoom(msg.Room)
-		c.joinRoom(room)
+		if !c.joinRoom(room) {
+			return
+		}
 		c.sendSuccess("Room created and joined: " + msg.Room)
 
 	case "join":
@@ -392,25 +687,27 @@ func (c *Client) handleCommand(msg shared.Message) {
 			c.sendError("Room not found: " + msg.Room)
 			return
 		}
-
-		c.joinRoom(room)
+		if !c.joinRoom(room) {
+			return
+		}
 
 		// Send recent message history
 		history := c.Server.MessageStore.GetRoomHistory(room.Name)
-		if len(history) > 0 {
+		if len(history) > 0 && c.botMay(CapHistory) {
 			historyMsg := shared.Message{
 				Type:      shared.MessageTypeCommand,
 				Content:   "Recent messages:",
 				Sender:    "Server",
 				Timestamp: time.Now(),
+				RequestID: c.requestID(),
 			}
 			historyBytes, _ := json.Marshal(historyMsg)
-			c.SendDirectMessage(historyBytes)
+			c.EnqueueReliable(historyBytes)
 
-			// Send the last 10 messages or all if less than 10
+			// Send the most recent messages, as many as configured
 			start := 0
-			if len(history) > 10 {
-				start = len(history) - 10
+			if count := c.Server.Config().JoinHistoryCount; len(history) > count {
+				start = len(history) - count
 			}
 
 			for _, historyItem := range history[start:] {
@@ -419,28 +716,26 @@ func (c *Client) handleCommand(msg shared.Message) {
 					Type: shared.MessageTypeCommand,
 					Content: fmt.Sprintf("[%s] %s: %s",
 						historyItem.Timestamp.Format("15:04:05"),
-						historyItem.Sender,
+						historySender(historyItem),
 						historyItem.Content),
 					Sender:    "Server",
 					Timestamp: time.Now(),
+					RequestID: c.requestID(),
 				}
 				msgBytes, _ := json.Marshal(formattedMsg)
-				c.SendDirectMessage(msgBytes)
+				c.EnqueueReliable(msgBytes)
 			}
 		}
 
 		c.sendSuccess("Joined room: " + msg.Room)
 
 	case "leave":
-		if c.Room != nil {
-			oldRoom := c.Room
-			c.Room = nil
-			oldRoom.RemoveClient(c)
-
+		if oldRoom := c.leaveRoom(); oldRoom != nil {
 			// Broadcast to everyone in the room that this user has left
-			oldRoom.BroadcastEvent(shared.EventUserLeft, c.Username, "")
+			oldRoom.BroadcastEvent(shared.EventUserLeft, c.Username(), "")
 
 			c.sendSuccess("Left room: " + oldRoom.Name)
+			c.sendSession(false)
 		} else {
 			c.sendError("Not in any room")
 		}
@@ -461,29 +756,32 @@ func (c *Client) handleCommand(msg shared.Message) {
 		content := parts[2]
 
 		// Find the recipient
-		target := c.Server.FindClientByUsername(recipient)
-		if target == nil {
-			c.sendError("User not found: " + recipient)
+		targets := c.reachableClients(recipient)
+		if len(targets) == 0 {
+			c.sendUnreachable(recipient)
 			return
 		}
 
 		directMsg := shared.Message{
-			Type:      shared.MessageTypeDirect,
-			Content:   content,
-			Sender:    c.Username,
-			Recipient: recipient,
-			Timestamp: time.Now(),
+			Type:       shared.MessageTypeDirect,
+			Content:    content,
+			Sender:     c.Username(),
+			SenderID:   c.UserID,
+			Bot:        c.IsBot,
+			SenderName: c.Server.Profiles.DisplayName(c.Username()),
+			Recipient:  recipient,
+			Timestamp:  time.Now(),
 		}
 
 		// Store in message history
-		c.Server.MessageStore.AddDirectMessage(c.Username, recipient, directMsg)
+		c.Server.MessageStore.AddDirectMessage(c.Username(), recipient, directMsg)
 
 		// Send the message
 		msgBytes, _ := json.Marshal(directMsg)
-		target.SendDirectMessage(msgBytes)
-		c.SendDirectMessage(msgBytes) // Also send to sender
+		c.deliverDirect(targets, directMsg, msgBytes)
+		c.Server.SendToUser(c.Username(), msgBytes) // Also send to the sender's sessions
 
-		log.Printf("Direct message from %s to %s", c.Username, recipient)
+		log.Printf("Direct message from %s to %s", c.Username(), recipient)
 
 	case "encrypt":
 		if len(msg.Content) < 2 {
@@ -511,65 +809,115 @@ func (c *Client) handleCommand(msg shared.Message) {
 		}
 
 		// Find the recipient
-		target := c.Server.FindClientByUsername(recipient)
-		if target == nil {
-			c.sendError("User not found: " + recipient)
+		targets := c.reachableClients(recipient)
+		if len(targets) == 0 {
+			c.sendUnreachable(recipient)
 			return
 		}
 
 		encryptedMsg := shared.Message{
-			Type:      shared.MessageTypeEncrypted,
-			Content:   encryptedContent,
-			Sender:    c.Username,
-			Recipient: recipient,
-			Timestamp: time.Now(),
-			Encrypted: true,
+			Type:       shared.MessageTypeEncrypted,
+			Content:    encryptedContent,
+			Sender:     c.Username(),
+			SenderID:   c.UserID,
+			Bot:        c.IsBot,
+			SenderName: c.Server.Profiles.DisplayName(c.Username()),
+			Recipient:  recipient,
+			Timestamp:  time.Now(),
+			Encrypted:  true,
 		}
 
 		// Store metadata in history (not the content)
 		historyMsg := encryptedMsg
 		historyMsg.Content = "[Encrypted message]"
-		c.Server.MessageStore.AddDirectMessage(c.Username, recipient, historyMsg)
+		c.Server.MessageStore.AddDirectMessage(c.Username(), recipient, historyMsg)
 
 		// Send the encrypted message
 		msgBytes, _ := json.Marshal(encryptedMsg)
-		target.SendDirectMessage(msgBytes)
-		c.SendDirectMessage(msgBytes) // Also send to sender
+		c.deliverDirect(targets, encryptedMsg, msgBytes)
+		c.Server.SendToUser(c.Username(), msgBytes) // Also send to the sender's sessions
 
-		log.Printf("Encrypted message from %s to %s", c.Username, recipient)
+		log.Printf("Encrypted message from %s to %s", c.Username(), recipient)
 
 	case "status":
-		if len(msg.Content) < 2 {
-			c.sendError("Usage: status <online|away|busy|offline>")
+		parts := strings.SplitN(msg.Content, " ", 3)
+		if len(parts) < 2 {
+			c.sendError("Usage: status <online|away|busy|offline> [text]")
 			return
 		}
 
-		parts := strings.Fields(msg.Content)
-		statusStr := strings.ToLower(parts[1])
-
-		var newStatus shared.UserStatus
-		switch statusStr {
-		case "online":
-			newStatus = shared.StatusOnline
-		case "away":
-			newStatus = shared.StatusAway
-		case "busy":
-			newStatus = shared.StatusBusy
-		case "offline":
-			newStatus = shared.StatusOffline
-		default:
+		status, ok := shared.ParseStatus(parts[1])
+		if !ok {
 			c.sendError("Invalid status. Use: online, away, busy, or offline")
 			return
 		}
 
-		c.Status = newStatus
+		text := ""
+		if len(parts) > 2 {
+			text = parts[2]
+		}
+		c.setStatus(status, text)
 
-		// Notify current room if any
-		if c.Room != nil {
-			c.Room.BroadcastEvent(shared.EventStatusChange, c.Username, statusStr)
+	case "whois":
+		parts := strings.Fields(msg.Content)
+		if len(parts) < 2 {
+			c.sendError("Usage: whois <username>")
+			return
+		}
+		if !c.Server.AuthManager.UserExists(parts[1]) {
+			c.sendError("User not found: " + parts[1])
+			return
 		}
+		c.sendSuccess(c.whois(parts[1]))
 
-		c.sendSuccess("Status updated to: " + statusStr)
+	case "watch":
+		parts := strings.Fields(msg.Content)
+		if len(parts) < 2 {
+			watching := c.Server.Presence.Watching(c.Username())
+			if len(watching) == 0 {
+				c.sendSuccess("You are not watching anyone")
+				return
+			}
+			c.sendSuccess("You are watching: " + strings.Join(watching, ", "))
+			return
+		}
+
+		target := parts[1]
+		switch {
+		case target == c.Username():
+			c.sendError("You cannot watch yourself")
+		case !c.Server.AuthManager.UserExists(target):
+			c.sendError("User not found: " + target)
+		default:
+			// Users who block the watcher never announce their presence to
+			// them, see announcePresence
+			c.Server.Presence.Watch(c.Username(), target)
+			c.sendSuccess("Watching " + target + ". " + c.whois(target))
+		}
+
+	case "unwatch":
+		parts := strings.Fields(msg.Content)
+		if len(parts) < 2 {
+			c.sendError("Usage: unwatch <username>")
+			return
+		}
+		if !c.Server.Presence.Unwatch(c.Username(), parts[1]) {
+			c.sendError("You are not watching " + parts[1])
+			return
+		}
+		c.sendSuccess("Stopped watching " + parts[1])
+
+	case "contacts", "addcontact", "removecontact", "block", "unblock", "blocked":
+		c.handleContactCommand(cmd, strings.Fields(msg.Content))
+
+	case "invite":
+		c.handleInvite(strings.Fields(msg.Content))
+
+	case "gmsg", "groups", "ghistory", "gadd", "gleave":
+		c.handleGroupCommand(cmd, msg)
+
+	case "profile":
+		c.handleProfile(msg.Content)
 
 	case "history":
 		parts := strings.Fields(msg.Content)
@@ -578,7 +926,7 @@ func (c *Client) handleCommand(msg shared.Message) {
 			// Direct message history
 			otherUser := parts[1]
 
-			history := c.Server.MessageStore.GetDirectMessageHistory(c.Username, otherUser)
+			history := c.Server.MessageStore.GetDirectMessageHistory(c.Username(), otherUser)
 			if len(history) == 0 {
 				c.sendSuccess("No message history with user: " + otherUser)
 				return
@@ -589,98 +937,162 @@ func (c *Client) handleCommand(msg shared.Message) {
 				Content:   "Message history with " + otherUser + ":",
 				Sender:    "Server",
 				Timestamp: time.Now(),
+				RequestID: c.requestID(),
 			}
 			historyBytes, _ := json.Marshal(historyMsg)
-			c.SendDirectMessage(historyBytes)
+			c.EnqueueReliable(historyBytes)
 
 			// Send all direct messages
 			for _, historyItem := range history {
-				// Ensure we're sending a copy of the message, not the original
-				privateMsg := historyItem
-				// Use MessageTypeCommand to ensure it's displayed properly and not broadcast
-				privateMsg.Type = shared.MessageTypeCommand
-				msgBytes, _ := json.Marshal(privateMsg)
-				c.SendDirectMessage(msgBytes)
+				c.sendHistoryItem(historyItem)
 			}
 		} else {
 			// Room history
-			if c.Room == nil {
+			room := c.Room()
+			if room == nil {
 				c.sendError("You are not in a room")
 				return
 			}
 
-			history := c.Server.MessageStore.GetRoomHistory(c.Room.Name)
+			history := c.Server.MessageStore.GetRoomHistory(room.Name)
 			if len(history) == 0 {
-				c.sendSuccess("No message history for room: " + c.Room.Name)
+				c.sendSuccess("No message history for room: " + room.Name)
 				return
 			}
 
 			historyMsg := shared.Message{
 				Type:      shared.MessageTypeCommand,
-				Content:   "Message history for room " + c.Room.Name + ":",
+				Content:   "Message history for room " + room.Name + ":",
 				Sender:    "Server",
 				Timestamp: time.Now(),
+				RequestID: c.requestID(),
 			}
 			historyBytes, _ := json.Marshal(historyMsg)
-			c.SendDirectMessage(historyBytes)
+			c.EnqueueReliable(historyBytes)
 
-			// Send the last 20 messages or all if less than 20
+			// Send the most recent messages, as many as configured
 			start := 0
-			if len(history) > 20 {
-				start = len(history) - 20
+			if count := c.Server.Config().HistoryCount; len(history) > count {
+				start = len(history) - count
 			}
 
 			for _, historyItem := range history[start:] {
-				// Format the history message to include sender information
-				formattedMsg := shared.Message{
-					Type: shared.MessageTypeCommand,
-					// Format the content to include sender, timestamp, and message
-					Content: fmt.Sprintf("[%s] %s: %s",
-						historyItem.Timestamp.Format("15:04:05"),
-						historyItem.Sender,
-						historyItem.Content),
-					Sender:    "Server",
-					Timestamp: time.Now(),
-				}
-				msgBytes, _ := json.Marshal(formattedMsg)
-				c.SendDirectMessage(msgBytes)
+				c.sendHistoryItem(historyItem)
 			}
 		}
 
-	case "exit":
-		// Clean up - leave any room first
-		if c.Room != nil {
-			oldRoom := c.Room
-			c.Room = nil
-			oldRoom.RemoveClient(c)
-			oldRoom.BroadcastEvent(shared.EventUserLeft, c.Username, "")
+	case "uploads":
+		c.sendSuccess(c.uploadSummary())
+
+	case "quota":
+		c.sendSuccess(c.quotaSummary())
+
+	case "files":
+		room := c.Room()
+		if room == nil {
+			c.sendError("You are not in a room")
+			return
 		}
+		c.sendSuccess(c.fileSummary(room))
+
+	case "download":
+		c.handleDownload(strings.TrimSpace(strings.TrimPrefix(msg.Content, cmd)))
+
+	case "delfile":
+		c.handleDeleteFile(strings.TrimSpace(strings.TrimPrefix(msg.Content, cmd)))
+
+	case "preview":
+		c.handlePreview(strings.TrimSpace(strings.TrimPrefix(msg.Content, cmd)))
+
+	case "exit":
+		c.endSession(c, "Disconnecting...")
+
+	case "sessions", "logout":
+		c.handleSessionCommand(cmd, strings.Fields(msg.Content))
+
+	case "unread":
+		c.sendSuccess(c.unreadSummary())
 
-		// Send goodbye message to client
-		c.sendSuccess("Goodbye! Disconnecting...")
+	case "bot", "bots":
+		c.handleBotCommand(strings.Fields(msg.Content))
 
-		// Schedule disconnection after message is sent
-		go func() {
-			// Give time for the goodbye message to be sent
-			time.Sleep(100 * time.Millisecond)
-			c.Server.Unregister <- c
-		}()
+	case "invitecode", "pending", "approve", "reject":
+		c.handleAdminCommand(cmd, strings.Fields(msg.Content)[1:])
 
 	default:
 		c.sendError("Unknown command: " + cmd)
 	}
 }
 
+// handleAdminCommand processes commands that require admin rights
+func (c *Client) handleAdminCommand(cmd string, args []string) {
+	am := c.Server.AuthManager
+	if !am.IsAdmin(c.Username()) {
+		c.sendError("This command requires admin rights")
+		return
+	}
+
+	switch cmd {
+	case "invitecode":
+		code, err := am.CreateInvite(c.Username())
+		if err != nil {
+			c.sendError("Could not create invite: " + err.Error())
+			return
+		}
+		log.Printf("Admin %s created an invite code", c.Username())
+		c.sendSuccess(fmt.Sprintf("Invite code: %s (valid for %v)", code, am.InviteValidity()))
+
+	case "pending":
+		pending := am.PendingUsers()
+		if len(pending) == 0 {
+			c.sendSuccess("No registrations awaiting approval")
+			return
+		}
+		c.sendSuccess(fmt.Sprintf("Awaiting approval (%d): %s", len(pending), strings.Join(pending, ", ")))
+
+	case "approve", "reject":
+		if len(args) < 1 {
+			c.sendError("Usage: " + cmd + " <username>")
+			return
+		}
+
+		var err error
+		if cmd == "approve" {
+			err = am.ApproveUser(args[0])
+		} else {
+			err = am.RejectUser(args[0])
+		}
+		if err != nil {
+			c.sendError(err.Error() + ": " + args[0])
+			return
+		}
+
+		log.Printf("Admin %s %sd registration of %s", c.Username(), cmd, args[0])
+		c.sendSuccess(fmt.Sprintf("Registration of %s %sd", args[0], cmd))
+	}
+}
+
+// sendHistoryItem sends a stored message in answer to a history request. It
+// keeps its fields, so clients can show it as they like, but is marked as
+// history so it is not taken for a new message.
+func (c *Client) sendHistoryItem(item shared.Message) {
+	item.Type = shared.MessageTypeHistory
+	item.RequestID = c.requestID()
+	itemBytes, _ := json.Marshal(item)
+	c.EnqueueReliable(itemBytes)
+}
+
 func (c *Client) sendError(message string) {
 	response := shared.Message{
 		Type:      shared.MessageTypeCommand,
 		Content:   "ERROR: " + message,
 		Sender:    "Server",
 		Timestamp: time.Now(),
+		RequestID: c.requestID(),
 	}
 
 	respBytes, _ := json.Marshal(response)
-	c.SendDirectMessage(respBytes)
+	c.EnqueueReliable(respBytes)
 }
 
 func (c *Client) sendSuccess(message string) {
@@ -689,8 +1101,16 @@ func (c *Client) sendSuccess(message string) {
 		Content:   "SUCCESS: " + message,
 		Sender:    "Server",
 		Timestamp: time.Now(),
+		RequestID: c.requestID(),
 	}
 
 	respBytes, _ := json.Marshal(response)
-	c.SendDirectMessage(respBytes)
+	c.EnqueueReliable(respBytes)
+}
+
+// notify is sendSuccess for news the client did not ask for, such as a change
+// made by another session. It would otherwise join the reply to whatever
+// request the client is handling at the time.
+func (c *Client) notify(message string) {
+	c.EnqueueReliable(serverNotice("SUCCESS: " + message))
 }
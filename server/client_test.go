@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"chatap.com/chatclient"
+)
+
+// serveTestListener accepts connections for a running server on a local port
+// and returns its address
+func serveTestListener(t *testing.T, s *Server) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			client := NewClient(conn, s)
+			if !s.register(client) {
+				conn.Close()
+				return
+			}
+			go client.ReadPump()
+			go client.WritePump()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// dialTestChat logs in a chatclient and joins the general room
+func dialTestChat(t *testing.T, addr, username, password string) *chatclient.Client {
+	t.Helper()
+	config := chatclient.DefaultConfig(addr)
+	config.Reconnect = false
+	config.DataDir = t.TempDir()
+	chat, err := chatclient.Dial(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(chat.Close)
+
+	ctx := context.Background()
+	if _, err := chat.Login(ctx, username, password); err != nil {
+		t.Fatalf("login as %s: %v", username, err)
+	}
+	if _, err := chat.Join(ctx, "general"); err != nil {
+		t.Fatalf("%s joining general: %v", username, err)
+	}
+	return chat
+}
+
+// expectChatEvent waits for an event with the given type and content
+func expectChatEvent(t *testing.T, chat *chatclient.Client, eventType chatclient.EventType, content string) {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case event := <-chat.Events():
+			if event.Type == eventType && event.Message.Content == content {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("no event with %q", content)
+		}
+	}
+}
+
+func TestRelayedMessagesAnswerNoRequest(t *testing.T) {
+	s := newTestServer(t)
+	go s.handleChannels()
+	defer close(s.quit)
+	s.AuthManager.RegisterUser("alice", "secret1")
+	s.AuthManager.RegisterUser("bob", "secret2")
+	s.RoomManager.CreateRoom("general")
+	addr := serveTestListener(t, s)
+
+	// Both clients number their requests alike: login, join, then the rest
+	alice := dialTestChat(t, addr, "alice", "secret1")
+	bob := dialTestChat(t, addr, "bob", "secret2")
+	server := s.ClientsOf("bob")[0]
+
+	// Bob's next request stays in flight while alice's requests with the
+	// same IDs are relayed to him
+	s.RoomManager.mu.Lock()
+	rooms := make(chan error)
+	go func() {
+		_, err := bob.Rooms(context.Background())
+		rooms <- err
+	}()
+	for deadline := time.Now().Add(5 * time.Second); server.requestID() != "3"; {
+		if time.Now().After(deadline) {
+			s.RoomManager.mu.Unlock()
+			t.Fatal("bob's request never reached the server")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx := context.Background()
+	if _, err := alice.Send(ctx, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	expectChatEvent(t, bob, chatclient.EventChat, "hello")
+	s.RoomManager.mu.Unlock()
+	if err := <-rooms; err != nil {
+		t.Fatalf("bob's rooms request: %v", err)
+	}
+
+	if _, err := alice.DM(ctx, "bob", "psst"); err != nil {
+		t.Fatal(err)
+	}
+	expectChatEvent(t, bob, chatclient.EventDirect, "psst")
+
+	// Stored messages keep no request ID either
+	for _, msg := range s.MessageStore.GetRoomHistory("general") {
+		if msg.RequestID != "" {
+			t.Fatalf("room history kept request ID %s", msg.RequestID)
+		}
+	}
+	for _, msg := range s.MessageStore.GetDirectMessageHistory("alice", "bob") {
+		if msg.RequestID != "" {
+			t.Fatalf("direct history kept request ID %s", msg.RequestID)
+		}
+	}
+}
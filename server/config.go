@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"chatap.com/shared"
+)
+
+const DefaultConfigPath = "server_config.json"
+
+// Config holds all server settings. It is loaded from a JSON file, then
+// overridden by CHAT_* environment variables and finally by command-line flags.
+type Config struct {
+	ListenAddr        string `json:"listenAddr"`
+	UploadsDir        string `json:"uploadsDir"`
+	MessageHistoryDir string `json:"messageHistoryDir"`
+
+	// Connections are dropped after this long without reading or writing
+	ReadTimeoutSeconds  int `json:"readTimeoutSeconds"`
+	WriteTimeoutSeconds int `json:"writeTimeoutSeconds"`
+	// Clients are pinged this often, so idle connections stay within the read timeout
+	PingIntervalSeconds int `json:"pingIntervalSeconds"`
+	// Online users are shown as away after this long without activity (0 disables)
+	AwayAfterMinutes int `json:"awayAfterMinutes"`
+	// Time allowed for a graceful shutdown
+	ShutdownTimeoutSeconds int `json:"shutdownTimeoutSeconds"`
+
+	// Messages replayed on /join and returned by /history
+	JoinHistoryCount int `json:"joinHistoryCount"`
+	HistoryCount     int `json:"historyCount"`
+
+	// Largest file chunk accepted from clients, and the chunk size of downloads
+	ChunkSize int `json:"chunkSize"`
+	// Deflate file chunks when it makes them smaller
+	CompressChunks bool `json:"compressChunks"`
+	// Unfinished uploads are discarded after this long without activity
+	UploadTTLMinutes int `json:"uploadTTLMinutes"`
+
+	Admins     []string         `json:"admins"`
+	RateLimits RateLimitConfig  `json:"rateLimits"`
+	Auth       AuthConfig       `json:"auth"`
+	SendQueue  SendQueueConfig  `json:"sendQueue"`
+	Files      FilePolicyConfig `json:"files"`
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		ListenAddr:             ":8080",
+		UploadsDir:             "uploads",
+		MessageHistoryDir:      "message_history",
+		ReadTimeoutSeconds:     300,
+		WriteTimeoutSeconds:    300,
+		PingIntervalSeconds:    30,
+		AwayAfterMinutes:       10,
+		ShutdownTimeoutSeconds: 30,
+		JoinHistoryCount:       10,
+		HistoryCount:           20,
+		ChunkSize:              shared.ChunkSize,
+		CompressChunks:         true,
+		UploadTTLMinutes:       6 * 60,
+		Admins:                 []string{"admin"},
+		RateLimits:             DefaultRateLimitConfig(),
+		Auth:                   DefaultAuthConfig(),
+		SendQueue:              DefaultSendQueueConfig(),
+		Files:                  DefaultFilePolicyConfig(),
+	}
+}
+
+func (c *Config) ReadTimeout() time.Duration {
+	return time.Duration(c.ReadTimeoutSeconds) * time.Second
+}
+
+func (c *Config) WriteTimeout() time.Duration {
+	return time.Duration(c.WriteTimeoutSeconds) * time.Second
+}
+
+func (c *Config) PingInterval() time.Duration {
+	return time.Duration(c.PingIntervalSeconds) * time.Second
+}
+
+func (c *Config) AwayAfter() time.Duration {
+	return time.Duration(c.AwayAfterMinutes) * time.Minute
+}
+
+func (c *Config) ShutdownTimeout() time.Duration {
+	return time.Duration(c.ShutdownTimeoutSeconds) * time.Second
+}
+
+func (c *Config) UploadTTL() time.Duration {
+	return time.Duration(c.UploadTTLMinutes) * time.Minute
+}
+
+// Validate checks the configuration and reports every problem found
+func (c *Config) Validate() error {
+	var problems []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+
+	check(c.ListenAddr != "", "listenAddr must not be empty")
+	check(c.UploadsDir != "", "uploadsDir must not be empty")
+	check(c.MessageHistoryDir != "", "messageHistoryDir must not be empty")
+	check(c.ReadTimeoutSeconds > 0, "readTimeoutSeconds must be positive")
+	check(c.WriteTimeoutSeconds > 0, "writeTimeoutSeconds must be positive")
+	check(c.PingIntervalSeconds > 0 && c.PingIntervalSeconds < c.ReadTimeoutSeconds,
+		"pingIntervalSeconds must be positive and less than readTimeoutSeconds")
+	check(c.AwayAfterMinutes >= 0, "awayAfterMinutes must not be negative")
+	check(c.ShutdownTimeoutSeconds > 0, "shutdownTimeoutSeconds must be positive")
+	check(c.JoinHistoryCount >= 0, "joinHistoryCount must not be negative")
+	check(c.HistoryCount >= 0, "historyCount must not be negative")
+	check(c.ChunkSize >= 1024 && c.ChunkSize <= shared.MaxChunkSize,
+		"chunkSize must be between 1024 and %d bytes", shared.MaxChunkSize)
+	check(c.UploadTTLMinutes > 0, "uploadTTLMinutes must be positive")
+
+	for _, set := range []struct {
+		name   string
+		limits LimitSet
+	}{{"perConnection", c.RateLimits.PerConnection}, {"perUser", c.RateLimits.PerUser}} {
+		for category := RateCategory(0); category < rateCategoryCount; category++ {
+			limit := set.limits.get(category)
+			check(limit.Rate >= 0 && limit.Burst >= 0, "rateLimits.%s.%s must not be negative", set.name, category)
+			check(limit.Rate == 0 || limit.Burst >= 1, "rateLimits.%s.%s burst must be at least 1", set.name, category)
+		}
+	}
+	check(c.RateLimits.MuteSeconds >= 0, "rateLimits.muteSeconds must not be negative")
+	check(c.RateLimits.ViolationWindowSeconds > 0, "rateLimits.violationWindowSeconds must be positive")
+
+	check(c.Auth.MaxFailures > 0, "auth.maxFailures must be positive")
+	check(c.Auth.LockoutBaseSeconds > 0, "auth.lockoutBaseSeconds must be positive")
+	check(c.Auth.LockoutMaxSeconds >= c.Auth.LockoutBaseSeconds, "auth.lockoutMaxSeconds must be at least lockoutBaseSeconds")
+	check(c.Auth.FailureResetSeconds > 0, "auth.failureResetSeconds must be positive")
+	check(c.Auth.InviteValidHours > 0, "auth.inviteValidHours must be positive")
+	check(c.Auth.MaxSessions > 0, "auth.maxSessions must be positive")
+	switch c.Auth.RegistrationMode {
+	case RegistrationOpen, RegistrationInvite, RegistrationApproval:
+	default:
+		problems = append(problems, fmt.Sprintf("auth.registrationMode must be %q, %q or %q, got %q",
+			RegistrationOpen, RegistrationInvite, RegistrationApproval, c.Auth.RegistrationMode))
+	}
+	switch c.Auth.DeletionPolicy {
+	case DeletionAnonymize, DeletionErase:
+	default:
+		problems = append(problems, fmt.Sprintf("auth.deletionPolicy must be %q or %q, got %q",
+			DeletionAnonymize, DeletionErase, c.Auth.DeletionPolicy))
+	}
+
+	check(c.SendQueue.MaxBytes >= 64<<10, "sendQueue.maxBytes must be at least 65536")
+	check(c.SendQueue.MaxBytes >= 4*c.ChunkSize, "sendQueue.maxBytes must be at least four times chunkSize")
+	check(c.SendQueue.MaxControlBytes >= 4<<10, "sendQueue.maxControlBytes must be at least 4096")
+	switch c.SendQueue.Policy {
+	case PolicyDropOldest, PolicyDisconnect:
+	default:
+		problems = append(problems, fmt.Sprintf("sendQueue.policy must be %q or %q, got %q",
+			PolicyDropOldest, PolicyDisconnect, c.SendQueue.Policy))
+	}
+
+	check(c.Files.MaxFileBytes >= 0, "files.maxFileBytes must not be negative")
+	check(c.Files.UserQuotaBytes >= 0, "files.userQuotaBytes must not be negative")
+	check(c.Files.RoomQuotaBytes >= 0, "files.roomQuotaBytes must not be negative")
+	for _, ext := range append(append([]string{}, c.Files.AllowedExtensions...), c.Files.DeniedExtensions...) {
+		check(strings.HasPrefix(ext, "."), "files: extension %q must start with a dot", ext)
+	}
+
+	if len(problems) > 0 {
+		return errors.New("invalid configuration:\n  " + strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// loadConfigFile reads a JSON config file on top of the defaults. A missing
+// file is only an error when required is set.
+func loadConfigFile(path string, required bool) (*Config, error) {
+	config := DefaultConfig()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) && !required {
+			return config, nil
+		}
+		return nil, fmt.Errorf("error reading config file: %v", err)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(config); err != nil {
+		return nil, fmt.Errorf("error parsing config file %s: %v", path, err)
+	}
+
+	return config, nil
+}
+
+// applyEnv overrides settings from CHAT_* environment variables
+func (c *Config) applyEnv() error {
+	stringVars := map[string]*string{
+		"CHAT_LISTEN_ADDR":          &c.ListenAddr,
+		"CHAT_UPLOADS_DIR":          &c.UploadsDir,
+		"CHAT_MESSAGE_HISTORY_DIR":  &c.MessageHistoryDir,
+		"CHAT_REGISTRATION_MODE":    &c.Auth.RegistrationMode,
+		"CHAT_DELETION_POLICY":      &c.Auth.DeletionPolicy,
+		"CHAT_SLOW_CONSUMER_POLICY": &c.SendQueue.Policy,
+	}
+	for name, target := range stringVars {
+		if value, ok := os.LookupEnv(name); ok {
+			*target = value
+		}
+	}
+
+	intVars := map[string]*int{
+		"CHAT_READ_TIMEOUT_SECONDS":     &c.ReadTimeoutSeconds,
+		"CHAT_WRITE_TIMEOUT_SECONDS":    &c.WriteTimeoutSeconds,
+		"CHAT_PING_INTERVAL_SECONDS":    &c.PingIntervalSeconds,
+		"CHAT_AWAY_AFTER_MINUTES":       &c.AwayAfterMinutes,
+		"CHAT_SHUTDOWN_TIMEOUT_SECONDS": &c.ShutdownTimeoutSeconds,
+		"CHAT_JOIN_HISTORY_COUNT":       &c.JoinHistoryCount,
+		"CHAT_HISTORY_COUNT":            &c.HistoryCount,
+		"CHAT_CHUNK_SIZE":               &c.ChunkSize,
+		"CHAT_UPLOAD_TTL_MINUTES":       &c.UploadTTLMinutes,
+		"CHAT_SEND_QUEUE_BYTES":         &c.SendQueue.MaxBytes,
+		"CHAT_MAX_SESSIONS":             &c.Auth.MaxSessions,
+	}
+	for name, target := range intVars {
+		if value, ok := os.LookupEnv(name); ok {
+			parsed, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("invalid value for %s: %v", name, err)
+			}
+			*target = parsed
+		}
+	}
+
+	if value, ok := os.LookupEnv("CHAT_ADMINS"); ok {
+		c.Admins = splitList(value)
+	}
+
+	return nil
+}
+
+func splitList(value string) []string {
+	items := make([]string, 0)
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// ConfigLoader remembers how the configuration was assembled so that it can be
+// rebuilt the same way on reload
+type ConfigLoader struct {
+	Path        string
+	PrintConfig bool
+
+	pathSet   bool
+	overrides map[string]string // Flags given on the command line
+}
+
+// ParseFlags defines and parses the server's command-line flags
+func ParseFlags(args []string) (*ConfigLoader, error) {
+	fs := flag.NewFlagSet("chat-server", flag.ContinueOnError)
+
+	loader := &ConfigLoader{overrides: make(map[string]string)}
+	fs.StringVar(&loader.Path, "config", DefaultConfigPath, "Path to the JSON config file")
+	fs.BoolVar(&loader.PrintConfig, "print-config", false, "Print the effective configuration and exit")
+	fs.String("addr", "", "Listen address (overrides listenAddr)")
+	fs.String("uploads-dir", "", "Uploads directory (overrides uploadsDir)")
+	fs.String("history-dir", "", "Message history directory (overrides messageHistoryDir)")
+	fs.Int("read-timeout", 0, "Read timeout in seconds (overrides readTimeoutSeconds)")
+	fs.Int("write-timeout", 0, "Write timeout in seconds (overrides writeTimeoutSeconds)")
+	fs.Int("join-history", 0, "Messages replayed on join (overrides joinHistoryCount)")
+	fs.Int("history", 0, "Messages returned by /history (overrides historyCount)")
+	fs.Int("chunk-size", 0, "Largest accepted file chunk in bytes (overrides chunkSize)")
+	fs.String("registration", "", "Registration mode: open, invite or approval")
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "config":
+			loader.pathSet = true
+		case "print-config":
+		default:
+			loader.overrides[f.Name] = f.Value.String()
+		}
+	})
+
+	return loader, nil
+}
+
+// Load builds the configuration from file, environment and flags and validates it
+func (cl *ConfigLoader) Load() (*Config, error) {
+	config, err := loadConfigFile(cl.Path, cl.pathSet)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := config.applyEnv(); err != nil {
+		return nil, err
+	}
+
+	for name, value := range cl.overrides {
+		if err := config.applyFlag(name, value); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+func (c *Config) applyFlag(name, value string) error {
+	stringFlags := map[string]*string{
+		"addr":         &c.ListenAddr,
+		"uploads-dir":  &c.UploadsDir,
+		"history-dir":  &c.MessageHistoryDir,
+		"registration": &c.Auth.RegistrationMode,
+	}
+	if target, ok := stringFlags[name]; ok {
+		*target = value
+		return nil
+	}
+
+	intFlags := map[string]*int{
+		"read-timeout":  &c.ReadTimeoutSeconds,
+		"write-timeout": &c.WriteTimeoutSeconds,
+		"join-history":  &c.JoinHistoryCount,
+		"history":       &c.HistoryCount,
+		"chunk-size":    &c.ChunkSize,
+	}
+	if target, ok := intFlags[name]; ok {
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid value for -%s: %v", name, err)
+		}
+		*target = parsed
+		return nil
+	}
+
+	return fmt.Errorf("unknown flag -%s", name)
+}
+
+// restartRequired lists settings that differ between two configs but cannot
+// be changed while the server is running
+func restartRequired(old, new *Config) []string {
+	var changed []string
+	if old.ListenAddr != new.ListenAddr {
+		changed = append(changed, "listenAddr")
+	}
+	if old.UploadsDir != new.UploadsDir {
+		changed = append(changed, "uploadsDir")
+	}
+	if old.MessageHistoryDir != new.MessageHistoryDir {
+		changed = append(changed, "messageHistoryDir")
+	}
+	// Uploads in progress and checkpointed ones were split with the old size
+	if old.ChunkSize != new.ChunkSize {
+		changed = append(changed, "chunkSize")
+	}
+	return changed
+}
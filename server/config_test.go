@@ -0,0 +1,28 @@
+package main
+
+import "testing"
+
+func TestReloadKeepsChunkSize(t *testing.T) {
+	s := newTestServer(t)
+	config := *s.Config()
+	config.ChunkSize = 256 << 10
+	config.SendQueue.MaxBytes = 1 << 20
+	s.config.Store(&config)
+
+	reloaded := config
+	reloaded.ChunkSize = 16 << 10
+	reloaded.SendQueue.MaxBytes = 64 << 10
+	reloaded.HistoryCount = config.HistoryCount + 1
+	s.ApplyConfig(&reloaded)
+
+	applied := s.Config()
+	if applied.ChunkSize != config.ChunkSize {
+		t.Fatalf("chunk size changed to %d while running", applied.ChunkSize)
+	}
+	if applied.HistoryCount != reloaded.HistoryCount {
+		t.Fatal("other settings were not reloaded")
+	}
+	if err := applied.Validate(); err != nil {
+		t.Fatalf("applied config is invalid: %v", err)
+	}
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"chatap.com/shared"
+)
+
+// ContactList is a user's contacts and the users they block
+type ContactList struct {
+	Contacts []string `json:"contacts,omitempty"`
+	Blocked  []string `json:"blocked,omitempty"`
+
+	// What each blocked user is shown as the last time they saw the user
+	BlockedSeen map[string]time.Time `json:"blocked_seen,omitempty"`
+}
+
+// ContactBook keeps every user's contact list. It is saved after every change.
+type ContactBook struct {
+	mu    sync.Mutex
+	path  string
+	lists map[string]*ContactList // map[username]*ContactList
+}
+
+func NewContactBook(path string) *ContactBook {
+	cb := &ContactBook{
+		path:  path,
+		lists: make(map[string]*ContactList),
+	}
+
+	data, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(data, &cb.lists); err != nil {
+			log.Printf("Error parsing contacts %s: %v", path, err)
+		}
+	case !os.IsNotExist(err):
+		log.Printf("Error reading contacts %s: %v", path, err)
+	}
+
+	return cb
+}
+
+// addName adds name to a sorted list unless it is there already
+func addName(names []string, name string) ([]string, bool) {
+	i := sort.SearchStrings(names, name)
+	if i < len(names) && names[i] == name {
+		return names, false
+	}
+	names = append(names, "")
+	copy(names[i+1:], names[i:])
+	names[i] = name
+	return names, true
+}
+
+// removeName removes name from a sorted list
+func removeName(names []string, name string) ([]string, bool) {
+	i := sort.SearchStrings(names, name)
+	if i == len(names) || names[i] != name {
+		return names, false
+	}
+	return append(names[:i], names[i+1:]...), true
+}
+
+func (cb *ContactBook) get(username string) *ContactList {
+	list, ok := cb.lists[username]
+	if !ok {
+		list = &ContactList{}
+		cb.lists[username] = list
+	}
+	return list
+}
+
+// Get returns a copy of a user's contact list
+func (cb *ContactBook) Get(username string) ContactList {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	list := cb.lists[username]
+	if list == nil {
+		return ContactList{}
+	}
+	return ContactList{
+		Contacts: append([]string(nil), list.Contacts...),
+		Blocked:  append([]string(nil), list.Blocked...),
+	}
+}
+
+// AddContact adds contact to a user's contacts and reports whether it was new
+func (cb *ContactBook) AddContact(username, contact string) bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	list := cb.get(username)
+	var added bool
+	list.Contacts, added = addName(list.Contacts, contact)
+	if added {
+		cb.save()
+	}
+	return added
+}
+
+// RemoveContact removes contact from a user's contacts and reports whether it
+// was there
+func (cb *ContactBook) RemoveContact(username, contact string) bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	list := cb.get(username)
+	var removed bool
+	list.Contacts, removed = removeName(list.Contacts, contact)
+	if removed {
+		cb.save()
+	}
+	return removed
+}
+
+// Block blocks a user, dropping them from the contacts, and reports whether
+// they were not blocked yet. lastSeen is when the blocked user last saw the
+// user online; it is all they see of the user from now on.
+func (cb *ContactBook) Block(username, blocked string, lastSeen time.Time) bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	list := cb.get(username)
+	var added bool
+	list.Blocked, added = addName(list.Blocked, blocked)
+	list.Contacts, _ = removeName(list.Contacts, blocked)
+	if added {
+		if list.BlockedSeen == nil {
+			list.BlockedSeen = make(map[string]time.Time)
+		}
+		list.BlockedSeen[blocked] = lastSeen
+		cb.save()
+	}
+	return added
+}
+
+// Unblock lifts a block and reports whether there was one
+func (cb *ContactBook) Unblock(username, blocked string) bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	list := cb.get(username)
+	var removed bool
+	list.Blocked, removed = removeName(list.Blocked, blocked)
+	if removed {
+		delete(list.BlockedSeen, blocked)
+		cb.save()
+	}
+	return removed
+}
+
+// Blocks reports whether username blocks sender
+func (cb *ContactBook) Blocks(username, sender string) bool {
+	_, blocked := cb.BlockedSeen(username, sender)
+	return blocked
+}
+
+// BlockedSeen reports whether username blocks sender, and if so when sender
+// last saw username online
+func (cb *ContactBook) BlockedSeen(username, sender string) (time.Time, bool) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	list := cb.lists[username]
+	if list == nil {
+		return time.Time{}, false
+	}
+	i := sort.SearchStrings(list.Blocked, sender)
+	if i == len(list.Blocked) || list.Blocked[i] != sender {
+		return time.Time{}, false
+	}
+	return list.BlockedSeen[sender], true
+}
+
+// RenameUser moves a user's contact list to a new name and renames them in
+// everyone else's
+func (cb *ContactBook) RenameUser(oldName, newName string) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if list, ok := cb.lists[oldName]; ok {
+		cb.lists[newName] = list
+		delete(cb.lists, oldName)
+	}
+	for _, list := range cb.lists {
+		var removed bool
+		if list.Contacts, removed = removeName(list.Contacts, oldName); removed {
+			list.Contacts, _ = addName(list.Contacts, newName)
+		}
+		if list.Blocked, removed = removeName(list.Blocked, oldName); removed {
+			list.Blocked, _ = addName(list.Blocked, newName)
+			if lastSeen, ok := list.BlockedSeen[oldName]; ok {
+				list.BlockedSeen[newName] = lastSeen
+				delete(list.BlockedSeen, oldName)
+			}
+		}
+	}
+	cb.save()
+}
+
+// RemoveUser deletes a user's contact list and removes them from everyone
+// else's
+func (cb *ContactBook) RemoveUser(username string) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	delete(cb.lists, username)
+	for _, list := range cb.lists {
+		list.Contacts, _ = removeName(list.Contacts, username)
+		list.Blocked, _ = removeName(list.Blocked, username)
+		delete(list.BlockedSeen, username)
+	}
+	cb.save()
+}
+
+// save writes the contact lists. The caller must hold cb.mu.
+func (cb *ContactBook) save() {
+	for username, list := range cb.lists {
+		if len(list.Contacts) == 0 && len(list.Blocked) == 0 {
+			delete(cb.lists, username)
+		}
+	}
+
+	data, err := json.MarshalIndent(cb.lists, "", "  ")
+	if err != nil {
+		log.Printf("Error serializing contacts: %v", err)
+		return
+	}
+
+	if err := os.MkdirAll(filepath.Dir(cb.path), 0755); err != nil {
+		log.Printf("Error creating contacts directory: %v", err)
+		return
+	}
+
+	// Write to a temporary file and rename it so a crash never leaves a truncated file
+	tmpPath := cb.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		log.Printf("Error writing contacts %s: %v", cb.path, err)
+		return
+	}
+	if err := os.Rename(tmpPath, cb.path); err != nil {
+		log.Printf("Error replacing contacts %s: %v", cb.path, err)
+	}
+}
+
+// reachableClients returns the sessions of a user who accepts messages from c.
+// Users who block c look offline, so c cannot tell it is blocked.
+func (c *Client) reachableClients(username string) []*Client {
+	if c.Server.Contacts.Blocks(username, c.Username()) {
+		return nil
+	}
+	return c.Server.ClientsOf(username)
+}
+
+// sendUnreachable answers a message to a user without reachable sessions.
+// Users who block c get the same answer as users who are offline.
+func (c *Client) sendUnreachable(username string) {
+	if !c.Server.AuthManager.UserExists(username) {
+		c.sendError("User not found: " + username)
+		return
+	}
+	c.sendError(username + " is offline")
+}
+
+// handleContactCommand handles the contact and block list commands
+func (c *Client) handleContactCommand(cmd string, args []string) {
+	contacts := c.Server.Contacts
+
+	if cmd == "contacts" || cmd == "blocked" {
+		list := contacts.Get(c.Username())
+		if cmd == "blocked" {
+			if len(list.Blocked) == 0 {
+				c.sendSuccess("You are not blocking anyone")
+				return
+			}
+			c.sendSuccess("Blocked users: " + strings.Join(list.Blocked, ", "))
+			return
+		}
+
+		if len(list.Contacts) == 0 {
+			c.sendSuccess("You have no contacts. Use addcontact <username> to add one")
+			return
+		}
+		lines := make([]string, 0, len(list.Contacts))
+		for _, contact := range list.Contacts {
+			lines = append(lines, "  "+c.whois(contact))
+		}
+		c.sendSuccess(fmt.Sprintf("Contacts (%d):\n%s", len(lines), strings.Join(lines, "\n")))
+		return
+	}
+
+	if len(args) < 2 {
+		c.sendError("Usage: " + cmd + " <username>")
+		return
+	}
+	username := args[1]
+
+	switch cmd {
+	case "addcontact":
+		switch {
+		case username == c.Username():
+			c.sendError("You cannot add yourself")
+		case !c.Server.AuthManager.UserExists(username):
+			c.sendError("User not found: " + username)
+		case contacts.Blocks(c.Username(), username):
+			c.sendError("Unblock " + username + " first")
+		default:
+			// Contacts come with a presence subscription
+			contacts.AddContact(c.Username(), username)
+			c.Server.Presence.Watch(c.Username(), username)
+			c.sendSuccess("Added " + username + " to your contacts. " + c.whois(username))
+		}
+
+	case "removecontact":
+		if !contacts.RemoveContact(c.Username(), username) {
+			c.sendError(username + " is not in your contacts")
+			return
+		}
+		c.Server.Presence.Unwatch(c.Username(), username)
+		c.sendSuccess("Removed " + username + " from your contacts")
+
+	case "block":
+		if username == c.Username() {
+			c.sendError("You cannot block yourself")
+			return
+		}
+		if !c.Server.AuthManager.UserExists(username) {
+			c.sendError("User not found: " + username)
+			return
+		}
+		// The blocked user keeps seeing the user as they last did
+		lastSeen := time.Now()
+		if presence, _ := c.Server.Presence.Get(c.Username()); presence.Status == shared.StatusOffline {
+			lastSeen = presence.LastSeen
+		}
+		if !contacts.Block(c.Username(), username, lastSeen) {
+			c.sendError(username + " is already blocked")
+			return
+		}
+		// Neither side keeps following the other's presence
+		c.Server.Presence.Unwatch(c.Username(), username)
+		c.Server.Presence.Unwatch(username, c.Username())
+		log.Printf("User %s blocked %s", c.Username(), username)
+		c.sendSuccess("Blocked " + username + ". They can no longer message you, send you files, invite you or mention you")
+
+	case "unblock":
+		if !contacts.Unblock(c.Username(), username) {
+			c.sendError(username + " is not blocked")
+			return
+		}
+		log.Printf("User %s unblocked %s", c.Username(), username)
+		c.sendSuccess("Unblocked " + username)
+	}
+}
+
+// handleInvite invites a user to the client's room
+func (c *Client) handleInvite(args []string) {
+	if len(args) < 2 {
+		c.sendError("Usage: invite <username>")
+		return
+	}
+	room := c.Room()
+	if room == nil {
+		c.sendError("You are not in a room")
+		return
+	}
+
+	username := args[1]
+	targets := c.reachableClients(username)
+	if len(targets) == 0 {
+		c.sendUnreachable(username)
+		return
+	}
+	for _, target := range targets {
+		if target.Room() == room {
+			c.sendError(username + " is already in " + room.Name)
+			return
+		}
+	}
+
+	invite := shared.CreateEventMessage(shared.EventRoomInvite, c.Username(), room.Name, "")
+	inviteBytes, _ := json.Marshal(invite)
+	for _, target := range targets {
+		target.SendDirectMessage(inviteBytes)
+	}
+
+	log.Printf("User %s invited %s to %s", c.Username(), username, room.Name)
+	c.sendSuccess("Invited " + username + " to " + room.Name)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"chatap.com/shared"
+)
+
+func TestBlockedUserSeesAnOfflineUser(t *testing.T) {
+	s := newTestServer(t)
+	go s.handleChannels()
+	defer close(s.quit)
+	s.AuthManager.RegisterUser("alice", "secret1")
+	s.AuthManager.RegisterUser("bob", "secret2")
+	s.AuthManager.RegisterUser("carol", "secret3")
+
+	alice := loginTestSession(t, s, "alice", "secret1")
+	bob := loginTestSession(t, s, "bob", "secret2")
+	bob.send(shared.Message{Type: shared.MessageTypeCommand, Content: "block alice"})
+	bob.expect("SUCCESS: Blocked alice")
+
+	// Bob is online but looks like carol, who is offline
+	for _, name := range []string{"bob", "carol"} {
+		alice.send(shared.Message{Type: shared.MessageTypeDirect, Recipient: name, Content: "hi"})
+		alice.expect("ERROR: " + name + " is offline")
+	}
+	alice.send(shared.Message{Type: shared.MessageTypeCommand, Content: "msg bob hi"})
+	alice.expect("ERROR: bob is offline")
+	alice.send(shared.Message{Type: shared.MessageTypeDirect, Recipient: "dave", Content: "hi"})
+	alice.expect("ERROR: User not found: dave")
+
+	// Last seen when the block was made, not never
+	alice.send(shared.Message{Type: shared.MessageTypeCommand, Content: "whois bob"})
+	alice.expect("SUCCESS: bob is offline, last seen")
+
+	data := testFileData()
+	uploadID := alice.uploadTestFile(s, "notes.txt", "bob", data)
+	for chunkID := 0; chunkID < shared.ChunkCount(int64(len(data)), shared.MinChunkSize); chunkID++ {
+		alice.sendChunk(uploadID, chunkID, data)
+	}
+	alice.expect("SUCCESS: File notes.txt queued until bob logs in")
+	if files := s.Files.List(directTarget("alice", "bob")); len(files) != 0 || s.Files.UploaderUsage("alice") != 0 {
+		t.Fatalf("file for bob stored: %+v", files)
+	}
+	if entries, _ := os.ReadDir(s.PartialUploadsDir()); len(entries) > 0 {
+		t.Fatalf("upload for bob left behind: %s", entries[0].Name())
+	}
+
+	// A group with bob takes the message, which bob never gets
+	alice.send(shared.Message{Type: shared.MessageTypeCommand, Content: "gmsg bob,carol hello group"})
+	alice.expect("hello group")
+	bob.send(shared.Message{Type: shared.MessageTypeCommand, Content: "blocked"})
+	for line := range bob.lines {
+		if line == "hello group" {
+			t.Fatal("bob got a group message from alice, whom bob blocks")
+		}
+		if strings.HasPrefix(line, "SUCCESS: Blocked users") {
+			break
+		}
+	}
+}
+
+func TestBlockKeepsLastSeen(t *testing.T) {
+	cb := NewContactBook(filepath.Join(t.TempDir(), "contacts.json"))
+	seen := time.Date(2026, 1, 2, 3, 4, 0, 0, time.UTC)
+	cb.Block("bob", "alice", seen)
+
+	cb.RenameUser("alice", "alicia")
+	if lastSeen, blocked := cb.BlockedSeen("bob", "alicia"); !blocked || !lastSeen.Equal(seen) {
+		t.Fatalf("after rename: blocked %v, last seen %v", blocked, lastSeen)
+	}
+
+	cb.RenameUser("bob", "robert")
+	reloaded := NewContactBook(cb.path)
+	if lastSeen, blocked := reloaded.BlockedSeen("robert", "alicia"); !blocked || !lastSeen.Equal(seen) {
+		t.Fatalf("after reload: blocked %v, last seen %v", blocked, lastSeen)
+	}
+
+	reloaded.Unblock("robert", "alicia")
+	if _, ok := reloaded.lists["robert"]; ok {
+		t.Fatal("empty contact list kept after unblocking")
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"chatap.com/shared"
+)
+
+// maxHeldMessages limits the DMs and mentions held for one busy user. Older
+// ones are dropped from the replay but still counted in the summary.
+const maxHeldMessages = 500
+
+// heldNotifications is what a busy user has not been shown yet
+type heldNotifications struct {
+	messages []shared.Message // DMs and mentions, oldest first
+	dropped  map[string]int   // Held messages over the limit, by kind
+	chatter  map[string]int   // Other room messages, by room
+	replied  map[string]bool  // Senders who already got the auto-reply
+}
+
+// DoNotDisturb holds notifications for busy users until they leave busy. Held
+// notifications are kept in memory only; DMs and room messages are in the
+// history anyway.
+type DoNotDisturb struct {
+	mu   sync.Mutex
+	held map[string]*heldNotifications
+}
+
+func NewDoNotDisturb() *DoNotDisturb {
+	return &DoNotDisturb{held: make(map[string]*heldNotifications)}
+}
+
+func (d *DoNotDisturb) get(username string) *heldNotifications {
+	held, ok := d.held[username]
+	if !ok {
+		held = &heldNotifications{
+			dropped: make(map[string]int),
+			chatter: make(map[string]int),
+			replied: make(map[string]bool),
+		}
+		d.held[username] = held
+	}
+	return held
+}
+
+// Hold keeps a DM or mention for a busy user
+func (d *DoNotDisturb) Hold(username string, msg shared.Message) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	held := d.get(username)
+	if len(held.messages) >= maxHeldMessages {
+		held.dropped[heldKind(held.messages[0])]++
+		held.messages = held.messages[1:]
+	}
+	held.messages = append(held.messages, msg)
+}
+
+// Skip counts a room message a busy user was not shown
+func (d *DoNotDisturb) Skip(username, room string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.get(username).chatter[room]++
+}
+
+// ShouldReply reports whether sender still needs the auto-reply from a busy
+// user. Each sender gets it once until the user leaves busy.
+func (d *DoNotDisturb) ShouldReply(username, sender string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	held := d.get(username)
+	if held.replied[sender] {
+		return false
+	}
+	held.replied[sender] = true
+	return true
+}
+
+// Release returns and forgets everything held for a user, or nil
+func (d *DoNotDisturb) Release(username string) *heldNotifications {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	held := d.held[username]
+	delete(d.held, username)
+	return held
+}
+
+// RenameUser moves what is held for a user to a new name
+func (d *DoNotDisturb) RenameUser(oldName, newName string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if held, ok := d.held[oldName]; ok {
+		d.held[newName] = held
+		delete(d.held, oldName)
+	}
+}
+
+// heldKind names what a held message is in the summary
+func heldKind(msg shared.Message) string {
+	if msg.Group != "" {
+		return "messages in group " + msg.Group
+	}
+	if msg.Room != "" {
+		return "mentions in " + msg.Room
+	}
+	return "direct messages from " + msg.Sender
+}
+
+// summary describes held notifications, e.g. "2 direct messages from alice,
+// 3 mentions in general, 14 other messages in general (see /history)"
+func (h *heldNotifications) summary() string {
+	counts := make(map[string]int)
+	for kind, count := range h.dropped {
+		counts[kind] += count
+	}
+	for _, msg := range h.messages {
+		counts[heldKind(msg)]++
+	}
+	for room, count := range h.chatter {
+		counts["other messages in "+room+" (see /history)"] += count
+	}
+	if len(counts) == 0 {
+		return ""
+	}
+
+	kinds := make([]string, 0, len(counts))
+	for kind := range counts {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+
+	parts := make([]string, len(kinds))
+	for i, kind := range kinds {
+		parts[i] = fmt.Sprintf("%d %s", counts[kind], kind)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// mentions reports whether content mentions @username as a whole name
+func mentions(content, username string) bool {
+	if username == "" {
+		return false
+	}
+
+	mention := "@" + username
+	for start := 0; ; {
+		i := strings.Index(content[start:], mention)
+		if i < 0 {
+			return false
+		}
+		end := start + i + len(mention)
+		if end == len(content) || !isNameByte(content[end]) {
+			return true
+		}
+		start = end
+	}
+}
+
+// isNameByte reports whether b can be part of a username
+func isNameByte(b byte) bool {
+	return b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z' || b >= '0' && b <= '9' || b == '-' || b == '_'
+}
+
+// deliverDirect sends a direct message to every session of its recipient, or
+// holds it while the recipient is busy and sends the sender an auto-reply.
+// Urgent messages always get through.
+func (c *Client) deliverDirect(targets []*Client, msg shared.Message, msgBytes []byte) {
+	// Busy applies to all of a user's sessions at once
+	if msg.Urgent || !targets[0].dnd.Load() {
+		for _, target := range targets {
+			target.SendDirectMessage(msgBytes)
+		}
+		return
+	}
+
+	recipient := targets[0].Username()
+	c.Server.DND.Hold(recipient, msg)
+	log.Printf("Held direct message from %s for busy user %s", c.Username(), recipient)
+
+	if !c.Server.DND.ShouldReply(recipient, c.Username()) {
+		return
+	}
+	presence, _ := c.Server.Presence.Get(recipient)
+	reply := shared.Message{
+		Type: shared.MessageTypeDirect,
+		Content: fmt.Sprintf("[Auto-reply] I'm %s and will see your message later. Use /urgent %s <message> if it can't wait.",
+			presence.Describe(), recipient),
+		Sender:    recipient,
+		Recipient: c.Username(),
+		Timestamp: time.Now(),
+	}
+	replyBytes, _ := json.Marshal(reply)
+	c.SendDirectMessage(replyBytes)
+}
+
+// setDND turns holding notifications on or off for all of a user's clients
+func (s *Server) setDND(username string, on bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for client := range s.Clients {
+		if client.Username() == username {
+			client.dnd.Store(on)
+		}
+	}
+}
+
+// releaseHeld sends every session of a user a summary of what was held while
+// they were busy, followed by the held DMs and mentions
+func (c *Client) releaseHeld() {
+	held := c.Server.DND.Release(c.Username())
+	if held == nil {
+		return
+	}
+
+	summary := held.summary()
+	if summary == "" {
+		return
+	}
+
+	notice := shared.Message{
+		Type:      shared.MessageTypeCommand,
+		Content:   "While you were busy: " + summary,
+		Sender:    "Server",
+		Timestamp: time.Now(),
+	}
+	noticeBytes, _ := json.Marshal(notice)
+	c.Server.SendToUser(c.Username(), noticeBytes)
+
+	for _, msg := range held.messages {
+		msgBytes, _ := json.Marshal(msg)
+		c.Server.SendToUser(c.Username(), msgBytes)
+	}
+	log.Printf("Released %d held messages for %s", len(held.messages), c.Username())
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"chatap.com/shared"
+)
+
+func TestMentions(t *testing.T) {
+	tests := []struct {
+		content string
+		want    bool
+	}{
+		{"@bob hi", true},
+		{"hi @bob", true},
+		{"hi @bob, how are you", true},
+		{"hi @bobby", false},
+		{"hi @bob_2", false},
+		{"@bobby and @bob", true},
+		{"bob", false},
+		{"mail bob@example.com", false},
+	}
+	for _, tt := range tests {
+		if got := mentions(tt.content, "bob"); got != tt.want {
+			t.Errorf("mentions(%q, bob) = %v", tt.content, got)
+		}
+	}
+	if mentions("@ hi", "") {
+		t.Error("empty username mentioned")
+	}
+}
+
+func TestHeldSummary(t *testing.T) {
+	d := NewDoNotDisturb()
+	d.Hold("bob", shared.Message{Sender: "alice"})
+	d.Hold("bob", shared.Message{Sender: "alice"})
+	d.Hold("bob", shared.Message{Sender: "carol", Room: "general"})
+	d.Skip("bob", "general")
+	d.Skip("bob", "general")
+
+	held := d.Release("bob")
+	want := "2 direct messages from alice, 1 mentions in general, 2 other messages in general (see /history)"
+	if got := held.summary(); got != want {
+		t.Fatalf("summary = %q, want %q", got, want)
+	}
+	if d.Release("bob") != nil {
+		t.Fatal("held notifications not forgotten on release")
+	}
+}
+
+func TestHeldMessagesOverLimitAreCounted(t *testing.T) {
+	d := NewDoNotDisturb()
+	for i := 0; i < maxHeldMessages+2; i++ {
+		d.Hold("bob", shared.Message{Sender: "alice", Content: fmt.Sprint(i)})
+	}
+
+	held := d.Release("bob")
+	if len(held.messages) != maxHeldMessages || held.messages[0].Content != "2" {
+		t.Fatalf("kept %d messages starting with %q", len(held.messages), held.messages[0].Content)
+	}
+	want := fmt.Sprintf("%d direct messages from alice", maxHeldMessages+2)
+	if got := held.summary(); got != want {
+		t.Fatalf("summary = %q, want %q", got, want)
+	}
+}
+
+func TestBusyHoldsDirectMessagesUntilReleased(t *testing.T) {
+	s := newTestServer(t)
+	go s.handleChannels()
+	defer close(s.quit)
+	s.AuthManager.RegisterUser("alice", "secret1")
+	s.AuthManager.RegisterUser("bob", "secret2")
+
+	alice := loginTestSession(t, s, "alice", "secret1")
+	bob := loginTestSession(t, s, "bob", "secret2")
+	bob.send(shared.Message{Type: shared.MessageTypeCommand, Content: "status busy"})
+	bob.expect("SUCCESS: Status updated to: busy")
+
+	alice.send(shared.Message{Type: shared.MessageTypeDirect, Recipient: "bob", Content: "first"})
+	alice.expect("[Auto-reply] I'm busy")
+	alice.send(shared.Message{Type: shared.MessageTypeDirect, Recipient: "bob", Content: "second"})
+	alice.send(shared.Message{Type: shared.MessageTypeDirect, Recipient: "bob", Content: "now", Urgent: true})
+	bob.expect("now")
+
+	bob.send(shared.Message{Type: shared.MessageTypeCommand, Content: "status online"})
+	bob.expect("While you were busy: 2 direct messages from alice")
+	bob.expect("first")
+	bob.expect("second")
+}
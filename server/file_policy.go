@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"chatap.com/shared"
+)
+
+// FilePolicyConfig limits what may be uploaded. Zero sizes mean no limit;
+// empty allow lists allow everything not denied.
+type FilePolicyConfig struct {
+	MaxFileBytes   int64 `json:"maxFileBytes"`
+	UserQuotaBytes int64 `json:"userQuotaBytes"`
+	RoomQuotaBytes int64 `json:"roomQuotaBytes"`
+
+	// Extensions such as ".png", compared case-insensitively
+	AllowedExtensions []string `json:"allowedExtensions"`
+	DeniedExtensions  []string `json:"deniedExtensions"`
+	// Content types sniffed from the first bytes, matched by prefix (e.g. "image/")
+	AllowedContentTypes []string `json:"allowedContentTypes"`
+	DeniedContentTypes  []string `json:"deniedContentTypes"`
+}
+
+func DefaultFilePolicyConfig() FilePolicyConfig {
+	return FilePolicyConfig{
+		MaxFileBytes:        100 << 20,
+		UserQuotaBytes:      1 << 30,
+		RoomQuotaBytes:      5 << 30,
+		AllowedExtensions:   []string{},
+		DeniedExtensions:    []string{".exe", ".bat", ".cmd", ".com", ".scr", ".msi", ".ps1", ".vbs"},
+		AllowedContentTypes: []string{},
+		DeniedContentTypes:  []string{},
+	}
+}
+
+// checkName applies the extension lists to a file name
+func (p FilePolicyConfig) checkName(name string) error {
+	ext := strings.ToLower(filepath.Ext(name))
+
+	for _, denied := range p.DeniedExtensions {
+		if strings.EqualFold(ext, denied) {
+			return fmt.Errorf("%s files are not allowed", ext)
+		}
+	}
+
+	if len(p.AllowedExtensions) == 0 {
+		return nil
+	}
+	for _, allowed := range p.AllowedExtensions {
+		if strings.EqualFold(ext, allowed) {
+			return nil
+		}
+	}
+	return fmt.Errorf("only %s files are allowed", strings.Join(p.AllowedExtensions, ", "))
+}
+
+// sniffContentType returns the content type of a file from its first bytes,
+// without parameters such as the charset
+func sniffContentType(head []byte) string {
+	contentType := http.DetectContentType(head)
+	if i := strings.Index(contentType, ";"); i >= 0 {
+		contentType = contentType[:i]
+	}
+	return contentType
+}
+
+// checkContent sniffs the content type from the start of a file and applies
+// the content type lists
+func (p FilePolicyConfig) checkContent(head []byte) error {
+	return p.checkContentType(sniffContentType(head))
+}
+
+// checkContentType applies the content type lists to a sniffed content type
+func (p FilePolicyConfig) checkContentType(contentType string) error {
+	for _, denied := range p.DeniedContentTypes {
+		if strings.HasPrefix(contentType, denied) {
+			return fmt.Errorf("%s content is not allowed", contentType)
+		}
+	}
+
+	if len(p.AllowedContentTypes) == 0 {
+		return nil
+	}
+	for _, allowed := range p.AllowedContentTypes {
+		if strings.HasPrefix(contentType, allowed) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s content is not allowed", contentType)
+}
+
+// checkSize applies the file size limit
+func (p FilePolicyConfig) checkSize(size int64) error {
+	if p.MaxFileBytes > 0 && size > p.MaxFileBytes {
+		return fmt.Errorf("file is %s, the limit is %s", shared.FormatSize(size), shared.FormatSize(p.MaxFileBytes))
+	}
+	return nil
+}
+
+// storageUsage returns the bytes stored and reserved by unfinished uploads for
+// a user and a room. The upload with ID exclude is not counted.
+func (s *Server) storageUsage(username, room, exclude string) (userBytes, roomBytes int64) {
+	userBytes = s.Files.UploaderUsage(username)
+	roomBytes = s.Files.RoomUsage(room)
+
+	reservedUser, reservedRoom := s.Uploads.Reserved(username, room, exclude)
+	return userBytes + reservedUser, roomBytes + reservedRoom
+}
+
+// checkUpload applies the file policy and quotas to an upload of info by
+// username into room. uploadID names an existing session to leave out of the
+// usage, or is empty for a new upload.
+func (s *Server) checkUpload(username, room, uploadID string, info shared.UploadInfo) error {
+	policy := s.Config().Files
+
+	if err := policy.checkSize(info.Size); err != nil {
+		return err
+	}
+	if err := policy.checkName(info.Filename); err != nil {
+		return err
+	}
+
+	userBytes, roomBytes := s.storageUsage(username, room, uploadID)
+	if policy.UserQuotaBytes > 0 && userBytes+info.Size > policy.UserQuotaBytes {
+		return fmt.Errorf("your storage quota would be exceeded (%s of %s used)",
+			shared.FormatSize(userBytes), shared.FormatSize(policy.UserQuotaBytes))
+	}
+	if policy.RoomQuotaBytes > 0 && !isDirectTarget(room) && roomBytes+info.Size > policy.RoomQuotaBytes {
+		return fmt.Errorf("room %s's storage quota would be exceeded (%s of %s used)",
+			room, shared.FormatSize(roomBytes), shared.FormatSize(policy.RoomQuotaBytes))
+	}
+
+	return nil
+}
+
+// quotaSummary describes the client's storage usage for the quota command
+func (c *Client) quotaSummary() string {
+	policy := c.Server.Config().Files
+	limit := func(bytes int64) string {
+		if bytes <= 0 {
+			return "unlimited"
+		}
+		return shared.FormatSize(bytes)
+	}
+
+	stored, files := c.Server.Files.UploaderFiles(c.Username())
+	reserved, _ := c.Server.Uploads.Reserved(c.Username(), "", "")
+	lines := []string{
+		fmt.Sprintf("Your storage: %s of %s (%d files, %s in unfinished uploads)",
+			shared.FormatSize(stored+reserved), limit(policy.UserQuotaBytes), files, shared.FormatSize(reserved)),
+	}
+
+	if room := c.Room(); room != nil {
+		_, roomBytes := c.Server.storageUsage(c.Username(), room.Name, "")
+		lines = append(lines, fmt.Sprintf("Room %s: %s of %s",
+			room.Name, shared.FormatSize(roomBytes), limit(policy.RoomQuotaBytes)))
+	}
+
+	lines = append(lines, "Largest file: "+limit(policy.MaxFileBytes))
+	return strings.Join(lines, "\n")
+}
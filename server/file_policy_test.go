@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+
+	"chatap.com/shared"
+)
+
+// Uploads are checked under the name they are stored as, so tricks that hide
+// an extension behind a path or a NUL byte do not get past the policy
+func TestFilePolicyChecksSanitizedName(t *testing.T) {
+	policy := DefaultFilePolicyConfig()
+	tests := []struct {
+		name    string
+		allowed bool
+	}{
+		{"notes.txt", true},
+		{"../../notes.txt", true},
+		{"/tmp/../run.exe", false},
+		{`..\..\Windows\run.EXE`, false},
+		{`C:\Users\bob\run.exe`, false},
+		{"photo.jpg\x00.exe", false},
+		{"run.exe\x00", false},
+		{"run.exe. . ", false},
+		{"run.exe:stream", true},
+	}
+	for _, tt := range tests {
+		name, err := shared.SanitizeFilename(tt.name)
+		if err != nil {
+			t.Errorf("SanitizeFilename(%q): %v", tt.name, err)
+			continue
+		}
+		if err := policy.checkName(name); (err == nil) != tt.allowed {
+			t.Errorf("checkName(%q) from %q: %v", name, tt.name, err)
+		}
+	}
+}
@@ -0,0 +1,746 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"chatap.com/shared"
+)
+
+// fileIndexName is the per-room index kept next to the room's files
+const fileIndexName = ".files.json"
+
+// directFilesDir holds one storage area per direct conversation. Room names
+// cannot contain '@', so it never clashes with a room.
+const directFilesDir = "@dm"
+
+// directPairSeparator joins the two users of a direct conversation's storage
+// area. Usernames cannot contain it, so no two pairs share an area.
+const directPairSeparator = "+"
+
+// directTarget returns the storage area for files between two users
+func directTarget(user1, user2 string) string {
+	if user2 < user1 {
+		user1, user2 = user2, user1
+	}
+	return directFilesDir + "/" + user1 + directPairSeparator + user2
+}
+
+func isDirectTarget(target string) bool {
+	return strings.HasPrefix(target, directFilesDir+"/")
+}
+
+// FileRecord describes a file stored in a room. Its content is the blob named
+// by Hash, so the same file shared in several places is stored once.
+type FileRecord struct {
+	ID         string    `json:"id"`
+	Name       string    `json:"name"`
+	Uploader   string    `json:"uploader"`
+	Size       int64     `json:"size"`
+	Hash       string    `json:"hash"`
+	UploadedAt time.Time `json:"uploaded_at"`
+
+	Meta *shared.FileMeta `json:"meta,omitempty"` // Missing for files stored before previews
+}
+
+// describe returns the size and a summary of the content, e.g. for announcements
+func (record FileRecord) describe() string {
+	if record.Meta == nil || record.Meta.ContentType == "" {
+		return shared.FormatSize(record.Size)
+	}
+	return shared.FormatSize(record.Size) + ", " + record.Meta.Summary()
+}
+
+// FileIndex keeps the list of files stored in each room. Indexes are loaded
+// from disk the first time a room is used. The records are the references to
+// the blob store: a blob is deleted when the last record naming it goes.
+type FileIndex struct {
+	mu      sync.Mutex
+	dir     string
+	blobs   *BlobStore
+	rooms   map[string][]FileRecord
+	scanned bool // Every room directory has been loaded
+}
+
+func NewFileIndex(uploadsDir string) *FileIndex {
+	return &FileIndex{
+		dir:   uploadsDir,
+		blobs: NewBlobStore(filepath.Join(uploadsDir, blobsDir)),
+		rooms: make(map[string][]FileRecord),
+	}
+}
+
+func newFileID() (string, error) {
+	buf := make([]byte, 4)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// Path returns where a stored file's content lives on disk
+func (fi *FileIndex) Path(record FileRecord) string {
+	return fi.blobs.Path(record.Hash)
+}
+
+// Stored reports whether content with the given hash and size is already kept
+func (fi *FileIndex) Stored(hash string, size int64) bool {
+	return fi.blobs.Has(hash, size)
+}
+
+// ProveStored answers a possession challenge from the stored content
+func (fi *FileIndex) ProveStored(hash string, challenge shared.ProofChallenge) (string, error) {
+	return shared.ProveChunk(fi.blobs.Path(hash), challenge)
+}
+
+// load returns a room's records, reading the index on first use. Files that
+// were stored before the room had an index are added with an unknown uploader,
+// and files kept in the room's directory are moved into the blob store.
+// The caller must hold fi.mu.
+func (fi *FileIndex) load(room string) []FileRecord {
+	if records, ok := fi.rooms[room]; ok {
+		return records
+	}
+
+	records := make([]FileRecord, 0)
+	indexPath := filepath.Join(fi.dir, room, fileIndexName)
+	data, err := os.ReadFile(indexPath)
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(data, &records); err != nil {
+			log.Printf("Error parsing file index %s: %v", indexPath, err)
+		}
+	case os.IsNotExist(err):
+		records = fi.scan(room)
+	default:
+		log.Printf("Error reading file index %s: %v", indexPath, err)
+	}
+
+	fi.rooms[room] = records
+	if err != nil && len(records) > 0 {
+		log.Printf("Indexed %d existing files in room %s", len(records), room)
+		fi.save(room)
+	}
+	fi.adopt(room, records)
+	return records
+}
+
+// adopt moves files stored in a room's directory by earlier versions into the
+// blob store. The caller must hold fi.mu.
+func (fi *FileIndex) adopt(room string, records []FileRecord) {
+	moved := 0
+	for _, record := range records {
+		loosePath := filepath.Join(fi.dir, room, record.Name)
+		if info, err := os.Lstat(loosePath); err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+
+		if err := fi.blobs.Put(loosePath, record.Hash); err != nil {
+			log.Printf("Error moving %s in room %s to the blob store: %v", record.Name, room, err)
+			continue
+		}
+		moved++
+	}
+
+	if moved > 0 {
+		log.Printf("Moved %d files in room %s to the blob store", moved, room)
+	}
+}
+
+// scan builds records for the files already in a room's directory
+func (fi *FileIndex) scan(room string) []FileRecord {
+	records := make([]FileRecord, 0)
+
+	entries, err := os.ReadDir(filepath.Join(fi.dir, room))
+	if err != nil {
+		return records
+	}
+
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		hash, size, err := shared.HashFile(filepath.Join(fi.dir, room, entry.Name()))
+		if err != nil {
+			log.Printf("Error hashing %s in room %s: %v", entry.Name(), room, err)
+			continue
+		}
+		id, err := newFileID()
+		if err != nil {
+			continue
+		}
+
+		records = append(records, FileRecord{
+			ID:         id,
+			Name:       entry.Name(),
+			Uploader:   "unknown",
+			Size:       size,
+			Hash:       hash,
+			UploadedAt: info.ModTime(),
+		})
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].UploadedAt.Before(records[j].UploadedAt)
+	})
+	return records
+}
+
+// save writes a room's index. The caller must hold fi.mu.
+func (fi *FileIndex) save(room string) {
+	data, err := json.MarshalIndent(fi.rooms[room], "", "  ")
+	if err != nil {
+		log.Printf("Error serializing file index for room %s: %v", room, err)
+		return
+	}
+
+	indexPath := filepath.Join(fi.dir, room, fileIndexName)
+	if err := os.MkdirAll(filepath.Dir(indexPath), 0755); err != nil {
+		log.Printf("Error creating directory for file index %s: %v", indexPath, err)
+		return
+	}
+
+	// Write to a temporary file and rename it so a crash never leaves a truncated index
+	tmpPath := indexPath + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		log.Printf("Error writing file index %s: %v", indexPath, err)
+		return
+	}
+	if err := os.Rename(tmpPath, indexPath); err != nil {
+		log.Printf("Error replacing file index %s: %v", indexPath, err)
+	}
+}
+
+// Add records a file in a room and returns the record with its ID and final
+// name assigned. The content is moved into the blob store from tmpPath, which
+// must match record.Hash; with an empty tmpPath the blob must already be
+// stored. A name already used in the room gets a " (2)" style suffix.
+func (fi *FileIndex) Add(room string, record FileRecord, tmpPath string) (FileRecord, error) {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+
+	records := fi.load(room)
+
+	for record.ID == "" || fi.hasID(records, record.ID) {
+		id, err := newFileID()
+		if err != nil {
+			return record, err
+		}
+		record.ID = id
+	}
+
+	name := record.Name
+	for n := 1; fi.hasName(records, record.Name); n++ {
+		record.Name = shared.CandidateFilename(name, n)
+	}
+
+	if tmpPath != "" {
+		if err := fi.blobs.Put(tmpPath, record.Hash); err != nil {
+			return record, err
+		}
+	} else if !fi.blobs.Has(record.Hash, record.Size) {
+		return record, fmt.Errorf("content of %s is no longer stored", record.Name)
+	}
+	if record.Meta == nil {
+		record.Meta = fi.meta(record.Hash)
+	}
+
+	fi.rooms[room] = append(records, record)
+	fi.save(room)
+
+	return record, nil
+}
+
+func (fi *FileIndex) hasID(records []FileRecord, id string) bool {
+	for _, record := range records {
+		if record.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (fi *FileIndex) hasName(records []FileRecord, name string) bool {
+	for _, record := range records {
+		if record.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Remove deletes a room's file by ID or name and returns its record. The blob
+// is deleted too once no room or conversation refers to it.
+func (fi *FileIndex) Remove(room, nameOrID string) (FileRecord, bool) {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+
+	records := fi.load(room)
+	index := fi.indexOf(records, nameOrID)
+	if index < 0 {
+		return FileRecord{}, false
+	}
+	record := records[index]
+
+	kept := make([]FileRecord, 0, len(records)-1)
+	kept = append(kept, records[:index]...)
+	fi.rooms[room] = append(kept, records[index+1:]...)
+	fi.save(room)
+	fi.release(room, record)
+
+	return record, true
+}
+
+// release deletes the blob of a removed record once nothing refers to it. The
+// caller must hold fi.mu.
+func (fi *FileIndex) release(room string, record FileRecord) {
+	if fi.references(record.Hash) > 0 {
+		return
+	}
+	if err := fi.blobs.Remove(record.Hash); err != nil {
+		log.Printf("Error removing blob %s: %v", record.Hash, err)
+	} else {
+		log.Printf("Removed blob %s, its last reference was %s in %s", record.Hash, record.Name, room)
+	}
+}
+
+// ReplaceUploader attributes every file uploaded by oldName to newName
+func (fi *FileIndex) ReplaceUploader(oldName, newName string) {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+
+	fi.loadAll()
+	for room, records := range fi.rooms {
+		changed := false
+		for i := range records {
+			if records[i].Uploader == oldName {
+				records[i].Uploader = newName
+				changed = true
+			}
+		}
+		if changed {
+			fi.save(room)
+		}
+	}
+}
+
+// RemoveUploads deletes every file uploaded by a user
+func (fi *FileIndex) RemoveUploads(username string) int {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+
+	fi.loadAll()
+	removed := make(map[string][]FileRecord)
+	for room, records := range fi.rooms {
+		kept := make([]FileRecord, 0, len(records))
+		for _, record := range records {
+			if record.Uploader == username {
+				removed[room] = append(removed[room], record)
+				continue
+			}
+			kept = append(kept, record)
+		}
+		if len(removed[room]) > 0 {
+			fi.rooms[room] = kept
+			fi.save(room)
+		}
+	}
+
+	count := 0
+	for room, records := range removed {
+		for _, record := range records {
+			fi.release(room, record)
+			count++
+		}
+	}
+	return count
+}
+
+// MoveArea moves the files of one storage area into another, for example
+// when a direct conversation changes hands. Names already used in the
+// destination get a " (2)" style suffix.
+func (fi *FileIndex) MoveArea(from, to string) {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+
+	moving := fi.load(from)
+	if len(moving) == 0 {
+		return
+	}
+	records := fi.load(to)
+	for _, record := range moving {
+		var err error
+		if records, err = fi.merge(records, record); err != nil {
+			log.Printf("Error moving %s to %s: %v", record.Name, to, err)
+			return
+		}
+	}
+	fi.rooms[to] = records
+	fi.save(to)
+
+	delete(fi.rooms, from)
+	if err := os.RemoveAll(filepath.Join(fi.dir, from)); err != nil {
+		log.Printf("Error removing storage area %s: %v", from, err)
+	}
+}
+
+// merge adds a record moved from another area, giving it a new ID or name if
+// either is already taken. The caller must hold fi.mu.
+func (fi *FileIndex) merge(records []FileRecord, record FileRecord) ([]FileRecord, error) {
+	for fi.hasID(records, record.ID) {
+		id, err := newFileID()
+		if err != nil {
+			return records, err
+		}
+		record.ID = id
+	}
+	name := record.Name
+	for n := 1; fi.hasName(records, record.Name); n++ {
+		record.Name = shared.CandidateFilename(name, n)
+	}
+	return append(records, record), nil
+}
+
+// RemoveArea deletes a storage area and the files in it
+func (fi *FileIndex) RemoveArea(target string) {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+
+	records := fi.load(target)
+	delete(fi.rooms, target)
+	if err := os.RemoveAll(filepath.Join(fi.dir, target)); err != nil {
+		log.Printf("Error removing storage area %s: %v", target, err)
+	}
+	for _, record := range records {
+		fi.release(target, record)
+	}
+}
+
+// meta returns the metadata recorded for a blob by any room or conversation.
+// The caller must hold fi.mu.
+func (fi *FileIndex) meta(hash string) *shared.FileMeta {
+	fi.loadAll()
+
+	for _, records := range fi.rooms {
+		for _, record := range records {
+			if record.Hash == hash && record.Meta != nil {
+				return record.Meta
+			}
+		}
+	}
+	return nil
+}
+
+// Thumbnail returns the path of an image file's thumbnail, drawing it the
+// first time it is asked for
+func (fi *FileIndex) Thumbnail(record FileRecord) (string, error) {
+	thumbPath := fi.blobs.ThumbnailPath(record.Hash)
+	if thumbPath == "" {
+		return "", fmt.Errorf("invalid hash for %s", record.Name)
+	}
+	if _, err := os.Stat(thumbPath); err == nil {
+		return thumbPath, nil
+	}
+
+	if err := writeThumbnail(fi.blobs.Path(record.Hash), thumbPath); err != nil {
+		return "", err
+	}
+	return thumbPath, nil
+}
+
+// references counts the records in every room and conversation that refer to
+// a blob. The caller must hold fi.mu.
+func (fi *FileIndex) references(hash string) int {
+	fi.loadAll()
+
+	count := 0
+	for _, records := range fi.rooms {
+		for _, record := range records {
+			if record.Hash == hash {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+// List returns the files stored in a room, oldest first
+func (fi *FileIndex) List(room string) []FileRecord {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+
+	records := fi.load(room)
+	return append([]FileRecord(nil), records...)
+}
+
+// Find looks up a room's file by ID or, failing that, by name
+func (fi *FileIndex) Find(room, nameOrID string) (FileRecord, bool) {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+
+	records := fi.load(room)
+	if index := fi.indexOf(records, nameOrID); index >= 0 {
+		return records[index], true
+	}
+	return FileRecord{}, false
+}
+
+// indexOf finds a record by ID or, failing that, by name
+func (fi *FileIndex) indexOf(records []FileRecord, nameOrID string) int {
+	for i, record := range records {
+		if record.ID == nameOrID {
+			return i
+		}
+	}
+	for i := len(records) - 1; i >= 0; i-- {
+		if records[i].Name == nameOrID {
+			return i
+		}
+	}
+	return -1
+}
+
+// loadAll loads the index of every room directory. The caller must hold fi.mu.
+func (fi *FileIndex) loadAll() {
+	if fi.scanned {
+		return
+	}
+
+	entries, err := os.ReadDir(fi.dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if entry.IsDir() && shared.ValidateRoomName(entry.Name()) == nil {
+			fi.load(entry.Name())
+		}
+	}
+
+	conversations, _ := os.ReadDir(filepath.Join(fi.dir, directFilesDir))
+	for _, entry := range conversations {
+		if entry.IsDir() {
+			fi.load(directFilesDir + "/" + entry.Name())
+		}
+	}
+
+	fi.scanned = true
+}
+
+// UploaderFiles returns the total size and number of files a user has stored
+// across all rooms
+func (fi *FileIndex) UploaderFiles(username string) (int64, int) {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+
+	fi.loadAll()
+
+	var total int64
+	count := 0
+	for _, records := range fi.rooms {
+		for _, record := range records {
+			if record.Uploader == username {
+				total += record.Size
+				count++
+			}
+		}
+	}
+	return total, count
+}
+
+// UploaderUsage returns the bytes a user has stored across all rooms
+func (fi *FileIndex) UploaderUsage(username string) int64 {
+	total, _ := fi.UploaderFiles(username)
+	return total
+}
+
+// RoomUsage returns the bytes stored in a room
+func (fi *FileIndex) RoomUsage(room string) int64 {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+
+	var total int64
+	for _, record := range fi.load(room) {
+		total += record.Size
+	}
+	return total
+}
+
+// fileSummary describes the files stored in a room for the files command
+func (c *Client) fileSummary(room *Room) string {
+	records := c.Server.Files.List(room.Name)
+	if len(records) == 0 {
+		return "No files in room " + room.Name
+	}
+
+	lines := make([]string, 0, len(records))
+	for _, record := range records {
+		lines = append(lines, fmt.Sprintf("  %s  %s  %s  by %s at %s  sha256:%s",
+			record.ID, record.Name, record.describe(), record.Uploader,
+			record.UploadedAt.Format("2006-01-02 15:04"), record.Hash))
+	}
+	return fmt.Sprintf("Files in room %s (%d):\n%s", room.Name, len(records), strings.Join(lines, "\n"))
+}
+
+// fileTarget parses the "<name|id>" or "@<username> <name|id>" argument of the
+// file commands into a storage area, the file to look up there and a
+// description of the area. It replies with an error and returns ok false when
+// the argument is unusable.
+func (c *Client) fileTarget(cmd, args string) (target, nameOrID, place string, ok bool) {
+	usage := fmt.Sprintf("Usage: %s <name|id> or %s @<username> <name|id>", cmd, cmd)
+
+	if strings.HasPrefix(args, "@") {
+		fields := strings.SplitN(args, " ", 2)
+		other := strings.TrimPrefix(fields[0], "@")
+		// Files from deleted users stay with their partner when they are anonymized
+		if len(fields) < 2 || other != deletedUser && shared.ValidateUsername(other) != nil {
+			c.sendError(usage)
+			return "", "", "", false
+		}
+		target = directTarget(c.Username(), other)
+		nameOrID = strings.TrimSpace(fields[1])
+		place = "your conversation with " + other
+	} else {
+		room := c.Room()
+		if room == nil {
+			c.sendError("You are not in a room. Join a room first.")
+			return "", "", "", false
+		}
+		target = room.Name
+		nameOrID = args
+		place = "room " + target
+	}
+	if nameOrID == "" {
+		c.sendError(usage)
+		return "", "", "", false
+	}
+
+	return target, nameOrID, place, true
+}
+
+// handleDownload streams a stored file back to the client in chunks. Files
+// from a direct conversation are addressed as "@user <name|id>".
+func (c *Client) handleDownload(args string) {
+	target, nameOrID, place, ok := c.fileTarget("download", args)
+	if !ok {
+		return
+	}
+
+	record, ok := c.Server.Files.Find(target, nameOrID)
+	if !ok {
+		c.sendError("File not found in " + place + ": " + nameOrID)
+		return
+	}
+
+	c.sendSuccess(fmt.Sprintf("Downloading %s (%s)", record.Name, shared.FormatSize(record.Size)))
+	log.Printf("User %s downloading %s from %s", c.Username(), record.Name, target)
+
+	go c.streamFile(target, record)
+}
+
+// handleDeleteFile removes a stored file. Only its uploader or an admin may
+// delete it.
+func (c *Client) handleDeleteFile(args string) {
+	target, nameOrID, place, ok := c.fileTarget("delfile", args)
+	if !ok {
+		return
+	}
+
+	record, ok := c.Server.Files.Find(target, nameOrID)
+	if !ok {
+		c.sendError("File not found in " + place + ": " + nameOrID)
+		return
+	}
+	if record.Uploader != c.Username() && !c.Server.AuthManager.IsAdmin(c.Username()) {
+		c.sendError("Only " + record.Uploader + " or an admin can delete " + record.Name)
+		return
+	}
+
+	// Look the file up by ID so a same-named upload in between is left alone
+	if _, ok := c.Server.Files.Remove(target, record.ID); !ok {
+		c.sendError("File not found in " + place + ": " + nameOrID)
+		return
+	}
+
+	c.Server.Metrics.Inc("files.deleted")
+	log.Printf("User %s deleted %s (id %s) from %s", c.Username(), record.Name, record.ID, target)
+	c.sendSuccess(fmt.Sprintf("Deleted %s from %s", record.Name, place))
+}
+
+// sendDirectFile tells the client about a file sent to it and streams it
+func (c *Client) sendDirectFile(target string, record FileRecord) {
+	notice := shared.Message{
+		Type:      shared.MessageTypeDirect,
+		Content:   fmt.Sprintf("sent you a file: %s (%s, id %s)", record.Name, record.describe(), record.ID),
+		Sender:    record.Uploader,
+		Recipient: c.Username(),
+		Timestamp: record.UploadedAt,
+	}
+	noticeBytes, _ := json.Marshal(notice)
+	c.SendDirectMessage(noticeBytes)
+
+	go c.streamFile(target, record)
+}
+
+// streamFile queues a file's chunks for the client, waiting whenever the send
+// queue is half full so that downloads never trip the slow-consumer policy
+func (c *Client) streamFile(target string, record FileRecord) {
+	transferID, err := newUploadID()
+	if err != nil {
+		log.Printf("Download of %s by %s failed: %v", record.Name, c.Username(), err)
+		return
+	}
+
+	// Chunks of a direct file carry no room
+	room := target
+	if isDirectTarget(target) {
+		room = ""
+	}
+
+	filePath := c.Server.Files.Path(record)
+	config := c.Server.Config()
+	err = shared.StreamFileChunks(filePath, config.ChunkSize, nil, func(chunk shared.FileMessage) error {
+		for c.queue.pending() > config.SendQueue.MaxBytes/2 {
+			select {
+			case <-time.After(20 * time.Millisecond):
+			case <-c.Server.quit:
+				return ErrServerClosed
+			}
+		}
+
+		chunk.UploadID = transferID
+		chunk.Filename = record.Name // The blob is named after its hash
+		chunk.Sender = record.Uploader
+		chunk.Room = room
+		chunk.Hash = record.Hash
+
+		frame, err := shared.EncodeFrame(chunk, config.CompressChunks)
+		if err != nil {
+			return err
+		}
+		// A dropped chunk would spoil the whole file, so chunks are kept
+		if !c.EnqueueReliable(frame) {
+			return fmt.Errorf("connection closed")
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Download of %s by %s stopped: %v", record.Name, c.Username(), err)
+		return
+	}
+
+	c.Server.Metrics.Inc("files.downloads")
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"chatap.com/chatclient"
+)
+
+// storeTestFile stores data as a file uploaded by uploader to target
+func storeTestFile(t *testing.T, s *Server, target, name, uploader string, data []byte) FileRecord {
+	t.Helper()
+	tmpPath := filepath.Join(s.PartialUploadsDir(), name+".tmp")
+	if err := os.MkdirAll(s.PartialUploadsDir(), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(data)
+	record, err := s.Files.Add(target, FileRecord{
+		Name:       name,
+		Uploader:   uploader,
+		Size:       int64(len(data)),
+		Hash:       hex.EncodeToString(sum[:]),
+		UploadedAt: time.Now(),
+	}, tmpPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return record
+}
+
+// expectDownload waits for a file to arrive and returns its content
+func expectDownload(t *testing.T, chat *chatclient.Client) []byte {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case event := <-chat.Events():
+			switch event.Type {
+			case chatclient.EventFileSaved:
+				data, err := os.ReadFile(event.Path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return data
+			case chatclient.EventFileFailed:
+				t.Fatalf("download failed: %v", event.Err)
+			}
+		case <-timeout:
+			t.Fatal("no file arrived")
+		}
+	}
+}
+
+func TestFilesAreListedAndDownloadedFromRooms(t *testing.T) {
+	s := newTestServer(t)
+	go s.handleChannels()
+	defer close(s.quit)
+	s.AuthManager.RegisterUser("alice", "secret1")
+	s.AuthManager.RegisterUser("bob", "secret2")
+	s.RoomManager.CreateRoom("general")
+	addr := serveTestListener(t, s)
+
+	// Bob joins long after the file was shared
+	data := testFileData()
+	record := storeTestFile(t, s, "general", "notes.txt", "alice", data)
+	bob := dialTestChat(t, addr, "bob", "secret2")
+	ctx := context.Background()
+
+	reply, err := bob.Command(ctx, "files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listing := reply.Text()
+	for _, want := range []string{"Files in room general (1):", record.ID, "notes.txt", "by alice", "sha256:" + record.Hash} {
+		if !strings.Contains(listing, want) {
+			t.Fatalf("listing lacks %q:\n%s", want, listing)
+		}
+	}
+
+	// By name and by ID
+	for _, nameOrID := range []string{"notes.txt", record.ID} {
+		if _, err := bob.Download(ctx, nameOrID); err != nil {
+			t.Fatalf("download %s: %v", nameOrID, err)
+		}
+		if got := expectDownload(t, bob); !bytes.Equal(got, data) {
+			t.Fatalf("download %s: got %d bytes", nameOrID, len(got))
+		}
+	}
+
+	var serverErr *chatclient.ServerError
+	if _, err := bob.Download(ctx, "missing.txt"); !errors.As(err, &serverErr) ||
+		serverErr.Message != "File not found in room general: missing.txt" {
+		t.Fatalf("download of a missing file: %v", err)
+	}
+	if _, err := bob.Leave(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bob.Command(ctx, "files"); !errors.As(err, &serverErr) {
+		t.Fatalf("files outside a room: %v", err)
+	}
+}
+
+func TestDirectFilesAreDownloadedByTheirPartners(t *testing.T) {
+	s := newTestServer(t)
+	go s.handleChannels()
+	defer close(s.quit)
+	s.AuthManager.RegisterUser("alice", "secret1")
+	s.AuthManager.RegisterUser("bob", "secret2")
+	s.AuthManager.RegisterUser("carol", "secret3")
+	s.RoomManager.CreateRoom("general")
+	addr := serveTestListener(t, s)
+
+	data := testFileData()
+	storeTestFile(t, s, directTarget("alice", "bob"), "memo.txt", "alice", data)
+	ctx := context.Background()
+
+	// Either partner names the other one
+	alice := dialTestChat(t, addr, "alice", "secret1")
+	bob := dialTestChat(t, addr, "bob", "secret2")
+	for chat, partner := range map[*chatclient.Client]string{alice: "bob", bob: "alice"} {
+		if _, err := chat.Download(ctx, "@"+partner+" memo.txt"); err != nil {
+			t.Fatalf("download from %s: %v", partner, err)
+		}
+		if got := expectDownload(t, chat); !bytes.Equal(got, data) {
+			t.Fatalf("download from %s: got %d bytes", partner, len(got))
+		}
+	}
+
+	// Nobody else finds it, nor is it in the room
+	carol := dialTestChat(t, addr, "carol", "secret3")
+	var serverErr *chatclient.ServerError
+	if _, err := carol.Download(ctx, "@alice memo.txt"); !errors.As(err, &serverErr) ||
+		serverErr.Message != "File not found in your conversation with alice: memo.txt" {
+		t.Fatalf("download by a third user: %v", err)
+	}
+	if _, err := bob.Download(ctx, "memo.txt"); !errors.As(err, &serverErr) {
+		t.Fatalf("direct file found in the room: %v", err)
+	}
+	if _, err := bob.Download(ctx, "@alice"); !errors.As(err, &serverErr) || !strings.HasPrefix(serverErr.Message, "Usage:") {
+		t.Fatalf("download without a file name: %v", err)
+	}
+}
+
+func TestBlobIsKeptWhileRecordsReferToIt(t *testing.T) {
+	s := newTestServer(t)
+	data := testFileData()
+	first := storeTestFile(t, s, "general", "notes.txt", "alice", data)
+	storeTestFile(t, s, "random", "copy.txt", "bob", data)
+	storeTestFile(t, s, directTarget("alice", "bob"), "notes.txt", "alice", data)
+	blob := s.Files.Path(first)
+
+	// A fresh index has to look in areas it has not loaded yet
+	files := NewFileIndex(s.Config().UploadsDir)
+	for _, area := range []string{"general", directTarget("alice", "bob")} {
+		if _, ok := files.Remove(area, "notes.txt"); !ok {
+			t.Fatalf("notes.txt not removed from %s", area)
+		}
+		if _, err := os.Stat(blob); err != nil {
+			t.Fatalf("blob removed while copy.txt refers to it: %v", err)
+		}
+	}
+
+	if _, ok := files.Remove("random", "copy.txt"); !ok {
+		t.Fatal("copy.txt not removed")
+	}
+	if _, err := os.Stat(blob); !os.IsNotExist(err) {
+		t.Fatalf("blob kept after its last record was removed: %v", err)
+	}
+	if files.Stored(first.Hash, first.Size) {
+		t.Fatal("removed blob still reported as stored")
+	}
+}
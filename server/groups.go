@@ -0,0 +1,465 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"chatap.com/shared"
+)
+
+// Group conversations are created with 3 to 10 members, the sender included.
+// The minimum only applies when a group is created: members may leave until
+// one is left, and that group is deleted.
+const (
+	minGroupMembers = 3
+	maxGroupMembers = 10
+)
+
+var (
+	ErrGroupNotFound = errors.New("group not found")
+	ErrGroupFull     = fmt.Errorf("a group has at most %d members", maxGroupMembers)
+)
+
+// Group is an ad-hoc conversation between a few users. Unlike a room it has
+// no name and only its members can see it.
+type Group struct {
+	ID        string    `json:"id"`
+	Members   []string  `json:"members"` // Sorted
+	CreatedBy string    `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// HasMember reports whether username belongs to the group
+func (g Group) HasMember(username string) bool {
+	i := sort.SearchStrings(g.Members, username)
+	return i < len(g.Members) && g.Members[i] == username
+}
+
+// GroupStore keeps every group conversation. It is saved after every change.
+type GroupStore struct {
+	mu     sync.Mutex
+	path   string
+	groups map[string]*Group
+}
+
+func NewGroupStore(path string) *GroupStore {
+	gs := &GroupStore{
+		path:   path,
+		groups: make(map[string]*Group),
+	}
+
+	data, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(data, &gs.groups); err != nil {
+			log.Printf("Error parsing groups %s: %v", path, err)
+		}
+	case !os.IsNotExist(err):
+		log.Printf("Error reading groups %s: %v", path, err)
+	}
+
+	return gs
+}
+
+func newGroupID() (string, error) {
+	buf := make([]byte, 4)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return "g" + hex.EncodeToString(buf), nil
+}
+
+// copyGroup returns a copy that callers may keep without holding gs.mu
+func copyGroup(g *Group) Group {
+	group := *g
+	group.Members = append([]string(nil), g.Members...)
+	return group
+}
+
+// Open returns the group with exactly these members, creating it if needed.
+// members must be sorted and include the creator.
+func (gs *GroupStore) Open(creator string, members []string) (Group, bool, error) {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+
+	for _, group := range gs.groups {
+		if strings.Join(group.Members, ",") == strings.Join(members, ",") {
+			return copyGroup(group), false, nil
+		}
+	}
+
+	id, err := newGroupID()
+	if err != nil {
+		return Group{}, false, err
+	}
+	group := &Group{
+		ID:        id,
+		Members:   append([]string(nil), members...),
+		CreatedBy: creator,
+		CreatedAt: time.Now(),
+	}
+	gs.groups[id] = group
+	gs.save()
+	return copyGroup(group), true, nil
+}
+
+// Get returns a group by ID
+func (gs *GroupStore) Get(id string) (Group, bool) {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+
+	group, ok := gs.groups[id]
+	if !ok {
+		return Group{}, false
+	}
+	return copyGroup(group), true
+}
+
+// AddMember adds a user to a group
+func (gs *GroupStore) AddMember(id, username string) (Group, error) {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+
+	group, ok := gs.groups[id]
+	if !ok {
+		return Group{}, ErrGroupNotFound
+	}
+	if len(group.Members) >= maxGroupMembers {
+		return Group{}, ErrGroupFull
+	}
+
+	var added bool
+	group.Members, added = addName(group.Members, username)
+	if !added {
+		return Group{}, fmt.Errorf("%s is already a member", username)
+	}
+	gs.save()
+	return copyGroup(group), nil
+}
+
+// RemoveMember takes a user out of a group, however few members are left. A
+// group left with a single member is deleted; its history is kept.
+func (gs *GroupStore) RemoveMember(id, username string) (Group, bool) {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+
+	group, ok := gs.groups[id]
+	if !ok {
+		return Group{}, false
+	}
+
+	var removed bool
+	group.Members, removed = removeName(group.Members, username)
+	if !removed {
+		return Group{}, false
+	}
+	if len(group.Members) < 2 {
+		delete(gs.groups, id)
+	}
+	gs.save()
+	return copyGroup(group), true
+}
+
+// ForUser returns the groups a user belongs to, oldest first
+func (gs *GroupStore) ForUser(username string) []Group {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+
+	groups := make([]Group, 0)
+	for _, group := range gs.groups {
+		if group.HasMember(username) {
+			groups = append(groups, copyGroup(group))
+		}
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].CreatedAt.Before(groups[j].CreatedAt)
+	})
+	return groups
+}
+
+// RenameUser renames a user in the groups they belong to
+func (gs *GroupStore) RenameUser(oldName, newName string) {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+
+	for _, group := range gs.groups {
+		var removed bool
+		if group.Members, removed = removeName(group.Members, oldName); removed {
+			group.Members, _ = addName(group.Members, newName)
+		}
+		if group.CreatedBy == oldName {
+			group.CreatedBy = newName
+		}
+	}
+	gs.save()
+}
+
+// RemoveUser takes a deleted user out of every group and returns the groups
+// that still have members to tell. Groups left with a single member are
+// deleted, as with RemoveMember.
+func (gs *GroupStore) RemoveUser(username string) []Group {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+
+	remaining := make([]Group, 0)
+	for id, group := range gs.groups {
+		if group.CreatedBy == username {
+			group.CreatedBy = deletedUser
+		}
+		var removed bool
+		if group.Members, removed = removeName(group.Members, username); !removed {
+			continue
+		}
+		if len(group.Members) < 2 {
+			delete(gs.groups, id)
+			continue
+		}
+		remaining = append(remaining, copyGroup(group))
+	}
+	gs.save()
+	return remaining
+}
+
+// save writes the groups. The caller must hold gs.mu.
+func (gs *GroupStore) save() {
+	data, err := json.MarshalIndent(gs.groups, "", "  ")
+	if err != nil {
+		log.Printf("Error serializing groups: %v", err)
+		return
+	}
+
+	if err := os.MkdirAll(filepath.Dir(gs.path), 0755); err != nil {
+		log.Printf("Error creating groups directory: %v", err)
+		return
+	}
+
+	// Write to a temporary file and rename it so a crash never leaves a truncated file
+	tmpPath := gs.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		log.Printf("Error writing groups %s: %v", gs.path, err)
+		return
+	}
+	if err := os.Rename(tmpPath, gs.path); err != nil {
+		log.Printf("Error replacing groups %s: %v", gs.path, err)
+	}
+}
+
+// memberGroup returns a group the client belongs to. Other groups are
+// reported as not found.
+func (c *Client) memberGroup(id string) (Group, bool) {
+	group, ok := c.Server.Groups.Get(id)
+	if !ok || !group.HasMember(c.Username()) {
+		c.sendError("Group not found: " + id)
+		return Group{}, false
+	}
+	return group, true
+}
+
+// openGroup finds or creates the group of the client and a comma-separated
+// list of other users
+func (c *Client) openGroup(list string) (Group, bool) {
+	members := []string{c.Username()}
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" || name == c.Username() {
+			continue
+		}
+		// Users who block the sender are let in like anyone else, so the
+		// sender cannot tell; sendGroupMessage drops what they would get
+		if !c.Server.AuthManager.UserExists(name) {
+			c.sendError("User not found: " + name)
+			return Group{}, false
+		}
+		members, _ = addName(members, name)
+	}
+
+	if len(members) < minGroupMembers || len(members) > maxGroupMembers {
+		c.sendError(fmt.Sprintf("A group needs %d to %d members, including you", minGroupMembers, maxGroupMembers))
+		return Group{}, false
+	}
+
+	group, created, err := c.Server.Groups.Open(c.Username(), members)
+	if err != nil {
+		log.Printf("Error creating group for %s: %v", c.Username(), err)
+		c.sendError("Could not create group: " + err.Error())
+		return Group{}, false
+	}
+	if created {
+		log.Printf("User %s created group %s with %s", c.Username(), group.ID, strings.Join(group.Members, ", "))
+	}
+	return group, true
+}
+
+// sendGroupMessage stores a message in a group's history and delivers it to
+// every session of every member, queueing it for members who are offline
+func (s *Server) sendGroupMessage(group Group, msg shared.Message) {
+	msg.Type = shared.MessageTypeGroup
+	msg.Group = group.ID
+	msg.Timestamp = time.Now()
+	s.MessageStore.AddGroupMessage(group.ID, msg)
+
+	msgBytes, _ := json.Marshal(msg)
+	for _, member := range group.Members {
+		if member != msg.Sender && s.Contacts.Blocks(member, msg.Sender) {
+			continue
+		}
+
+		clients := s.ClientsOf(member)
+		switch {
+		case len(clients) == 0:
+			queued := msg
+			s.Mailbox.Add(member, MailItem{Kind: MailGroupMessage, From: msg.Sender, Target: group.ID, Message: &queued})
+		case clients[0].dnd.Load() && !msg.Urgent && member != msg.Sender:
+			s.DND.Hold(member, msg)
+		default:
+			for _, client := range clients {
+				client.SendDirectMessage(msgBytes)
+			}
+		}
+	}
+}
+
+// groupNotice records a membership change in a group's history and tells its
+// members
+func (s *Server) groupNotice(group Group, content string) {
+	s.sendGroupMessage(group, shared.Message{Content: content, Sender: "Server"})
+}
+
+// handleGroupCommand handles group conversation commands
+func (c *Client) handleGroupCommand(cmd string, msg shared.Message) {
+	content := msg.Content
+	switch cmd {
+	case "gmsg":
+		parts := strings.SplitN(content, " ", 3)
+		if len(parts) < 3 || strings.TrimSpace(parts[2]) == "" {
+			c.sendError("Usage: gmsg <user1,user2,...|group-id> <message>")
+			return
+		}
+
+		var group Group
+		var ok bool
+		if strings.Contains(parts[1], ",") {
+			group, ok = c.openGroup(parts[1])
+		} else if _, exists := c.Server.Groups.Get(parts[1]); !exists && c.Server.AuthManager.UserExists(parts[1]) {
+			c.sendError(fmt.Sprintf("A group needs %d to %d members, including you. Use msg to message one user",
+				minGroupMembers, maxGroupMembers))
+			return
+		} else {
+			group, ok = c.memberGroup(parts[1])
+		}
+		if !ok {
+			return
+		}
+
+		c.Server.sendGroupMessage(group, shared.Message{
+			Content:    parts[2],
+			Sender:     c.Username(),
+			SenderID:   c.UserID,
+			Bot:        c.IsBot,
+			SenderName: c.Server.Profiles.DisplayName(c.Username()),
+			Urgent:     msg.Urgent,
+		})
+		log.Printf("Group message from %s to %s", c.Username(), group.ID)
+
+	case "groups":
+		groups := c.Server.Groups.ForUser(c.Username())
+		if len(groups) == 0 {
+			c.sendSuccess("You are not in any group. Start one with gmsg <user1,user2> <message>")
+			return
+		}
+		lines := make([]string, len(groups))
+		for i, group := range groups {
+			lines[i] = fmt.Sprintf("  %s: %s", group.ID, c.Server.describeUsers(group.Members))
+		}
+		c.sendSuccess(fmt.Sprintf("Groups (%d):\n%s", len(groups), strings.Join(lines, "\n")))
+
+	case "ghistory":
+		args := strings.Fields(content)
+		if len(args) < 2 {
+			c.sendError("Usage: ghistory <group-id>")
+			return
+		}
+		group, ok := c.memberGroup(args[1])
+		if !ok {
+			return
+		}
+
+		history := c.Server.MessageStore.GetGroupHistory(group.ID)
+		if len(history) == 0 {
+			c.sendSuccess("No message history for group: " + group.ID)
+			return
+		}
+		start := 0
+		if count := c.Server.Config().HistoryCount; len(history) > count {
+			start = len(history) - count
+		}
+
+		historyMsg := shared.Message{
+			Type:      shared.MessageTypeCommand,
+			Content:   "Message history for group " + group.ID + ":",
+			Sender:    "Server",
+			Timestamp: time.Now(),
+			RequestID: c.requestID(),
+		}
+		historyBytes, _ := json.Marshal(historyMsg)
+		c.EnqueueReliable(historyBytes)
+
+		for _, item := range history[start:] {
+			c.sendHistoryItem(item)
+		}
+
+	case "gadd":
+		args := strings.Fields(content)
+		if len(args) < 3 {
+			c.sendError("Usage: gadd <group-id> <username>")
+			return
+		}
+		group, ok := c.memberGroup(args[1])
+		if !ok {
+			return
+		}
+
+		username := args[2]
+		// As in openGroup, a user who blocks the sender is added all the same
+		if !c.Server.AuthManager.UserExists(username) {
+			c.sendError("User not found: " + username)
+			return
+		}
+		group, err := c.Server.Groups.AddMember(group.ID, username)
+		if err != nil {
+			c.sendError("Could not add " + username + ": " + err.Error())
+			return
+		}
+
+		log.Printf("User %s added %s to group %s", c.Username(), username, group.ID)
+		c.Server.groupNotice(group, c.Username()+" added "+username+" to the group")
+
+	case "gleave":
+		args := strings.Fields(content)
+		if len(args) < 2 {
+			c.sendError("Usage: gleave <group-id>")
+			return
+		}
+		group, ok := c.memberGroup(args[1])
+		if !ok {
+			return
+		}
+
+		group, _ = c.Server.Groups.RemoveMember(group.ID, c.Username())
+		log.Printf("User %s left group %s", c.Username(), group.ID)
+		c.sendSuccess("Left group " + group.ID)
+		if len(group.Members) > 1 {
+			c.Server.groupNotice(group, c.Username()+" left the group")
+		}
+	}
+}
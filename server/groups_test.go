@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"chatap.com/chatclient"
+	"chatap.com/shared"
+)
+
+func TestGroupMessagesWaitForOfflineMembers(t *testing.T) {
+	s := newTestServer(t)
+	go s.handleChannels()
+	defer close(s.quit)
+	s.AuthManager.RegisterUser("alice", "secret1")
+	s.AuthManager.RegisterUser("bob", "secret2")
+	s.AuthManager.RegisterUser("carol", "secret3")
+
+	alice := loginTestSession(t, s, "alice", "secret1")
+	bob := loginTestSession(t, s, "bob", "secret2")
+	alice.send(shared.Message{Type: shared.MessageTypeCommand, Content: "gmsg bob,carol first"})
+	alice.send(shared.Message{Type: shared.MessageTypeCommand, Content: "gmsg bob,carol second"})
+	bob.expect("first")
+	bob.expect("second")
+
+	queued := func() int {
+		s.Mailbox.mu.Lock()
+		defer s.Mailbox.mu.Unlock()
+		return len(s.Mailbox.items["carol"])
+	}
+	if n := queued(); n != 2 {
+		t.Fatalf("%d messages queued for the offline member", n)
+	}
+
+	// Both arrive in order at the next login, and only once
+	carol := loginTestSession(t, s, "carol", "secret3")
+	carol.expect("first")
+	carol.expect("second")
+	if n := queued(); n != 0 {
+		t.Fatalf("%d messages still queued after login", n)
+	}
+}
+
+func TestGroupHistoryIsTypedAndGroupsShrink(t *testing.T) {
+	s := newTestServer(t)
+	go s.handleChannels()
+	defer close(s.quit)
+	for _, name := range []string{"alice", "bob", "carol", "dave"} {
+		s.AuthManager.RegisterUser(name, "secret1")
+	}
+	s.RoomManager.CreateRoom("general")
+	addr := serveTestListener(t, s)
+	ctx := context.Background()
+
+	alice := dialTestChat(t, addr, "alice", "secret1")
+	bob := dialTestChat(t, addr, "bob", "secret1")
+	for _, text := range []string{"first", "ERROR: not really"} {
+		if _, err := alice.GroupMessage(ctx, "bob,carol", text); err != nil {
+			t.Fatal(err)
+		}
+	}
+	id := s.Groups.ForUser("alice")[0].ID
+
+	messages, err := bob.GroupHistory(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 2 || messages[1].Content != "ERROR: not really" {
+		t.Fatalf("history: %+v", messages)
+	}
+	for _, msg := range messages {
+		if msg.Type != shared.MessageTypeHistory || msg.Group != id || msg.Sender != "alice" {
+			t.Fatalf("history item %+v", msg)
+		}
+	}
+
+	dave := dialTestChat(t, addr, "dave", "secret1")
+	var serverErr *chatclient.ServerError
+	if _, err := dave.GroupHistory(ctx, id); !errors.As(err, &serverErr) || serverErr.Message != "Group not found: "+id {
+		t.Fatalf("history of another group: %v", err)
+	}
+
+	// Members may leave below the size a group is created with, until one is left
+	if _, err := bob.Command(ctx, "gleave "+id); err != nil {
+		t.Fatal(err)
+	}
+	if group, ok := s.Groups.Get(id); !ok || len(group.Members) != 2 {
+		t.Fatalf("after one member left: %+v, %v", group, ok)
+	}
+	kept := len(s.MessageStore.GetGroupHistory(id))
+	if _, err := alice.Command(ctx, "gleave "+id); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.Groups.Get(id); ok {
+		t.Fatal("group with a single member kept")
+	}
+	if len(s.MessageStore.GetGroupHistory(id)) != kept {
+		t.Fatal("history of the deleted group was not kept")
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"chatap.com/shared"
+)
+
+// isHeartbeat reports whether a message only keeps the connection alive and
+// so does not count as user activity
+func isHeartbeat(messageType int) bool {
+	return messageType == shared.MessageTypePing || messageType == shared.MessageTypePong
+}
+
+// heartbeatLoop pings every connection so idle but healthy clients keep
+// answering within the read timeout, and moves inactive users to away
+func (s *Server) heartbeatLoop() {
+	for {
+		select {
+		case <-time.After(s.Config().PingInterval()):
+			s.heartbeat()
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+func (s *Server) heartbeat() {
+	s.mu.Lock()
+	clients := make([]*Client, 0, len(s.Clients))
+	for client := range s.Clients {
+		clients = append(clients, client)
+	}
+	s.mu.Unlock()
+
+	ping := shared.Message{
+		Type:      shared.MessageTypePing,
+		Sender:    "Server",
+		Timestamp: time.Now(),
+	}
+	pingBytes, _ := json.Marshal(ping)
+
+	awayAfter := s.Config().AwayAfter()
+	for _, client := range clients {
+		client.EnqueueControl(pingBytes)
+
+		if awayAfter > 0 && client.loggedIn.Load() && client.IdleFor() >= awayAfter {
+			client.markIdle()
+		}
+	}
+}
+
+// IdleFor returns how long ago the client last sent anything but a heartbeat
+func (c *Client) IdleFor() time.Duration {
+	return time.Since(time.Unix(0, c.lastActive.Load()))
+}
+
+// markIdle marks the client idle and switches its user to away once all their
+// sessions are idle
+func (c *Client) markIdle() {
+	if !c.idle.CompareAndSwap(false, true) {
+		return
+	}
+	// The user is away only once all their sessions are idle
+	for _, client := range c.Server.ClientsOf(c.Username()) {
+		if !client.idle.Load() {
+			return
+		}
+	}
+
+	if presence, changed := c.Server.Presence.MarkIdle(c.Username()); changed {
+		log.Printf("User %s is now away after %v of inactivity", c.Username(), c.IdleFor().Round(time.Second))
+		c.Server.announcePresence(c.Username(), presence.Describe())
+	}
+}
+
+// markActive records activity and brings a user who went away automatically
+// back online
+func (c *Client) markActive() {
+	c.lastActive.Store(time.Now().UnixNano())
+
+	if !c.idle.CompareAndSwap(true, false) || !c.loggedIn.Load() {
+		return
+	}
+
+	if presence, changed := c.Server.Presence.MarkActive(c.Username()); changed {
+		log.Printf("User %s is active again", c.Username())
+		c.Server.announcePresence(c.Username(), presence.Describe())
+	}
+}
+
+// answerPing replies to a client's heartbeat
+func (c *Client) answerPing() {
+	pong := shared.Message{
+		Type:      shared.MessageTypePong,
+		Sender:    "Server",
+		Timestamp: time.Now(),
+	}
+	pongBytes, _ := json.Marshal(pong)
+	c.EnqueueControl(pongBytes)
+}
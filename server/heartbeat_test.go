@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"chatap.com/shared"
+)
+
+func TestSilentConnectionsTimeOut(t *testing.T) {
+	s := newTestServer(t)
+	config := *s.Config()
+	config.ReadTimeoutSeconds = 1
+	s.config.Store(&config)
+	go s.handleChannels()
+	defer close(s.quit)
+
+	conn, peer := net.Pipe()
+	t.Cleanup(func() { peer.Close() })
+	client := NewClient(conn, s)
+	if !s.register(client) {
+		t.Fatal("server refused the client")
+	}
+	go client.ReadPump()
+	go client.WritePump()
+
+	received := make(chan shared.Message, 16)
+	go func() {
+		defer close(received)
+		scanner := bufio.NewScanner(peer)
+		for scanner.Scan() {
+			var msg shared.Message
+			json.Unmarshal(scanner.Bytes(), &msg)
+			received <- msg
+		}
+	}()
+	pong, _ := json.Marshal(shared.Message{Type: shared.MessageTypePong})
+	pong = append(pong, '\n')
+
+	// Answering the server's pings keeps the connection open past the read
+	// timeout, though it is no activity
+	for deadline := time.Now().Add(1500 * time.Millisecond); time.Now().Before(deadline); {
+		s.heartbeat()
+		select {
+		case msg := <-received:
+			if msg.Type != shared.MessageTypePing {
+				t.Fatalf("got %+v, want a ping", msg)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("no ping")
+		}
+		if _, err := peer.Write(pong); err != nil {
+			t.Fatalf("connection dropped while answering pings: %v", err)
+		}
+		time.Sleep(300 * time.Millisecond)
+	}
+	if idle := client.IdleFor(); idle < time.Second {
+		t.Fatalf("idle for %v after only answering pings", idle)
+	}
+
+	// Silence drops it
+	timeout := time.After(3 * time.Second)
+	for open := true; open; {
+		select {
+		case _, open = <-received:
+		case <-timeout:
+			t.Fatal("silent connection was not dropped")
+		}
+	}
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+		s.mu.Lock()
+		registered := s.Clients[client]
+		s.mu.Unlock()
+		if !registered {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out client is still registered")
+		}
+	}
+}
+
+// makeIdle backdates a session's last activity
+func (ts *testSession) makeIdle(d time.Duration) {
+	ts.client.lastActive.Store(time.Now().Add(-d).UnixNano())
+}
+
+func TestInactiveUsersGoAway(t *testing.T) {
+	s := newTestServer(t)
+	go s.handleChannels()
+	defer close(s.quit)
+	s.AuthManager.RegisterUser("alice", "secret1")
+	s.AuthManager.RegisterUser("bob", "secret2")
+	awayAfter := s.Config().AwayAfter()
+
+	bob := loginTestSession(t, s, "bob", "secret2")
+	bob.send(shared.Message{Type: shared.MessageTypeCommand, Content: "watch alice"})
+	bob.expect("SUCCESS: Watching alice")
+	alice := loginTestSession(t, s, "alice", "secret1")
+	other := loginTestSession(t, s, "alice", "secret1")
+	bob.expect("alice is now online")
+
+	// Alice is away only once both sessions are idle
+	alice.makeIdle(awayAfter)
+	s.heartbeat()
+	if presence, _ := s.Presence.Get("alice"); presence.Status != shared.StatusOnline {
+		t.Fatalf("away with a session active: %s", presence.Describe())
+	}
+	other.makeIdle(awayAfter)
+	bob.makeIdle(awayAfter / 2)
+	s.heartbeat()
+	bob.expect("alice is now away")
+	if presence, _ := s.Presence.Get("bob"); presence.Status != shared.StatusOnline {
+		t.Fatalf("bob went away before the limit: %s", presence.Describe())
+	}
+
+	// Any session's activity brings alice back
+	other.send(shared.Message{Type: shared.MessageTypeCommand, Content: "list"})
+	bob.expect("alice is now online")
+
+	// A status alice chose is left alone
+	alice.send(shared.Message{Type: shared.MessageTypeCommand, Content: "status busy"})
+	bob.expect("alice is now busy")
+	alice.makeIdle(awayAfter)
+	other.makeIdle(awayAfter)
+	s.heartbeat()
+	if presence, _ := s.Presence.Get("alice"); presence.Status != shared.StatusBusy {
+		t.Fatalf("chosen status replaced by %s", presence.Describe())
+	}
+}
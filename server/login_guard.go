@@ -0,0 +1,210 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// AuthConfig configures brute-force protection, registration and account
+// deletion policy
+type AuthConfig struct {
+	// Failed logins tolerated before lockouts begin
+	MaxFailures int `json:"maxFailures"`
+	// Lockout grows exponentially from the base up to the max
+	LockoutBaseSeconds int `json:"lockoutBaseSeconds"`
+	LockoutMaxSeconds  int `json:"lockoutMaxSeconds"`
+	// Failure counters are forgotten after this long without a new failure
+	FailureResetSeconds int `json:"failureResetSeconds"`
+
+	// Registrations allowed per IP address
+	RegistrationLimit RateLimit `json:"registrationLimit"`
+	// One of "open", "invite" or "approval"
+	RegistrationMode string `json:"registrationMode"`
+	InviteValidHours int    `json:"inviteValidHours"`
+
+	// Sessions one user may have open at once, e.g. a laptop and a bot
+	MaxSessions int `json:"maxSessions"`
+
+	// What happens to a deleted account's direct messages and uploads:
+	// "anonymize" or "erase"
+	DeletionPolicy string `json:"deletionPolicy"`
+}
+
+const (
+	RegistrationOpen     = "open"
+	RegistrationInvite   = "invite"
+	RegistrationApproval = "approval"
+)
+
+const (
+	DeletionAnonymize = "anonymize" // Kept, attributed to deletedUser
+	DeletionErase     = "erase"     // Deleted
+)
+
+func DefaultAuthConfig() AuthConfig {
+	return AuthConfig{
+		MaxFailures:         5,
+		LockoutBaseSeconds:  30,
+		LockoutMaxSeconds:   3600,
+		FailureResetSeconds: 3600,
+		// Roughly five registrations per IP per hour
+		RegistrationLimit: RateLimit{Rate: 5.0 / 3600, Burst: 5},
+		RegistrationMode:  RegistrationOpen,
+		InviteValidHours:  7 * 24,
+		MaxSessions:       5,
+		DeletionPolicy:    DeletionAnonymize,
+	}
+}
+
+type failureRecord struct {
+	failures    int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+// LoginGuard tracks failed logins per account and per IP and throttles registrations
+type LoginGuard struct {
+	mu            sync.Mutex
+	config        AuthConfig
+	accounts      map[string]*failureRecord
+	ips           map[string]*failureRecord
+	registrations map[string]*TokenBucket
+}
+
+func NewLoginGuard(config AuthConfig) *LoginGuard {
+	return &LoginGuard{
+		config:        config,
+		accounts:      make(map[string]*failureRecord),
+		ips:           make(map[string]*failureRecord),
+		registrations: make(map[string]*TokenBucket),
+	}
+}
+
+// SetConfig applies new lockout and registration limits. Existing lockouts
+// and registration buckets are kept.
+func (lg *LoginGuard) SetConfig(config AuthConfig) {
+	lg.mu.Lock()
+	defer lg.mu.Unlock()
+	lg.config = config
+}
+
+// remoteIP extracts the IP part of a connection's remote address
+func remoteIP(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
+
+// LockedFor returns how long the account or IP remains locked out, or zero
+func (lg *LoginGuard) LockedFor(username, ip string) time.Duration {
+	lg.mu.Lock()
+	defer lg.mu.Unlock()
+
+	now := time.Now()
+	var wait time.Duration
+	for _, record := range []*failureRecord{lg.accounts[username], lg.ips[ip]} {
+		if record != nil && now.Before(record.lockedUntil) {
+			if remaining := record.lockedUntil.Sub(now); remaining > wait {
+				wait = remaining
+			}
+		}
+	}
+	return wait
+}
+
+// RecordFailure counts a failed login against both the account and the IP
+func (lg *LoginGuard) RecordFailure(username, ip string) {
+	lg.mu.Lock()
+	defer lg.mu.Unlock()
+
+	lg.recordFailure(lg.accounts, username)
+	lg.recordFailure(lg.ips, ip)
+}
+
+func (lg *LoginGuard) recordFailure(records map[string]*failureRecord, key string) {
+	now := time.Now()
+	record, ok := records[key]
+	if !ok || now.Sub(record.lastFailure) > time.Duration(lg.config.FailureResetSeconds)*time.Second {
+		record = &failureRecord{}
+		records[key] = record
+	}
+
+	record.failures++
+	record.lastFailure = now
+
+	if record.failures >= lg.config.MaxFailures {
+		// Double the lockout for every failure past the threshold
+		lockout := time.Duration(lg.config.LockoutBaseSeconds) * time.Second
+		maxLockout := time.Duration(lg.config.LockoutMaxSeconds) * time.Second
+		for i := lg.config.MaxFailures; i < record.failures && lockout < maxLockout; i++ {
+			lockout *= 2
+		}
+		if lockout > maxLockout {
+			lockout = maxLockout
+		}
+		record.lockedUntil = now.Add(lockout)
+	}
+}
+
+// RecordSuccess clears the account's failure counter. The IP counter is kept so
+// that a valid account cannot be used to reset guessing against others.
+func (lg *LoginGuard) RecordSuccess(username string) {
+	lg.mu.Lock()
+	defer lg.mu.Unlock()
+
+	delete(lg.accounts, username)
+}
+
+// AllowRegistration reports whether the IP may register another account
+func (lg *LoginGuard) AllowRegistration(ip string) bool {
+	lg.mu.Lock()
+	bucket, ok := lg.registrations[ip]
+	if !ok {
+		bucket = NewTokenBucket(lg.config.RegistrationLimit)
+		lg.registrations[ip] = bucket
+	}
+	lg.mu.Unlock()
+
+	return bucket.Allow(1)
+}
+
+// pruneLoop periodically drops failure records that have expired, until quit
+// is closed
+func (lg *LoginGuard) pruneLoop(interval time.Duration, quit <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			lg.prune()
+		case <-quit:
+			return
+		}
+	}
+}
+
+func (lg *LoginGuard) prune() {
+	lg.mu.Lock()
+	defer lg.mu.Unlock()
+
+	now := time.Now()
+	reset := time.Duration(lg.config.FailureResetSeconds) * time.Second
+	for _, records := range []map[string]*failureRecord{lg.accounts, lg.ips} {
+		for key, record := range records {
+			if now.After(record.lockedUntil) && now.Sub(record.lastFailure) > reset {
+				delete(records, key)
+			}
+		}
+	}
+
+	// A full registration bucket is indistinguishable from a new one
+	for ip, bucket := range lg.registrations {
+		if bucket.Allow(bucket.burst) {
+			delete(lg.registrations, ip)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"chatap.com/shared"
+)
+
+// Kinds of mailbox items
+const (
+	MailFile         = "file"  // A file sent with /sendfile
+	MailGroupMessage = "group" // A message in a group conversation
+)
+
+// MailItem is something held for a user until their next login
+type MailItem struct {
+	Kind     string          `json:"kind"`
+	From     string          `json:"from"`
+	Target   string          `json:"target,omitempty"`  // Storage area of a file
+	FileID   string          `json:"file_id,omitempty"` // File in that area
+	Message  *shared.Message `json:"message,omitempty"`
+	QueuedAt time.Time       `json:"queued_at"`
+}
+
+// Mailbox keeps deliveries for offline users. It is saved after every change.
+type Mailbox struct {
+	mu    sync.Mutex
+	path  string
+	items map[string][]MailItem // map[username][]MailItem
+}
+
+func NewMailbox(path string) *Mailbox {
+	mb := &Mailbox{
+		path:  path,
+		items: make(map[string][]MailItem),
+	}
+
+	data, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(data, &mb.items); err != nil {
+			log.Printf("Error parsing mailbox %s: %v", path, err)
+		}
+	case !os.IsNotExist(err):
+		log.Printf("Error reading mailbox %s: %v", path, err)
+	}
+
+	return mb
+}
+
+// Add queues an item for a user
+func (mb *Mailbox) Add(username string, item MailItem) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	if item.QueuedAt.IsZero() {
+		item.QueuedAt = time.Now()
+	}
+	mb.items[username] = append(mb.items[username], item)
+	mb.save()
+}
+
+// Take removes and returns everything queued for a user, oldest first
+func (mb *Mailbox) Take(username string) []MailItem {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	items := mb.items[username]
+	if len(items) == 0 {
+		return nil
+	}
+	delete(mb.items, username)
+	mb.save()
+	return items
+}
+
+// RenameUser moves a user's queued items to a new name and updates the items
+// they sent to others
+func (mb *Mailbox) RenameUser(oldName, newName string) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	if items, ok := mb.items[oldName]; ok {
+		mb.items[newName] = items
+		delete(mb.items, oldName)
+	}
+	mb.replaceSender(oldName, newName, false)
+	mb.save()
+}
+
+// RemoveUser drops a deleted user's queued items and attributes what they sent
+// to deletedUser. With erase the files they sent are dropped too, since they
+// are deleted.
+func (mb *Mailbox) RemoveUser(username string, erase bool) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	delete(mb.items, username)
+	mb.replaceSender(username, deletedUser, erase)
+	mb.save()
+}
+
+// replaceSender attributes the items sent by oldName to newName. Files live in
+// the conversation's storage area, which moves with the name. The caller must
+// hold mb.mu.
+func (mb *Mailbox) replaceSender(oldName, newName string, dropFiles bool) {
+	for recipient, items := range mb.items {
+		kept := items[:0]
+		for _, item := range items {
+			if item.Kind == MailFile {
+				switch {
+				case item.From == oldName && dropFiles:
+					continue
+				case item.From == oldName:
+					item.Target = directTarget(newName, recipient)
+				case item.Target == directTarget(item.From, oldName):
+					// Queued for oldName itself before a rename
+					item.Target = directTarget(item.From, newName)
+				}
+			}
+			if item.From == oldName {
+				item.From = newName
+			}
+			if item.Message != nil && item.Message.Sender == oldName {
+				queued := *item.Message
+				queued.Sender = newName
+				if newName == deletedUser {
+					queued.SenderID, queued.SenderName = "", ""
+				}
+				item.Message = &queued
+			}
+			kept = append(kept, item)
+		}
+		if len(kept) == 0 {
+			delete(mb.items, recipient)
+			continue
+		}
+		mb.items[recipient] = kept
+	}
+}
+
+// save writes the mailbox. The caller must hold mb.mu.
+func (mb *Mailbox) save() {
+	data, err := json.Marshal(mb.items)
+	if err != nil {
+		log.Printf("Error serializing mailbox: %v", err)
+		return
+	}
+
+	if err := os.MkdirAll(filepath.Dir(mb.path), 0755); err != nil {
+		log.Printf("Error creating mailbox directory: %v", err)
+		return
+	}
+
+	// Write to a temporary file and rename it so a crash never leaves a truncated mailbox
+	tmpPath := mb.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		log.Printf("Error writing mailbox %s: %v", mb.path, err)
+		return
+	}
+	if err := os.Rename(tmpPath, mb.path); err != nil {
+		log.Printf("Error replacing mailbox %s: %v", mb.path, err)
+	}
+}
+
+// deliverMail hands the client everything queued while it was offline
+func (c *Client) deliverMail() {
+	items := c.Server.Mailbox.Take(c.Username())
+	if len(items) == 0 {
+		return
+	}
+
+	log.Printf("Delivering %d queued items to %s", len(items), c.Username())
+	for _, item := range items {
+		switch item.Kind {
+		case MailFile:
+			record, ok := c.Server.Files.Find(item.Target, item.FileID)
+			if !ok {
+				log.Printf("Queued file %s for %s no longer exists", item.FileID, c.Username())
+				continue
+			}
+			c.sendDirectFile(item.Target, record)
+
+		case MailGroupMessage:
+			if item.Message == nil {
+				continue
+			}
+			msgBytes, _ := json.Marshal(item.Message)
+			c.SendDirectMessage(msgBytes)
+
+		default:
+			log.Printf("Unknown mailbox item kind %q for %s", item.Kind, c.Username())
+		}
+	}
+}
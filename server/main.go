@@ -1,15 +1,74 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
 )
 
 func main() {
-	server := NewServer(":8080")
+	loader, err := ParseFlags(os.Args[1:])
+	if err != nil {
+		os.Exit(2)
+	}
 
-	// Register some test users
-	server.AuthManager.RegisterUser("admin", "admin123")
-	server.AuthManager.RegisterUser("test", "test123")
+	config, err := loader.Load()
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	log.Fatal(server.Run())
+	if loader.PrintConfig {
+		data, _ := json.MarshalIndent(config, "", "  ")
+		fmt.Println(string(data))
+		return
+	}
+
+	server := NewServer(config)
+
+	// Register some test users on a fresh server
+	if server.AuthManager.UserCount() == 0 {
+		server.AuthManager.RegisterUser("admin", "admin123")
+		server.AuthManager.RegisterUser("test", "test123")
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- server.Run()
+	}()
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+
+	for {
+		select {
+		case err := <-errCh:
+			log.Fatal(err)
+
+		case sig := <-sigCh:
+			if sig == syscall.SIGHUP {
+				// Reload safe-to-change settings without dropping connections
+				newConfig, err := loader.Load()
+				if err != nil {
+					log.Printf("Config reload failed, keeping current settings: %v", err)
+					continue
+				}
+				server.ApplyConfig(newConfig)
+				continue
+			}
+
+			log.Printf("Received %v, shutting down", sig)
+
+			// Give clients and pending work a bounded amount of time
+			ctx, cancel := context.WithTimeout(context.Background(), server.Config().ShutdownTimeout())
+			if err := server.Shutdown(ctx); err != nil {
+				log.Printf("Shutdown did not complete cleanly: %v", err)
+			}
+			cancel()
+			return
+		}
+	}
 }
@@ -7,34 +7,35 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
 	"sync"
 	"time"
 
 	"chatap.com/shared"
 )
 
-const (
-	MessageHistoryDir = "message_history"
-)
-
 // MessageStore manages all message history for rooms and direct messages
 type MessageStore struct {
 	mu             sync.RWMutex
 	roomMessages   map[string][]shared.Message // map[roomName][]Message
 	directMessages map[string][]shared.Message // map[user1_user2][]Message
+	groupMessages  map[string][]shared.Message // map[groupID][]Message
 	server         *Server
+	dir            string
 }
 
-func NewMessageStore(server *Server) *MessageStore {
+func NewMessageStore(server *Server, dir string) *MessageStore {
 	// Create message history directory if it doesn't exist
-	if err := os.MkdirAll(MessageHistoryDir, 0755); err != nil {
+	if err := os.MkdirAll(dir, 0755); err != nil {
 		log.Printf("Failed to create message history directory: %v", err)
 	}
 
 	ms := &MessageStore{
 		roomMessages:   make(map[string][]shared.Message),
 		directMessages: make(map[string][]shared.Message),
+		groupMessages:  make(map[string][]shared.Message),
 		server:         server,
+		dir:            dir,
 	}
 
 	// Load existing message history
@@ -46,7 +47,7 @@ func NewMessageStore(server *Server) *MessageStore {
 // loadAllMessages loads all saved message history from files
 func (ms *MessageStore) loadAllMessages() {
 	// Load room messages
-	files, err := filepath.Glob(filepath.Join(MessageHistoryDir, "room_*.json"))
+	files, err := filepath.Glob(filepath.Join(ms.dir, "room_*.json"))
 	if err != nil {
 		log.Printf("Error searching for room history files: %v", err)
 		return
@@ -56,6 +57,10 @@ func (ms *MessageStore) loadAllMessages() {
 		// Extract room name from filename
 		roomName := filepath.Base(file)
 		roomName = roomName[5 : len(roomName)-5] // Remove "room_" prefix and ".json" suffix
+		if err := shared.ValidateRoomName(roomName); err != nil {
+			log.Printf("Skipping history file with invalid room name: %s", file)
+			continue
+		}
 
 		// Load messages
 		messages, err := ms.loadMessagesFromFile(file)
@@ -69,7 +74,7 @@ func (ms *MessageStore) loadAllMessages() {
 	}
 
 	// Load direct messages
-	files, err = filepath.Glob(filepath.Join(MessageHistoryDir, "dm_*.json"))
+	files, err = filepath.Glob(filepath.Join(ms.dir, "dm_*.json"))
 	if err != nil {
 		log.Printf("Error searching for direct message history files: %v", err)
 		return
@@ -90,6 +95,28 @@ func (ms *MessageStore) loadAllMessages() {
 		ms.directMessages[conversationKey] = messages
 		log.Printf("Loaded %d direct messages for conversation: %s", len(messages), conversationKey)
 	}
+
+	// Load group conversations
+	files, err = filepath.Glob(filepath.Join(ms.dir, "grp_*.json"))
+	if err != nil {
+		log.Printf("Error searching for group history files: %v", err)
+		return
+	}
+
+	for _, file := range files {
+		// Extract the group ID from the filename
+		groupID := filepath.Base(file)
+		groupID = groupID[4 : len(groupID)-5] // Remove "grp_" prefix and ".json" suffix
+
+		messages, err := ms.loadMessagesFromFile(file)
+		if err != nil {
+			log.Printf("Error loading group messages for %s: %v", groupID, err)
+			continue
+		}
+
+		ms.groupMessages[groupID] = messages
+		log.Printf("Loaded %d messages for group: %s", len(messages), groupID)
+	}
 }
 
 // loadMessagesFromFile loads messages from a JSON file
@@ -123,14 +150,47 @@ func (ms *MessageStore) saveMessagesToFile(filePath string, messages []shared.Me
 		return fmt.Errorf("error creating directory: %v", err)
 	}
 
-	// Write to file
-	if err := ioutil.WriteFile(filePath, data, 0644); err != nil {
+	// Write to a temporary file and rename it so a crash never leaves a truncated history
+	tmpPath := filePath + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, data, 0644); err != nil {
 		return fmt.Errorf("error writing file: %v", err)
 	}
+	if err := os.Rename(tmpPath, filePath); err != nil {
+		return fmt.Errorf("error replacing file: %v", err)
+	}
 
 	return nil
 }
 
+// Flush writes every room and direct message history to disk. It waits for
+// any write in progress to finish first.
+func (ms *MessageStore) Flush() error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	var firstErr error
+	for roomName, messages := range ms.roomMessages {
+		filePath := filepath.Join(ms.dir, fmt.Sprintf("room_%s.json", roomName))
+		if err := ms.saveMessagesToFile(filePath, messages); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	for key, messages := range ms.directMessages {
+		filePath := filepath.Join(ms.dir, fmt.Sprintf("dm_%s.json", key))
+		if err := ms.saveMessagesToFile(filePath, messages); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	for groupID, messages := range ms.groupMessages {
+		filePath := filepath.Join(ms.dir, fmt.Sprintf("grp_%s.json", groupID))
+		if err := ms.saveMessagesToFile(filePath, messages); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
 // AddRoomMessage adds a message to a room's history
 func (ms *MessageStore) AddRoomMessage(roomName string, msg shared.Message) {
 	ms.mu.Lock()
@@ -153,7 +213,7 @@ func (ms *MessageStore) AddRoomMessage(roomName string, msg shared.Message) {
 	ms.roomMessages[roomName] = append(ms.roomMessages[roomName], messageCopy)
 
 	// Save to file automatically
-	filePath := filepath.Join(MessageHistoryDir, fmt.Sprintf("room_%s.json", roomName))
+	filePath := filepath.Join(ms.dir, fmt.Sprintf("room_%s.json", roomName))
 	if err := ms.saveMessagesToFile(filePath, ms.roomMessages[roomName]); err != nil {
 		log.Printf("Error saving room message history for %s: %v", roomName, err)
 	}
@@ -197,7 +257,7 @@ func (ms *MessageStore) AddDirectMessage(sender, recipient string, msg shared.Me
 	ms.directMessages[key] = append(ms.directMessages[key], messageCopy)
 
 	// Save to file automatically
-	filePath := filepath.Join(MessageHistoryDir, fmt.Sprintf("dm_%s.json", key))
+	filePath := filepath.Join(ms.dir, fmt.Sprintf("dm_%s.json", key))
 	if err := ms.saveMessagesToFile(filePath, ms.directMessages[key]); err != nil {
 		log.Printf("Error saving direct message history for %s: %v", key, err)
 	}
@@ -220,9 +280,177 @@ func (ms *MessageStore) GetDirectMessageHistory(user1, user2 string) []shared.Me
 	return []shared.Message{}
 }
 
+// AddGroupMessage adds a message to a group conversation's history
+func (ms *MessageStore) AddGroupMessage(groupID string, msg shared.Message) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	messageCopy := msg
+	if messageCopy.Timestamp.IsZero() {
+		messageCopy.Timestamp = time.Now()
+	}
+	ms.groupMessages[groupID] = append(ms.groupMessages[groupID], messageCopy)
+
+	// Save to file automatically
+	filePath := filepath.Join(ms.dir, fmt.Sprintf("grp_%s.json", groupID))
+	if err := ms.saveMessagesToFile(filePath, ms.groupMessages[groupID]); err != nil {
+		log.Printf("Error saving group message history for %s: %v", groupID, err)
+	}
+}
+
+// GetGroupHistory returns all messages of a group conversation
+func (ms *MessageStore) GetGroupHistory(groupID string) []shared.Message {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	messages := ms.groupMessages[groupID]
+	result := make([]shared.Message, len(messages))
+	copy(result, messages)
+	return result
+}
+
+// DirectPartners returns the users a user has direct conversations with
+func (ms *MessageStore) DirectPartners(username string) []string {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	partners := make([]string, 0)
+	for key, messages := range ms.directMessages {
+		if partner, ok := conversationPartner(key, messages, username); ok {
+			partners = append(partners, partner)
+		}
+	}
+	sort.Strings(partners)
+	return partners
+}
+
 func getConversationKey(user1, user2 string) string {
 	if user1 < user2 {
 		return user1 + "_" + user2
 	}
 	return user2 + "_" + user1
 }
+
+// conversationPartner returns the other user of a direct conversation when
+// username takes part in it
+func conversationPartner(key string, messages []shared.Message, username string) (string, bool) {
+	for _, msg := range messages {
+		var partner string
+		switch username {
+		case msg.Sender:
+			partner = msg.Recipient
+		case msg.Recipient:
+			partner = msg.Sender
+		default:
+			continue
+		}
+		if getConversationKey(username, partner) == key {
+			return partner, true
+		}
+	}
+	return "", false
+}
+
+// replaceUser attributes a user's messages to newName and newID and reports
+// whether any changed. Messages stored before user IDs are matched by name. An
+// empty newID anonymizes the messages.
+func replaceUser(messages []shared.Message, id, oldName, newName, newID string) bool {
+	changed := false
+	for i := range messages {
+		msg := &messages[i]
+		if id != "" && msg.SenderID == id || msg.SenderID == "" && msg.Sender == oldName {
+			msg.Sender, msg.SenderID = newName, newID
+			if newID == "" {
+				msg.SenderName = ""
+			}
+			changed = true
+		}
+		if msg.Recipient == oldName {
+			msg.Recipient = newName
+			changed = true
+		}
+	}
+	return changed
+}
+
+// RenameUser attributes a renamed user's messages to their new name and moves
+// their direct conversations along. It returns the users they have direct
+// conversations with.
+func (ms *MessageStore) RenameUser(id, oldName, newName string) []string {
+	return ms.moveUser(id, oldName, newName, id, false)
+}
+
+// RemoveUser anonymizes a deleted user's messages. Their direct conversations
+// are attributed to deletedUser too, or deleted when erase is set. It returns
+// the users they had direct conversations with.
+func (ms *MessageStore) RemoveUser(id, username string, erase bool) []string {
+	return ms.moveUser(id, username, deletedUser, "", erase)
+}
+
+func (ms *MessageStore) moveUser(id, oldName, newName, newID string, dropDirect bool) []string {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	for roomName, messages := range ms.roomMessages {
+		if replaceUser(messages, id, oldName, newName, newID) {
+			filePath := filepath.Join(ms.dir, fmt.Sprintf("room_%s.json", roomName))
+			if err := ms.saveMessagesToFile(filePath, messages); err != nil {
+				log.Printf("Error saving room message history for %s: %v", roomName, err)
+			}
+		}
+	}
+	for groupID, messages := range ms.groupMessages {
+		if replaceUser(messages, id, oldName, newName, newID) {
+			filePath := filepath.Join(ms.dir, fmt.Sprintf("grp_%s.json", groupID))
+			if err := ms.saveMessagesToFile(filePath, messages); err != nil {
+				log.Printf("Error saving group message history for %s: %v", groupID, err)
+			}
+		}
+	}
+
+	// Find the conversations first, moving them adds new keys to the map
+	partners := make(map[string]string) // map[key]partner
+	for key, messages := range ms.directMessages {
+		if partner, ok := conversationPartner(key, messages, oldName); ok {
+			partners[key] = partner
+		}
+	}
+
+	names := make([]string, 0, len(partners))
+	for key, partner := range partners {
+		names = append(names, partner)
+		messages := ms.directMessages[key]
+		delete(ms.directMessages, key)
+
+		if !dropDirect {
+			replaceUser(messages, id, oldName, newName, newID)
+			if partner == oldName {
+				partner = newName
+			}
+			newKey := getConversationKey(newName, partner)
+			merged := messages
+			if existing := ms.directMessages[newKey]; len(existing) > 0 {
+				// Conversations with several deleted users end up together
+				merged = append(existing, messages...)
+				sort.SliceStable(merged, func(i, j int) bool {
+					return merged[i].Timestamp.Before(merged[j].Timestamp)
+				})
+			}
+			ms.directMessages[newKey] = merged
+
+			filePath := filepath.Join(ms.dir, fmt.Sprintf("dm_%s.json", newKey))
+			if err := ms.saveMessagesToFile(filePath, merged); err != nil {
+				log.Printf("Error saving direct message history for %s: %v", newKey, err)
+				continue // Keep the old file rather than lose the conversation
+			}
+		}
+
+		filePath := filepath.Join(ms.dir, fmt.Sprintf("dm_%s.json", key))
+		if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+			log.Printf("Error removing direct message history %s: %v", filePath, err)
+		}
+	}
+
+	sort.Strings(names)
+	return names
+}
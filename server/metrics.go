@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics holds simple named counters for server observability
+type Metrics struct {
+	mu       sync.Mutex
+	counters map[string]int64
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		counters: make(map[string]int64),
+	}
+}
+
+// Inc increments a counter by one
+func (m *Metrics) Inc(name string) {
+	m.Add(name, 1)
+}
+
+// Add increments a counter by n
+func (m *Metrics) Add(name string, n int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counters[name] += n
+}
+
+// Snapshot returns a copy of all counters
+func (m *Metrics) Snapshot() map[string]int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	result := make(map[string]int64, len(m.counters))
+	for name, value := range m.counters {
+		result[name] = value
+	}
+	return result
+}
+
+// String formats the counters as sorted "name=value" pairs
+func (m *Metrics) String() string {
+	snapshot := m.Snapshot()
+
+	names := make([]string, 0, len(snapshot))
+	for name := range snapshot {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		parts = append(parts, fmt.Sprintf("%s=%d", name, snapshot[name]))
+	}
+	return strings.Join(parts, " ")
+}
+
+// logPeriodically writes the counters to the log at the given interval, until
+// quit is closed
+func (m *Metrics) logPeriodically(interval time.Duration, quit <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if stats := m.String(); stats != "" {
+				log.Printf("Metrics: %s", stats)
+			}
+		case <-quit:
+			return
+		}
+	}
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"chatap.com/shared"
+)
+
+// Presence is a user's chosen availability. It is kept while the user is
+// offline, so it is restored when they log in again.
+type Presence struct {
+	Status     shared.UserStatus `json:"status"`
+	StatusText string            `json:"status_text,omitempty"`
+	LastSeen   time.Time         `json:"last_seen"`      // Last disconnect or change while invisible
+	Auto       bool              `json:"auto,omitempty"` // Set to away after inactivity, not by the user
+}
+
+// Describe returns the status with its custom text, e.g. "busy (in a meeting)"
+func (p Presence) Describe() string {
+	if p.StatusText == "" {
+		return p.Status.String()
+	}
+	return p.Status.String() + " (" + p.StatusText + ")"
+}
+
+// presenceFile is how presence is saved to disk
+type presenceFile struct {
+	Users    map[string]Presence `json:"users"`
+	Watchers map[string][]string `json:"watchers"` // map[watched user][]watcher
+}
+
+// PresenceService holds every user's presence and who watches whom. Presence
+// and subscriptions are saved after every change; connection counts are not.
+type PresenceService struct {
+	mu       sync.Mutex
+	path     string
+	users    map[string]Presence
+	watchers map[string]map[string]bool
+	sessions map[string]int // Open connections per user
+}
+
+func NewPresenceService(path string) *PresenceService {
+	ps := &PresenceService{
+		path:     path,
+		users:    make(map[string]Presence),
+		watchers: make(map[string]map[string]bool),
+		sessions: make(map[string]int),
+	}
+
+	data, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		var saved presenceFile
+		if err := json.Unmarshal(data, &saved); err != nil {
+			log.Printf("Error parsing presence %s: %v", path, err)
+			break
+		}
+		if saved.Users != nil {
+			ps.users = saved.Users
+		}
+		for user, watchers := range saved.Watchers {
+			ps.watchers[user] = make(map[string]bool)
+			for _, watcher := range watchers {
+				ps.watchers[user][watcher] = true
+			}
+		}
+	case !os.IsNotExist(err):
+		log.Printf("Error reading presence %s: %v", path, err)
+	}
+
+	return ps
+}
+
+// cleanText strips control characters from user-supplied text such as a
+// status, and cuts it to maxLength runes
+func cleanText(text string, maxLength int) string {
+	text = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, strings.ToValidUTF8(text, ""))
+	text = strings.TrimSpace(text)
+
+	if runes := []rune(text); len(runes) > maxLength {
+		text = string(runes[:maxLength])
+	}
+	return text
+}
+
+// Connect records a new connection for a user and returns their presence.
+// Logging in counts as activity, so an automatic away is cleared.
+func (ps *PresenceService) Connect(username string) Presence {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	ps.sessions[username]++
+	presence := ps.users[username]
+	if presence.Auto {
+		presence.Status, presence.Auto = shared.StatusOnline, false
+		ps.users[username] = presence
+		ps.save()
+	}
+	return presence
+}
+
+// Disconnect records a closed connection. It returns true when it was the
+// user's last one.
+func (ps *PresenceService) Disconnect(username string) bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	count, ok := ps.sessions[username]
+	if !ok {
+		return false // Forgotten by RemoveUser
+	}
+	if count > 1 {
+		ps.sessions[username]--
+		return false
+	}
+	delete(ps.sessions, username)
+
+	presence := ps.users[username]
+	presence.LastSeen = time.Now()
+	ps.users[username] = presence
+	ps.save()
+	return true
+}
+
+// Set changes a user's status and custom text and returns the new presence
+func (ps *PresenceService) Set(username string, status shared.UserStatus, text string) Presence {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	presence := ps.users[username]
+	presence.Status = status
+	presence.StatusText = cleanText(text, shared.MaxStatusTextLength)
+	presence.Auto = false
+	if status == shared.StatusOffline {
+		// Invisible users are reported as last seen when they went invisible
+		presence.LastSeen = time.Now()
+	}
+	ps.users[username] = presence
+	ps.save()
+	return presence
+}
+
+// MarkIdle switches an online user to away after inactivity. It reports
+// whether the status changed; users who chose another status keep it.
+func (ps *PresenceService) MarkIdle(username string) (Presence, bool) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	presence := ps.users[username]
+	if presence.Status != shared.StatusOnline {
+		return presence, false
+	}
+	presence.Status, presence.Auto = shared.StatusAway, true
+	ps.users[username] = presence
+	ps.save()
+	return presence, true
+}
+
+// MarkActive switches a user set to away by MarkIdle back to online and
+// reports whether the status changed
+func (ps *PresenceService) MarkActive(username string) (Presence, bool) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	presence := ps.users[username]
+	if !presence.Auto {
+		return presence, false
+	}
+	presence.Status, presence.Auto = shared.StatusOnline, false
+	ps.users[username] = presence
+	ps.save()
+	return presence, true
+}
+
+// Get returns a user's presence and whether they are connected
+func (ps *PresenceService) Get(username string) (Presence, bool) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	return ps.users[username], ps.sessions[username] > 0
+}
+
+// Watch subscribes watcher to a user's presence changes
+func (ps *PresenceService) Watch(watcher, username string) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if ps.watchers[username] == nil {
+		ps.watchers[username] = make(map[string]bool)
+	}
+	ps.watchers[username][watcher] = true
+	ps.save()
+}
+
+// Unwatch cancels a subscription and reports whether there was one
+func (ps *PresenceService) Unwatch(watcher, username string) bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if !ps.watchers[username][watcher] {
+		return false
+	}
+	delete(ps.watchers[username], watcher)
+	if len(ps.watchers[username]) == 0 {
+		delete(ps.watchers, username)
+	}
+	ps.save()
+	return true
+}
+
+// Watchers returns who is subscribed to a user
+func (ps *PresenceService) Watchers(username string) []string {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	watchers := make([]string, 0, len(ps.watchers[username]))
+	for watcher := range ps.watchers[username] {
+		watchers = append(watchers, watcher)
+	}
+	sort.Strings(watchers)
+	return watchers
+}
+
+// Watching returns the users a watcher is subscribed to
+func (ps *PresenceService) Watching(watcher string) []string {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	watched := make([]string, 0)
+	for username, watchers := range ps.watchers {
+		if watchers[watcher] {
+			watched = append(watched, username)
+		}
+	}
+	sort.Strings(watched)
+	return watched
+}
+
+// RenameUser moves a user's presence, connections and subscriptions to a new
+// name
+func (ps *PresenceService) RenameUser(oldName, newName string) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if presence, ok := ps.users[oldName]; ok {
+		ps.users[newName] = presence
+		delete(ps.users, oldName)
+	}
+	if count, ok := ps.sessions[oldName]; ok {
+		ps.sessions[newName] = count
+		delete(ps.sessions, oldName)
+	}
+	if watchers, ok := ps.watchers[oldName]; ok {
+		ps.watchers[newName] = watchers
+		delete(ps.watchers, oldName)
+	}
+	for _, watchers := range ps.watchers {
+		if watchers[oldName] {
+			delete(watchers, oldName)
+			watchers[newName] = true
+		}
+	}
+	ps.save()
+}
+
+// RemoveUser forgets a deleted user's presence and subscriptions
+func (ps *PresenceService) RemoveUser(username string) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	delete(ps.users, username)
+	delete(ps.sessions, username)
+	delete(ps.watchers, username)
+	for watched, watchers := range ps.watchers {
+		delete(watchers, username)
+		if len(watchers) == 0 {
+			delete(ps.watchers, watched)
+		}
+	}
+	ps.save()
+}
+
+// save writes presence and subscriptions. The caller must hold ps.mu.
+func (ps *PresenceService) save() {
+	saved := presenceFile{
+		Users:    ps.users,
+		Watchers: make(map[string][]string, len(ps.watchers)),
+	}
+	for username, watchers := range ps.watchers {
+		for watcher := range watchers {
+			saved.Watchers[username] = append(saved.Watchers[username], watcher)
+		}
+		sort.Strings(saved.Watchers[username])
+	}
+
+	data, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		log.Printf("Error serializing presence: %v", err)
+		return
+	}
+
+	if err := os.MkdirAll(filepath.Dir(ps.path), 0755); err != nil {
+		log.Printf("Error creating presence directory: %v", err)
+		return
+	}
+
+	// Write to a temporary file and rename it so a crash never leaves a truncated file
+	tmpPath := ps.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		log.Printf("Error writing presence %s: %v", ps.path, err)
+		return
+	}
+	if err := os.Rename(tmpPath, ps.path); err != nil {
+		log.Printf("Error replacing presence %s: %v", ps.path, err)
+	}
+}
+
+// announcePresence tells the rooms the user is in and everyone watching the
+// user that their presence is now description. Watchers who share a room with
+// the user hear it once, from the room.
+func (s *Server) announcePresence(username, description string) {
+	rooms := make(map[*Room]bool)
+	for _, client := range s.ClientsOf(username) {
+		if room := client.Room(); room != nil && !rooms[room] {
+			rooms[room] = true
+			room.BroadcastEvent(shared.EventStatusChange, username, description)
+		}
+	}
+
+	event := shared.CreateEventMessage(shared.EventStatusChange, username, "", description)
+	eventBytes, _ := json.Marshal(event)
+	for _, watcher := range s.Presence.Watchers(username) {
+		if s.Contacts.Blocks(username, watcher) {
+			continue
+		}
+		for _, client := range s.ClientsOf(watcher) {
+			if !rooms[client.Room()] {
+				client.Enqueue(eventBytes)
+			}
+		}
+	}
+}
+
+// setStatus changes the client's status and announces it
+func (c *Client) setStatus(status shared.UserStatus, text string) {
+	presence := c.Server.Presence.Set(c.Username(), status, text)
+	log.Printf("User %s changed status to %s", c.Username(), presence.Describe())
+
+	c.Server.announcePresence(c.Username(), presence.Describe())
+	c.sendSuccess("Status updated to: " + presence.Describe())
+
+	// Busy means do not disturb until the user picks another status
+	c.Server.setDND(c.Username(), status == shared.StatusBusy)
+	if status != shared.StatusBusy {
+		c.releaseHeld()
+	}
+}
+
+// presenceFor returns a user's presence as c sees it. Users who block c look
+// offline since c last saw them, like in reachableClients.
+func (c *Client) presenceFor(username string) (Presence, bool) {
+	if lastSeen, blocked := c.Server.Contacts.BlockedSeen(username, c.Username()); blocked {
+		return Presence{Status: shared.StatusOffline, LastSeen: lastSeen}, false
+	}
+	return c.Server.Presence.Get(username)
+}
+
+// whois describes a user's presence for the whois command
+func (c *Client) whois(username string) string {
+	presence, connected := c.presenceFor(username)
+	if bot, ok := c.Server.AuthManager.Bot(username); ok {
+		username += " [bot of " + bot.Owner + "]"
+	}
+	if connected && presence.Status != shared.StatusOffline {
+		return fmt.Sprintf("%s is %s", username, presence.Describe())
+	}
+
+	if presence.LastSeen.IsZero() {
+		return username + " is offline and has not been seen yet"
+	}
+	ago := time.Since(presence.LastSeen).Round(time.Minute)
+	return fmt.Sprintf("%s is offline, last seen %s (%v ago)",
+		username, presence.LastSeen.Format("2006-01-02 15:04"), ago)
+}
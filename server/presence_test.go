@@ -0,0 +1,141 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"chatap.com/shared"
+)
+
+func TestPresenceSurvivesSessionsAndRestarts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "presence.json")
+	ps := NewPresenceService(path)
+
+	// Only the last of two sessions going counts as leaving
+	ps.Connect("alice")
+	ps.Connect("alice")
+	if ps.Disconnect("alice") {
+		t.Fatal("first of two sessions reported as the last")
+	}
+	if _, connected := ps.Get("alice"); !connected {
+		t.Fatal("alice not connected with a session left")
+	}
+	if !ps.Disconnect("alice") {
+		t.Fatal("last session not reported")
+	}
+	presence, connected := ps.Get("alice")
+	if connected || presence.LastSeen.IsZero() {
+		t.Fatalf("after leaving: connected %v, last seen %v", connected, presence.LastSeen)
+	}
+
+	// Status text is cleaned
+	presence = ps.Set("alice", shared.StatusBusy, " in a \x1b[1mmeeting\n ")
+	if presence.Describe() != "busy (in a [1mmeeting)" {
+		t.Fatalf("status %q", presence.Describe())
+	}
+
+	ps.Watch("bob", "alice")
+	ps.Watch("carol", "alice")
+	ps.Watch("alice", "carol")
+
+	restarted := NewPresenceService(path)
+	if presence, _ := restarted.Get("alice"); presence.Status != shared.StatusBusy || presence.StatusText != "in a [1mmeeting" {
+		t.Fatalf("restored %+v", presence)
+	}
+	if watchers := restarted.Watchers("alice"); len(watchers) != 2 || watchers[0] != "bob" || watchers[1] != "carol" {
+		t.Fatalf("restored watchers %v", watchers)
+	}
+
+	// Renaming and removing users carry their subscriptions along
+	restarted.RenameUser("alice", "alicia")
+	if watching := restarted.Watching("carol"); len(watching) != 1 || watching[0] != "alicia" {
+		t.Fatalf("carol watching %v after the rename", watching)
+	}
+	if watchers := restarted.Watchers("alicia"); len(watchers) != 2 {
+		t.Fatalf("alicia's watchers %v", watchers)
+	}
+	restarted.RemoveUser("carol")
+	if watchers := restarted.Watchers("alicia"); len(watchers) != 1 || watchers[0] != "bob" {
+		t.Fatalf("watchers %v after carol was removed", watchers)
+	}
+	if restarted.Unwatch("carol", "alicia") {
+		t.Fatal("removed user still watching")
+	}
+}
+
+func TestWatchersHearPresenceChanges(t *testing.T) {
+	s := newTestServer(t)
+	go s.handleChannels()
+	defer close(s.quit)
+	s.AuthManager.RegisterUser("alice", "secret1")
+	s.AuthManager.RegisterUser("bob", "secret2")
+	s.AuthManager.CreateBot("helper", "bob")
+
+	alice := loginTestSession(t, s, "alice", "secret1")
+	for _, refused := range []struct{ command, reply string }{
+		{"watch alice", "ERROR: You cannot watch yourself"},
+		{"watch dave", "ERROR: User not found: dave"},
+		{"whois dave", "ERROR: User not found: dave"},
+		{"unwatch bob", "ERROR: You are not watching bob"},
+	} {
+		alice.send(shared.Message{Type: shared.MessageTypeCommand, Content: refused.command})
+		alice.expect(refused.reply)
+	}
+	alice.send(shared.Message{Type: shared.MessageTypeCommand, Content: "watch bob"})
+	alice.expect("SUCCESS: Watching bob. bob is offline and has not been seen yet")
+	alice.send(shared.Message{Type: shared.MessageTypeCommand, Content: "watch"})
+	alice.expect("SUCCESS: You are watching: bob")
+	alice.send(shared.Message{Type: shared.MessageTypeCommand, Content: "whois helper"})
+	alice.expect("SUCCESS: helper [bot of bob] is offline")
+
+	// Bob shares no room with alice, so alice hears of bob as a watcher
+	bob := loginTestSession(t, s, "bob", "secret2")
+	alice.expect("bob is now online")
+	bob.send(shared.Message{Type: shared.MessageTypeCommand, Content: "status busy in a meeting"})
+	bob.expect("SUCCESS: Status updated to: busy (in a meeting)")
+	alice.expect("bob is now busy (in a meeting)")
+	alice.send(shared.Message{Type: shared.MessageTypeCommand, Content: "whois bob"})
+	alice.expect("SUCCESS: bob is busy (in a meeting)")
+
+	bob.conn.Close()
+	alice.expect("bob is now offline")
+	alice.send(shared.Message{Type: shared.MessageTypeCommand, Content: "whois bob"})
+	alice.expect("SUCCESS: bob is offline, last seen")
+
+	alice.send(shared.Message{Type: shared.MessageTypeCommand, Content: "unwatch bob"})
+	alice.expect("SUCCESS: Stopped watching bob")
+	if watchers := s.Presence.Watchers("bob"); len(watchers) != 0 {
+		t.Fatalf("bob still watched by %v", watchers)
+	}
+}
+func TestAutoAwayOnlyReplacesOnline(t *testing.T) {
+	ps := NewPresenceService(filepath.Join(t.TempDir(), "presence.json"))
+
+	ps.Connect("alice")
+	if presence, changed := ps.MarkIdle("alice"); !changed || presence.Status != shared.StatusAway || !presence.Auto {
+		t.Fatalf("idle: %+v, changed %v", presence, changed)
+	}
+	if _, changed := ps.MarkIdle("alice"); changed {
+		t.Fatal("marked idle twice")
+	}
+	if presence, changed := ps.MarkActive("alice"); !changed || presence.Status != shared.StatusOnline {
+		t.Fatalf("active: %+v, changed %v", presence, changed)
+	}
+
+	// A chosen status stays, also when the user is active again
+	ps.Set("alice", shared.StatusAway, "lunch")
+	if _, changed := ps.MarkIdle("alice"); changed {
+		t.Fatal("chosen away replaced")
+	}
+	if _, changed := ps.MarkActive("alice"); changed {
+		t.Fatal("chosen away cleared by activity")
+	}
+
+	// Logging in again counts as activity
+	ps.Set("alice", shared.StatusOnline, "")
+	ps.MarkIdle("alice")
+	ps.Disconnect("alice")
+	if presence := ps.Connect("alice"); presence.Status != shared.StatusOnline || presence.Auto {
+		t.Fatalf("after logging in again: %+v", presence)
+	}
+}
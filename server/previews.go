@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif" // Register the decoders used for thumbnails
+	_ "image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+
+	"chatap.com/shared"
+)
+
+const (
+	thumbnailSize      = 128      // Longest side of a thumbnail in pixels
+	maxThumbnailPixels = 40 << 20 // Larger images are not decoded
+	previewLines       = 5        // Lines of a text file shown in a preview
+	previewLineLength  = 120
+)
+
+// describeFile works out the content type of a file and, depending on it, the
+// image dimensions or the number of lines
+func describeFile(path string) (shared.FileMeta, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return shared.FileMeta{}, err
+	}
+	defer file.Close()
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return shared.FileMeta{}, err
+	}
+
+	meta := shared.FileMeta{ContentType: sniffContentType(head[:n])}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return meta, err
+	}
+
+	switch {
+	case strings.HasPrefix(meta.ContentType, "image/"):
+		// Only the header is decoded; unsupported formats keep no dimensions
+		if config, _, err := image.DecodeConfig(file); err == nil {
+			meta.Width, meta.Height = config.Width, config.Height
+		}
+
+	case strings.HasPrefix(meta.ContentType, "text/"):
+		lines, err := countLines(file)
+		if err != nil {
+			return meta, err
+		}
+		meta.Lines = lines
+	}
+
+	return meta, nil
+}
+
+// countLines counts newline-terminated lines plus a final unterminated one
+func countLines(r io.Reader) (int, error) {
+	buf := make([]byte, 32<<10)
+	lines := 0
+	var last byte
+
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			lines += bytes.Count(buf[:n], []byte{'\n'})
+			last = buf[n-1]
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if last != 0 && last != '\n' {
+		lines++
+	}
+	return lines, nil
+}
+
+// headLines returns up to count lines from the start of a text file, cut to
+// maxLength runes and stripped of control characters so they are safe to
+// print on a terminal
+func headLines(path string, count, maxLength int) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	lines := make([]string, 0, count)
+	reader := bufio.NewReader(file)
+	for len(lines) < count {
+		line, err := reader.ReadString('\n')
+		if line == "" && err != nil {
+			break
+		}
+
+		line = strings.ToValidUTF8(strings.TrimRight(line, "\r\n"), "?")
+		line = strings.Map(func(r rune) rune {
+			if r == '\t' {
+				return ' '
+			}
+			if unicode.IsControl(r) {
+				return -1
+			}
+			return r
+		}, line)
+		if runes := []rune(line); len(runes) > maxLength {
+			line = string(runes[:maxLength]) + "..."
+		}
+		lines = append(lines, line)
+
+		if err != nil {
+			break
+		}
+	}
+
+	return lines, nil
+}
+
+// writeThumbnail decodes the image at srcPath and writes a PNG no larger than
+// thumbnailSize on either side to dstPath
+func writeThumbnail(srcPath, dstPath string) error {
+	file, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	config, _, err := image.DecodeConfig(file)
+	if err != nil {
+		return err
+	}
+	if int64(config.Width)*int64(config.Height) > maxThumbnailPixels {
+		return fmt.Errorf("image is too large for a thumbnail (%dx%d)", config.Width, config.Height)
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	img, _, err := image.Decode(file)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file and rename it so readers never see a partial thumbnail
+	tmp, err := os.CreateTemp(filepath.Dir(dstPath), ".thumb-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := png.Encode(tmp, scaleImage(img, thumbnailSize)); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dstPath)
+}
+
+// scaleImage shrinks img to fit a size x size box, keeping its aspect ratio.
+// Each thumbnail pixel averages a grid of up to 4x4 samples from its area.
+func scaleImage(img image.Image, size int) image.Image {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	thumbWidth, thumbHeight := width, height
+	if width > size || height > size {
+		if width >= height {
+			thumbWidth, thumbHeight = size, height*size/width
+		} else {
+			thumbWidth, thumbHeight = width*size/height, size
+		}
+	}
+	if thumbWidth < 1 {
+		thumbWidth = 1
+	}
+	if thumbHeight < 1 {
+		thumbHeight = 1
+	}
+
+	thumb := image.NewNRGBA(image.Rect(0, 0, thumbWidth, thumbHeight))
+	for y := 0; y < thumbHeight; y++ {
+		y0, y1 := y*height/thumbHeight, (y+1)*height/thumbHeight
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		stepY := (y1-y0)/4 + 1
+
+		for x := 0; x < thumbWidth; x++ {
+			x0, x1 := x*width/thumbWidth, (x+1)*width/thumbWidth
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+			stepX := (x1-x0)/4 + 1
+
+			var r, g, b, a, samples uint64
+			for sy := y0; sy < y1; sy += stepY {
+				for sx := x0; sx < x1; sx += stepX {
+					sr, sg, sb, sa := img.At(bounds.Min.X+sx, bounds.Min.Y+sy).RGBA()
+					r, g, b, a = r+uint64(sr), g+uint64(sg), b+uint64(sb), a+uint64(sa)
+					samples++
+				}
+			}
+
+			thumb.Set(x, y, color.RGBA64{
+				R: uint16(r / samples),
+				G: uint16(g / samples),
+				B: uint16(b / samples),
+				A: uint16(a / samples),
+			})
+		}
+	}
+
+	return thumb
+}
+
+// handlePreview sends the client a description of a stored file. Files from a
+// direct conversation are addressed as "@user <name|id>".
+func (c *Client) handlePreview(args string) {
+	target, nameOrID, place, ok := c.fileTarget("preview", args)
+	if !ok {
+		return
+	}
+
+	record, ok := c.Server.Files.Find(target, nameOrID)
+	if !ok {
+		c.sendError("File not found in " + place + ": " + nameOrID)
+		return
+	}
+
+	// The preview is the reply, so it is sent before the request is
+	// acknowledged even though drawing a thumbnail can take a moment
+	c.sendPreview(record)
+}
+
+// sendPreview sends a file's metadata with its first lines or its thumbnail
+func (c *Client) sendPreview(record FileRecord) {
+	path := c.Server.Files.Path(record)
+
+	// Files stored before previews existed are described on demand
+	meta := record.Meta
+	if meta == nil {
+		described, err := describeFile(path)
+		if err != nil {
+			log.Printf("Error describing %s for %s: %v", record.Name, c.Username(), err)
+			c.sendError("Preview failed: " + err.Error())
+			return
+		}
+		meta = &described
+	}
+
+	preview := shared.PreviewMessage{
+		Message: shared.Message{
+			Type:      shared.MessageTypePreview,
+			Sender:    "Server",
+			Timestamp: time.Now(),
+			RequestID: c.requestID(),
+		},
+		FileMeta: *meta,
+		FileID:   record.ID,
+		Filename: record.Name,
+		Size:     record.Size,
+		Uploader: record.Uploader,
+	}
+
+	var thumbnail []byte
+	switch {
+	case strings.HasPrefix(meta.ContentType, "text/"):
+		lines, err := headLines(path, previewLines, previewLineLength)
+		if err != nil {
+			log.Printf("Error reading %s for a preview: %v", record.Name, err)
+		}
+		preview.Head = lines
+
+	case meta.Width > 0:
+		thumbPath, err := c.Server.Files.Thumbnail(record)
+		if err == nil {
+			thumbnail, err = os.ReadFile(thumbPath)
+		}
+		if err != nil {
+			log.Printf("No thumbnail for %s: %v", record.Name, err)
+		}
+	}
+	preview.PayloadLen = len(thumbnail)
+
+	header, err := json.Marshal(preview)
+	if err != nil {
+		log.Printf("Error serializing preview of %s: %v", record.Name, err)
+		return
+	}
+	c.EnqueueReliable(shared.AppendPayload(header, thumbnail))
+	c.Server.Metrics.Inc("files.previews")
+}
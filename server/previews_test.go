@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testImage returns a PNG of the given size
+func testImage(t *testing.T, width, height int) []byte {
+	t.Helper()
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.NRGBA{R: uint8(x), G: uint8(y), B: 200, A: 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDescribeFile(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"notes.txt", []byte("one\ntwo\nthree"), "text/plain, 3 lines"},
+		{"single.txt", []byte("one\n"), "text/plain, 1 line"},
+		{"wide.png", testImage(t, 300, 20), "image/png 300x20"},
+		{"data.bin", []byte{0, 1, 2, 3}, "application/octet-stream"},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(dir, tt.name)
+		if err := os.WriteFile(path, tt.data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		meta, err := describeFile(path)
+		if err != nil || meta.Summary() != tt.want {
+			t.Errorf("%s: %q, %v, want %q", tt.name, meta.Summary(), err, tt.want)
+		}
+	}
+}
+
+func TestThumbnailFitsAndIsDrawnOnce(t *testing.T) {
+	s := newTestServer(t)
+	record := storeTestFile(t, s, "general", "wide.png", "alice", testImage(t, 400, 100))
+
+	thumbPath, err := s.Files.Thumbnail(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Open(thumbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := png.DecodeConfig(file)
+	file.Close()
+	if err != nil || config.Width != thumbnailSize || config.Height != thumbnailSize/4 {
+		t.Fatalf("thumbnail is %dx%d: %v", config.Width, config.Height, err)
+	}
+
+	// Later requests use the thumbnail already drawn
+	if err := os.WriteFile(thumbPath, []byte("cached"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if again, err := s.Files.Thumbnail(record); err != nil || again != thumbPath {
+		t.Fatalf("second thumbnail %s: %v", again, err)
+	}
+	if data, _ := os.ReadFile(thumbPath); string(data) != "cached" {
+		t.Fatal("thumbnail drawn again")
+	}
+
+	// It goes with the blob
+	s.Files.Remove("general", record.ID)
+	if _, err := os.Stat(thumbPath); !os.IsNotExist(err) {
+		t.Fatalf("thumbnail kept after its blob was removed: %v", err)
+	}
+
+	text := storeTestFile(t, s, "general", "notes.txt", "alice", testFileData())
+	if _, err := s.Files.Thumbnail(text); err == nil {
+		t.Fatal("thumbnail drawn for text")
+	}
+}
+
+func TestPreviewsOfTextAndImages(t *testing.T) {
+	s := newTestServer(t)
+	go s.handleChannels()
+	defer close(s.quit)
+	s.AuthManager.RegisterUser("bob", "secret2")
+	s.RoomManager.CreateRoom("general")
+	addr := serveTestListener(t, s)
+
+	lines := "first\tline\n\x1b[31mred\x1b[0m\n" + strings.Repeat("x", previewLineLength+10) + "\nfour\nfive\nsix\n"
+	storeTestFile(t, s, "general", "notes.txt", "alice", []byte(lines))
+	picture := storeTestFile(t, s, directTarget("alice", "bob"), "tall.png", "alice", testImage(t, 50, 200))
+	bob := dialTestChat(t, addr, "bob", "secret2")
+	ctx := context.Background()
+
+	// Text shows its first lines, safe to print
+	preview, thumbnail, err := bob.Preview(ctx, "notes.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"first line", "[31mred[0m", strings.Repeat("x", previewLineLength) + "...", "four", "five"}
+	if strings.Join(preview.Head, "\n") != strings.Join(want, "\n") || preview.Lines != 6 || thumbnail != nil {
+		t.Fatalf("text preview: %q, %d lines, %d thumbnail bytes", preview.Head, preview.Lines, len(thumbnail))
+	}
+
+	// An image comes with its thumbnail
+	preview, thumbnail, err = bob.Preview(ctx, "@alice "+picture.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if preview.Filename != "tall.png" || preview.Width != 50 || preview.Height != 200 || preview.Uploader != "alice" {
+		t.Fatalf("image preview: %+v", preview)
+	}
+	config, err := png.DecodeConfig(bytes.NewReader(thumbnail))
+	if err != nil || config.Width != thumbnailSize/4 || config.Height != thumbnailSize {
+		t.Fatalf("thumbnail is %dx%d: %v", config.Width, config.Height, err)
+	}
+}
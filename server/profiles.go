@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/png"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"chatap.com/shared"
+)
+
+const (
+	avatarsDir        = ".avatars" // Under the uploads directory
+	avatarSize        = 64         // Longest side of a stored avatar in pixels
+	maxAvatarPixels   = 16 << 20
+	maxDisplayNameLen = 32
+	maxBioLen         = 200
+	maxPronounsLen    = 20
+)
+
+// profileFields are the text fields set with "profile set <field> <value>"
+var profileFields = []string{"name", "bio", "timezone", "pronouns"}
+
+// ProfileStore keeps user profiles. Profiles are saved after every change and
+// avatars are stored as small PNGs, one per user.
+type ProfileStore struct {
+	mu        sync.Mutex
+	path      string
+	avatarDir string
+	profiles  map[string]shared.UserProfile
+}
+
+func NewProfileStore(path, avatarDir string) *ProfileStore {
+	ps := &ProfileStore{
+		path:      path,
+		avatarDir: avatarDir,
+		profiles:  make(map[string]shared.UserProfile),
+	}
+
+	data, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(data, &ps.profiles); err != nil {
+			log.Printf("Error parsing profiles %s: %v", path, err)
+		}
+	case !os.IsNotExist(err):
+		log.Printf("Error reading profiles %s: %v", path, err)
+	}
+
+	return ps
+}
+
+// Get returns a user's profile
+func (ps *ProfileStore) Get(username string) shared.UserProfile {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	return ps.profiles[username]
+}
+
+// DisplayName returns a user's display name, or "" if they have none
+func (ps *ProfileStore) DisplayName(username string) string {
+	return ps.Get(username).DisplayName
+}
+
+// Set changes one text field of a user's profile. An empty value clears it.
+func (ps *ProfileStore) Set(username, field, value string) (shared.UserProfile, error) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	profile := ps.profiles[username]
+	switch field {
+	case "name":
+		profile.DisplayName = cleanText(value, maxDisplayNameLen)
+	case "bio":
+		profile.Bio = cleanText(value, maxBioLen)
+	case "pronouns":
+		profile.Pronouns = cleanText(value, maxPronounsLen)
+	case "timezone":
+		value = strings.TrimSpace(value)
+		if value != "" {
+			if _, err := time.LoadLocation(value); err != nil || strings.EqualFold(value, "local") {
+				return profile, fmt.Errorf("unknown timezone %q, use a name such as Europe/Paris", value)
+			}
+		}
+		profile.Timezone = value
+	default:
+		return profile, fmt.Errorf("unknown field %q, use one of: %s, avatar", field, strings.Join(profileFields, ", "))
+	}
+
+	ps.profiles[username] = profile
+	ps.save()
+	return profile, nil
+}
+
+// avatarPath returns where a user's avatar is stored
+func (ps *ProfileStore) avatarPath(username string) string {
+	return filepath.Join(ps.avatarDir, username+".png")
+}
+
+// SetAvatar decodes an uploaded image and stores it, scaled down, as the
+// user's avatar
+func (ps *ProfileStore) SetAvatar(username string, data []byte) error {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("not a PNG, JPEG or GIF image")
+	}
+	if int64(config.Width)*int64(config.Height) > maxAvatarPixels {
+		return fmt.Errorf("image is too large (%dx%d)", config.Width, config.Height)
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("invalid image: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, scaleImage(img, avatarSize)); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(ps.avatarDir, 0755); err != nil {
+		return err
+	}
+	// Write to a temporary file and rename it so readers never see a partial avatar
+	path := ps.avatarPath(username)
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	profile := ps.profiles[username]
+	profile.HasAvatar = true
+	ps.profiles[username] = profile
+	ps.save()
+	return nil
+}
+
+// ClearAvatar removes a user's avatar
+func (ps *ProfileStore) ClearAvatar(username string) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if err := os.Remove(ps.avatarPath(username)); err != nil && !os.IsNotExist(err) {
+		log.Printf("Error removing avatar of %s: %v", username, err)
+	}
+	profile := ps.profiles[username]
+	profile.HasAvatar = false
+	ps.profiles[username] = profile
+	ps.save()
+}
+
+// Avatar returns a user's avatar PNG, or nil if they have none
+func (ps *ProfileStore) Avatar(username string) []byte {
+	if !ps.Get(username).HasAvatar {
+		return nil
+	}
+	data, err := os.ReadFile(ps.avatarPath(username))
+	if err != nil {
+		log.Printf("Error reading avatar of %s: %v", username, err)
+		return nil
+	}
+	return data
+}
+
+// RenameUser moves a user's profile and avatar to a new name
+func (ps *ProfileStore) RenameUser(oldName, newName string) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	profile, ok := ps.profiles[oldName]
+	if !ok {
+		return
+	}
+	if profile.HasAvatar {
+		if err := os.Rename(ps.avatarPath(oldName), ps.avatarPath(newName)); err != nil {
+			log.Printf("Error moving avatar of %s: %v", oldName, err)
+			profile.HasAvatar = false
+		}
+	}
+	ps.profiles[newName] = profile
+	delete(ps.profiles, oldName)
+	ps.save()
+}
+
+// RemoveUser deletes a user's profile and avatar
+func (ps *ProfileStore) RemoveUser(username string) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if err := os.Remove(ps.avatarPath(username)); err != nil && !os.IsNotExist(err) {
+		log.Printf("Error removing avatar of %s: %v", username, err)
+	}
+	delete(ps.profiles, username)
+	ps.save()
+}
+
+// save writes the profiles. The caller must hold ps.mu.
+func (ps *ProfileStore) save() {
+	for username, profile := range ps.profiles {
+		if profile == (shared.UserProfile{}) {
+			delete(ps.profiles, username)
+		}
+	}
+
+	data, err := json.MarshalIndent(ps.profiles, "", "  ")
+	if err != nil {
+		log.Printf("Error serializing profiles: %v", err)
+		return
+	}
+
+	if err := os.MkdirAll(filepath.Dir(ps.path), 0755); err != nil {
+		log.Printf("Error creating profiles directory: %v", err)
+		return
+	}
+
+	// Write to a temporary file and rename it so a crash never leaves a truncated file
+	tmpPath := ps.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		log.Printf("Error writing profiles %s: %v", ps.path, err)
+		return
+	}
+	if err := os.Rename(tmpPath, ps.path); err != nil {
+		log.Printf("Error replacing profiles %s: %v", ps.path, err)
+	}
+}
+
+// announceProfile tells the rooms a user is in that their profile changed
+func (s *Server) announceProfile(username, change string) {
+	s.mu.RLock()
+	rooms := make(map[*Room]bool)
+	for client := range s.Clients {
+		if room := client.Room(); client.Username() == username && room != nil {
+			rooms[room] = true
+		}
+	}
+	s.mu.RUnlock()
+
+	for room := range rooms {
+		room.BroadcastEvent(shared.EventProfileUpdated, username, change)
+	}
+}
+
+// handleProfile shows a profile or changes the client's own:
+//
+//	profile [username]
+//	profile set <name|bio|timezone|pronouns> [value]
+//	profile set avatar
+//
+// An empty value clears a field. Avatars are uploaded as a MessageTypeProfile
+// frame, see handleAvatarUpload; "profile set avatar" removes the avatar.
+func (c *Client) handleProfile(content string) {
+	parts := strings.SplitN(content, " ", 4)
+
+	if len(parts) < 2 || parts[1] != "set" {
+		username := c.Username()
+		if len(parts) > 1 && parts[1] != "" {
+			username = parts[1]
+		}
+		if !c.Server.AuthManager.UserExists(username) {
+			c.sendError("User not found: " + username)
+			return
+		}
+		c.sendProfile(username)
+		return
+	}
+
+	if len(parts) < 3 {
+		c.sendError("Usage: profile set <" + strings.Join(profileFields, "|") + "|avatar> [value]")
+		return
+	}
+	field := strings.ToLower(parts[2])
+	value := ""
+	if len(parts) > 3 {
+		value = parts[3]
+	}
+
+	if field == "avatar" {
+		c.Server.Profiles.ClearAvatar(c.Username())
+		c.sendSuccess("Avatar removed")
+		c.Server.announceProfile(c.Username(), "removed their avatar")
+		return
+	}
+
+	profile, err := c.Server.Profiles.Set(c.Username(), field, value)
+	if err != nil {
+		c.sendError("Could not update profile: " + err.Error())
+		return
+	}
+
+	change := "cleared their " + field
+	switch {
+	case field == "name" && profile.DisplayName != "":
+		change = "is now known as " + profile.DisplayName
+	case value != "":
+		change = "updated their " + field
+	}
+	log.Printf("User %s %s", c.Username(), change)
+	c.sendSuccess("Profile updated")
+	c.Server.announceProfile(c.Username(), change)
+}
+
+// handleAvatarUpload stores an avatar sent as the payload of a profile frame
+func (c *Client) handleAvatarUpload(rawMsg, payload []byte) {
+	if !c.loggedIn.Load() {
+		c.sendError("Not authenticated")
+		return
+	}
+
+	var profileMsg shared.ProfileMessage
+	if err := json.Unmarshal(rawMsg, &profileMsg); err != nil || profileMsg.Content != "avatar" {
+		c.sendError("Invalid profile message")
+		return
+	}
+	if len(payload) == 0 || len(payload) > shared.MaxAvatarBytes {
+		c.sendError(fmt.Sprintf("An avatar must be an image of at most %s", shared.FormatSize(shared.MaxAvatarBytes)))
+		return
+	}
+
+	if err := c.Server.Profiles.SetAvatar(c.Username(), payload); err != nil {
+		log.Printf("Rejected avatar from %s: %v", c.Username(), err)
+		c.sendError("Could not set avatar: " + err.Error())
+		return
+	}
+
+	log.Printf("User %s changed their avatar", c.Username())
+	c.sendSuccess("Avatar updated")
+	c.Server.announceProfile(c.Username(), "changed their avatar")
+}
+
+// sendProfile sends the client a user's profile with their avatar
+func (c *Client) sendProfile(username string) {
+	profile := c.Server.Profiles.Get(username)
+	avatar := c.Server.Profiles.Avatar(username)
+
+	profileMsg := shared.ProfileMessage{
+		Message: shared.Message{
+			Type:      shared.MessageTypeProfile,
+			Sender:    "Server",
+			Timestamp: time.Now(),
+			RequestID: c.requestID(),
+		},
+		UserProfile: profile,
+		Username:    username,
+		PayloadLen:  len(avatar),
+	}
+
+	header, err := json.Marshal(profileMsg)
+	if err != nil {
+		log.Printf("Error serializing profile of %s: %v", username, err)
+		return
+	}
+	c.EnqueueReliable(shared.AppendPayload(header, avatar))
+}
+
+// describeUsers formats usernames with their display names for listings,
+// marking bots, e.g. "alice (Alice Liddell), bob, weather [bot]"
+func (s *Server) describeUsers(usernames []string) string {
+	sort.Strings(usernames)
+	described := make([]string, len(usernames))
+	for i, username := range usernames {
+		described[i] = username
+		if name := s.Profiles.DisplayName(username); name != "" && name != username {
+			described[i] += " (" + name + ")"
+		}
+		if s.AuthManager.IsBot(username) {
+			described[i] += " [bot]"
+		}
+	}
+	return strings.Join(described, ", ")
+}
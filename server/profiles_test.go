@@ -0,0 +1,45 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"chatap.com/shared"
+)
+
+func TestProfileSet(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "profiles.json")
+	ps := NewProfileStore(path, filepath.Join(dir, "avatars"))
+
+	tests := []struct {
+		field, value string
+		ok           bool
+	}{
+		{"name", " Alice\x07 Liddell ", true},
+		{"bio", strings.Repeat("x", maxBioLen+10), true},
+		{"timezone", "UTC", true},
+		{"timezone", "Local", false},
+		{"timezone", "Mars/Olympus_Mons", false},
+		{"email", "alice@example.com", false},
+	}
+	for _, tt := range tests {
+		if _, err := ps.Set("alice", tt.field, tt.value); (err == nil) != tt.ok {
+			t.Errorf("Set(%s, %q): %v", tt.field, tt.value, err)
+		}
+	}
+
+	profile := NewProfileStore(path, filepath.Join(dir, "avatars")).Get("alice")
+	if profile.DisplayName != "Alice Liddell" || len(profile.Bio) != maxBioLen || profile.Timezone != "UTC" {
+		t.Fatalf("saved profile %+v", profile)
+	}
+
+	// Clearing every field forgets the profile
+	for _, field := range profileFields {
+		ps.Set("alice", field, "")
+	}
+	if profile := NewProfileStore(path, filepath.Join(dir, "avatars")).Get("alice"); profile != (shared.UserProfile{}) {
+		t.Fatalf("cleared profile saved as %+v", profile)
+	}
+}
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"chatap.com/shared"
+)
+
+// RateCategory identifies which limit a message is counted against
+type RateCategory int
+
+const (
+	RateText RateCategory = iota
+	RateDirect
+	RateCommand
+	RateAuth
+	RateFileBytes
+	RateControl
+	rateCategoryCount
+)
+
+func (rc RateCategory) String() string {
+	switch rc {
+	case RateText:
+		return "text"
+	case RateDirect:
+		return "direct"
+	case RateCommand:
+		return "command"
+	case RateAuth:
+		return "auth"
+	case RateFileBytes:
+		return "file_bytes"
+	case RateControl:
+		return "control"
+	}
+	return "unknown"
+}
+
+// RateLimit describes a single token bucket: Rate tokens are added per second, up to Burst
+type RateLimit struct {
+	Rate  float64 `json:"rate"`
+	Burst float64 `json:"burst"`
+}
+
+// LimitSet holds one limit per message category
+type LimitSet struct {
+	Text      RateLimit `json:"text"`
+	Direct    RateLimit `json:"direct"`
+	Command   RateLimit `json:"command"`
+	Auth      RateLimit `json:"auth"`
+	FileBytes RateLimit `json:"fileBytes"`
+	Control   RateLimit `json:"control"` // Protocol messages, like upload control
+}
+
+func (ls LimitSet) get(category RateCategory) RateLimit {
+	switch category {
+	case RateText:
+		return ls.Text
+	case RateDirect:
+		return ls.Direct
+	case RateCommand:
+		return ls.Command
+	case RateAuth:
+		return ls.Auth
+	case RateFileBytes:
+		return ls.FileBytes
+	case RateControl:
+		return ls.Control
+	}
+	return RateLimit{}
+}
+
+// RateLimitConfig configures flood protection for connections and users
+type RateLimitConfig struct {
+	PerConnection LimitSet `json:"perConnection"`
+	PerUser       LimitSet `json:"perUser"`
+
+	// Escalation: the first violations in a window only produce a warning,
+	// then the offender is muted, and finally disconnected.
+	MuteAfter              int `json:"muteAfter"`
+	DisconnectAfter        int `json:"disconnectAfter"`
+	MuteSeconds            int `json:"muteSeconds"`
+	ViolationWindowSeconds int `json:"violationWindowSeconds"`
+}
+
+// DefaultRateLimitConfig returns limits that comfortably fit interactive use
+func DefaultRateLimitConfig() RateLimitConfig {
+	return RateLimitConfig{
+		PerConnection: LimitSet{
+			Text:      RateLimit{Rate: 5, Burst: 10},
+			Direct:    RateLimit{Rate: 5, Burst: 10},
+			Command:   RateLimit{Rate: 10, Burst: 20},
+			Auth:      RateLimit{Rate: 0.2, Burst: 5},
+			FileBytes: RateLimit{Rate: 4 << 20, Burst: 8 << 20},
+			Control:   RateLimit{Rate: 20, Burst: 50},
+		},
+		PerUser: LimitSet{
+			Text:      RateLimit{Rate: 10, Burst: 20},
+			Direct:    RateLimit{Rate: 10, Burst: 20},
+			Command:   RateLimit{Rate: 20, Burst: 40},
+			Auth:      RateLimit{Rate: 0.5, Burst: 10},
+			FileBytes: RateLimit{Rate: 8 << 20, Burst: 16 << 20},
+			Control:   RateLimit{Rate: 40, Burst: 100},
+		},
+		MuteAfter:              3,
+		DisconnectAfter:        6,
+		MuteSeconds:            30,
+		ViolationWindowSeconds: 60,
+	}
+}
+
+// TokenBucket is a simple thread-safe token bucket
+type TokenBucket struct {
+	mu       sync.Mutex
+	rate     float64
+	burst    float64
+	tokens   float64
+	lastFill time.Time
+}
+
+func NewTokenBucket(limit RateLimit) *TokenBucket {
+	return &TokenBucket{
+		rate:     limit.Rate,
+		burst:    limit.Burst,
+		tokens:   limit.Burst,
+		lastFill: time.Now(),
+	}
+}
+
+// Allow takes n tokens from the bucket if they are available.
+// A bucket with a zero rate is treated as unlimited.
+func (tb *TokenBucket) Allow(n float64) bool {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	if tb.rate <= 0 {
+		return true
+	}
+
+	now := time.Now()
+	tb.tokens += now.Sub(tb.lastFill).Seconds() * tb.rate
+	if tb.tokens > tb.burst {
+		tb.tokens = tb.burst
+	}
+	tb.lastFill = now
+
+	// A single request larger than the burst can never succeed otherwise,
+	// so let it through when the bucket is full and drain the bucket
+	if n > tb.burst && tb.tokens >= tb.burst {
+		tb.tokens = 0
+		return true
+	}
+
+	if tb.tokens < n {
+		return false
+	}
+	tb.tokens -= n
+	return true
+}
+
+// Refund returns tokens taken for a request that was refused elsewhere
+func (tb *TokenBucket) Refund(n float64) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	tb.tokens += n
+	if tb.tokens > tb.burst {
+		tb.tokens = tb.burst
+	}
+}
+
+// rateLimiter groups one token bucket per category
+type rateLimiter struct {
+	buckets [rateCategoryCount]*TokenBucket
+}
+
+func newRateLimiter(set LimitSet) *rateLimiter {
+	rl := &rateLimiter{}
+	for i := range rl.buckets {
+		rl.buckets[i] = NewTokenBucket(set.get(RateCategory(i)))
+	}
+	return rl
+}
+
+func (rl *rateLimiter) allow(category RateCategory, n float64) bool {
+	return rl.buckets[category].Allow(n)
+}
+
+func (rl *rateLimiter) refund(category RateCategory, n float64) {
+	rl.buckets[category].Refund(n)
+}
+
+// floodRecord tracks the rate limit violations of a user, or of an IP before
+// login, for escalating responses
+type floodRecord struct {
+	violations  int
+	windowStart time.Time
+	mutedUntil  time.Time
+}
+
+// FloodGuard keeps flood escalation per user, so an offender who reconnects
+// keeps their warnings and mute. Connections that have not logged in yet are
+// tracked per IP.
+type FloodGuard struct {
+	mu     sync.Mutex
+	config RateLimitConfig
+	users  map[string]*floodRecord
+	ips    map[string]*floodRecord
+}
+
+func NewFloodGuard(config RateLimitConfig) *FloodGuard {
+	return &FloodGuard{
+		config: config,
+		users:  make(map[string]*floodRecord),
+		ips:    make(map[string]*floodRecord),
+	}
+}
+
+func (fg *FloodGuard) SetConfig(config RateLimitConfig) {
+	fg.mu.Lock()
+	defer fg.mu.Unlock()
+	fg.config = config
+}
+
+// lookup returns where the record of a user, or of the IP if not logged in,
+// is kept
+func (fg *FloodGuard) lookup(username, ip string) (map[string]*floodRecord, string) {
+	if username == "" {
+		return fg.ips, ip
+	}
+	return fg.users, username
+}
+
+// record returns the record of a user, or of the IP, creating it on first use
+func (fg *FloodGuard) record(username, ip string) *floodRecord {
+	records, key := fg.lookup(username, ip)
+	if records[key] == nil {
+		records[key] = &floodRecord{}
+	}
+	return records[key]
+}
+
+// MutedFor returns how long the user, or the IP if not logged in, remains
+// muted, or zero
+func (fg *FloodGuard) MutedFor(username, ip string) time.Duration {
+	fg.mu.Lock()
+	defer fg.mu.Unlock()
+
+	records, key := fg.lookup(username, ip)
+	if record := records[key]; record != nil && time.Now().Before(record.mutedUntil) {
+		return time.Until(record.mutedUntil)
+	}
+	return 0
+}
+
+// RecordViolation counts a violation against the user, or the IP if not
+// logged in. It returns the count in the current window.
+func (fg *FloodGuard) RecordViolation(username, ip string) int {
+	fg.mu.Lock()
+	defer fg.mu.Unlock()
+
+	now := time.Now()
+	window := time.Duration(fg.config.ViolationWindowSeconds) * time.Second
+	record := fg.record(username, ip)
+	if record.windowStart.IsZero() || now.Sub(record.windowStart) > window {
+		record.windowStart = now
+		record.violations = 0
+	}
+	record.violations++
+	return record.violations
+}
+
+// Mute mutes the user, or the IP if not logged in, for a while
+func (fg *FloodGuard) Mute(username, ip string, muteFor time.Duration) {
+	fg.mu.Lock()
+	defer fg.mu.Unlock()
+	fg.record(username, ip).mutedUntil = time.Now().Add(muteFor)
+}
+
+// pruneLoop periodically drops records whose window and mute have passed,
+// until quit is closed
+func (fg *FloodGuard) pruneLoop(interval time.Duration, quit <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			fg.prune()
+		case <-quit:
+			return
+		}
+	}
+}
+
+func (fg *FloodGuard) prune() {
+	fg.mu.Lock()
+	defer fg.mu.Unlock()
+
+	now := time.Now()
+	window := time.Duration(fg.config.ViolationWindowSeconds) * time.Second
+	for _, records := range []map[string]*floodRecord{fg.users, fg.ips} {
+		for key, record := range records {
+			if now.After(record.mutedUntil) && now.Sub(record.windowStart) > window {
+				delete(records, key)
+			}
+		}
+	}
+}
+
+// classifyMessage returns the rate category and cost of an incoming message
+// whose frame is size bytes long
+func classifyMessage(msg shared.Message, size int) (RateCategory, float64) {
+	switch msg.Type {
+	case shared.MessageTypeAuth:
+		return RateAuth, 1
+	case shared.MessageTypeText:
+		return RateText, 1
+	case shared.MessageTypeDirect, shared.MessageTypeEncrypted:
+		return RateDirect, 1
+	case shared.MessageTypeFile, shared.MessageTypeProfile:
+		return RateFileBytes, float64(size)
+	case shared.MessageTypeUpload, shared.MessageTypePong, shared.MessageTypeReadMarker:
+		// Upload control comes with every upload, pongs answer the heartbeat
+		// and read markers follow reading, so they must not use up the commands
+		return RateControl, 1
+	case shared.MessageTypeCommand:
+		if strings.HasPrefix(msg.Content, "msg ") || strings.HasPrefix(msg.Content, "encrypt ") ||
+			strings.HasPrefix(msg.Content, "gmsg ") {
+			return RateDirect, 1
+		}
+	}
+	return RateCommand, 1
+}
+
+// isPostingCategory reports whether a category is blocked while a client is muted
+func isPostingCategory(category RateCategory) bool {
+	return category == RateText || category == RateDirect || category == RateFileBytes
+}
+
+// resetUserRateLimiters discards the per-user limiters so new limits take effect
+func (s *Server) resetUserRateLimiters() {
+	s.limitersMu.Lock()
+	defer s.limitersMu.Unlock()
+	s.userLimiters = make(map[string]*rateLimiter)
+}
+
+// userRateLimiter returns the shared limiter for a username, creating it on first use
+func (s *Server) userRateLimiter(username string) *rateLimiter {
+	s.limitersMu.Lock()
+	defer s.limitersMu.Unlock()
+
+	rl, ok := s.userLimiters[username]
+	if !ok {
+		rl = newRateLimiter(s.Config().RateLimits.PerUser)
+		s.userLimiters[username] = rl
+	}
+	return rl
+}
+
+// checkRateLimit applies the per-connection and per-user limits to an incoming
+// message. It returns whether the message may be processed and whether the
+// client should be disconnected.
+func (c *Client) checkRateLimit(msg shared.Message, size int) (allowed bool, disconnect bool) {
+	category, cost := classifyMessage(msg, size)
+	cfg := c.Server.Config().RateLimits
+	now := time.Now()
+
+	ip := remoteIP(c.Conn)
+
+	if isPostingCategory(category) {
+		if muted := c.Server.Floods.MutedFor(c.Username(), ip); muted > 0 {
+			c.Server.Metrics.Inc("ratelimit.muted_drops")
+			// Avoid answering every dropped message while muted
+			if now.Sub(c.lastMuteNotice) >= time.Second {
+				c.lastMuteNotice = now
+				c.sendError(fmt.Sprintf("You are muted for another %v for flooding", muted.Round(time.Second)))
+			}
+			return false, false
+		}
+	}
+
+	limiter := c.limiter.Load()
+	ok := limiter.allow(category, cost)
+	if ok && c.Username() != "" && !c.Server.userRateLimiter(c.Username()).allow(category, cost) {
+		// Only messages that get through count against the connection
+		limiter.refund(category, cost)
+		ok = false
+	}
+	if ok {
+		return true, false
+	}
+
+	c.Server.Metrics.Inc("ratelimit." + category.String())
+
+	// Violations count against the user, so reconnecting does not start a
+	// clean record, without muting others behind the same IP
+	violations := c.Server.Floods.RecordViolation(c.Username(), ip)
+
+	who := c.Username()
+	if who == "" {
+		who = c.Conn.RemoteAddr().String()
+	}
+
+	switch {
+	case cfg.DisconnectAfter > 0 && violations >= cfg.DisconnectAfter:
+		c.Server.Metrics.Inc("ratelimit.disconnects")
+		log.Printf("Rate limit: disconnecting %s after %d violations (%s)", who, violations, category)
+		c.sendError("Disconnected for flooding")
+		return false, true
+
+	case cfg.MuteAfter > 0 && violations >= cfg.MuteAfter:
+		muteFor := time.Duration(cfg.MuteSeconds) * time.Second
+		c.Server.Floods.Mute(c.Username(), ip, muteFor)
+		c.lastMuteNotice = now
+		c.Server.Metrics.Inc("ratelimit.mutes")
+		log.Printf("Rate limit: muting %s for %v after %d violations (%s)", who, muteFor, violations, category)
+		c.sendError(fmt.Sprintf("You have been muted for %v for flooding", muteFor))
+
+	default:
+		c.Server.Metrics.Inc("ratelimit.warnings")
+		log.Printf("Rate limit: warning %s (%s, violation %d)", who, category, violations)
+		c.sendError("You are sending too fast, slow down (" + category.String() + ")")
+	}
+
+	return false, false
+}
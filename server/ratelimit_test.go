@@ -0,0 +1,119 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"chatap.com/shared"
+)
+
+func TestTokenBucket(t *testing.T) {
+	tb := NewTokenBucket(RateLimit{Rate: 0.001, Burst: 3})
+	for i := 0; i < 3; i++ {
+		if !tb.Allow(1) {
+			t.Fatalf("request %d within the burst was refused", i)
+		}
+	}
+	if tb.Allow(1) {
+		t.Fatal("request over the burst was allowed")
+	}
+
+	tb.Refund(1)
+	if !tb.Allow(1) {
+		t.Fatal("refunded token could not be used")
+	}
+
+	// A request larger than the burst drains a full bucket
+	tb = NewTokenBucket(RateLimit{Rate: 0.001, Burst: 3})
+	if !tb.Allow(10) || tb.Allow(1) {
+		t.Fatal("oversized request did not drain the full bucket")
+	}
+
+	if unlimited := NewTokenBucket(RateLimit{}); !unlimited.Allow(1e9) {
+		t.Fatal("bucket with a zero rate is not unlimited")
+	}
+}
+
+func TestFloodGuardEscalatesPerUser(t *testing.T) {
+	fg := NewFloodGuard(DefaultRateLimitConfig())
+	for i := 1; i <= 3; i++ {
+		if violations := fg.RecordViolation("alice", "10.0.0.1"); violations != i {
+			t.Fatalf("violation %d counted as %d", i, violations)
+		}
+	}
+	fg.Mute("alice", "10.0.0.1", time.Minute)
+
+	// A reconnect from elsewhere keeps the mute, but others behind the same
+	// address are not muted with the flooder
+	if fg.MutedFor("alice", "10.0.0.2") <= 0 {
+		t.Fatal("mute did not follow the user")
+	}
+	if fg.MutedFor("bob", "10.0.0.1") > 0 {
+		t.Fatal("another user behind the same IP was muted")
+	}
+	if violations := fg.RecordViolation("bob", "10.0.0.1"); violations != 1 {
+		t.Fatalf("bob starts with %d violations", violations)
+	}
+
+	// Before login the IP is all there is to go by
+	fg.Mute("", "10.0.0.3", time.Minute)
+	if fg.MutedFor("", "10.0.0.3") <= 0 || fg.MutedFor("carol", "10.0.0.3") > 0 {
+		t.Fatal("IP mute before login applied wrongly")
+	}
+}
+
+func TestClassifyMessage(t *testing.T) {
+	tests := []struct {
+		msg      shared.Message
+		category RateCategory
+	}{
+		{shared.Message{Type: shared.MessageTypeText, Content: "hi"}, RateText},
+		{shared.Message{Type: shared.MessageTypeDirect}, RateDirect},
+		{shared.Message{Type: shared.MessageTypeCommand, Content: "msg bob hi"}, RateDirect},
+		{shared.Message{Type: shared.MessageTypeCommand, Content: "list"}, RateCommand},
+		{shared.Message{Type: shared.MessageTypeAuth}, RateAuth},
+		{shared.Message{Type: shared.MessageTypeFile}, RateFileBytes},
+		{shared.Message{Type: shared.MessageTypeUpload, Content: "start"}, RateControl},
+		{shared.Message{Type: shared.MessageTypePong}, RateControl},
+		{shared.Message{Type: shared.MessageTypeReadMarker}, RateControl},
+	}
+	for _, tt := range tests {
+		if category, _ := classifyMessage(tt.msg, 100); category != tt.category {
+			t.Errorf("%v %q classified as %v, want %v", tt.msg.Type, tt.msg.Content, category, tt.category)
+		}
+	}
+}
+
+func TestRateLimitRejectedByUserKeepsConnectionTokens(t *testing.T) {
+	s := newTestServer(t)
+	config := *s.Config()
+	config.RateLimits.PerConnection.Text = RateLimit{Rate: 0.001, Burst: 2}
+	config.RateLimits.PerUser.Text = RateLimit{Rate: 0.001, Burst: 1}
+	s.config.Store(&config)
+
+	alice := newTestClient(t, s)
+	alice.setUsername("alice")
+	text := shared.Message{Type: shared.MessageTypeText, Content: "hi"}
+	if allowed, _ := alice.checkRateLimit(text, 10); !allowed {
+		t.Fatal("first message was refused")
+	}
+	if allowed, _ := alice.checkRateLimit(text, 10); allowed {
+		t.Fatal("message over the per-user limit was allowed")
+	}
+	if !alice.limiter.Load().allow(RateText, 1) {
+		t.Fatal("message refused per user used up a connection token")
+	}
+
+	// Flooding mutes alice, not bob on the same address
+	for i := 0; i < config.RateLimits.MuteAfter; i++ {
+		alice.checkRateLimit(text, 10)
+	}
+	if s.Floods.MutedFor("alice", remoteIP(alice.Conn)) <= 0 {
+		t.Fatal("flooder was not muted")
+	}
+	bob := newTestClient(t, s)
+	bob.setUsername("bob")
+	if allowed, _ := bob.checkRateLimit(text, 10); !allowed {
+		t.Fatal("another user on the flooder's address was refused")
+	}
+}
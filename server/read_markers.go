@@ -0,0 +1,282 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"chatap.com/shared"
+)
+
+// ReadMarkers keeps how far each user has read each conversation, so that
+// all of a user's sessions agree on what is unread. Conversations are named
+// as in shared.ReadMarkerMessage. Markers move with every message read, so
+// they are saved by Flush, which flushLoop calls periodically.
+type ReadMarkers struct {
+	mu      sync.Mutex
+	path    string
+	markers map[string]map[string]time.Time // map[username]map[conversation]read up to
+	dirty   bool                            // Changed since the last save
+}
+
+func NewReadMarkers(path string) *ReadMarkers {
+	rm := &ReadMarkers{
+		path:    path,
+		markers: make(map[string]map[string]time.Time),
+	}
+
+	data, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(data, &rm.markers); err != nil {
+			log.Printf("Error parsing read markers %s: %v", path, err)
+		}
+	case !os.IsNotExist(err):
+		log.Printf("Error reading read markers %s: %v", path, err)
+	}
+
+	return rm
+}
+
+// Mark moves a user's marker for a conversation forward. It reports whether
+// the marker moved; markers never go back.
+func (rm *ReadMarkers) Mark(username, conversation string, readUpTo time.Time) bool {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	if !readUpTo.After(rm.markers[username][conversation]) {
+		return false
+	}
+	if rm.markers[username] == nil {
+		rm.markers[username] = make(map[string]time.Time)
+	}
+	rm.markers[username][conversation] = readUpTo
+	rm.dirty = true
+	return true
+}
+
+// Flush saves the markers if they changed since the last save
+func (rm *ReadMarkers) Flush() error {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	if !rm.dirty {
+		return nil
+	}
+	return rm.save()
+}
+
+// flushLoop flushes the markers at the given interval until quit is closed
+func (rm *ReadMarkers) flushLoop(interval time.Duration, quit <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := rm.Flush(); err != nil {
+				log.Printf("Error saving read markers: %v", err)
+			}
+		case <-quit:
+			return
+		}
+	}
+}
+
+// ForUser returns a copy of a user's markers
+func (rm *ReadMarkers) ForUser(username string) map[string]time.Time {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	markers := make(map[string]time.Time, len(rm.markers[username]))
+	for conversation, readUpTo := range rm.markers[username] {
+		markers[conversation] = readUpTo
+	}
+	return markers
+}
+
+// RenameUser moves a user's markers to a new name, along with the markers
+// others keep for their direct conversation with the user
+func (rm *ReadMarkers) RenameUser(oldName, newName string) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	if markers, ok := rm.markers[oldName]; ok {
+		rm.markers[newName] = markers
+		delete(rm.markers, oldName)
+	}
+	rm.moveConversation(shared.DirectConversation(oldName), shared.DirectConversation(newName))
+	if err := rm.save(); err != nil {
+		log.Printf("Error saving read markers: %v", err)
+	}
+}
+
+// RemoveUser forgets a deleted user's markers. Direct conversations with the
+// user are now with deletedUser.
+func (rm *ReadMarkers) RemoveUser(username string) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	delete(rm.markers, username)
+	rm.moveConversation(shared.DirectConversation(username), shared.DirectConversation(deletedUser))
+	if err := rm.save(); err != nil {
+		log.Printf("Error saving read markers: %v", err)
+	}
+}
+
+// moveConversation renames a conversation in everyone's markers, keeping the
+// later marker when both exist. The caller must hold rm.mu.
+func (rm *ReadMarkers) moveConversation(from, to string) {
+	for _, markers := range rm.markers {
+		readUpTo, ok := markers[from]
+		if !ok {
+			continue
+		}
+		delete(markers, from)
+		if readUpTo.After(markers[to]) {
+			markers[to] = readUpTo
+		}
+	}
+}
+
+// save writes the markers. The caller must hold rm.mu.
+func (rm *ReadMarkers) save() error {
+	data, err := json.MarshalIndent(rm.markers, "", "  ")
+	if err != nil {
+		return fmt.Errorf("serializing read markers: %v", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(rm.path), 0755); err != nil {
+		return fmt.Errorf("creating read markers directory: %v", err)
+	}
+
+	// Write to a temporary file and rename it so a crash never leaves a truncated file
+	tmpPath := rm.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return fmt.Errorf("writing read markers %s: %v", rm.path, err)
+	}
+	if err := os.Rename(tmpPath, rm.path); err != nil {
+		return fmt.Errorf("replacing read markers %s: %v", rm.path, err)
+	}
+	rm.dirty = false
+	return nil
+}
+
+// canMark reports whether the client may keep a marker for a conversation
+func (c *Client) canMark(conversation string) bool {
+	switch {
+	case strings.HasPrefix(conversation, "#"):
+		return shared.ValidateRoomName(conversation[1:]) == nil
+	case strings.HasPrefix(conversation, "@"):
+		name := conversation[1:]
+		return name == deletedUser || shared.ValidateUsername(name) == nil
+	default:
+		group, ok := c.Server.Groups.Get(conversation)
+		return ok && group.HasMember(c.Username())
+	}
+}
+
+// handleReadMarker records how far the client's user has read a conversation
+// and tells their other sessions
+func (c *Client) handleReadMarker(rawMsg []byte) {
+	if !c.loggedIn.Load() {
+		c.sendError("Not authenticated")
+		return
+	}
+
+	var marker shared.ReadMarkerMessage
+	if err := json.Unmarshal(rawMsg, &marker); err != nil || !c.canMark(marker.Conversation) {
+		c.sendError("Invalid read marker")
+		return
+	}
+	if now := time.Now(); marker.ReadUpTo.After(now) {
+		marker.ReadUpTo = now
+	}
+	if !c.Server.ReadMarkers.Mark(c.Username(), marker.Conversation, marker.ReadUpTo) {
+		return
+	}
+
+	update := shared.ReadMarkerMessage{
+		Message: shared.Message{
+			Type:      shared.MessageTypeReadMarker,
+			Sender:    "Server",
+			Timestamp: time.Now(),
+		},
+		Conversation: marker.Conversation,
+		ReadUpTo:     marker.ReadUpTo,
+	}
+	updateBytes, _ := json.Marshal(update)
+	for _, client := range c.Server.ClientsOf(c.Username()) {
+		if client != c {
+			client.SendDirectMessage(updateBytes)
+		}
+	}
+}
+
+// countUnread counts the messages from others after a read marker
+func countUnread(messages []shared.Message, username string, readUpTo time.Time) int {
+	count := 0
+	for _, msg := range messages {
+		if msg.Sender != username && msg.Timestamp.After(readUpTo) {
+			count++
+		}
+	}
+	return count
+}
+
+// unreadSummary lists the client's conversations with unread messages for
+// the unread command. Rooms count once the user has read them on some device
+// or while one of their sessions is in them.
+func (c *Client) unreadSummary() string {
+	s := c.Server
+	markers := s.ReadMarkers.ForUser(c.Username())
+	lines := make([]string, 0)
+
+	rooms := make(map[string]bool)
+	for conversation := range markers {
+		if strings.HasPrefix(conversation, "#") {
+			rooms[conversation[1:]] = true
+		}
+	}
+	for _, client := range s.ClientsOf(c.Username()) {
+		if room := client.Room(); room != nil {
+			rooms[room.Name] = true
+		}
+	}
+	roomNames := make([]string, 0, len(rooms))
+	for name := range rooms {
+		roomNames = append(roomNames, name)
+	}
+	sort.Strings(roomNames)
+	for _, name := range roomNames {
+		conversation := shared.RoomConversation(name)
+		if count := countUnread(s.MessageStore.GetRoomHistory(name), c.Username(), markers[conversation]); count > 0 {
+			lines = append(lines, fmt.Sprintf("  %s: %d", conversation, count))
+		}
+	}
+
+	for _, partner := range s.MessageStore.DirectPartners(c.Username()) {
+		conversation := shared.DirectConversation(partner)
+		history := s.MessageStore.GetDirectMessageHistory(c.Username(), partner)
+		if count := countUnread(history, c.Username(), markers[conversation]); count > 0 {
+			lines = append(lines, fmt.Sprintf("  %s: %d", conversation, count))
+		}
+	}
+
+	for _, group := range s.Groups.ForUser(c.Username()) {
+		if count := countUnread(s.MessageStore.GetGroupHistory(group.ID), c.Username(), markers[group.ID]); count > 0 {
+			lines = append(lines, fmt.Sprintf("  %s (%s): %d", group.ID, strings.Join(group.Members, ", "), count))
+		}
+	}
+
+	if len(lines) == 0 {
+		return "No unread messages"
+	}
+	return "Unread messages:\n" + strings.Join(lines, "\n")
+}
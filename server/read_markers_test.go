@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"chatap.com/shared"
+)
+
+func TestReadMarkersAreSavedOnFlush(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "read_markers.json")
+	rm := NewReadMarkers(path)
+
+	readUpTo := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	if !rm.Mark("alice", "#general", readUpTo) {
+		t.Fatal("marker did not move")
+	}
+	if rm.Mark("alice", "#general", readUpTo.Add(-time.Second)) {
+		t.Fatal("marker moved back")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatal("marker saved before the flush")
+	}
+
+	if err := rm.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if got := NewReadMarkers(path).ForUser("alice")["#general"]; !got.Equal(readUpTo) {
+		t.Fatalf("saved marker %v, want %v", got, readUpTo)
+	}
+}
+
+func TestShutdownFlushesReadMarkers(t *testing.T) {
+	s := newTestServer(t)
+	go s.handleChannels()
+
+	conversation := shared.RoomConversation("general")
+	s.ReadMarkers.Mark("alice", conversation, time.Now())
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := NewReadMarkers(s.ReadMarkers.path).ForUser("alice")[conversation]; !ok {
+		t.Fatal("marker lost at shutdown")
+	}
+}
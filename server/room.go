@@ -3,29 +3,25 @@ package main
 import (
 	"encoding/json"
 	"log"
-	"os"
-	"strings"
 	"sync"
 
 	"chatap.com/shared"
 )
 
 type Room struct {
-	Name               string
-	Clients            map[*Client]bool
-	Broadcast          chan []byte
-	mu                 sync.RWMutex
-	Server             *Server // Add reference to server
-	receivedFileChunks map[string][]shared.FileMessage
+	Name      string
+	Clients   map[*Client]bool
+	Broadcast chan []byte
+	mu        sync.RWMutex
+	Server    *Server // Add reference to server
 }
 
 func NewRoom(name string, server *Server) *Room {
 	return &Room{
-		Name:               name,
-		Clients:            make(map[*Client]bool),
-		Broadcast:          make(chan []byte),
-		Server:             server,
-		receivedFileChunks: make(map[string][]shared.FileMessage),
+		Name:      name,
+		Clients:   make(map[*Client]bool),
+		Broadcast: make(chan []byte),
+		Server:    server,
 	}
 }
 
@@ -53,13 +49,9 @@ func (r *Room) BroadcastMessage(message []byte, sender *Client) {
 			continue
 		}
 
-		select {
-		case client.Send <- message:
+		// The client's slow-consumer policy handles full queues
+		if client.Enqueue(message) {
 			clientCount++
-		default:
-			// Client's send buffer is full
-			log.Printf("Message dropped for client %s (username: %s) in room %s: send buffer full.",
-				client.Conn.RemoteAddr(), client.Username, r.Name)
 		}
 	}
 
@@ -68,59 +60,68 @@ func (r *Room) BroadcastMessage(message []byte, sender *Client) {
 	}
 }
 
-// BroadcastEvent broadcasts a standard event to all clients in the room
-func (r *Room) BroadcastEvent(eventType int, username string, extraInfo string) {
-	notification := shared.CreateEventMessage(eventType, username, r.Name, extraInfo)
-	notificationBytes, _ := json.Marshal(notification)
-	r.BroadcastMessage(notificationBytes, nil) // nil means broadcast to everyone
-}
+// BroadcastChat sends a chat message to everyone in the room. Busy members
+// get it later if it mentions them and are only told how many others they
+// missed, unless it is urgent. Mentions from a blocked user are dropped.
+// Members who are mentioned also get the message on their sessions in other
+// rooms.
+func (r *Room) BroadcastChat(msg shared.Message, message []byte) {
+	r.mu.RLock()
 
-// HandleFileChunk stores file chunks and processes complete files
-func (r *Room) HandleFileChunk(fileMsg shared.FileMessage) {
-	fileKey := fileMsg.Sender + "_" + fileMsg.Filename // Create unique key per user and filename
+	clientCount := 0
+	held := make(map[string]bool)      // Members it was held or counted for, once per user
+	mentioned := make(map[string]bool) // Members it was delivered to as a mention
+	for client := range r.Clients {
+		username := client.Username()
+		mention := mentions(msg.Content, username)
+		if mention && r.Server.Contacts.Blocks(username, msg.Sender) {
+			// Blocked users cannot get someone's attention by mentioning them
+			continue
+		}
 
-	r.mu.Lock()
-	if _, ok := r.receivedFileChunks[fileKey]; !ok {
-		r.receivedFileChunks[fileKey] = make([]shared.FileMessage, 0, fileMsg.TotalChunks)
-	}
-	r.receivedFileChunks[fileKey] = append(r.receivedFileChunks[fileKey], fileMsg)
-	currentChunks := len(r.receivedFileChunks[fileKey])
-	r.mu.Unlock()
+		if client.dnd.Load() && username != msg.Sender {
+			switch {
+			case held[username]:
+				continue
+			case mention && !msg.Urgent:
+				held[username] = true
+				r.Server.DND.Hold(username, msg)
+				continue
+			case !mention:
+				held[username] = true
+				r.Server.DND.Skip(username, r.Name)
+				continue
+			}
+		}
 
-	// Check if all chunks are received
-	if currentChunks == fileMsg.TotalChunks {
-		go r.saveCompleteFile(fileKey, fileMsg.Filename)
+		if client.Enqueue(message) {
+			clientCount++
+		}
+		if mention {
+			mentioned[username] = true
+		}
 	}
-}
+	r.mu.RUnlock()
 
-// saveCompleteFile saves the assembled file chunks to the server's uploads directory
-func (r *Room) saveCompleteFile(fileKey string, filename string) {
-	r.mu.Lock()
-	chunks := r.receivedFileChunks[fileKey]
-	delete(r.receivedFileChunks, fileKey) // Remove from memory after processing
-	r.mu.Unlock()
-
-	// Extract username from fileKey (format is "username_filename")
-	parts := strings.SplitN(fileKey, "_", 2)
-	username := parts[0]
-
-	// Get the upload directory path from the server
-	uploadDir := r.Server.GetRoomUploadPath(r.Name)
-	if err := os.MkdirAll(uploadDir, 0755); err != nil {
-		log.Printf("Failed to create upload directory for room %s: %v", r.Name, err)
-		return
+	if clientCount > 0 {
+		log.Printf("Broadcast message to %d clients in room %s", clientCount, r.Name)
 	}
 
-	// Save the file
-	if err := shared.SaveFileFromChunks(chunks, uploadDir); err != nil {
-		log.Printf("Failed to save file %s in room %s: %v", filename, r.Name, err)
-		return
+	// Looking up sessions takes the server lock, so it happens outside r.mu
+	for username := range mentioned {
+		for _, client := range r.Server.ClientsOf(username) {
+			if client.Room() != r {
+				client.Enqueue(message)
+			}
+		}
 	}
+}
 
-	log.Printf("File %s successfully saved in room %s at %s", filename, r.Name, uploadDir)
-
-	// Notify room that file is available using the new event system
-	r.BroadcastEvent(shared.EventFileUploaded, username, filename)
+// BroadcastEvent broadcasts a standard event to all clients in the room
+func (r *Room) BroadcastEvent(eventType int, username string, extraInfo string) {
+	notification := shared.CreateEventMessage(eventType, username, r.Name, extraInfo)
+	notificationBytes, _ := json.Marshal(notification)
+	r.BroadcastMessage(notificationBytes, nil) // nil means broadcast to everyone
 }
 
 type RoomManager struct {
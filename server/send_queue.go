@@ -0,0 +1,221 @@
+package main
+
+import (
+	"sync"
+)
+
+// Slow-consumer policies applied when a client's outgoing queue is full
+const (
+	PolicyDropOldest = "drop-oldest"
+	PolicyDisconnect = "disconnect"
+)
+
+// SendQueueConfig bounds each client's outgoing queue
+type SendQueueConfig struct {
+	// Maximum bytes buffered in the normal lane
+	MaxBytes int `json:"maxBytes"`
+	// Maximum bytes buffered in the control lane; overflowing it always disconnects
+	MaxControlBytes int `json:"maxControlBytes"`
+	// What to do when the normal lane is full: "drop-oldest" or "disconnect"
+	Policy string `json:"policy"`
+}
+
+func DefaultSendQueueConfig() SendQueueConfig {
+	return SendQueueConfig{
+		MaxBytes:        4 << 20,
+		MaxControlBytes: 256 << 10,
+		Policy:          PolicyDropOldest,
+	}
+}
+
+// pushResult describes the outcome of queueing a message
+type pushResult struct {
+	queued       bool
+	droppedCount int
+	droppedBytes int
+	overflow     bool // The policy requires the client to be disconnected
+}
+
+// queuedMessage is a message waiting in the normal lane
+type queuedMessage struct {
+	data []byte
+	keep bool // Never dropped by the drop-oldest policy
+}
+
+// sendQueue is a byte-bounded outgoing queue with a priority lane for control
+// frames. It is safe for concurrent use; a single writer drains it with pop.
+type sendQueue struct {
+	mu           sync.Mutex
+	config       SendQueueConfig
+	control      [][]byte
+	normal       []queuedMessage
+	controlBytes int
+	normalBytes  int
+	closed       bool
+	draining     bool // Closing once the queued messages are written
+	notify       chan struct{}
+}
+
+func newSendQueue(config SendQueueConfig) *sendQueue {
+	return &sendQueue{
+		config: config,
+		notify: make(chan struct{}, 1),
+	}
+}
+
+// push appends a message to the control or normal lane, applying the policy
+// when the lane is full
+func (q *sendQueue) push(message []byte, control bool) pushResult {
+	return q.add(message, control, false)
+}
+
+// pushKept appends a message to the normal lane that the drop-oldest policy
+// never drops. If it does not fit, the client has to be disconnected.
+func (q *sendQueue) pushKept(message []byte) pushResult {
+	return q.add(message, false, true)
+}
+
+func (q *sendQueue) add(message []byte, control, keep bool) pushResult {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var result pushResult
+	if q.closed || q.draining {
+		return result
+	}
+
+	size := len(message)
+	if control {
+		if q.controlBytes+size > q.config.MaxControlBytes {
+			result.overflow = true
+			return result
+		}
+		q.control = append(q.control, message)
+		q.controlBytes += size
+	} else {
+		if q.normalBytes+size > q.config.MaxBytes {
+			if q.config.Policy == PolicyDisconnect {
+				result.overflow = true
+				return result
+			}
+
+			// Drop the oldest messages that may be dropped until the new one fits
+			remaining := q.normal[:0]
+			for _, queued := range q.normal {
+				if !queued.keep && q.normalBytes+size > q.config.MaxBytes {
+					result.droppedCount++
+					result.droppedBytes += len(queued.data)
+					q.normalBytes -= len(queued.data)
+					continue
+				}
+				remaining = append(remaining, queued)
+			}
+			for i := len(remaining); i < len(q.normal); i++ {
+				q.normal[i] = queuedMessage{}
+			}
+			q.normal = remaining
+
+			if q.normalBytes+size > q.config.MaxBytes {
+				if keep {
+					result.overflow = true
+					return result
+				}
+				result.droppedCount++
+				result.droppedBytes += size
+				return result
+			}
+		}
+		q.normal = append(q.normal, queuedMessage{data: message, keep: keep})
+		q.normalBytes += size
+	}
+
+	result.queued = true
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	return result
+}
+
+// pop blocks until a message is available, preferring the control lane.
+// It returns false once the queue has been closed, or drained after drain.
+func (q *sendQueue) pop() ([]byte, bool) {
+	for {
+		q.mu.Lock()
+		if q.closed {
+			q.mu.Unlock()
+			return nil, false
+		}
+		if len(q.control) > 0 {
+			message := q.control[0]
+			q.control[0] = nil
+			q.control = q.control[1:]
+			q.controlBytes -= len(message)
+			q.mu.Unlock()
+			return message, true
+		}
+		if len(q.normal) > 0 {
+			message := q.normal[0].data
+			q.normal[0] = queuedMessage{}
+			q.normal = q.normal[1:]
+			q.normalBytes -= len(message)
+			q.mu.Unlock()
+			return message, true
+		}
+		if q.draining {
+			q.closed = true
+			q.mu.Unlock()
+			return nil, false
+		}
+		q.mu.Unlock()
+
+		<-q.notify
+	}
+}
+
+// setConfig changes the limits for messages queued from now on
+func (q *sendQueue) setConfig(config SendQueueConfig) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.config = config
+}
+
+// pending returns the number of bytes waiting to be written
+func (q *sendQueue) pending() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.controlBytes + q.normalBytes
+}
+
+// drain stops queueing messages and lets the writer write those already
+// queued, after which pop reports the queue closed
+func (q *sendQueue) drain() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.draining = true
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+// close discards queued messages and wakes the writer. It may be called more than once.
+func (q *sendQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return
+	}
+	q.closed = true
+	q.control = nil
+	q.normal = nil
+	q.controlBytes = 0
+	q.normalBytes = 0
+
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
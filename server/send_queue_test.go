@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"chatap.com/shared"
+)
+
+func testQueueConfig(maxBytes int, policy string) SendQueueConfig {
+	return SendQueueConfig{
+		MaxBytes:        maxBytes,
+		MaxControlBytes: maxBytes,
+		Policy:          policy,
+	}
+}
+
+func TestSendQueueLanesConcurrent(t *testing.T) {
+	q := newSendQueue(testQueueConfig(1<<30, PolicyDisconnect))
+
+	const producers, perProducer = 8, 500
+	var wg sync.WaitGroup
+	for p := 0; p < producers; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			for i := 0; i < perProducer; i++ {
+				control := i%3 == 0
+				if result := q.push([]byte(fmt.Sprintf("%d/%d", p, i)), control); !result.queued {
+					t.Errorf("push %d/%d was not queued: %+v", p, i, result)
+				}
+			}
+		}(p)
+	}
+
+	// A single writer drains the queue while producers push, keeping each
+	// producer's messages in order within a lane
+	received := make(chan int)
+	go func() {
+		count := 0
+		last := make(map[string]int)
+		for {
+			message, ok := q.pop()
+			if !ok {
+				received <- count
+				return
+			}
+			var p, i int
+			fmt.Sscanf(string(message), "%d/%d", &p, &i)
+			lane := fmt.Sprintf("%d-%v", p, i%3 == 0)
+			if previous, seen := last[lane]; seen && i <= previous {
+				t.Errorf("message %d/%d popped after %d", p, i, previous)
+			}
+			last[lane] = i
+			count++
+			if count == producers*perProducer {
+				q.close()
+			}
+		}
+	}()
+
+	wg.Wait()
+	select {
+	case count := <-received:
+		if count != producers*perProducer {
+			t.Fatalf("popped %d messages, want %d", count, producers*perProducer)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("writer did not drain the queue")
+	}
+	if pending := q.pending(); pending != 0 {
+		t.Fatalf("%d bytes pending after close", pending)
+	}
+}
+
+func TestSendQueueControlFirst(t *testing.T) {
+	q := newSendQueue(testQueueConfig(1024, PolicyDropOldest))
+	q.push([]byte("normal"), false)
+	q.push([]byte("control"), true)
+
+	for _, want := range []string{"control", "normal"} {
+		message, ok := q.pop()
+		if !ok || string(message) != want {
+			t.Fatalf("pop = %q, %v; want %q", message, ok, want)
+		}
+	}
+}
+
+func TestSendQueueDropOldest(t *testing.T) {
+	q := newSendQueue(testQueueConfig(10, PolicyDropOldest))
+	for _, message := range []string{"aaaa", "bbbb"} {
+		if result := q.push([]byte(message), false); !result.queued || result.droppedCount != 0 {
+			t.Fatalf("push %q: %+v", message, result)
+		}
+	}
+
+	result := q.push([]byte("cccccc"), false)
+	if !result.queued || result.droppedCount != 1 || result.droppedBytes != 4 || result.overflow {
+		t.Fatalf("push over the limit: %+v", result)
+	}
+
+	// A message larger than the whole lane empties it and is dropped itself
+	result = q.push(bytes.Repeat([]byte("x"), 11), false)
+	if result.queued || result.droppedCount != 3 || result.overflow {
+		t.Fatalf("push of an oversized message: %+v", result)
+	}
+	if pending := q.pending(); pending != 0 {
+		t.Fatalf("%d bytes pending, want 0", pending)
+	}
+}
+
+func TestSendQueueDisconnectPolicy(t *testing.T) {
+	q := newSendQueue(testQueueConfig(8, PolicyDisconnect))
+	if result := q.push([]byte("12345678"), false); !result.queued {
+		t.Fatalf("push within the limit: %+v", result)
+	}
+	if result := q.push([]byte("9"), false); result.queued || !result.overflow || result.droppedCount != 0 {
+		t.Fatalf("push over the limit: %+v", result)
+	}
+
+	// The control lane always disconnects when it overflows
+	q = newSendQueue(testQueueConfig(8, PolicyDropOldest))
+	q.push([]byte("12345678"), true)
+	if result := q.push([]byte("9"), true); result.queued || !result.overflow {
+		t.Fatalf("control push over the limit: %+v", result)
+	}
+}
+
+func TestSendQueueKeepsReplies(t *testing.T) {
+	q := newSendQueue(testQueueConfig(10, PolicyDropOldest))
+	q.push([]byte("aaaa"), false)
+	if result := q.pushKept([]byte("bbbb")); !result.queued {
+		t.Fatalf("kept push within the limit: %+v", result)
+	}
+
+	// Only droppable messages make room
+	if result := q.push([]byte("cccccc"), false); !result.queued || result.droppedCount != 1 {
+		t.Fatalf("push over the limit: %+v", result)
+	}
+
+	// Kept messages stay in order with the others
+	for _, want := range []string{"bbbb", "cccccc"} {
+		if message, _ := q.pop(); string(message) != want {
+			t.Fatalf("pop = %q, want %q", message, want)
+		}
+	}
+
+	// A kept message that cannot fit disconnects instead
+	q.pushKept([]byte("eeeeeeee"))
+	if result := q.pushKept([]byte("ffff")); result.queued || !result.overflow {
+		t.Fatalf("kept push that cannot fit: %+v", result)
+	}
+}
+
+func TestSendQueueDrain(t *testing.T) {
+	q := newSendQueue(testQueueConfig(1024, PolicyDropOldest))
+	q.push([]byte("normal"), false)
+	q.push([]byte("control"), true)
+	q.drain()
+	if result := q.push([]byte("late"), false); result.queued {
+		t.Fatal("push to a draining queue was queued")
+	}
+
+	for _, want := range []string{"control", "normal"} {
+		message, ok := q.pop()
+		if !ok || string(message) != want {
+			t.Fatalf("pop = %q, %v; want %q", message, ok, want)
+		}
+	}
+	if _, ok := q.pop(); ok {
+		t.Fatal("pop returned a message after draining")
+	}
+}
+
+func TestSendQueueCloseWakesWriter(t *testing.T) {
+	q := newSendQueue(testQueueConfig(1024, PolicyDropOldest))
+	done := make(chan bool)
+	go func() {
+		_, ok := q.pop()
+		done <- ok
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	q.close()
+	q.close()
+	select {
+	case ok := <-done:
+		if ok {
+			t.Fatal("pop returned a message from a closed queue")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("close did not wake the writer")
+	}
+	if result := q.push([]byte("late"), false); result.queued {
+		t.Fatal("push to a closed queue was queued")
+	}
+}
+
+// newTestServer returns a server with its stores in a temporary directory
+func newTestServer(t *testing.T) *Server {
+	t.Helper()
+	dir := t.TempDir()
+	config := DefaultConfig()
+	config.MessageHistoryDir = filepath.Join(dir, "message_history")
+	config.UploadsDir = filepath.Join(dir, "uploads")
+	if err := config.Validate(); err != nil {
+		t.Fatalf("test configuration: %v", err)
+	}
+	return NewServer(config)
+}
+
+// newTestClient connects a client to its server over a pipe whose other end
+// is drained
+func newTestClient(t *testing.T, s *Server) *Client {
+	t.Helper()
+	conn, peer := net.Pipe()
+	t.Cleanup(func() { peer.Close() })
+	go io.Copy(io.Discard, peer)
+
+	client := NewClient(conn, s)
+	go client.WritePump()
+	return client
+}
+
+func TestEnqueueRacesDisconnectAndUnregister(t *testing.T) {
+	s := newTestServer(t)
+	go s.handleChannels()
+	defer close(s.quit)
+
+	for round := 0; round < 20; round++ {
+		client := newTestClient(t, s)
+		s.Register <- client
+
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				message := bytes.Repeat([]byte("m"), 512)
+				for j := 0; j < 50; j++ {
+					if i%2 == 0 {
+						client.EnqueueControl(message)
+					} else {
+						client.Enqueue(message)
+					}
+				}
+			}(i)
+		}
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			client.disconnect()
+		}()
+		go func() {
+			defer wg.Done()
+			s.unregister(client)
+		}()
+		wg.Wait()
+
+		// Once disconnected nothing is queued any more
+		if client.Enqueue([]byte("late")) {
+			t.Fatal("message queued after disconnect")
+		}
+	}
+
+	// The last unregistration may still be in progress
+	deadline := time.Now().Add(time.Second)
+	for {
+		s.mu.RLock()
+		registered := len(s.Clients)
+		s.mu.RUnlock()
+		if registered == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d clients still registered", registered)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCommandRepliesSurviveDropOldest(t *testing.T) {
+	s := newTestServer(t)
+	config := *s.Config()
+	config.SendQueue.MaxBytes = 4 * config.ChunkSize
+	config.SendQueue.Policy = PolicyDropOldest
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	s.config.Store(&config)
+
+	// Nothing writes the queue, so it fills up
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	client := NewClient(conn, s)
+	client.login("alice", "")
+	client.request.Store("7")
+	client.handleCommand(shared.Message{Type: shared.MessageTypeCommand, Content: "rooms"})
+
+	broadcast := bytes.Repeat([]byte("b"), config.ChunkSize)
+	for i := 0; i < 8; i++ {
+		client.Enqueue(broadcast)
+	}
+
+	for client.queue.pending() > 0 {
+		message, _ := client.queue.pop()
+		var reply shared.Message
+		if json.Unmarshal(message, &reply) == nil && reply.RequestID == "7" {
+			return
+		}
+	}
+	t.Fatal("the rooms reply was dropped")
+}
+
+func TestFloodDisconnectWritesErrorFirst(t *testing.T) {
+	s := newTestServer(t)
+	config := *s.Config()
+	config.RateLimits.PerConnection.Command = RateLimit{Rate: 0.001, Burst: 1}
+	config.RateLimits.MuteAfter = 0
+	config.RateLimits.DisconnectAfter = 2
+	s.config.Store(&config)
+	go s.handleChannels()
+	defer close(s.quit)
+
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	client := NewClient(conn, s)
+	s.Register <- client
+	go client.ReadPump()
+	go client.WritePump()
+
+	go func() {
+		for i := 0; i < 3; i++ {
+			if _, err := peer.Write([]byte(`{"type":1,"content":"rooms"}` + "\n")); err != nil {
+				return
+			}
+		}
+	}()
+
+	// Everything queued is written before the connection closes
+	peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var last string
+	scanner := bufio.NewScanner(peer)
+	for scanner.Scan() {
+		last = scanner.Text()
+	}
+	if !strings.Contains(last, "ERROR: Disconnected for flooding") {
+		t.Fatalf("last message before the connection closed: %q", last)
+	}
+}
@@ -1,56 +1,149 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"chatap.com/shared"
 )
 
-const (
-	UploadsDir = "uploads"
-)
+// ErrServerClosed is returned by Run after Shutdown has been called
+var ErrServerClosed = errors.New("server closed")
 
 type Server struct {
 	Addr         string
+	config       atomic.Pointer[Config]
 	AuthManager  *AuthManager
+	LoginGuard   *LoginGuard
+	Floods       *FloodGuard
 	RoomManager  *RoomManager
 	MessageStore *MessageStore
+	Uploads      *UploadManager
+	Files        *FileIndex
+	Mailbox      *Mailbox
+	Presence     *PresenceService
+	DND          *DoNotDisturb
+	Contacts     *ContactBook
+	Groups       *GroupStore
+	Profiles     *ProfileStore
+	ReadMarkers  *ReadMarkers
 	Clients      map[*Client]bool
 	Register     chan *Client
 	Unregister   chan *Client
+	Metrics      *Metrics
 	mu           sync.RWMutex
+
+	// Per-user rate limiters shared by all of a user's connections
+	userLimiters map[string]*rateLimiter
+	limitersMu   sync.Mutex
+
+	// Shutdown state
+	listener     net.Listener
+	shuttingDown bool
+	quit         chan struct{}
+	fileSaves    sync.WaitGroup // In-flight file assemblies
+	savesMu      sync.Mutex
+	savesStopped bool // Set once Shutdown waits for fileSaves
 }
 
-func NewServer(addr string) *Server {
+func NewServer(config *Config) *Server {
 	server := &Server{
-		Addr:        addr,
-		AuthManager: NewAuthManager(),
+		Addr:        config.ListenAddr,
+		AuthManager: NewAuthManager(config.Auth, filepath.Join(config.MessageHistoryDir, "users.json")),
+		LoginGuard:  NewLoginGuard(config.Auth),
+		Floods:      NewFloodGuard(config.RateLimits),
 		Clients:     make(map[*Client]bool),
 		Register:    make(chan *Client),
 		Unregister:  make(chan *Client),
+		Metrics:     NewMetrics(),
+
+		userLimiters: make(map[string]*rateLimiter),
+		quit:         make(chan struct{}),
 	}
 
+	server.config.Store(config)
+	server.AuthManager.SetAdmins(config.Admins)
+
 	// Initialize message store
-	server.MessageStore = NewMessageStore(server)
+	server.MessageStore = NewMessageStore(server, config.MessageHistoryDir)
 
 	// Initialize RoomManager with reference to server
 	server.RoomManager = NewRoomManager(server)
 
+	server.Uploads = NewUploadManager(server)
+	server.Files = NewFileIndex(config.UploadsDir)
+	server.Mailbox = NewMailbox(filepath.Join(config.MessageHistoryDir, "mailbox.json"))
+	server.Presence = NewPresenceService(filepath.Join(config.MessageHistoryDir, "presence.json"))
+	server.DND = NewDoNotDisturb()
+	server.Contacts = NewContactBook(filepath.Join(config.MessageHistoryDir, "contacts.json"))
+	server.Groups = NewGroupStore(filepath.Join(config.MessageHistoryDir, "groups.json"))
+	server.Profiles = NewProfileStore(filepath.Join(config.MessageHistoryDir, "profiles.json"),
+		filepath.Join(config.UploadsDir, avatarsDir))
+	server.ReadMarkers = NewReadMarkers(filepath.Join(config.MessageHistoryDir, "read_markers.json"))
+
 	return server
 }
 
+// Config returns the current configuration. It must be treated as read-only.
+func (s *Server) Config() *Config {
+	return s.config.Load()
+}
+
+// ApplyConfig switches a running server to a reloaded configuration. Settings
+// that need a restart keep their current values; connections stay open.
+func (s *Server) ApplyConfig(config *Config) {
+	old := s.Config()
+	if changed := restartRequired(old, config); len(changed) > 0 {
+		log.Printf("Config reload: changes to %s need a restart and were not applied", strings.Join(changed, ", "))
+		updated := *config
+		updated.ListenAddr = old.ListenAddr
+		updated.UploadsDir = old.UploadsDir
+		updated.MessageHistoryDir = old.MessageHistoryDir
+		updated.ChunkSize = old.ChunkSize
+		if updated.SendQueue.MaxBytes < 4*updated.ChunkSize {
+			updated.SendQueue.MaxBytes = 4 * updated.ChunkSize
+		}
+		config = &updated
+	}
+
+	s.config.Store(config)
+	s.AuthManager.Configure(config.Auth)
+	s.AuthManager.SetAdmins(config.Admins)
+	s.LoginGuard.SetConfig(config.Auth)
+	s.Floods.SetConfig(config.RateLimits)
+	s.resetUserRateLimiters()
+
+	// Existing connections pick up the new limits too
+	s.mu.RLock()
+	for client := range s.Clients {
+		client.limiter.Store(newRateLimiter(config.RateLimits.PerConnection))
+		client.queue.setConfig(config.SendQueue)
+	}
+	s.mu.RUnlock()
+
+	log.Printf("Configuration reloaded")
+}
+
 func (s *Server) Run() error {
 	// Create uploads directory
-	if err := os.MkdirAll(UploadsDir, 0755); err != nil {
+	uploadsDir := s.Config().UploadsDir
+	if err := os.MkdirAll(uploadsDir, 0755); err != nil {
 		return fmt.Errorf("failed to create uploads directory: %v", err)
 	}
-	log.Printf("Uploads directory initialized at: %s", UploadsDir)
+	log.Printf("Uploads directory initialized at: %s", uploadsDir)
+
+	// Pick up uploads interrupted by the last shutdown
+	s.Uploads.Restore()
 
 	listener, err := net.Listen("tcp", s.Addr)
 	if err != nil {
@@ -58,53 +151,91 @@ func (s *Server) Run() error {
 	}
 	defer listener.Close()
 
+	s.mu.Lock()
+	if s.shuttingDown {
+		s.mu.Unlock()
+		return ErrServerClosed
+	}
+	s.listener = listener
+	s.mu.Unlock()
+
 	go s.handleChannels()
+	go s.Metrics.logPeriodically(time.Minute, s.quit)
+	go s.LoginGuard.pruneLoop(10*time.Minute, s.quit)
+	go s.Floods.pruneLoop(10*time.Minute, s.quit)
+	go s.Uploads.expireLoop(time.Minute)
+	go s.ReadMarkers.flushLoop(5*time.Second, s.quit)
+	go s.AuthManager.flushLoop(time.Minute, s.quit)
+	go s.heartbeatLoop()
 
 	log.Printf("TCP Chat Server started on %s", s.Addr)
 
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
+			if s.isShuttingDown() {
+				return ErrServerClosed
+			}
 			log.Printf("Error accepting connection: %v", err)
 			continue
 		}
 
 		// Set timeout for idle connections
-		conn.SetDeadline(time.Now().Add(5 * time.Minute))
+		conn.SetDeadline(time.Now().Add(s.Config().ReadTimeout()))
 
 		client := NewClient(conn, s)
-		s.Register <- client
+		if !s.register(client) {
+			conn.Close()
+			return ErrServerClosed
+		}
 
 		go client.ReadPump()
 		go client.WritePump()
 	}
 }
 
+// register adds a new connection. It fails once the server has stopped.
+func (s *Server) register(client *Client) bool {
+	select {
+	case s.Register <- client:
+		return true
+	case <-s.quit:
+		return false
+	}
+}
+
 func (s *Server) handleChannels() {
 	for {
 		select {
+		case <-s.quit:
+			return
+
 		case client := <-s.Register:
 			s.mu.Lock()
+			if s.shuttingDown {
+				// Accepted just before the listener closed, but too late to
+				// be told about the shutdown
+				s.mu.Unlock()
+				client.disconnect()
+				continue
+			}
 			s.Clients[client] = true
 			s.mu.Unlock()
 			log.Printf("New client connected: %s", client.Conn.RemoteAddr())
 
 		case client := <-s.Unregister:
 			s.mu.Lock()
-			if _, ok := s.Clients[client]; ok {
-				// Store room reference before removing the client
-				room := client.Room
-				username := client.Username
+			_, registered := s.Clients[client]
+			if registered {
+				// Take the client out of its room before removing it
+				room := client.leaveRoom()
+				username := client.Username()
 
 				delete(s.Clients, client)
-				close(client.Send)
+				client.disconnect()
 
 				// If client was in a room, notify other members about the disconnection
 				if room != nil && username != "" {
-					// First remove client from room's client list
-					room.RemoveClient(client)
-
-					// Then broadcast that they've disconnected
 					room.BroadcastEvent(shared.EventUserDisconnected, username, "")
 
 					log.Printf("Client %s removed from room %s due to disconnection",
@@ -114,48 +245,92 @@ func (s *Server) handleChannels() {
 				log.Printf("Client disconnected: %s", client.Conn.RemoteAddr())
 			}
 			s.mu.Unlock()
+
+			// Announcing looks clients up, so it must happen outside s.mu.
+			// Sessions ended by another one count even though they were
+			// logged out first.
+			if username := client.Username(); registered && username != "" && s.Presence.Disconnect(username) {
+				if presence, _ := s.Presence.Get(username); presence.Status != shared.StatusOffline {
+					s.announcePresence(username, shared.StatusOffline.String())
+				}
+			}
 		}
 	}
 }
 
-// Add this new method to find a client by username
+// FindClientByUsername returns one of a user's sessions, or nil when they are
+// not connected. Use ClientsOf to reach every session.
 func (s *Server) FindClientByUsername(username string) *Client {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
 	for client := range s.Clients {
-		if client.Username == username {
+		if client.Username() == username {
 			return client
 		}
 	}
 	return nil
 }
 
-// Add this new method to send a message to a specific client
-func (s *Server) SendToClient(username string, message []byte) bool {
-	client := s.FindClientByUsername(username)
-	if client == nil {
-		return false
+// ClientsOf returns every logged-in session of a user, oldest first
+func (s *Server) ClientsOf(username string) []*Client {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	clients := make([]*Client, 0, 1)
+	for client := range s.Clients {
+		if client.loggedIn.Load() && client.Username() == username {
+			clients = append(clients, client)
+		}
 	}
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].ConnectedAt.Before(clients[j].ConnectedAt)
+	})
+	return clients
+}
 
-	client.SendDirectMessage(message)
-	return true
+// SendToUser sends a message to every session of a user and reports whether
+// they have any
+func (s *Server) SendToUser(username string, message []byte) bool {
+	clients := s.ClientsOf(username)
+	for _, client := range clients {
+		client.SendDirectMessage(message)
+	}
+	return len(clients) > 0
 }
 
-// GetRoomUploadPath returns the path where files for a specific room should be stored
-func (s *Server) GetRoomUploadPath(roomName string) string {
-	return filepath.Join(UploadsDir, roomName)
+// sendErrorToUser reports a failure to every session of a user. It is for
+// outcomes that answer no particular request, such as a background file save.
+func (s *Server) sendErrorToUser(username, message string) {
+	s.SendToUser(username, serverNotice("ERROR: "+message))
 }
 
-// IsUserLoggedIn checks if a username is already being used by an active client
-func (s *Server) IsUserLoggedIn(username string) bool {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+// sendSuccessToUser is sendErrorToUser for outcomes that went well
+func (s *Server) sendSuccessToUser(username, message string) {
+	s.SendToUser(username, serverNotice("SUCCESS: "+message))
+}
 
-	for client := range s.Clients {
-		if client.isLoggedIn && client.Username == username {
-			return true
+func serverNotice(content string) []byte {
+	notice, _ := json.Marshal(shared.Message{
+		Type:      shared.MessageTypeCommand,
+		Content:   content,
+		Sender:    "Server",
+		Timestamp: time.Now(),
+	})
+	return notice
+}
+
+// PartialUploadsDir returns where unfinished uploads are checkpointed
+func (s *Server) PartialUploadsDir() string {
+	return filepath.Join(s.Config().UploadsDir, ".partial")
+}
+
+// FindSession returns a user's session by ID
+func (s *Server) FindSession(username, sessionID string) *Client {
+	for _, client := range s.ClientsOf(username) {
+		if client.SessionID == sessionID {
+			return client
 		}
 	}
-	return false
+	return nil
 }
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"chatap.com/shared"
+)
+
+// maxDeviceNameLength limits the device name a client gives at login
+const maxDeviceNameLength = 32
+
+func newSessionID() (string, error) {
+	buf := make([]byte, 3)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return "s" + hex.EncodeToString(buf), nil
+}
+
+// deviceName cleans the device name sent at login
+func deviceName(name string) string {
+	if name = cleanText(name, maxDeviceNameLength); name == "" {
+		return "unknown device"
+	}
+	return name
+}
+
+// describeSession returns a line about the session for /sessions, e.g.
+// "s1a2b3  laptop  127.0.0.1  since 2024-05-01 09:12:03  in general"
+func (c *Client) describeSession() string {
+	parts := []string{
+		c.SessionID,
+		c.Device,
+		remoteIP(c.Conn),
+		"since " + c.ConnectedAt.Format("2006-01-02 15:04:05"),
+	}
+	if room := c.Room(); room != nil {
+		parts = append(parts, "in "+room.Name)
+	}
+	if idle := c.IdleFor(); idle >= time.Minute {
+		parts = append(parts, "idle "+idle.Round(time.Minute).String())
+	}
+	return strings.Join(parts, "  ")
+}
+
+// otherSessions tells a client about the user's sessions on other devices
+func (c *Client) otherSessions() string {
+	devices := make([]string, 0)
+	for _, client := range c.Server.ClientsOf(c.Username()) {
+		if client != c {
+			devices = append(devices, client.Device+" ("+client.SessionID+")")
+		}
+	}
+	return strings.Join(devices, ", ")
+}
+
+// handleSessionCommand lists the user's sessions or logs one out
+func (c *Client) handleSessionCommand(cmd string, args []string) {
+	switch cmd {
+	case "sessions":
+		sessions := c.Server.ClientsOf(c.Username())
+		lines := make([]string, len(sessions))
+		for i, client := range sessions {
+			lines[i] = "  " + client.describeSession()
+			if client == c {
+				lines[i] += "  (this session)"
+			}
+		}
+		c.sendSuccess(fmt.Sprintf("Sessions (%d):\n%s", len(sessions), strings.Join(lines, "\n")))
+
+	case "logout":
+		if len(args) < 2 {
+			c.sendError("Usage: logout <session-id>. See sessions for the IDs")
+			return
+		}
+		target := c.Server.FindSession(c.Username(), args[1])
+		if target == nil {
+			c.sendError("No such session: " + args[1])
+			return
+		}
+
+		log.Printf("User %s logged out session %s (%s) from session %s", c.Username(), target.SessionID, target.Device, c.SessionID)
+		if target != c {
+			c.sendSuccess("Logged out " + target.Device + " (" + target.SessionID + ")")
+		}
+		target.endSession(c, "Logged out by "+c.Device+" ("+c.SessionID+")")
+	}
+}
+
+// endSession takes the client out of its room, says goodbye with the reason
+// and disconnects it. by is the session whose request ended it, if any; the
+// goodbye is only part of the reply when that is the client itself.
+func (c *Client) endSession(by *Client, reason string) {
+	// Nothing the client sends from now on counts
+	c.loggedIn.Store(false)
+	if room := c.leaveRoom(); room != nil {
+		room.BroadcastEvent(shared.EventUserLeft, c.Username(), "")
+	}
+	if by == c {
+		c.sendSuccess("Goodbye! " + reason)
+		c.sendSession(true)
+		// The request is over; the queue takes nothing once it drains
+		c.finishRequest(c.requestID())
+	} else {
+		c.notify("Goodbye! " + reason)
+		c.notifySession(true)
+	}
+
+	// ReadPump unregisters the client once the goodbye is written
+	c.disconnectAfterFlush()
+}
+
+// sendSession tells the client its username and room after either changed,
+// or that its session ended
+func (c *Client) sendSession(ended bool) {
+	c.EnqueueReliable(c.sessionMessage(ended, c.requestID()))
+}
+
+// notifySession is sendSession for changes made by another session, which
+// belong to none of the client's requests
+func (c *Client) notifySession(ended bool) {
+	c.EnqueueReliable(c.sessionMessage(ended, ""))
+}
+
+// sessionMessage builds the message sendSession and notifySession send
+func (c *Client) sessionMessage(ended bool, requestID string) []byte {
+	session := shared.SessionMessage{
+		Message: shared.Message{
+			Type:      shared.MessageTypeSession,
+			Sender:    "Server",
+			Timestamp: time.Now(),
+			RequestID: requestID,
+		},
+		Username: c.Username(),
+		Ended:    ended,
+	}
+	if room := c.Room(); room != nil && !ended {
+		session.Room = room.Name
+	}
+
+	sessionBytes, _ := json.Marshal(session)
+	return sessionBytes
+}
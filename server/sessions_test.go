@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"chatap.com/shared"
+)
+
+func TestLogoutWhileRoomIsBusy(t *testing.T) {
+	s := newTestServer(t)
+	go s.handleChannels()
+	defer close(s.quit)
+	s.AuthManager.RegisterUser("alice", "secret1")
+	s.AuthManager.RegisterUser("bob", "secret2")
+
+	ending := loginTestSession(t, s, "alice", "secret1")
+	other := loginTestSession(t, s, "alice", "secret1")
+	bob := loginTestSession(t, s, "bob", "secret2")
+	for _, session := range []*testSession{ending, bob} {
+		session.send(shared.Message{Type: shared.MessageTypeCommand, Content: "join", Room: "general"})
+		session.expect("SUCCESS: Joined room")
+	}
+
+	// Mentions make the room look up the rooms of alice's sessions while
+	// the other session takes the ending one out of its room
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 10; i++ {
+			bob.send(shared.Message{Type: shared.MessageTypeText, Content: "hi @alice", Room: "general"})
+			ending.trySend(shared.Message{Type: shared.MessageTypeCommand, Content: "list"})
+		}
+	}()
+	other.send(shared.Message{Type: shared.MessageTypeCommand, Content: "logout " + ending.client.SessionID})
+	<-done
+
+	ending.expect("SUCCESS: Goodbye!")
+	room := s.RoomManager.GetRoom("general")
+	deadline := time.Now().Add(time.Second)
+	for {
+		room.mu.RLock()
+		inRoom := room.Clients[ending.client]
+		room.mu.RUnlock()
+		if !inRoom && ending.client.Room() == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("ended session is still in its room")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSessionEndedByAnotherAnswersNoRequest(t *testing.T) {
+	s := newTestServer(t)
+	newSession := func() *Client {
+		conn, peer := net.Pipe()
+		t.Cleanup(func() { peer.Close() })
+		client := NewClient(conn, s)
+		client.login("alice", "")
+		return client
+	}
+	ending, other := newSession(), newSession()
+
+	// The ending session is in the middle of its own request
+	ending.request.Store("5")
+	other.request.Store("5")
+	ending.endSession(other, "Logged out")
+
+	goodbyes := 0
+	for ending.queue.pending() > 0 {
+		message, _ := ending.queue.pop()
+		var msg shared.Message
+		json.Unmarshal(message, &msg)
+		if msg.RequestID != "" {
+			t.Fatalf("%q joined request %s", message, msg.RequestID)
+		}
+		goodbyes++
+	}
+	if goodbyes != 2 {
+		t.Fatalf("%d messages queued, want the goodbye and the ended session", goodbyes)
+	}
+}
+
+func TestEndingOwnSessionCompletesTheRequest(t *testing.T) {
+	s := newTestServer(t)
+	go s.handleChannels()
+	defer close(s.quit)
+	s.AuthManager.RegisterUser("alice", "secret1")
+	s.RoomManager.CreateRoom("general")
+	addr := serveTestListener(t, s)
+
+	ctx := context.Background()
+	for _, command := range []string{"exit", "logout "} {
+		chat := dialTestChat(t, addr, "alice", "secret1")
+		sessions := s.ClientsOf("alice")
+		server := sessions[len(sessions)-1]
+		if command == "logout " {
+			command += server.SessionID
+		}
+
+		reply, err := chat.Command(ctx, command)
+		if err != nil {
+			t.Fatalf("%s: %v", command, err)
+		}
+		if !strings.HasPrefix(reply.Text(), "SUCCESS: Goodbye!") {
+			t.Fatalf("%s: %q", command, reply.Text())
+		}
+		if server.loggedIn.Load() {
+			t.Fatalf("still logged in after %s", command)
+		}
+		<-chat.Done()
+	}
+}
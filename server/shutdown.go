@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"chatap.com/shared"
+)
+
+// ReconnectHint is included in the shutdown notice sent to clients
+const ReconnectHint = "Please reconnect in a minute."
+
+func (s *Server) isShuttingDown() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.shuttingDown
+}
+
+// unregister hands a client to handleChannels unless the server has stopped
+func (s *Server) unregister(client *Client) {
+	select {
+	case s.Unregister <- client:
+	case <-s.quit:
+	}
+}
+
+// Shutdown stops accepting connections, notifies connected clients, waits for
+// in-flight file assemblies, checkpoints partial uploads, flushes message
+// history and read markers and closes all connections. Work left when ctx
+// expires is abandoned and ctx's error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	if s.shuttingDown {
+		s.mu.Unlock()
+		return ErrServerClosed
+	}
+	s.shuttingDown = true
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	clients := make([]*Client, 0, len(s.Clients))
+	for client := range s.Clients {
+		clients = append(clients, client)
+	}
+	s.mu.Unlock()
+
+	log.Printf("Shutting down: notifying %d clients", len(clients))
+
+	notice := shared.CreateEventMessage(shared.EventServerShutdown, "", "", ReconnectHint)
+	noticeBytes, _ := json.Marshal(notice)
+	for _, client := range clients {
+		client.EnqueueControl(noticeBytes)
+	}
+
+	// Let the notice and any queued messages reach the clients
+	s.waitForQueues(ctx, clients)
+
+	for _, client := range clients {
+		client.disconnect()
+	}
+
+	// Finish files whose last chunk has already arrived. Uploads completed from
+	// now on are checkpointed and saved after the restart.
+	s.savesMu.Lock()
+	s.savesStopped = true
+	s.savesMu.Unlock()
+
+	saved := make(chan struct{})
+	go func() {
+		s.fileSaves.Wait()
+		close(saved)
+	}()
+	select {
+	case <-saved:
+	case <-ctx.Done():
+		log.Printf("Shutdown: gave up waiting for file assemblies: %v", ctx.Err())
+	}
+
+	s.Uploads.Checkpoint()
+
+	if err := s.MessageStore.Flush(); err != nil {
+		log.Printf("Shutdown: error flushing message history: %v", err)
+	}
+	if err := s.ReadMarkers.Flush(); err != nil {
+		log.Printf("Shutdown: error flushing read markers: %v", err)
+	}
+	s.AuthManager.Flush()
+
+	close(s.quit)
+	log.Printf("Shutdown complete")
+
+	return ctx.Err()
+}
+
+// waitForQueues waits until every client's send queue is empty, or until half
+// of the remaining shutdown time has passed
+func (s *Server) waitForQueues(ctx context.Context, clients []*Client) {
+	deadline := time.Now().Add(2 * time.Second)
+	if d, ok := ctx.Deadline(); ok {
+		deadline = time.Now().Add(time.Until(d) / 2)
+	}
+
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+
+	for time.Now().Before(deadline) {
+		pending := 0
+		for _, client := range clients {
+			pending += client.queue.pending()
+		}
+		if pending == 0 {
+			return
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"chatap.com/shared"
+)
+
+func TestRegisterDuringShutdown(t *testing.T) {
+	s := newTestServer(t)
+	go s.handleChannels()
+
+	// Shutdown has taken its snapshot of the clients
+	s.mu.Lock()
+	s.shuttingDown = true
+	s.mu.Unlock()
+
+	client := newTestClient(t, s)
+	if !s.register(client) {
+		t.Fatal("register failed before the server stopped")
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for client.Enqueue([]byte("ping")) {
+		if time.Now().After(deadline) {
+			t.Fatal("client registered during shutdown was not disconnected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	s.mu.RLock()
+	registered := s.Clients[client]
+	s.mu.RUnlock()
+	if registered {
+		t.Fatal("client registered during shutdown")
+	}
+
+	// Once the server has stopped, registering no longer blocks
+	close(s.quit)
+	done := make(chan bool)
+	go func() { done <- s.register(newTestClient(t, s)) }()
+	select {
+	case ok := <-done:
+		if ok {
+			t.Fatal("register succeeded after the server stopped")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("register blocked after the server stopped")
+	}
+}
+
+func TestUploadCompletedDuringShutdown(t *testing.T) {
+	s := newTestServer(t)
+	go s.handleChannels()
+
+	early := completeTestUpload(t, s, "early.txt", []byte("saved before the restart"))
+	late := completeTestUpload(t, s, "late.txt", []byte("saved after the restart"))
+
+	// A save that started before Shutdown is waited for
+	s.saveUpload(early)
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.Files.Find("general", "early.txt"); !ok {
+		t.Fatal("file saved during shutdown is missing")
+	}
+
+	// One completed once Shutdown waited is left checkpointed
+	s.saveUpload(late)
+	if _, ok := s.Files.Find("general", "late.txt"); ok {
+		t.Fatal("file saved after shutdown waited for saves")
+	}
+
+	restarted := NewServer(s.Config())
+	restarted.Uploads.Restore()
+	restarted.fileSaves.Wait()
+	if _, ok := restarted.Files.Find("general", "late.txt"); !ok {
+		t.Fatal("checkpointed complete upload was not saved after the restart")
+	}
+}
+
+// completeTestUpload starts an upload to the general room and writes all of
+// data as its only chunk
+func completeTestUpload(t *testing.T, s *Server, filename string, data []byte) *shared.FileAssembler {
+	t.Helper()
+	sum := sha256.Sum256(data)
+	info := shared.UploadInfo{
+		Filename:    filename,
+		Size:        int64(len(data)),
+		Hash:        hex.EncodeToString(sum[:]),
+		ChunkSize:   len(data),
+		TotalChunks: 1,
+	}
+	assembler, _, err := s.Uploads.Start("alice", "general", "", info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := assembler.WriteChunk(shared.FileMessage{ChunkID: 0, Data: data}); err != nil {
+		t.Fatal(err)
+	}
+	return assembler
+}
@@ -0,0 +1,829 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"chatap.com/shared"
+)
+
+// uploadSession is an upload in progress. Its progress lives in the assembler.
+type uploadSession struct {
+	assembler *shared.FileAssembler
+	updatedAt time.Time
+}
+
+// storedProof is the challenge sent to a client that uploads content the
+// server already stores, with what to share once it is answered
+type storedProof struct {
+	target    string
+	recipient string
+	info      shared.UploadInfo
+	challenge shared.ProofChallenge
+}
+
+// UploadManager tracks upload sessions by ID. Sessions outlive the connection
+// that started them so that an interrupted upload can be resumed.
+type UploadManager struct {
+	server   *Server
+	mu       sync.Mutex
+	sessions map[string]*uploadSession
+}
+
+func NewUploadManager(server *Server) *UploadManager {
+	return &UploadManager{
+		server:   server,
+		sessions: make(map[string]*uploadSession),
+	}
+}
+
+func newUploadID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// Restore reopens the uploads checkpointed by a previous run
+func (um *UploadManager) Restore() {
+	metaPaths, err := filepath.Glob(filepath.Join(um.server.PartialUploadsDir(), "*.part.json"))
+	if err != nil {
+		log.Printf("Error listing partial uploads: %v", err)
+		return
+	}
+
+	var complete []*shared.FileAssembler
+	um.mu.Lock()
+	for _, metaPath := range metaPaths {
+		assembler, err := shared.OpenFileAssembler(metaPath)
+		if err != nil || assembler.Info.UploadID == "" {
+			log.Printf("Skipping unreadable partial upload %s: %v", metaPath, err)
+			continue
+		}
+
+		// The expiry clock keeps running from the last checkpoint
+		updatedAt := time.Now()
+		if info, err := os.Stat(metaPath); err == nil {
+			updatedAt = info.ModTime()
+		}
+
+		um.sessions[assembler.Info.UploadID] = &uploadSession{assembler: assembler, updatedAt: updatedAt}
+		log.Printf("Restored partial upload %s of %s by %s (%d/%d chunks)",
+			assembler.Info.UploadID, assembler.Info.Filename, assembler.Sender,
+			assembler.Received(), assembler.Info.TotalChunks)
+
+		// Completed while the previous run was shutting down
+		if assembler.Complete() {
+			complete = append(complete, assembler)
+		}
+	}
+	um.mu.Unlock()
+
+	for _, assembler := range complete {
+		um.server.saveUpload(assembler)
+	}
+}
+
+// Start opens a new upload session into target, a room or a direct
+// conversation with recipient. If the sender already has an unfinished upload
+// of the same file to the same place, that session is returned instead.
+func (um *UploadManager) Start(sender, target, recipient string, info shared.UploadInfo) (*shared.FileAssembler, bool, error) {
+	if existing := um.FindByFile(sender, info.Filename, info.Hash); existing != nil && existing.Target == target {
+		return existing, false, nil
+	}
+
+	uploadID, err := newUploadID()
+	if err != nil {
+		return nil, false, err
+	}
+	info.UploadID = uploadID
+
+	assembler, err := shared.NewFileAssembler(um.server.PartialUploadsDir(), info, sender, target)
+	if err != nil {
+		return nil, false, err
+	}
+	assembler.Recipient = recipient
+
+	um.mu.Lock()
+	um.sessions[uploadID] = &uploadSession{assembler: assembler, updatedAt: time.Now()}
+	um.mu.Unlock()
+
+	return assembler, true, nil
+}
+
+// Get returns the sender's upload with the given ID and marks it active
+func (um *UploadManager) Get(sender, uploadID string) *shared.FileAssembler {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+
+	session, ok := um.sessions[uploadID]
+	if !ok || session.assembler.Sender != sender {
+		return nil
+	}
+	session.updatedAt = time.Now()
+	return session.assembler
+}
+
+// FindByFile looks up the sender's unfinished upload of a file by name and hash
+func (um *UploadManager) FindByFile(sender, filename, hash string) *shared.FileAssembler {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+
+	for _, session := range um.sessions {
+		info := session.assembler.Info
+		if session.assembler.Sender == sender && info.Filename == filename && info.Hash == hash {
+			session.updatedAt = time.Now()
+			return session.assembler
+		}
+	}
+	return nil
+}
+
+// List returns the sender's unfinished uploads, oldest first
+func (um *UploadManager) List(sender string) []*shared.FileAssembler {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+
+	sessions := make([]*uploadSession, 0)
+	for _, session := range um.sessions {
+		if session.assembler.Sender == sender {
+			sessions = append(sessions, session)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].updatedAt.Before(sessions[j].updatedAt)
+	})
+
+	uploads := make([]*shared.FileAssembler, len(sessions))
+	for i, session := range sessions {
+		uploads[i] = session.assembler
+	}
+	return uploads
+}
+
+// Reserved returns the declared sizes of unfinished uploads by a user and into
+// a room, leaving out the upload with ID exclude
+func (um *UploadManager) Reserved(sender, room, exclude string) (userBytes, roomBytes int64) {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+
+	for uploadID, session := range um.sessions {
+		if uploadID == exclude {
+			continue
+		}
+		if session.assembler.Sender == sender {
+			userBytes += session.assembler.Info.Size
+		}
+		if session.assembler.Target == room {
+			roomBytes += session.assembler.Info.Size
+		}
+	}
+	return userBytes, roomBytes
+}
+
+// AbortUser discards every unfinished upload by a user and returns how many
+// there were
+func (um *UploadManager) AbortUser(sender string) int {
+	um.mu.Lock()
+	aborted := make([]*shared.FileAssembler, 0)
+	for uploadID, session := range um.sessions {
+		if session.assembler.Sender == sender {
+			delete(um.sessions, uploadID)
+			aborted = append(aborted, session.assembler)
+		}
+	}
+	um.mu.Unlock()
+
+	for _, assembler := range aborted {
+		assembler.Abort()
+		log.Printf("Aborted partial upload %s of %s by %s", assembler.Info.UploadID, assembler.Info.Filename, sender)
+	}
+	return len(aborted)
+}
+
+// remove forgets a session. Only the caller that gets true may finish it.
+func (um *UploadManager) remove(uploadID string) bool {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+
+	if _, ok := um.sessions[uploadID]; !ok {
+		return false
+	}
+	delete(um.sessions, uploadID)
+	return true
+}
+
+// Checkpoint records the progress of every unfinished upload so that it
+// survives a restart
+func (um *UploadManager) Checkpoint() {
+	um.mu.Lock()
+	sessions := um.sessions
+	um.sessions = make(map[string]*uploadSession)
+	um.mu.Unlock()
+
+	for uploadID, session := range sessions {
+		assembler := session.assembler
+		metaPath, err := assembler.Checkpoint()
+		if err != nil {
+			log.Printf("Failed to checkpoint upload %s: %v", uploadID, err)
+			continue
+		}
+
+		log.Printf("Checkpointed partial upload %s of %s by %s (%d/%d chunks) to %s",
+			uploadID, assembler.Info.Filename, assembler.Sender,
+			assembler.Received(), assembler.Info.TotalChunks, metaPath)
+	}
+}
+
+// expireLoop periodically discards uploads that have been idle for longer
+// than the configured TTL
+func (um *UploadManager) expireLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			um.expire(um.server.Config().UploadTTL())
+		case <-um.server.quit:
+			return
+		}
+	}
+}
+
+func (um *UploadManager) expire(ttl time.Duration) {
+	now := time.Now()
+
+	um.mu.Lock()
+	expired := make([]*shared.FileAssembler, 0)
+	for uploadID, session := range um.sessions {
+		if now.Sub(session.updatedAt) > ttl {
+			delete(um.sessions, uploadID)
+			expired = append(expired, session.assembler)
+		}
+	}
+	um.mu.Unlock()
+
+	for _, assembler := range expired {
+		assembler.Abort()
+		um.server.Metrics.Inc("uploads.expired")
+		log.Printf("Expired partial upload %s of %s by %s (%d/%d chunks)",
+			assembler.Info.UploadID, assembler.Info.Filename, assembler.Sender,
+			assembler.Received(), assembler.Info.TotalChunks)
+	}
+}
+
+// handleUploadMessage starts or resumes an upload session. Uploads go to the
+// client's room, or to a single user when the message names a recipient.
+func (c *Client) handleUploadMessage(rawMsg []byte) {
+	if !c.loggedIn.Load() {
+		c.sendError("Not authenticated")
+		return
+	}
+
+	var uploadMsg shared.UploadMessage
+	if err := json.Unmarshal(rawMsg, &uploadMsg); err != nil {
+		log.Printf("Error unmarshaling upload message: %v", err)
+		return
+	}
+	// Stored blobs are named by their lowercase hash
+	uploadMsg.Hash = strings.ToLower(uploadMsg.Hash)
+
+	uploads := c.Server.Uploads
+	var assembler *shared.FileAssembler
+
+	switch uploadMsg.Content {
+	case shared.UploadStart:
+		var target, place string
+		recipient := uploadMsg.Recipient
+		room := c.Room()
+		switch {
+		case recipient == c.Username():
+			c.sendError("You cannot send a file to yourself")
+			return
+		case recipient != "":
+			// A file for a user is a direct message too
+			if c.botRefuses(CapDirect) {
+				return
+			}
+			// Users who block the sender look offline, see deliverDirectFile
+			if !c.Server.AuthManager.UserExists(recipient) {
+				c.sendError("User not found: " + recipient)
+				return
+			}
+			target = directTarget(c.Username(), recipient)
+			place = "for " + recipient
+		case room == nil:
+			c.sendError("You are not in a room. Join a room first.")
+			return
+		default:
+			target = room.Name
+			place = "in room " + target
+		}
+
+		info := uploadMsg.UploadInfo
+		name, err := shared.SanitizeFilename(info.Filename)
+		if err != nil {
+			c.sendError("Upload rejected: " + err.Error())
+			return
+		}
+		info.Filename = name
+
+		if err := c.validateUpload(info); err != nil {
+			c.sendError("Upload rejected: " + err.Error())
+			return
+		}
+		info = c.negotiateUpload(info)
+		if info.TotalChunks > shared.MaxChunks {
+			c.sendError(fmt.Sprintf("Upload rejected: a file may have at most %d chunks", shared.MaxChunks))
+			return
+		}
+
+		// Restarting an upload must not count its own reservation
+		exclude := ""
+		if existing := uploads.FindByFile(c.Username(), info.Filename, info.Hash); existing != nil {
+			exclude = existing.Info.UploadID
+		}
+		if err := c.Server.checkUpload(c.Username(), target, exclude, info); err != nil {
+			c.Server.Metrics.Inc("uploads.rejected_policy")
+			c.sendError("Upload rejected: " + err.Error())
+			return
+		}
+
+		// Content the server already stores is shared without sending it again,
+		// once the client proves it has it. Its bytes passed the content checks
+		// when they were first uploaded.
+		if c.Server.Files.Stored(info.Hash, info.Size) {
+			c.challengeStoredFile(target, recipient, info)
+			return
+		}
+
+		var created bool
+		assembler, created, err = uploads.Start(c.Username(), target, recipient, info)
+		if err != nil {
+			log.Printf("Error starting upload of %s from %s: %v", info.Filename, c.Username(), err)
+			c.sendError("Upload failed: " + err.Error())
+			return
+		}
+
+		if created {
+			log.Printf("Upload %s of %s (%d bytes) started by %s %s",
+				assembler.Info.UploadID, info.Filename, info.Size, c.Username(), place)
+			if recipient == "" {
+				room.BroadcastEvent(shared.EventFileSending, c.Username(), info.Filename)
+			}
+		}
+
+	case shared.UploadResume:
+		if uploadMsg.UploadID != "" {
+			assembler = uploads.Get(c.Username(), uploadMsg.UploadID)
+		} else {
+			assembler = uploads.FindByFile(c.Username(), uploadMsg.Filename, uploadMsg.Hash)
+		}
+		if assembler == nil {
+			c.sendError("No unfinished upload to resume for " + uploadMsg.Filename)
+			return
+		}
+		if uploadMsg.Hash != "" && uploadMsg.Hash != assembler.Info.Hash {
+			c.sendError("The file has changed since the upload started, send it again")
+			return
+		}
+
+		// Limits may have changed since the upload started
+		if err := c.Server.checkUpload(c.Username(), assembler.Target, assembler.Info.UploadID, assembler.Info); err != nil {
+			c.rejectUpload(assembler, err)
+			return
+		}
+
+		log.Printf("Upload %s of %s resumed by %s (%d/%d chunks)", assembler.Info.UploadID,
+			assembler.Info.Filename, c.Username(), assembler.Received(), assembler.Info.TotalChunks)
+
+	case shared.UploadProof:
+		c.checkStoredProof(uploadMsg)
+		return
+
+	default:
+		c.sendError("Unknown upload action: " + uploadMsg.Content)
+		return
+	}
+
+	reply := shared.UploadMessage{
+		Message: shared.Message{
+			Type:      shared.MessageTypeUpload,
+			Content:   shared.UploadReady,
+			Sender:    "Server",
+			Recipient: assembler.Recipient,
+			Timestamp: time.Now(),
+			RequestID: c.requestID(),
+		},
+		UploadInfo: assembler.Info,
+		Missing:    assembler.Missing(),
+		Received:   assembler.Received(),
+	}
+	replyBytes, _ := json.Marshal(reply)
+	c.EnqueueReliable(replyBytes)
+}
+
+// validateUpload checks the file description sent with an upload start
+func (c *Client) validateUpload(info shared.UploadInfo) error {
+	switch {
+	case info.Size <= 0:
+		return fmt.Errorf("file is empty")
+	case info.ChunkSize <= 0:
+		return fmt.Errorf("chunk size must be positive")
+	case info.TotalChunks != shared.ChunkCount(info.Size, info.ChunkSize):
+		return fmt.Errorf("%d bytes in %d-byte chunks is %d chunks, not %d",
+			info.Size, info.ChunkSize, shared.ChunkCount(info.Size, info.ChunkSize), info.TotalChunks)
+	}
+
+	if !isBlobHash(info.Hash) {
+		return fmt.Errorf("a SHA-256 file hash is required")
+	}
+
+	return nil
+}
+
+// negotiateUpload settles the chunk size and compression of a new upload. The
+// client's chunk size is lowered to the server's limit, tiny chunks are
+// raised to it so an upload cannot need millions of them, and compression is
+// only kept when the server allows it.
+func (c *Client) negotiateUpload(info shared.UploadInfo) shared.UploadInfo {
+	config := c.Server.Config()
+
+	if info.ChunkSize > config.ChunkSize || info.ChunkSize < shared.MinChunkSize {
+		info.ChunkSize = config.ChunkSize
+		info.TotalChunks = shared.ChunkCount(info.Size, info.ChunkSize)
+	}
+	if info.Compression != shared.CompressionDeflate || !config.CompressChunks {
+		info.Compression = ""
+	}
+
+	return info
+}
+
+// handleFileChunk stores a chunk of an upload session. The chunk's data is
+// the frame payload.
+func (c *Client) handleFileChunk(rawMsg, payload []byte) {
+	if !c.loggedIn.Load() {
+		c.sendError("Not authenticated")
+		return
+	}
+
+	fileMsg, err := shared.DecodeFileFrame(rawMsg, payload, c.Server.Config().ChunkSize)
+	if err != nil {
+		log.Printf("Error decoding file chunk from %s: %v", c.Username(), err)
+		c.sendError("File transfer failed: " + err.Error())
+		return
+	}
+
+	if fileMsg.UploadID == "" {
+		c.sendError("File chunks must belong to an upload, start one with /file")
+		return
+	}
+	if fileMsg.Checksum == "" {
+		c.sendError("File chunks must carry a checksum")
+		return
+	}
+
+	assembler := c.Server.Uploads.Get(c.Username(), fileMsg.UploadID)
+	if assembler == nil {
+		c.sendError("Unknown or expired upload: " + fileMsg.UploadID)
+		return
+	}
+	info := assembler.Info
+
+	// Limits may have been lowered, or files shared, since the upload started
+	if err := c.Server.checkUpload(c.Username(), assembler.Target, info.UploadID, info); err != nil {
+		c.rejectUpload(assembler, err)
+		return
+	}
+	// Enforce the policy on the bytes themselves, not just the declaration. The
+	// start of the file is checked when it arrives and again once complete.
+	if fileMsg.ChunkID == 0 {
+		if err := c.Server.Config().Files.checkContent(fileMsg.Data); err != nil {
+			c.rejectUpload(assembler, err)
+			return
+		}
+	}
+
+	if err := assembler.WriteChunk(fileMsg); err != nil {
+		if err == shared.ErrDuplicateChunk {
+			c.sendError(fmt.Sprintf("Chunk %d of %s was already received", fileMsg.ChunkID, info.Filename))
+			return
+		}
+		c.Server.Metrics.Inc("uploads.rejected_chunks")
+		log.Printf("Error storing chunk %d of upload %s from %s: %v", fileMsg.ChunkID, info.UploadID, c.Username(), err)
+		c.sendError("File transfer failed: " + err.Error())
+		return
+	}
+
+	log.Printf("Received file chunk %d/%d for %s from %s (upload %s)",
+		fileMsg.ChunkID+1, info.TotalChunks, info.Filename, c.Username(), info.UploadID)
+
+	if assembler.Complete() {
+		c.Server.saveUpload(assembler)
+	}
+}
+
+// saveUpload saves a completed upload in the background, once. After Shutdown
+// has stopped waiting for saves the upload is left for the checkpoint instead.
+func (s *Server) saveUpload(assembler *shared.FileAssembler) {
+	s.savesMu.Lock()
+	defer s.savesMu.Unlock()
+
+	if s.savesStopped || !s.Uploads.remove(assembler.Info.UploadID) {
+		return
+	}
+	s.fileSaves.Add(1)
+	go func() {
+		defer s.fileSaves.Done()
+		s.saveCompleteFile(assembler)
+	}()
+}
+
+// challengeStoredFile asks the client to prove it holds content the server
+// already stores: it must hash a random nonce and a chunk chosen here
+func (c *Client) challengeStoredFile(target, recipient string, info shared.UploadInfo) {
+	nonce := make([]byte, 16)
+	chunk, err := rand.Int(rand.Reader, big.NewInt(int64(info.TotalChunks)))
+	if err == nil {
+		_, err = rand.Read(nonce)
+	}
+	if err != nil {
+		log.Printf("Error creating challenge for %s from %s: %v", info.Filename, c.Username(), err)
+		c.sendError("Upload failed: " + err.Error())
+		return
+	}
+
+	challenge := shared.ProofChallenge{
+		Nonce:  hex.EncodeToString(nonce),
+		Offset: chunk.Int64() * int64(info.ChunkSize),
+	}
+	challenge.Length = int(info.Size - challenge.Offset)
+	if challenge.Length > info.ChunkSize {
+		challenge.Length = info.ChunkSize
+	}
+	c.proof = &storedProof{target: target, recipient: recipient, info: info, challenge: challenge}
+
+	reply := shared.UploadMessage{
+		Message: shared.Message{
+			Type:      shared.MessageTypeUpload,
+			Content:   shared.UploadProve,
+			Sender:    "Server",
+			Recipient: recipient,
+			Timestamp: time.Now(),
+			RequestID: c.requestID(),
+		},
+		UploadInfo: info,
+		Challenge:  &challenge,
+	}
+	replyBytes, _ := json.Marshal(reply)
+	c.EnqueueReliable(replyBytes)
+}
+
+// checkStoredProof shares the stored file the client was challenged for if
+// its answer matches the stored content
+func (c *Client) checkStoredProof(answer shared.UploadMessage) {
+	proof := c.proof
+	c.proof = nil
+	if proof == nil || answer.Hash != proof.info.Hash {
+		c.sendError("No upload is waiting for proof of " + answer.Filename)
+		return
+	}
+
+	expected, err := c.Server.Files.ProveStored(proof.info.Hash, proof.challenge)
+	if err != nil {
+		log.Printf("Error checking proof for %s from %s: %v", proof.info.Filename, c.Username(), err)
+		c.sendError("Upload failed: the stored copy is gone, send the file again")
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(answer.Proof), []byte(expected)) != 1 {
+		c.Server.Metrics.Inc("uploads.proof_failed")
+		log.Printf("%s failed to prove holding %s (%s)", c.Username(), proof.info.Filename, proof.info.Hash)
+		c.sendError("Upload rejected: the file does not match the stored copy")
+		return
+	}
+
+	c.shareStoredFile(proof.target, proof.recipient, proof.info)
+}
+
+// shareStoredFile adds a file whose content the server already has to target
+// and tells the client that no upload is needed. Sending the same file under
+// the same name again reuses its record and announces it again.
+func (c *Client) shareStoredFile(target, recipient string, info shared.UploadInfo) {
+	blocked := recipient != "" && c.Server.Contacts.Blocks(recipient, c.Username())
+	record, found := c.Server.Files.Find(target, info.Filename)
+	if !blocked && (!found || record.Hash != info.Hash) {
+		var err error
+		record, err = c.Server.Files.Add(target, FileRecord{
+			Name:       info.Filename,
+			Uploader:   c.Username(),
+			Size:       info.Size,
+			Hash:       info.Hash,
+			UploadedAt: time.Now(),
+		}, "")
+		if err != nil {
+			log.Printf("Error sharing stored file %s from %s: %v", info.Filename, c.Username(), err)
+			c.sendError("Upload failed: " + err.Error())
+			return
+		}
+	}
+
+	if !blocked {
+		c.Server.Metrics.Inc("uploads.deduplicated")
+		log.Printf("File %s from %s shared in %s from stored content %s", record.Name, c.Username(), target, record.Hash)
+	}
+
+	info.UploadID = ""
+	reply := shared.UploadMessage{
+		Message: shared.Message{
+			Type:      shared.MessageTypeUpload,
+			Content:   shared.UploadSkipped,
+			Sender:    "Server",
+			Recipient: recipient,
+			Timestamp: time.Now(),
+			RequestID: c.requestID(),
+		},
+		UploadInfo: info,
+	}
+	replyBytes, _ := json.Marshal(reply)
+	c.EnqueueReliable(replyBytes)
+
+	if blocked {
+		c.Server.refuseDirectFile(c.Username(), recipient, info.Filename)
+		return
+	}
+	c.Server.publishFile(c.Username(), target, recipient, record)
+}
+
+// rejectUpload discards an upload that breaks the file policy
+func (c *Client) rejectUpload(assembler *shared.FileAssembler, reason error) {
+	info := assembler.Info
+	if c.Server.Uploads.remove(info.UploadID) {
+		assembler.Abort()
+	}
+
+	c.Server.Metrics.Inc("uploads.rejected_policy")
+	log.Printf("Rejected upload %s of %s from %s: %v", info.UploadID, info.Filename, c.Username(), reason)
+	c.sendError(fmt.Sprintf("Upload of %s rejected: %v", info.Filename, reason))
+}
+
+// uploadPlace describes where an upload goes, e.g. "in room general"
+func uploadPlace(assembler *shared.FileAssembler) string {
+	if assembler.Recipient != "" {
+		return "for " + assembler.Recipient
+	}
+	return "in room " + assembler.Target
+}
+
+// saveCompleteFile moves an assembled upload into the blob store, indexes it
+// and announces it to the room or delivers it to the recipient
+func (s *Server) saveCompleteFile(assembler *shared.FileAssembler) {
+	info := assembler.Info
+	fail := func(err error) {
+		log.Printf("Failed to save file %s from %s %s: %v", info.Filename, assembler.Sender, uploadPlace(assembler), err)
+		assembler.Abort()
+		s.sendErrorToUser(assembler.Sender, fmt.Sprintf("Upload of %s failed: %v. Please send it again.", info.Filename, err))
+	}
+
+	tmpPath, err := assembler.Finish()
+	if err != nil {
+		if err == shared.ErrHashMismatch {
+			s.Metrics.Inc("uploads.hash_mismatches")
+		}
+		fail(err)
+		return
+	}
+
+	var meta *shared.FileMeta
+	described, err := describeFile(tmpPath)
+	if err == nil {
+		meta = &described
+	} else {
+		log.Printf("Error describing %s from %s: %v", info.Filename, assembler.Sender, err)
+	}
+
+	// The finished file is checked against the policy as it is now
+	policy := s.Config().Files
+	err = s.checkUpload(assembler.Sender, assembler.Target, info.UploadID, info)
+	if err == nil {
+		err = policy.checkContentType(described.ContentType)
+	}
+	if err != nil {
+		s.Metrics.Inc("uploads.rejected_policy")
+		fail(err)
+		return
+	}
+
+	// Nothing is kept for a recipient who blocks the sender
+	if assembler.Recipient != "" && s.Contacts.Blocks(assembler.Recipient, assembler.Sender) {
+		assembler.Abort()
+		s.refuseDirectFile(assembler.Sender, assembler.Recipient, info.Filename)
+		return
+	}
+
+	// Name collisions are resolved by renaming rather than overwriting
+	record, err := s.Files.Add(assembler.Target, FileRecord{
+		Name:       info.Filename,
+		Uploader:   assembler.Sender,
+		Size:       info.Size,
+		Hash:       info.Hash,
+		UploadedAt: time.Now(),
+		Meta:       meta,
+	}, tmpPath)
+	if err != nil {
+		fail(err)
+		return
+	}
+	log.Printf("File %s from %s successfully saved %s as %s (blob %s)",
+		info.Filename, assembler.Sender, uploadPlace(assembler), record.Name, record.Hash)
+
+	if meta != nil && meta.Width > 0 {
+		if _, err := s.Files.Thumbnail(record); err != nil {
+			log.Printf("No thumbnail for %s: %v", record.Name, err)
+		}
+	}
+
+	s.publishFile(assembler.Sender, assembler.Target, assembler.Recipient, record)
+}
+
+// publishFile announces a newly stored file to the room or delivers it to the
+// recipient of a direct transfer
+func (s *Server) publishFile(sender, target, recipient string, record FileRecord) {
+	if recipient != "" {
+		s.deliverDirectFile(sender, recipient, target, record)
+		return
+	}
+
+	// Members fetch the file with /download instead of receiving it unasked
+	if room := s.RoomManager.GetRoom(target); room != nil {
+		room.BroadcastEvent(shared.EventFileUploaded, sender,
+			fmt.Sprintf("%s (%s, id %s)", record.Name, record.describe(), record.ID))
+	}
+}
+
+// uploadSummary describes the user's unfinished uploads for the uploads command
+func (c *Client) uploadSummary() string {
+	uploads := c.Server.Uploads.List(c.Username())
+	if len(uploads) == 0 {
+		return "No unfinished uploads"
+	}
+
+	lines := make([]string, 0, len(uploads))
+	for _, assembler := range uploads {
+		info := assembler.Info
+		lines = append(lines, fmt.Sprintf("  %s  %s %s: %d/%d chunks",
+			info.UploadID, info.Filename, uploadPlace(assembler), assembler.Received(), info.TotalChunks))
+	}
+	return fmt.Sprintf("Unfinished uploads (%d):\n%s", len(uploads), strings.Join(lines, "\n"))
+}
+
+// refuseDirectFile drops a file for a recipient who blocks the sender. The
+// sender is told the file was queued, as for any offline user.
+func (s *Server) refuseDirectFile(sender, recipient, filename string) {
+	log.Printf("File %s from %s discarded, %s blocks them", filename, sender, recipient)
+	s.sendSuccessToUser(sender, fmt.Sprintf("File %s queued until %s logs in", filename, recipient))
+}
+
+// deliverDirectFile records a file sent to a single user in the conversation's
+// history and hands it to the recipient now or at their next login
+func (s *Server) deliverDirectFile(sender, recipient, target string, record FileRecord) {
+	entry := shared.Message{
+		Type:      shared.MessageTypeDirect,
+		Content:   fmt.Sprintf("[File] %s (%s, id %s)", record.Name, record.describe(), record.ID),
+		Sender:    sender,
+		Recipient: recipient,
+		Timestamp: record.UploadedAt,
+	}
+	s.MessageStore.AddDirectMessage(sender, recipient, entry)
+
+	status := "delivered to " + recipient
+	if clients := s.ClientsOf(recipient); len(clients) > 0 {
+		for _, client := range clients {
+			client.sendDirectFile(target, record)
+		}
+	} else {
+		s.Mailbox.Add(recipient, MailItem{
+			Kind:   MailFile,
+			From:   sender,
+			Target: target,
+			FileID: record.ID,
+		})
+		status = "queued until " + recipient + " logs in"
+	}
+
+	log.Printf("File %s from %s %s", record.Name, sender, status)
+	s.sendSuccessToUser(sender, fmt.Sprintf("File %s %s", record.Name, status))
+}
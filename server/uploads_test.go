@@ -0,0 +1,370 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"chatap.com/shared"
+)
+
+func TestUploadHashIsCaseInsensitive(t *testing.T) {
+	s := newTestServer(t)
+	go s.handleChannels()
+	defer close(s.quit)
+	s.AuthManager.RegisterUser("alice", "secret1")
+
+	alice := loginTestSession(t, s, "alice", "secret1")
+	alice.send(shared.Message{Type: shared.MessageTypeCommand, Content: "join", Room: "general"})
+	alice.expect("SUCCESS: Joined room")
+
+	data := []byte("hello")
+	sum := sha256.Sum256(data)
+	alice.send(shared.UploadMessage{
+		Message: shared.Message{Type: shared.MessageTypeUpload, Content: shared.UploadStart},
+		UploadInfo: shared.UploadInfo{
+			Filename:    "hello.txt",
+			Size:        int64(len(data)),
+			Hash:        strings.ToUpper(hex.EncodeToString(sum[:])),
+			ChunkSize:   shared.ChunkSize,
+			TotalChunks: 1,
+		},
+	})
+	alice.expect(shared.UploadReady)
+
+	uploads := s.Uploads.List("alice")
+	if len(uploads) != 1 {
+		t.Fatalf("%d uploads started", len(uploads))
+	}
+	if hash := uploads[0].Info.Hash; !isBlobHash(hash) {
+		t.Fatalf("upload started with hash %q", hash)
+	}
+}
+
+// uploadTestFile starts an upload of data in 1 KB chunks, to recipient or to
+// the session's room, and returns its ID
+func (ts *testSession) uploadTestFile(s *Server, filename, recipient string, data []byte) string {
+	ts.t.Helper()
+	sum := sha256.Sum256(data)
+	ts.send(shared.UploadMessage{
+		Message: shared.Message{Type: shared.MessageTypeUpload, Content: shared.UploadStart, Recipient: recipient},
+		UploadInfo: shared.UploadInfo{
+			Filename:    filename,
+			Size:        int64(len(data)),
+			Hash:        hex.EncodeToString(sum[:]),
+			ChunkSize:   shared.MinChunkSize,
+			TotalChunks: shared.ChunkCount(int64(len(data)), shared.MinChunkSize),
+		},
+	})
+	ts.expect(shared.UploadReady)
+
+	for _, assembler := range s.Uploads.List(ts.client.Username()) {
+		if assembler.Info.Filename == filename {
+			return assembler.Info.UploadID
+		}
+	}
+	ts.t.Fatalf("upload of %s was not started", filename)
+	return ""
+}
+
+// sendChunk sends one chunk of an upload started by uploadTestFile
+func (ts *testSession) sendChunk(uploadID string, chunkID int, data []byte) {
+	ts.t.Helper()
+	chunk := data[chunkID*shared.MinChunkSize:]
+	if len(chunk) > shared.MinChunkSize {
+		chunk = chunk[:shared.MinChunkSize]
+	}
+	frame, err := shared.EncodeFrame(shared.FileMessage{
+		Message:  shared.Message{Type: shared.MessageTypeFile},
+		UploadID: uploadID,
+		ChunkID:  chunkID,
+		Checksum: shared.ChunkChecksum(chunk),
+		Data:     chunk,
+	}, false)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	if _, err := ts.conn.Write(append(frame, '\n')); err != nil {
+		ts.t.Fatalf("send chunk: %v", err)
+	}
+}
+
+// testFileData returns text that spans a few upload chunks
+func testFileData() []byte {
+	return []byte(strings.Repeat("a line of text in a test upload\n", 100))
+}
+
+func TestUploadToRoom(t *testing.T) {
+	s := newTestServer(t)
+	go s.handleChannels()
+	defer close(s.quit)
+	s.AuthManager.RegisterUser("alice", "secret1")
+
+	alice := loginTestSession(t, s, "alice", "secret1")
+	alice.send(shared.Message{Type: shared.MessageTypeCommand, Content: "join", Room: "general"})
+	alice.expect("SUCCESS: Joined room")
+
+	data := testFileData()
+	uploadID := alice.uploadTestFile(s, "notes.txt", "", data)
+	for chunkID := 0; chunkID < shared.ChunkCount(int64(len(data)), shared.MinChunkSize); chunkID++ {
+		alice.sendChunk(uploadID, chunkID, data)
+	}
+	alice.expect("File notes.txt")
+
+	record, ok := s.Files.Find("general", "notes.txt")
+	if !ok || record.Size != int64(len(data)) || record.Uploader != "alice" {
+		t.Fatalf("stored %+v", record)
+	}
+}
+
+func TestDirectUploadNotifiesEverySession(t *testing.T) {
+	s := newTestServer(t)
+	go s.handleChannels()
+	defer close(s.quit)
+	s.AuthManager.RegisterUser("alice", "secret1")
+	s.AuthManager.RegisterUser("bob", "secret2")
+
+	alice := loginTestSession(t, s, "alice", "secret1")
+	other := loginTestSession(t, s, "alice", "secret1")
+
+	data := testFileData()
+	uploadID := alice.uploadTestFile(s, "notes.txt", "bob", data)
+	for chunkID := 0; chunkID < shared.ChunkCount(int64(len(data)), shared.MinChunkSize); chunkID++ {
+		alice.sendChunk(uploadID, chunkID, data)
+	}
+	alice.expect("SUCCESS: File notes.txt queued until bob logs in")
+	other.expect("SUCCESS: File notes.txt queued until bob logs in")
+
+	if _, ok := s.Files.Find(directTarget("alice", "bob"), "notes.txt"); !ok {
+		t.Fatal("direct file was not stored in the conversation's area")
+	}
+}
+
+func TestUploadQuotaCheckedAsChunksArrive(t *testing.T) {
+	s := newTestServer(t)
+	go s.handleChannels()
+	defer close(s.quit)
+	s.AuthManager.RegisterUser("alice", "secret1")
+
+	alice := loginTestSession(t, s, "alice", "secret1")
+	alice.send(shared.Message{Type: shared.MessageTypeCommand, Content: "join", Room: "general"})
+	alice.expect("SUCCESS: Joined room")
+
+	data := testFileData()
+	uploadID := alice.uploadTestFile(s, "notes.txt", "", data)
+	alice.sendChunk(uploadID, 0, data)
+
+	// A reload lowers the quota below the upload in progress
+	config := *s.Config()
+	config.Files.UserQuotaBytes = int64(len(data)) - 1
+	s.config.Store(&config)
+
+	alice.sendChunk(uploadID, 1, data)
+	alice.expect("ERROR: Upload of notes.txt rejected: your storage quota would be exceeded")
+	if uploads := s.Uploads.List("alice"); len(uploads) != 0 {
+		t.Fatalf("%d uploads left after the quota was exceeded", len(uploads))
+	}
+}
+
+func TestFinishedUploadIsCheckedAgainstContentPolicy(t *testing.T) {
+	s := newTestServer(t)
+	go s.handleChannels()
+	defer close(s.quit)
+	s.AuthManager.RegisterUser("alice", "secret1")
+
+	alice := loginTestSession(t, s, "alice", "secret1")
+	alice.send(shared.Message{Type: shared.MessageTypeCommand, Content: "join", Room: "general"})
+	alice.expect("SUCCESS: Joined room")
+
+	data := testFileData()
+	uploadID := alice.uploadTestFile(s, "notes.txt", "", data)
+	alice.sendChunk(uploadID, 0, data)
+
+	// Text is refused once the first chunk has passed
+	config := *s.Config()
+	config.Files.DeniedContentTypes = []string{"text/"}
+	s.config.Store(&config)
+
+	for chunkID := 1; chunkID < shared.ChunkCount(int64(len(data)), shared.MinChunkSize); chunkID++ {
+		alice.sendChunk(uploadID, chunkID, data)
+	}
+	alice.expect("ERROR: Upload of notes.txt failed: text/plain content is not allowed")
+	if _, ok := s.Files.Find("general", "notes.txt"); ok {
+		t.Fatal("refused file was stored")
+	}
+}
+
+// resumeTestUpload asks for the chunks still missing from an upload of data
+func (ts *testSession) resumeTestUpload(filename string, data []byte) {
+	ts.t.Helper()
+	sum := sha256.Sum256(data)
+	ts.send(shared.UploadMessage{
+		Message:    shared.Message{Type: shared.MessageTypeUpload, Content: shared.UploadResume},
+		UploadInfo: shared.UploadInfo{Filename: filename, Hash: hex.EncodeToString(sum[:])},
+	})
+}
+
+func TestUploadResumesWithMissingChunks(t *testing.T) {
+	s := newTestServer(t)
+	go s.handleChannels()
+	defer close(s.quit)
+	s.AuthManager.RegisterUser("alice", "secret1")
+
+	alice := loginTestSession(t, s, "alice", "secret1")
+	alice.send(shared.Message{Type: shared.MessageTypeCommand, Content: "join", Room: "general"})
+	alice.expect("SUCCESS: Joined room")
+
+	data := testFileData()
+	uploadID := alice.uploadTestFile(s, "notes.txt", "", data)
+	alice.sendChunk(uploadID, 0, data)
+	alice.sendChunk(uploadID, 2, data)
+
+	alice.resumeTestUpload("notes.txt", data)
+	alice.expect(shared.UploadReady)
+
+	// A new session picks the upload up where the first one left it
+	again := loginTestSession(t, s, "alice", "secret1")
+	again.send(shared.Message{Type: shared.MessageTypeCommand, Content: "join", Room: "general"})
+	again.expect("SUCCESS: Joined room")
+	again.resumeTestUpload("notes.txt", data)
+	again.expect(shared.UploadReady)
+
+	missing := s.Uploads.Get("alice", uploadID).Missing()
+	if len(missing) != 2 || missing[0] != (shared.ChunkRange{Start: 1, End: 1}) || missing[1] != (shared.ChunkRange{Start: 3, End: 3}) {
+		t.Fatalf("missing %v", missing)
+	}
+
+	// The ranges survive a restart
+	s.Uploads.Checkpoint()
+	restarted := NewServer(s.Config())
+	restarted.Uploads.Restore()
+	restored := restarted.Uploads.Get("alice", uploadID)
+	if restored == nil {
+		t.Fatal("upload was not restored")
+	}
+	if missing := restored.Missing(); len(missing) != 2 || missing[0].Start != 1 || missing[1].Start != 3 {
+		t.Fatalf("missing after the restart %v", missing)
+	}
+	restored.Abort()
+}
+
+func TestExpiredUploadIsRefusedOnResume(t *testing.T) {
+	s := newTestServer(t)
+	go s.handleChannels()
+	defer close(s.quit)
+	s.AuthManager.RegisterUser("alice", "secret1")
+
+	alice := loginTestSession(t, s, "alice", "secret1")
+	alice.send(shared.Message{Type: shared.MessageTypeCommand, Content: "join", Room: "general"})
+	alice.expect("SUCCESS: Joined room")
+
+	data := testFileData()
+	idle := alice.uploadTestFile(s, "idle.txt", "", data)
+	alice.sendChunk(idle, 0, data)
+	active := alice.uploadTestFile(s, "active.txt", "", data)
+	alice.resumeTestUpload("idle.txt", data)
+	alice.expect(shared.UploadReady)
+
+	// Only the upload idle for longer than the TTL expires
+	ttl := s.Config().UploadTTL()
+	s.Uploads.mu.Lock()
+	s.Uploads.sessions[idle].updatedAt = time.Now().Add(-ttl - time.Minute)
+	s.Uploads.mu.Unlock()
+	s.Uploads.expire(ttl)
+
+	if s.Uploads.Get("alice", active) == nil {
+		t.Fatal("active upload expired")
+	}
+	alice.resumeTestUpload("idle.txt", data)
+	alice.expect("ERROR: No unfinished upload to resume for idle.txt")
+	alice.sendChunk(idle, 1, data)
+	alice.expect("ERROR: Unknown or expired upload: " + idle)
+
+	if _, err := os.Stat(filepath.Join(s.PartialUploadsDir(), idle+".part")); !os.IsNotExist(err) {
+		t.Fatalf("partial file of the expired upload kept: %v", err)
+	}
+}
+
+func TestStoredContentIsSharedOnProof(t *testing.T) {
+	s := newTestServer(t)
+	go s.handleChannels()
+	defer close(s.quit)
+	s.AuthManager.RegisterUser("alice", "secret1")
+	s.AuthManager.RegisterUser("bob", "secret2")
+	s.RoomManager.CreateRoom("general")
+	addr := serveTestListener(t, s)
+
+	data := testFileData()
+	stored := storeTestFile(t, s, "random", "notes.txt", "alice", data)
+	path := filepath.Join(t.TempDir(), "mine.txt")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Bob proves to have the content and sends none of it
+	bob := dialTestChat(t, addr, "bob", "secret2")
+	upload, err := bob.UploadFile(context.Background(), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !upload.Skipped {
+		t.Fatal("stored content was uploaded again")
+	}
+	record, ok := s.Files.Find("general", "mine.txt")
+	if !ok || record.Hash != stored.Hash || record.Uploader != "bob" {
+		t.Fatalf("shared %+v", record)
+	}
+	if len(s.Uploads.List("bob")) != 0 {
+		t.Fatal("an upload was started")
+	}
+}
+
+func TestWrongProofSharesNothing(t *testing.T) {
+	s := newTestServer(t)
+	go s.handleChannels()
+	defer close(s.quit)
+	s.AuthManager.RegisterUser("bob", "secret2")
+
+	data := testFileData()
+	storeTestFile(t, s, "random", "notes.txt", "alice", data)
+	bob := loginTestSession(t, s, "bob", "secret2")
+	bob.send(shared.Message{Type: shared.MessageTypeCommand, Content: "join", Room: "general"})
+	bob.expect("SUCCESS: Joined room")
+
+	// Knowing the hash is not enough
+	sum := sha256.Sum256(data)
+	info := shared.UploadInfo{
+		Filename:    "notes.txt",
+		Size:        int64(len(data)),
+		Hash:        hex.EncodeToString(sum[:]),
+		ChunkSize:   shared.MinChunkSize,
+		TotalChunks: shared.ChunkCount(int64(len(data)), shared.MinChunkSize),
+	}
+	bob.send(shared.UploadMessage{
+		Message:    shared.Message{Type: shared.MessageTypeUpload, Content: shared.UploadStart},
+		UploadInfo: info,
+	})
+	bob.expect(shared.UploadProve)
+	bob.send(shared.UploadMessage{
+		Message:    shared.Message{Type: shared.MessageTypeUpload, Content: shared.UploadProof},
+		UploadInfo: info,
+		Proof:      hex.EncodeToString(sum[:]),
+	})
+	bob.expect("ERROR: Upload rejected: the file does not match the stored copy")
+	if _, ok := s.Files.Find("general", "notes.txt"); ok {
+		t.Fatal("file shared without proof")
+	}
+
+	// The challenge is used up
+	bob.send(shared.UploadMessage{
+		Message:    shared.Message{Type: shared.MessageTypeUpload, Content: shared.UploadProof},
+		UploadInfo: info,
+		Proof:      hex.EncodeToString(sum[:]),
+	})
+	bob.expect("ERROR: No upload is waiting for proof of notes.txt")
+}
@@ -22,6 +22,9 @@ const (
 	EventServerNotice
 	EventStatusChange
 	EventTypingIndicator
+	EventServerShutdown
+	EventRoomInvite
+	EventProfileUpdated
 )
 
 // CreateEventMessage creates a standardized event message
@@ -36,7 +39,7 @@ func CreateEventMessage(eventType int, username, roomName, extraInfo string) Mes
 	case EventUserDisconnected:
 		content = username + " has disconnected from the server"
 	case EventFileUploaded:
-		content = "File " + extraInfo + " uploaded by " + username + " is available"
+		content = "File " + extraInfo + " uploaded by " + username + " is available. Use /download to fetch it"
 	case EventFileSending:
 		content = username + " is sending file: " + extraInfo
 	case EventRoomCreated:
@@ -47,6 +50,12 @@ func CreateEventMessage(eventType int, username, roomName, extraInfo string) Mes
 		content = username + " is typing..."
 	case EventServerNotice:
 		content = extraInfo
+	case EventServerShutdown:
+		content = "Server is shutting down. " + extraInfo
+	case EventProfileUpdated:
+		content = username + " " + extraInfo
+	case EventRoomInvite:
+		content = username + " invited you to join " + roomName + ". Use /join " + roomName
 	default:
 		content = extraInfo
 	}
@@ -1,115 +1,346 @@
 package shared
 
 import (
-	"encoding/base64"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
-	"sort"
+	"strings"
+	"sync"
 	"time"
 )
 
-const ChunkSize = 8192 // 8KB chunks
+const (
+	ChunkSize    = 64 << 10 // Chunk size clients ask for
+	MinChunkSize = 1 << 10  // Smaller chunks are raised to the server's size
+	MaxChunkSize = 1 << 20  // Largest chunk any peer accepts
+	MaxChunks    = 1 << 20  // Bounds an upload's chunk bitmap and checkpoint
+)
 
-func EncodeFileToChunks(filePath string) ([]FileMessage, error) {
+// StreamFileChunks reads the requested chunk ranges of a file (all chunks when
+// ranges is nil) one chunk at a time and passes each chunk to send, so the
+// whole file is never held in memory. The chunk's Data is reused after send
+// returns.
+func StreamFileChunks(filePath string, chunkSize int, ranges []ChunkRange, send func(FileMessage) error) error {
 	// Check if file exists
 	_, err := os.Stat(filePath)
 	if os.IsNotExist(err) {
-		return nil, fmt.Errorf("file does not exist: %s", filePath)
+		return fmt.Errorf("file does not exist: %s", filePath)
 	}
 
 	file, err := os.Open(filePath)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer file.Close()
 
 	fileInfo, err := file.Stat()
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	// Check if file is empty
 	totalSize := fileInfo.Size()
 	if totalSize == 0 {
-		return nil, fmt.Errorf("file is empty: %s", filePath)
+		return fmt.Errorf("file is empty: %s", filePath)
 	}
 
 	fileName := filepath.Base(filePath)
-	totalChunks := int((totalSize + ChunkSize - 1) / ChunkSize)
+	totalChunks := ChunkCount(totalSize, chunkSize)
+	if ranges == nil {
+		ranges = []ChunkRange{{Start: 0, End: totalChunks - 1}}
+	}
 
-	chunks := make([]FileMessage, 0, totalChunks)
+	buffer := make([]byte, chunkSize)
 
-	buffer := make([]byte, ChunkSize)
-	chunkID := 0
+	for _, chunkRange := range ranges {
+		if chunkRange.Start < 0 || chunkRange.End >= totalChunks || chunkRange.Start > chunkRange.End {
+			return fmt.Errorf("invalid chunk range %d-%d for %s", chunkRange.Start, chunkRange.End, fileName)
+		}
 
-	for {
-		bytesRead, err := file.Read(buffer)
-		if err != nil {
-			if err == io.EOF {
-				break
+		for chunkID := chunkRange.Start; chunkID <= chunkRange.End; chunkID++ {
+			offset := int64(chunkID) * int64(chunkSize)
+			bytesRead, err := file.ReadAt(buffer, offset)
+			if err != nil && err != io.EOF {
+				return err
 			}
-			return nil, err
-		}
 
-		if bytesRead == 0 {
-			break
-		}
+			chunk := FileMessage{
+				Message: Message{
+					Type:      MessageTypeFile,
+					Timestamp: time.Now(),
+				},
+				Filename:    fileName,
+				Size:        totalSize,
+				ChunkID:     chunkID,
+				TotalChunks: totalChunks,
+				Offset:      offset,
+				Checksum:    ChunkChecksum(buffer[:bytesRead]),
+				Data:        buffer[:bytesRead],
+			}
 
-		encodedData := base64.StdEncoding.EncodeToString(buffer[:bytesRead])
-
-		chunk := FileMessage{
-			Message: Message{
-				Type:      MessageTypeFile,
-				Timestamp: time.Now(),
-			},
-			Filename:    fileName,
-			Size:        totalSize,
-			ChunkID:     chunkID,
-			TotalChunks: totalChunks,
-			Data:        []byte(encodedData),
+			if err := send(chunk); err != nil {
+				return err
+			}
 		}
+	}
 
-		chunks = append(chunks, chunk)
-		chunkID++
+	return nil
+}
+
+// FileAssembler writes the chunks of one incoming file straight to a temporary
+// file at their offsets and tracks which chunks have arrived. The temporary
+// file is renamed into place by Commit.
+type FileAssembler struct {
+	Info      UploadInfo
+	Sender    string
+	Target    string // Where the finished file is stored, e.g. a room name
+	Recipient string // Set for files sent to a single user
+
+	mu       sync.Mutex
+	file     *os.File
+	tmpPath  string
+	received ChunkBitmap
+}
+
+// assemblerCheckpoint is the metadata saved next to a partial file
+type assemblerCheckpoint struct {
+	Info      UploadInfo  `json:"info"`
+	Sender    string      `json:"sender"`
+	Target    string      `json:"target"`
+	Recipient string      `json:"recipient,omitempty"`
+	Received  ChunkBitmap `json:"received"`
+}
+
+// NewFileAssembler creates the temporary file for an upload in tmpDir, which
+// should be on the same filesystem as the final destination
+func NewFileAssembler(tmpDir string, info UploadInfo, sender, target string) (*FileAssembler, error) {
+	if err := os.MkdirAll(tmpDir, 0755); err != nil {
+		return nil, err
 	}
 
-	return chunks, nil
+	var file *os.File
+	var err error
+	if isSafeID(info.UploadID) {
+		file, err = os.OpenFile(filepath.Join(tmpDir, info.UploadID+".part"), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	} else {
+		file, err = os.CreateTemp(tmpDir, "upload-*.part")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileAssembler{
+		Info:     info,
+		Sender:   sender,
+		Target:   target,
+		file:     file,
+		tmpPath:  file.Name(),
+		received: NewChunkBitmap(info.TotalChunks),
+	}, nil
 }
 
-func SaveFileFromChunks(chunks []FileMessage, outputDir string) error {
-	if len(chunks) == 0 {
-		return nil
+// OpenFileAssembler reopens a partial file from the metadata written by Checkpoint
+func OpenFileAssembler(metaPath string) (*FileAssembler, error) {
+	data, err := os.ReadFile(metaPath)
+	if err != nil {
+		return nil, err
 	}
 
-	fileName := chunks[0].Filename
-	outputPath := filepath.Join(outputDir, fileName)
+	var checkpoint assemblerCheckpoint
+	if err := json.Unmarshal(data, &checkpoint); err != nil {
+		return nil, err
+	}
+	if len(checkpoint.Received) != len(NewChunkBitmap(checkpoint.Info.TotalChunks)) {
+		return nil, fmt.Errorf("corrupt checkpoint %s", metaPath)
+	}
 
-	file, err := os.Create(outputPath)
+	tmpPath := strings.TrimSuffix(metaPath, ".json")
+	file, err := os.OpenFile(tmpPath, os.O_RDWR, 0600)
 	if err != nil {
+		return nil, err
+	}
+
+	return &FileAssembler{
+		Info:      checkpoint.Info,
+		Sender:    checkpoint.Sender,
+		Target:    checkpoint.Target,
+		Recipient: checkpoint.Recipient,
+		file:      file,
+		tmpPath:   tmpPath,
+		received:  checkpoint.Received,
+	}, nil
+}
+
+// WriteChunk checks a chunk and writes it at its offset. A chunk that was
+// already written is rejected with ErrDuplicateChunk.
+func (fa *FileAssembler) WriteChunk(chunk FileMessage) error {
+	data := chunk.Data
+
+	if chunk.ChunkID < 0 || chunk.ChunkID >= fa.Info.TotalChunks {
+		return fmt.Errorf("chunk %d is out of range (file has %d chunks)", chunk.ChunkID, fa.Info.TotalChunks)
+	}
+
+	if chunk.Checksum != "" && chunk.Checksum != ChunkChecksum(data) {
+		return fmt.Errorf("chunk %d: %w", chunk.ChunkID, ErrChunkChecksum)
+	}
+
+	// With a declared chunk size the offset and length follow from the chunk ID
+	offset := chunk.Offset
+	if fa.Info.ChunkSize > 0 {
+		offset = int64(chunk.ChunkID) * int64(fa.Info.ChunkSize)
+		expected := int64(fa.Info.ChunkSize)
+		if remaining := fa.Info.Size - offset; remaining < expected {
+			expected = remaining
+		}
+		if int64(len(data)) != expected {
+			return fmt.Errorf("chunk %d has %d bytes, expected %d", chunk.ChunkID, len(data), expected)
+		}
+	}
+	if offset < 0 || offset+int64(len(data)) > fa.Info.Size {
+		return fmt.Errorf("chunk %d is outside the file (offset %d, %d bytes)", chunk.ChunkID, offset, len(data))
+	}
+
+	fa.mu.Lock()
+	defer fa.mu.Unlock()
+
+	if fa.file == nil {
+		return fmt.Errorf("upload of %s is closed", fa.Info.Filename)
+	}
+
+	if fa.received.Has(chunk.ChunkID) {
+		return ErrDuplicateChunk
+	}
+
+	if _, err := fa.file.WriteAt(data, offset); err != nil {
 		return err
 	}
-	defer file.Close()
+	fa.received.Set(chunk.ChunkID)
 
-	// Sort chunks by ChunkID
-	sortedChunks := make([]FileMessage, len(chunks))
-	copy(sortedChunks, chunks)
-	sort.Slice(sortedChunks, func(i, j int) bool {
-		return sortedChunks[i].ChunkID < sortedChunks[j].ChunkID
-	})
+	return nil
+}
+
+// Complete reports whether every chunk has been written
+func (fa *FileAssembler) Complete() bool {
+	fa.mu.Lock()
+	defer fa.mu.Unlock()
+	return fa.received.Count() >= fa.Info.TotalChunks
+}
+
+// Received returns the number of chunks written so far
+func (fa *FileAssembler) Received() int {
+	fa.mu.Lock()
+	defer fa.mu.Unlock()
+	return fa.received.Count()
+}
+
+// Missing returns the chunk ranges that have not been written yet
+func (fa *FileAssembler) Missing() []ChunkRange {
+	fa.mu.Lock()
+	defer fa.mu.Unlock()
+	return fa.received.Missing(fa.Info.TotalChunks)
+}
+
+// Commit finishes the file and moves it to destDir under its sanitized name,
+// returning the final path. An existing file is never replaced: the name gets
+// a " (2)" style suffix instead. On ErrHashMismatch the temporary file is left
+// for Abort.
+func (fa *FileAssembler) Commit(destDir string) (string, error) {
+	name, err := SanitizeFilename(fa.Info.Filename)
+	if err != nil {
+		return "", err
+	}
+
+	tmpPath, err := fa.Finish()
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(destDir, 0755); err != nil {
+		return "", err
+	}
+
+	return placeFile(tmpPath, destDir, name)
+}
+
+// Finish flushes and closes the temporary file and checks it against the
+// declared hash, returning its path for the caller to move into place. On
+// ErrHashMismatch the temporary file is left for Abort.
+func (fa *FileAssembler) Finish() (string, error) {
+	fa.mu.Lock()
+	defer fa.mu.Unlock()
+
+	if fa.file == nil {
+		return "", fmt.Errorf("upload of %s is closed", fa.Info.Filename)
+	}
+
+	if err := fa.file.Sync(); err != nil {
+		return "", err
+	}
 
-	for _, chunk := range sortedChunks {
-		data, err := base64.StdEncoding.DecodeString(string(chunk.Data))
-		if err != nil {
-			return err
+	if fa.Info.Hash != "" {
+		hash := sha256.New()
+		if _, err := io.Copy(hash, io.NewSectionReader(fa.file, 0, fa.Info.Size)); err != nil {
+			return "", err
 		}
+		if hex.EncodeToString(hash.Sum(nil)) != fa.Info.Hash {
+			return "", ErrHashMismatch
+		}
+	}
+	if err := fa.file.Close(); err != nil {
+		return "", err
+	}
+	fa.file = nil
+	os.Remove(fa.tmpPath + ".json")
+
+	return fa.tmpPath, nil
+}
+
+// Checkpoint closes the temporary file and records what has been received in
+// a metadata file next to it, so the partial data survives a restart
+func (fa *FileAssembler) Checkpoint() (string, error) {
+	fa.mu.Lock()
+	defer fa.mu.Unlock()
 
-		_, err = file.Write(data)
-		if err != nil {
-			return err
+	if fa.file != nil {
+		if err := fa.file.Sync(); err != nil {
+			return "", err
 		}
+		fa.file.Close()
+		fa.file = nil
 	}
 
-	return nil
+	data, err := json.Marshal(assemblerCheckpoint{
+		Info:      fa.Info,
+		Sender:    fa.Sender,
+		Target:    fa.Target,
+		Recipient: fa.Recipient,
+		Received:  fa.received,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	metaPath := fa.tmpPath + ".json"
+	if err := os.WriteFile(metaPath, data, 0644); err != nil {
+		return "", err
+	}
+
+	return metaPath, nil
+}
+
+// Abort closes and removes the temporary file and any checkpoint
+func (fa *FileAssembler) Abort() {
+	fa.mu.Lock()
+	defer fa.mu.Unlock()
+
+	if fa.file != nil {
+		fa.file.Close()
+		fa.file = nil
+	}
+	os.Remove(fa.tmpPath)
+	os.Remove(fa.tmpPath + ".json")
 }
@@ -0,0 +1,174 @@
+package shared
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testUpload describes data split into chunks of chunkSize bytes
+func testUpload(data []byte, chunkSize int) UploadInfo {
+	sum := sha256.Sum256(data)
+	return UploadInfo{
+		UploadID:    "0123456789abcdef",
+		Filename:    "notes.txt",
+		Size:        int64(len(data)),
+		Hash:        hex.EncodeToString(sum[:]),
+		ChunkSize:   chunkSize,
+		TotalChunks: ChunkCount(int64(len(data)), chunkSize),
+	}
+}
+
+// testChunk returns chunk chunkID of data
+func testChunk(data []byte, chunkSize, chunkID int) FileMessage {
+	end := (chunkID + 1) * chunkSize
+	if end > len(data) {
+		end = len(data)
+	}
+	chunk := data[chunkID*chunkSize : end]
+	return FileMessage{ChunkID: chunkID, Offset: int64(chunkID * chunkSize), Checksum: ChunkChecksum(chunk), Data: chunk}
+}
+
+func TestFileAssemblerOutOfOrder(t *testing.T) {
+	data := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+	info := testUpload(data, 8)
+	dir := t.TempDir()
+	fa, err := NewFileAssembler(filepath.Join(dir, "tmp"), info, "alice", "general")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The short last chunk first, then the rest backwards
+	for _, chunkID := range []int{4, 2, 0} {
+		if err := fa.WriteChunk(testChunk(data, 8, chunkID)); err != nil {
+			t.Fatalf("chunk %d: %v", chunkID, err)
+		}
+	}
+	if err := fa.WriteChunk(testChunk(data, 8, 2)); err != ErrDuplicateChunk {
+		t.Fatalf("chunk 2 again: %v", err)
+	}
+	if missing := fa.Missing(); len(missing) != 2 || missing[0] != (ChunkRange{1, 1}) || missing[1] != (ChunkRange{3, 3}) {
+		t.Fatalf("missing %v", missing)
+	}
+	if _, err := fa.Commit(dir); err != ErrHashMismatch {
+		t.Fatalf("committing with chunks missing: %v", err)
+	}
+	fa.Abort()
+
+	fa, _ = NewFileAssembler(filepath.Join(dir, "tmp"), info, "alice", "general")
+	for _, chunkID := range []int{3, 1, 4, 0, 2} {
+		if fa.Complete() {
+			t.Fatalf("complete before chunk %d", chunkID)
+		}
+		if err := fa.WriteChunk(testChunk(data, 8, chunkID)); err != nil {
+			t.Fatalf("chunk %d: %v", chunkID, err)
+		}
+	}
+	if !fa.Complete() || fa.Received() != 5 {
+		t.Fatalf("complete %v with %d chunks", fa.Complete(), fa.Received())
+	}
+
+	path, err := fa.Commit(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(path); !bytes.Equal(got, data) {
+		t.Fatalf("assembled %q", got)
+	}
+	if entries, _ := os.ReadDir(filepath.Join(dir, "tmp")); len(entries) > 0 {
+		t.Fatalf("temporary file %s left behind", entries[0].Name())
+	}
+}
+
+func TestFileAssemblerOffsets(t *testing.T) {
+	data := []byte("0123456789abcdefghij")
+	dir := t.TempDir()
+
+	// With a chunk size the offset follows from the chunk ID, whatever the
+	// chunk claims
+	fa, err := NewFileAssembler(dir, testUpload(data, 8), "alice", "general")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fa.Abort()
+	chunk := testChunk(data, 8, 1)
+	chunk.Offset = 0
+	if err := fa.WriteChunk(chunk); err != nil {
+		t.Fatal(err)
+	}
+
+	// Chunk lengths must match the chunk size, but for the last one
+	short := FileMessage{ChunkID: 0, Data: data[:4]}
+	long := FileMessage{ChunkID: 2, Data: []byte("ghijx")}
+	for _, bad := range []FileMessage{short, long, {ChunkID: 3, Data: data[:4]}, {ChunkID: -1, Data: data[:8]}} {
+		if err := fa.WriteChunk(bad); err == nil {
+			t.Errorf("chunk %d with %d bytes written", bad.ChunkID, len(bad.Data))
+		}
+	}
+	corrupt := testChunk(data, 8, 0)
+	corrupt.Checksum = ChunkChecksum(data[1:9])
+	if err := fa.WriteChunk(corrupt); !errors.Is(err, ErrChunkChecksum) {
+		t.Errorf("corrupt chunk: %v", err)
+	}
+
+	// Without one the chunk's own offset is used, inside the file only
+	info := testUpload(data, 8)
+	info.ChunkSize = 0
+	info.UploadID = ""
+	free, err := NewFileAssembler(dir, info, "alice", "general")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer free.Abort()
+	if err := free.WriteChunk(FileMessage{ChunkID: 0, Offset: 16, Data: data[12:]}); err == nil {
+		t.Error("chunk past the end of the file written")
+	}
+	for chunkID, offset := range []int{12, 0, 6} {
+		end := offset + 8
+		if end > len(data) {
+			end = len(data)
+		}
+		if err := free.WriteChunk(FileMessage{ChunkID: chunkID, Offset: int64(offset), Data: data[offset:end]}); err != nil {
+			t.Fatalf("chunk at %d: %v", offset, err)
+		}
+	}
+	path, err := free.Commit(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(path); !bytes.Equal(got, data) {
+		t.Fatalf("assembled %q", got)
+	}
+}
+
+func TestStreamFileChunksRanges(t *testing.T) {
+	data := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+	path := filepath.Join(t.TempDir(), "notes.txt")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []int
+	err := StreamFileChunks(path, 8, []ChunkRange{{3, 4}, {1, 1}}, func(chunk FileMessage) error {
+		want := testChunk(data, 8, chunk.ChunkID)
+		if !bytes.Equal(chunk.Data, want.Data) || chunk.Offset != want.Offset || chunk.Checksum != want.Checksum {
+			t.Errorf("chunk %d: %q at %d", chunk.ChunkID, chunk.Data, chunk.Offset)
+		}
+		if chunk.TotalChunks != 5 || chunk.Size != int64(len(data)) {
+			t.Errorf("chunk %d of %d, size %d", chunk.ChunkID, chunk.TotalChunks, chunk.Size)
+		}
+		got = append(got, chunk.ChunkID)
+		return nil
+	})
+	if err != nil || len(got) != 3 || got[0] != 3 || got[1] != 4 || got[2] != 1 {
+		t.Fatalf("sent chunks %v: %v", got, err)
+	}
+
+	if err := StreamFileChunks(path, 8, []ChunkRange{{4, 5}}, func(FileMessage) error { return nil }); err == nil {
+		t.Error("range past the last chunk streamed")
+	}
+}
@@ -0,0 +1,148 @@
+package shared
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Every frame on the wire starts with a JSON header line. When the header has
+// a payload_len, that many raw bytes and a newline follow it. File chunks
+// carry their data this way instead of base64 text inside the JSON.
+
+// Chunk payload compression, negotiated per upload in UploadInfo.Compression
+const CompressionDeflate = "deflate"
+
+var (
+	ErrFrameTooLarge  = errors.New("frame payload too large")
+	ErrMalformedFrame = errors.New("malformed frame")
+)
+
+// frameHeader holds the header fields ReadFrame needs
+type frameHeader struct {
+	PayloadLen int `json:"payload_len"`
+}
+
+// ReadFrame reads one frame, returning its JSON header and any payload.
+// Payloads longer than maxPayload are refused with ErrFrameTooLarge.
+func ReadFrame(r *bufio.Reader, maxPayload int) (header, payload []byte, err error) {
+	header, err = r.ReadBytes('\n')
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Only frames that mention a payload are decoded twice
+	if !bytes.Contains(header, []byte(`"payload_len"`)) {
+		return header, nil, nil
+	}
+
+	var fh frameHeader
+	if err := json.Unmarshal(header, &fh); err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrMalformedFrame, err)
+	}
+	if fh.PayloadLen < 0 {
+		return nil, nil, ErrMalformedFrame
+	}
+	if fh.PayloadLen > maxPayload {
+		return nil, nil, fmt.Errorf("%w: %d bytes, limit %d", ErrFrameTooLarge, fh.PayloadLen, maxPayload)
+	}
+	if fh.PayloadLen == 0 {
+		return header, nil, nil
+	}
+
+	payload = make([]byte, fh.PayloadLen+1)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, nil, err
+	}
+	if payload[fh.PayloadLen] != '\n' {
+		return nil, nil, ErrMalformedFrame
+	}
+
+	return header, payload[:fh.PayloadLen], nil
+}
+
+// EncodeFrame encodes a file chunk as a header line followed by its data,
+// without the final newline that ends every frame. With compress set the data
+// is deflated when that makes it smaller.
+func EncodeFrame(chunk FileMessage, compress bool) ([]byte, error) {
+	payload := chunk.Data
+	chunk.Compression = ""
+
+	if compress && len(payload) > 0 {
+		var buf bytes.Buffer
+		writer, err := flate.NewWriter(&buf, flate.BestSpeed)
+		if err != nil {
+			return nil, err
+		}
+		writer.Write(payload)
+		if err := writer.Close(); err != nil {
+			return nil, err
+		}
+
+		if buf.Len() < len(payload) {
+			payload = buf.Bytes()
+			chunk.Compression = CompressionDeflate
+		}
+	}
+	chunk.PayloadLen = len(payload)
+
+	header, err := json.Marshal(chunk)
+	if err != nil {
+		return nil, err
+	}
+
+	return AppendPayload(header, payload), nil
+}
+
+// AppendPayload builds a frame from a JSON header, whose payload_len must
+// match, and its payload. The frame's final newline is left to the writer,
+// as for any message.
+func AppendPayload(header, payload []byte) []byte {
+	if len(payload) == 0 {
+		return header
+	}
+
+	frame := make([]byte, 0, len(header)+1+len(payload))
+	frame = append(frame, header...)
+	frame = append(frame, '\n')
+	return append(frame, payload...)
+}
+
+// DecodeFileFrame turns a frame read by ReadFrame back into a file chunk,
+// decompressing its data. Chunks that expand beyond maxChunk are refused.
+func DecodeFileFrame(header, payload []byte, maxChunk int) (FileMessage, error) {
+	var chunk FileMessage
+	if err := json.Unmarshal(header, &chunk); err != nil {
+		return chunk, err
+	}
+	if chunk.PayloadLen != len(payload) {
+		return chunk, ErrMalformedFrame
+	}
+
+	switch chunk.Compression {
+	case "":
+		chunk.Data = payload
+
+	case CompressionDeflate:
+		reader := flate.NewReader(bytes.NewReader(payload))
+		defer reader.Close()
+
+		data, err := io.ReadAll(io.LimitReader(reader, int64(maxChunk)+1))
+		if err != nil {
+			return chunk, fmt.Errorf("chunk %d: %v", chunk.ChunkID, err)
+		}
+		if len(data) > maxChunk {
+			return chunk, fmt.Errorf("chunk %d: %w", chunk.ChunkID, ErrFrameTooLarge)
+		}
+		chunk.Data = data
+
+	default:
+		return chunk, fmt.Errorf("chunk %d: unknown compression %q", chunk.ChunkID, chunk.Compression)
+	}
+
+	return chunk, nil
+}
@@ -0,0 +1,197 @@
+package shared
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// benchChunkSize matches the server's default chunk size
+const benchChunkSize = 64 << 10
+
+// base64Chunk is a file chunk as sent before binary frames. Its data was
+// base64 text, which JSON then encoded as base64 again.
+type base64Chunk struct {
+	FileMessage
+	Data []byte `json:"data"`
+}
+
+// benchChunk returns a chunk of text, which deflates well, or of random
+// bytes, which do not
+func benchChunk(compressible bool) FileMessage {
+	data := make([]byte, benchChunkSize)
+	if compressible {
+		line := []byte("2026-10-18 12:00:00 INFO request served in 12ms\n")
+		for i := range data {
+			data[i] = line[i%len(line)]
+		}
+	} else {
+		rand.New(rand.NewSource(1)).Read(data)
+	}
+
+	return FileMessage{
+		Message:     Message{Type: MessageTypeFile, Sender: "alice"},
+		UploadID:    "0123456789abcdef",
+		Filename:    "bench.log",
+		Size:        10 * benchChunkSize,
+		ChunkID:     3,
+		TotalChunks: 10,
+		Offset:      3 * benchChunkSize,
+		Data:        data,
+	}
+}
+
+func benchmarkBase64JSON(b *testing.B, compressible bool) {
+	chunk := benchChunk(compressible)
+	b.SetBytes(int64(len(chunk.Data)))
+	b.ReportAllocs()
+
+	var wire int
+	for i := 0; i < b.N; i++ {
+		encoded, err := json.Marshal(base64Chunk{
+			FileMessage: chunk,
+			Data:        []byte(base64.StdEncoding.EncodeToString(chunk.Data)),
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+		wire = len(encoded) + 1
+
+		reader := bufio.NewReader(bytes.NewReader(append(encoded, '\n')))
+		header, _, err := ReadFrame(reader, benchChunkSize)
+		if err != nil {
+			b.Fatal(err)
+		}
+		var decoded base64Chunk
+		if err := json.Unmarshal(header, &decoded); err != nil {
+			b.Fatal(err)
+		}
+		data, err := base64.StdEncoding.DecodeString(string(decoded.Data))
+		if err != nil {
+			b.Fatal(err)
+		}
+		if len(data) != len(chunk.Data) {
+			b.Fatalf("decoded %d bytes, want %d", len(data), len(chunk.Data))
+		}
+	}
+	b.ReportMetric(float64(wire), "wire-bytes/chunk")
+}
+
+func benchmarkFrame(b *testing.B, compressible, compress bool) {
+	chunk := benchChunk(compressible)
+	b.SetBytes(int64(len(chunk.Data)))
+	b.ReportAllocs()
+
+	var wire int
+	for i := 0; i < b.N; i++ {
+		encoded, err := EncodeFrame(chunk, compress)
+		if err != nil {
+			b.Fatal(err)
+		}
+		wire = len(encoded) + 1
+
+		reader := bufio.NewReader(bytes.NewReader(append(encoded, '\n')))
+		header, payload, err := ReadFrame(reader, benchChunkSize)
+		if err != nil {
+			b.Fatal(err)
+		}
+		decoded, err := DecodeFileFrame(header, payload, benchChunkSize)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if !bytes.Equal(decoded.Data, chunk.Data) {
+			b.Fatal("decoded data differs from the chunk")
+		}
+	}
+	b.ReportMetric(float64(wire), "wire-bytes/chunk")
+}
+
+func BenchmarkChunkBase64JSONText(b *testing.B)   { benchmarkBase64JSON(b, true) }
+func BenchmarkChunkBase64JSONRandom(b *testing.B) { benchmarkBase64JSON(b, false) }
+func BenchmarkChunkFrameText(b *testing.B)        { benchmarkFrame(b, true, false) }
+func BenchmarkChunkFrameRandom(b *testing.B)      { benchmarkFrame(b, false, false) }
+func BenchmarkChunkDeflateText(b *testing.B)      { benchmarkFrame(b, true, true) }
+func BenchmarkChunkDeflateRandom(b *testing.B)    { benchmarkFrame(b, false, true) }
+
+func TestReadFrameErrors(t *testing.T) {
+	tests := []struct {
+		name, frame string
+		want        error
+	}{
+		{"oversized payload", `{"payload_len":9}` + "\n123456789\n", ErrFrameTooLarge},
+		{"negative payload", `{"payload_len":-1}` + "\n", ErrMalformedFrame},
+		{"bad header", `{"payload_len":"four"}` + "\nabcd\n", ErrMalformedFrame},
+		{"payload without newline", `{"payload_len":4}` + "\nabcde\n", ErrMalformedFrame},
+		{"truncated payload", `{"payload_len":8}` + "\nabc", io.ErrUnexpectedEOF},
+		{"truncated header", `{"type":1`, io.EOF},
+	}
+	for _, tt := range tests {
+		header, payload, err := ReadFrame(bufio.NewReader(strings.NewReader(tt.frame)), 8)
+		if !errors.Is(err, tt.want) {
+			t.Errorf("%s: got %q, %q, %v, want %v", tt.name, header, payload, err, tt.want)
+		}
+	}
+}
+
+func TestReadFrameKeepsFollowingFrames(t *testing.T) {
+	frame, err := EncodeFrame(FileMessage{Message: Message{Type: MessageTypeFile}, Data: []byte("a\nb")}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(strings.NewReader(string(frame) + "\n" + `{"type":1}` + "\n"))
+
+	header, payload, err := ReadFrame(r, 8)
+	if err != nil || string(payload) != "a\nb" {
+		t.Fatalf("first frame: %q, %q, %v", header, payload, err)
+	}
+	header, payload, err = ReadFrame(r, 8)
+	if err != nil || string(header) != `{"type":1}`+"\n" || payload != nil {
+		t.Fatalf("second frame: %q, %q, %v", header, payload, err)
+	}
+}
+
+func TestDecodeFileFrameErrors(t *testing.T) {
+	data := bytes.Repeat([]byte("a"), 1024)
+	compressed, err := EncodeFrame(FileMessage{Message: Message{Type: MessageTypeFile}, Data: data}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, payload, err := ReadFrame(bufio.NewReader(bytes.NewReader(append(compressed, '\n'))), len(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(header, []byte(CompressionDeflate)) || len(payload) >= len(data) {
+		t.Fatalf("chunk was not compressed: %q", header)
+	}
+
+	chunk, err := DecodeFileFrame(header, payload, len(data))
+	if err != nil || !bytes.Equal(chunk.Data, data) {
+		t.Fatalf("decoding at the limit: %d bytes, %v", len(chunk.Data), err)
+	}
+
+	// A small payload may not expand past the limit
+	if _, err := DecodeFileFrame(header, payload, len(data)-1); !errors.Is(err, ErrFrameTooLarge) {
+		t.Errorf("expanding past the limit: %v", err)
+	}
+	if _, err := DecodeFileFrame(header, payload[:len(payload)-1], len(data)); !errors.Is(err, ErrMalformedFrame) {
+		t.Errorf("payload shorter than payload_len: %v", err)
+	}
+	if _, err := DecodeFileFrame([]byte(`{"type":`), nil, len(data)); err == nil {
+		t.Error("bad header decoded")
+	}
+
+	unknown, _ := json.Marshal(FileMessage{Compression: "zstd", PayloadLen: len(payload)})
+	if _, err := DecodeFileFrame(unknown, payload, len(data)); err == nil || !strings.Contains(err.Error(), "zstd") {
+		t.Errorf("unknown compression: %v", err)
+	}
+	corrupt, _ := json.Marshal(FileMessage{Compression: CompressionDeflate, PayloadLen: 4})
+	if _, err := DecodeFileFrame(corrupt, []byte{0xff, 0xff, 0xff, 0xff}, len(data)); err == nil {
+		t.Error("corrupt deflate data decoded")
+	}
+}
@@ -1,6 +1,7 @@
 package shared
 
 import (
+	"strings"
 	"time"
 )
 
@@ -12,6 +13,16 @@ const (
 	MessageTypeDirect    // Add type for direct messages
 	MessageTypeStatus    // Add type for status updates
 	MessageTypeEncrypted // Add type for encrypted messages
+	MessageTypeUpload    // Upload session negotiation
+	MessageTypePreview   // Description of a stored file
+	MessageTypePing      // Heartbeat, answered with a pong
+	MessageTypePong
+	MessageTypeGroup      // Message in a group conversation
+	MessageTypeProfile    // A user's profile, or a new avatar
+	MessageTypeReadMarker // How far a user has read a conversation
+	MessageTypeAck        // All replies to a request were sent
+	MessageTypeSession    // The session's user or room changed, or it ended
+	MessageTypeHistory    // A stored room, direct or group message, in answer to a history request
 )
 
 // UserStatus represents a user's online status
@@ -24,29 +35,145 @@ const (
 	StatusOffline
 )
 
+// MaxStatusTextLength limits the custom text shown with a status
+const MaxStatusTextLength = 100
+
+var statusNames = []string{"online", "away", "busy", "offline"}
+
+func (s UserStatus) String() string {
+	if s < 0 || int(s) >= len(statusNames) {
+		return "unknown"
+	}
+	return statusNames[s]
+}
+
+// ParseStatus parses a status name such as "busy"
+func ParseStatus(name string) (UserStatus, bool) {
+	for i, statusName := range statusNames {
+		if strings.EqualFold(name, statusName) {
+			return UserStatus(i), true
+		}
+	}
+	return StatusOnline, false
+}
+
 type Message struct {
-	Type      int       `json:"type"`
-	Content   string    `json:"content"`
-	Sender    string    `json:"sender"`
-	Room      string    `json:"room"`
-	Timestamp time.Time `json:"timestamp"`
-	Recipient string    `json:"recipient,omitempty"` // For direct messages
-	Encrypted bool      `json:"encrypted,omitempty"` // For encrypted messages
+	Type       int       `json:"type"`
+	Content    string    `json:"content"`
+	Sender     string    `json:"sender"`
+	SenderID   string    `json:"sender_id,omitempty"`   // Sender's user ID, kept when they are renamed
+	Bot        bool      `json:"bot,omitempty"`         // Sent by a bot account
+	SenderName string    `json:"sender_name,omitempty"` // Sender's display name, if set
+	Room       string    `json:"room"`
+	Timestamp  time.Time `json:"timestamp"`
+	Recipient  string    `json:"recipient,omitempty"` // For direct messages
+	Encrypted  bool      `json:"encrypted,omitempty"` // For encrypted messages
+	Urgent     bool      `json:"urgent,omitempty"`    // Delivered even to busy users
+	Group      string    `json:"group,omitempty"`     // Group conversation ID
+
+	// A client may tag a message with a request ID. The server's replies to it
+	// carry the same ID, followed by a MessageTypeAck once all were sent.
+	RequestID string `json:"request_id,omitempty"`
 }
 
 type FileMessage struct {
 	Message
+	UploadID    string `json:"upload_id,omitempty"`
 	Filename    string `json:"filename"`
 	Size        int64  `json:"size"`
 	ChunkID     int    `json:"chunk_id"`
 	TotalChunks int    `json:"total_chunks"`
-	Data        []byte `json:"data"`
+	Offset      int64  `json:"offset"`             // Byte position of this chunk in the file
+	Checksum    string `json:"checksum,omitempty"` // Hex SHA-256 of the uncompressed chunk
+	Hash        string `json:"hash,omitempty"`     // Hex SHA-256 of the whole file
+	Compression string `json:"compression,omitempty"`
+	PayloadLen  int    `json:"payload_len"` // Length of the binary payload after the header
+	Data        []byte `json:"-"`           // Sent as the frame payload, see EncodeFrame
 }
 
-type AuthMessage struct {
+// UploadMessage opens or resumes an upload session
+type UploadMessage struct {
+	Message
+	UploadInfo
+	Missing   []ChunkRange    `json:"missing,omitempty"`   // Chunks the server still needs
+	Received  int             `json:"received,omitempty"`  // Chunks the server already has
+	Challenge *ProofChallenge `json:"challenge,omitempty"` // Sent with UploadProve
+	Proof     string          `json:"proof,omitempty"`     // Sent with UploadProof, see ProveChunk
+}
+
+// PreviewMessage describes a stored file in answer to a preview request. An
+// image's thumbnail follows as a PNG frame payload.
+type PreviewMessage struct {
+	Message
+	FileMeta
+	FileID     string   `json:"file_id"`
+	Filename   string   `json:"filename"`
+	Size       int64    `json:"size"`
+	Uploader   string   `json:"uploader"`
+	Head       []string `json:"head,omitempty"` // First lines of a text file
+	PayloadLen int      `json:"payload_len,omitempty"`
+}
+
+// MaxAvatarBytes limits the size of an avatar image upload
+const MaxAvatarBytes = 256 << 10
+
+// UserProfile is what users tell others about themselves
+type UserProfile struct {
+	DisplayName string `json:"display_name,omitempty"`
+	Bio         string `json:"bio,omitempty"`
+	Timezone    string `json:"timezone,omitempty"` // IANA name such as "Europe/Paris"
+	Pronouns    string `json:"pronouns,omitempty"`
+	HasAvatar   bool   `json:"has_avatar,omitempty"`
+}
+
+// ProfileMessage carries a user's profile with their avatar as a PNG frame
+// payload. Clients send it with content "avatar" and the image as payload to
+// set their avatar.
+type ProfileMessage struct {
+	Message
+	UserProfile
+	Username   string `json:"username"`
+	PayloadLen int    `json:"payload_len,omitempty"`
+}
+
+// SessionMessage tells a client the state of its session whenever it
+// changes: on login, when it joins or leaves a room, when the user is renamed
+// and when the server ends the session. Room is empty outside any room.
+type SessionMessage struct {
 	Message
 	Username string `json:"username"`
-	Password string `json:"password"`
+	Ended    bool   `json:"ended,omitempty"` // Ended on purpose, so it should not be resumed
+}
+
+// ReadMarkerMessage says a user has read a conversation up to a time. Clients
+// send it as they show messages; the server passes it on to the user's other
+// sessions.
+type ReadMarkerMessage struct {
+	Message
+	Conversation string    `json:"conversation"` // See RoomConversation and DirectConversation; groups use their ID
+	ReadUpTo     time.Time `json:"read_up_to"`
+}
+
+// RoomConversation names a room in read markers
+func RoomConversation(room string) string {
+	return "#" + room
+}
+
+// DirectConversation names the direct conversation with a user in read markers
+func DirectConversation(username string) string {
+	return "@" + username
+}
+
+type AuthMessage struct {
+	Message
+	Username   string `json:"username"`
+	Password   string `json:"password"`
+	Device     string `json:"device,omitempty"`      // Names the session in /sessions
+	InviteCode string `json:"invite_code,omitempty"` // Required when registration is invite-only
+	Token      string `json:"token,omitempty"`       // A bot's API token, for "token" logins
+
+	// For "passwd" while logged in; "rename" takes the new name in Username
+	NewPassword string `json:"new_password,omitempty"`
 }
 
 // DirectMessage type for private user-to-user messaging
@@ -58,5 +185,6 @@ type DirectMessage struct {
 // StatusMessage for user status updates
 type StatusMessage struct {
 	Message
-	Status UserStatus `json:"status"`
+	Status     UserStatus `json:"status"`
+	StatusText string     `json:"status_text,omitempty"` // Custom text such as "in a meeting"
 }
@@ -0,0 +1,173 @@
+package shared
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	MaxFilenameLength = 255 // Bytes, the common filesystem limit
+	MaxRoomNameLength = 32
+	MaxUsernameLength = 32
+)
+
+var (
+	ErrInvalidFilename = errors.New("invalid file name")
+	ErrInvalidRoomName = errors.New("room names must be 1-32 letters, digits, '-' or '_'")
+	ErrInvalidUsername = errors.New("usernames must be 1-32 letters, digits, '-' or '_'")
+)
+
+// Names that Windows refuses to use as files, with or without an extension
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// SanitizeFilename turns a file name received from the network into one that
+// is safe to create inside a directory: any directory part is dropped, control
+// and reserved characters are replaced, and hidden or reserved names are
+// prefixed. It fails when nothing usable is left.
+func SanitizeFilename(name string) (string, error) {
+	// Treat both separators as separators whatever the local OS
+	name = strings.ReplaceAll(name, "\\", "/")
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
+	}
+
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r == utf8.RuneError, unicode.IsControl(r):
+			return -1
+		case strings.ContainsRune(`<>:"|?*`, r):
+			return '_'
+		}
+		return r
+	}, name)
+
+	// Windows ignores trailing dots and spaces
+	name = strings.TrimRight(strings.TrimSpace(name), ". ")
+	if name == "" {
+		return "", ErrInvalidFilename
+	}
+
+	// Leading dots would hide the file or clash with index files
+	if strings.HasPrefix(name, ".") {
+		name = "_" + name
+	}
+
+	base := strings.ToUpper(strings.TrimSuffix(name, filepath.Ext(name)))
+	if reservedNames[base] {
+		name = "_" + name
+	}
+
+	if len(name) > MaxFilenameLength {
+		ext := filepath.Ext(name)
+		if len(ext) > 16 {
+			ext = ""
+		}
+		name = truncateUTF8(strings.TrimSuffix(name, ext), MaxFilenameLength-len(ext)) + ext
+	}
+
+	return name, nil
+}
+
+func truncateUTF8(s string, maxBytes int) string {
+	if len(s) <= maxBytes {
+		return s
+	}
+	for maxBytes > 0 && !utf8.RuneStart(s[maxBytes]) {
+		maxBytes--
+	}
+	return s[:maxBytes]
+}
+
+// ValidateRoomName checks that a room name is safe to use in file paths
+func ValidateRoomName(name string) error {
+	if !isPlainName(name, MaxRoomNameLength) {
+		return ErrInvalidRoomName
+	}
+	return nil
+}
+
+// ValidateUsername checks that a username is safe to use in file paths
+func ValidateUsername(name string) error {
+	if !isPlainName(name, MaxUsernameLength) {
+		return ErrInvalidUsername
+	}
+	return nil
+}
+
+// isPlainName reports whether name is 1 to maxLength ASCII letters, digits,
+// '-' or '_'
+func isPlainName(name string, maxLength int) bool {
+	if name == "" || len(name) > maxLength {
+		return false
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// isSafeID reports whether an upload or transfer ID can be used in a file name
+func isSafeID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, r := range id {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// CandidateFilename returns the name to try on the n-th collision, e.g.
+// "report (2).pdf". The first candidate is the name itself.
+func CandidateFilename(name string, n int) string {
+	if n == 0 {
+		return name
+	}
+	ext := filepath.Ext(name)
+	return fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(name, ext), n+1, ext)
+}
+
+// placeFile moves tmpPath to destDir/name without replacing an existing file,
+// trying "name (2)", "name (3)"... on collisions. It returns the final path.
+func placeFile(tmpPath, destDir, name string) (string, error) {
+	for n := 0; n < 1000; n++ {
+		candidate := filepath.Join(destDir, CandidateFilename(name, n))
+
+		// A hard link fails if the target exists, so two uploads can't race
+		// for the same name
+		err := os.Link(tmpPath, candidate)
+		if err == nil {
+			os.Remove(tmpPath)
+			return candidate, nil
+		}
+		if errors.Is(err, os.ErrExist) {
+			continue
+		}
+
+		// Filesystems without hard links fall back to a checked rename
+		if _, statErr := os.Lstat(candidate); statErr == nil {
+			continue
+		}
+		if err := os.Rename(tmpPath, candidate); err != nil {
+			return "", err
+		}
+		return candidate, nil
+	}
+
+	return "", fmt.Errorf("too many files named %s", name)
+}
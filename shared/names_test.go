@@ -0,0 +1,46 @@
+package shared
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSanitizeFilename(t *testing.T) {
+	tests := []struct {
+		name, want string
+	}{
+		{"report.pdf", "report.pdf"},
+		{"../../etc/passwd", "passwd"},
+		{"..", ""},
+		{"../", ""},
+		{"/etc/shadow", "shadow"},
+		{"/", ""},
+		{`C:\Windows\System32\drivers\etc\hosts`, "hosts"},
+		{`..\..\boot.ini`, "boot.ini"},
+		{`\\server\share\file.txt`, "file.txt"},
+		{"C:file.txt", "C_file.txt"},
+		{"evil\x00.txt", "evil.txt"},
+		{"\x00", ""},
+		{"a/b\x00/../c.txt", "c.txt"},
+		{"line\nbreak.txt", "linebreak.txt"},
+		{".hidden", "_.hidden"},
+		{"CON.txt", "_CON.txt"},
+		{"name. . ", "name"},
+		{strings.Repeat("x", 300) + ".txt", strings.Repeat("x", MaxFilenameLength-4) + ".txt"},
+	}
+	for _, tt := range tests {
+		got, err := SanitizeFilename(tt.name)
+		if tt.want == "" {
+			if err != ErrInvalidFilename {
+				t.Errorf("SanitizeFilename(%q) = %q, %v, want ErrInvalidFilename", tt.name, got, err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("SanitizeFilename(%q) = %q, %v, want %q", tt.name, got, err, tt.want)
+		}
+		if strings.ContainsAny(got, "/\\\x00") || got == "." || got == ".." {
+			t.Errorf("SanitizeFilename(%q) = %q is not a plain name", tt.name, got)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package shared
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"os"
+)
+
+// Upload actions carried in UploadMessage.Content
+const (
+	UploadStart   = "start"   // Client announces a new upload
+	UploadResume  = "resume"  // Client asks which chunks are still missing
+	UploadReady   = "ready"   // Server accepts and lists the chunks it needs
+	UploadSkipped = "skipped" // Server already has the content, nothing to send
+	UploadProve   = "prove"   // Server has the content and asks the client to prove it has it too
+	UploadProof   = "proof"   // Client answers the server's challenge
+)
+
+var (
+	ErrDuplicateChunk = errors.New("chunk already received")
+	ErrChunkChecksum  = errors.New("chunk checksum does not match")
+	ErrHashMismatch   = errors.New("file hash does not match")
+)
+
+// UploadInfo describes a file being transferred
+type UploadInfo struct {
+	UploadID    string `json:"upload_id,omitempty"`
+	Filename    string `json:"filename"`
+	Size        int64  `json:"size"`
+	Hash        string `json:"hash,omitempty"` // Hex SHA-256 of the whole file
+	ChunkSize   int    `json:"chunk_size"`
+	TotalChunks int    `json:"total_chunks"`
+	Compression string `json:"compression,omitempty"` // Requested by the client, confirmed by the server
+}
+
+// FileMeta is what the server learns about a stored file's content
+type FileMeta struct {
+	ContentType string `json:"content_type"`
+	Width       int    `json:"width,omitempty"` // Images only
+	Height      int    `json:"height,omitempty"`
+	Lines       int    `json:"lines,omitempty"` // Text only
+}
+
+// Summary describes the content in a few words, e.g. "image/png 640x480"
+func (m FileMeta) Summary() string {
+	switch {
+	case m.Width > 0:
+		return fmt.Sprintf("%s %dx%d", m.ContentType, m.Width, m.Height)
+	case m.Lines == 1:
+		return m.ContentType + ", 1 line"
+	case m.Lines > 0:
+		return fmt.Sprintf("%s, %d lines", m.ContentType, m.Lines)
+	}
+	return m.ContentType
+}
+
+// ChunkRange is an inclusive range of chunk IDs
+type ChunkRange struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+// ChunkCount returns how many chunks a file of the given size is split into
+func ChunkCount(size int64, chunkSize int) int {
+	return int((size + int64(chunkSize) - 1) / int64(chunkSize))
+}
+
+// FormatSize formats a byte count for display, e.g. "12.3 KB"
+func FormatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+// ChunkChecksum returns the hex SHA-256 of a chunk's decoded data
+func ChunkChecksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// HashFile returns the hex SHA-256 and size of a file
+func HashFile(filePath string) (string, int64, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", 0, err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), size, nil
+}
+
+// ProofChallenge asks a client to show it holds a file the server already
+// stores before the stored copy is shared for it. Knowing the file's hash is
+// not enough: the answer covers a random nonce and a chunk the server picks.
+type ProofChallenge struct {
+	Nonce  string `json:"nonce"` // Hex random bytes hashed before the chunk
+	Offset int64  `json:"offset"`
+	Length int    `json:"length"`
+}
+
+// ProveChunk answers a challenge with the hex SHA-256 of the nonce followed by
+// the chosen part of the file
+func ProveChunk(filePath string, challenge ProofChallenge) (string, error) {
+	nonce, err := hex.DecodeString(challenge.Nonce)
+	if err != nil || challenge.Offset < 0 || challenge.Length <= 0 {
+		return "", fmt.Errorf("invalid challenge")
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	hash.Write(nonce)
+	n, err := io.Copy(hash, io.NewSectionReader(file, challenge.Offset, int64(challenge.Length)))
+	if err != nil {
+		return "", err
+	}
+	if n != int64(challenge.Length) {
+		return "", fmt.Errorf("file is shorter than the challenge")
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// ChunkBitmap records which chunks of a file have been received
+type ChunkBitmap []uint64
+
+func NewChunkBitmap(totalChunks int) ChunkBitmap {
+	return make(ChunkBitmap, (totalChunks+63)/64)
+}
+
+func (b ChunkBitmap) Set(chunkID int) {
+	b[chunkID/64] |= 1 << uint(chunkID%64)
+}
+
+func (b ChunkBitmap) Has(chunkID int) bool {
+	return b[chunkID/64]&(1<<uint(chunkID%64)) != 0
+}
+
+// Count returns the number of chunks received
+func (b ChunkBitmap) Count() int {
+	count := 0
+	for _, word := range b {
+		count += bits.OnesCount64(word)
+	}
+	return count
+}
+
+// Missing returns the ranges of chunks not yet received
+func (b ChunkBitmap) Missing(totalChunks int) []ChunkRange {
+	ranges := make([]ChunkRange, 0)
+	start := -1
+	for i := 0; i < totalChunks; i++ {
+		if !b.Has(i) {
+			if start < 0 {
+				start = i
+			}
+			continue
+		}
+		if start >= 0 {
+			ranges = append(ranges, ChunkRange{Start: start, End: i - 1})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		ranges = append(ranges, ChunkRange{Start: start, End: totalChunks - 1})
+	}
+	return ranges
+}